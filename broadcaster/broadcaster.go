@@ -1,37 +1,238 @@
 package broadcaster
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/metrics"
+	"github.com/wolakec/makhzen/tracing"
 )
 
-type Broadcaster struct{}
+// Broadcaster sends messages to other nodes. When Secret is set each
+// message is signed with it, and when Token is set it is sent as a bearer
+// token, for nodes that require authentication. Client, when set, is used
+// to send messages, for example over TLS; otherwise http.DefaultClient is.
+// Metrics, when set, records the outcome and latency of every message,
+// Logger logs them and Tracer traces them. When GRPC is set messages are
+// sent over one gRPC Peer.Replicate stream to each node, rather than in a
+// POST to /message each.
+type Broadcaster struct {
+	Secret  []byte
+	Token   string
+	Client  *http.Client
+	Metrics *metrics.Registry
+	Logger  *logging.Logger
+	Tracer  *tracing.Tracer
+	GRPC    bool
+
+	mu      sync.Mutex
+	streams map[string]*peerStream
+}
+
+// Operations carried by a Message. An empty Op is treated as OpPut so that
+// messages from older nodes are still applied. OpMerge carries replicated
+// state in State, to be merged with the receiver's copy of Type.
+// OpNamespace carries the settings of a new namespace in State. OpExpire
+// sets the TTL of Key, or removes its expiry when TTL is zero. OpPing
+// carries nothing and only checks that the node can be reached.
+const (
+	OpPut       = "put"
+	OpDelete    = "delete"
+	OpMerge     = "merge"
+	OpNamespace = "namespace"
+	OpExpire    = "expire"
+	OpPing      = "ping"
+)
 
+// Message is sent to other nodes for every local change. Values of type
+// bytes are sent in Data, with the ContentType they were uploaded with, so
+// they survive JSON encoding unchanged. Flags are those a memcached client
+// stored the value with. Changes to a namespace other than the default one
+// name it in Namespace. Timestamp is when the change was made on the node
+// that made it, in nanoseconds since the Unix epoch, and orders it among
+// other changes to Key. Since, in the same form, is when a replicated type
+// was created over a deleted key. RequestID, the ID of the request that made the
+// change, is sent in the X-Request-ID header, and Traceparent, the span
+// that sent it, in the traceparent header.
 type Message struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Op          string          `json:"op,omitempty"`
+	Namespace   string          `json:"namespace,omitempty"`
+	Key         string          `json:"key"`
+	Value       string          `json:"value"`
+	Type        string          `json:"type,omitempty"`
+	Data        []byte          `json:"data,omitempty"`
+	ContentType string          `json:"contentType,omitempty"`
+	Flags       uint32          `json:"flags,omitempty"`
+	State       json.RawMessage `json:"state,omitempty"`
+	TTL         int64           `json:"ttl,omitempty"`
+	Timestamp   int64           `json:"timestamp,omitempty"`
+	Since       int64           `json:"since,omitempty"`
+	RequestID   string          `json:"-"`
+	Traceparent string          `json:"-"`
 }
 
-func (b *Broadcaster) SendMessage(key string, value string, addr string) error {
-	url := fmt.Sprintf("%s/message", addr)
+func (b *Broadcaster) SendMessage(msg Message, addr string) error {
+	_, span := b.Tracer.StartRemote(msg.Traceparent, "replication.send")
+	span.SetAttribute("peer", addr)
+	span.SetAttribute("op", msg.Op)
+	span.SetAttribute("key", msg.Key)
+	if sc := span.Context(); sc.Valid() {
+		msg.Traceparent = sc.Traceparent()
+	}
+
+	start := time.Now()
+	err := b.send(msg, addr)
 
-	payload := fmt.Sprintf(`
-		{
-			"key": "%s",
-			"value": "%s"
-		}
-	`, key, value)
+	span.SetError(err)
+	span.End()
 
-	resp, err := http.Post(url, "application/json", strings.NewReader(payload))
+	b.Logger.Debug("sent message", "request_id", msg.RequestID, "peer", addr, "op", msg.Op,
+		"namespace", msg.Namespace, "key", msg.Key, "duration", time.Since(start), "err", err)
+
+	return err
+}
+
+func (b *Broadcaster) send(msg Message, addr string) error {
+	if b.Metrics == nil {
+		return b.post(msg, addr)
+	}
+
+	inFlight := b.Metrics.Gauge("makhzen_replication_in_flight", "Messages being sent to each node.", "peer").With(addr)
+	inFlight.Add(1)
+	defer inFlight.Add(-1)
+
+	start := time.Now()
+	err := b.post(msg, addr)
+
+	b.Metrics.Histogram("makhzen_replication_duration_seconds", "Time taken to send a message to each node.", metrics.DefaultBuckets, "peer").
+		With(addr).Observe(time.Since(start).Seconds())
+
+	result, up := "success", 1.0
+	if err != nil {
+		result, up = "failure", 0
+	}
+
+	b.Metrics.Counter("makhzen_replication_messages_total", "Messages sent to each node, by result.", "peer", "result").With(addr, result).Inc()
+	b.Metrics.Gauge("makhzen_peer_up", "Whether the last message sent to each node succeeded.", "peer").With(addr).Set(up)
+
+	return err
+}
+
+func (b *Broadcaster) post(msg Message, addr string) error {
+	if b.GRPC {
+		return b.sendStream(msg, addr)
+	}
+
+	payload, err := json.Marshal(msg)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := b.newRequest(addr+"/message", payload)
 
 	if err != nil {
 		return err
 	}
 
+	if msg.RequestID != "" {
+		req.Header.Set(logging.RequestIDHeader, msg.RequestID)
+	}
+	if msg.Traceparent != "" {
+		req.Header.Set(tracing.Header, msg.Traceparent)
+	}
+
+	resp, err := b.client().Do(req)
+
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("node did not return 200 response: %s", resp.Status)
 	}
 
 	return nil
 }
+
+// Request posts body as JSON to path on the node at addr, authenticated
+// and signed as messages are, and decodes the response into v. It is used
+// for requests between nodes other than messages, such as those made by
+// consistency checks.
+func (b *Broadcaster) Request(ctx context.Context, addr string, path string, body interface{}, v interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := b.newRequest(addr+path, payload)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
+	}
+
+	resp, err := b.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("node returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// newRequest returns a POST of payload to url, carrying the token and
+// signature when they are set.
+func (b *Broadcaster) newRequest(url string, payload []byte) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if err := b.authorize(req, payload); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// authorize adds the token and the signature of req, whose body is
+// payload, when they are set.
+func (b *Broadcaster) authorize(req *http.Request, payload []byte) error {
+	if b.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.Token)
+	}
+
+	if len(b.Secret) > 0 {
+		return signRequest(req, b.Secret, payload)
+	}
+
+	return nil
+}
+
+func (b *Broadcaster) client() *http.Client {
+	if b.Client == nil {
+		return http.DefaultClient
+	}
+
+	return b.Client
+}
@@ -1,11 +1,18 @@
 package broadcaster
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/metrics"
 )
 
 func TestSendMessage(t *testing.T) {
@@ -19,7 +26,7 @@ func TestSendMessage(t *testing.T) {
 
 		url := ts.URL
 
-		err := b.SendMessage("region", "us-east-1", url)
+		err := b.SendMessage(Message{Key: "region", Value: "us-east-1"}, url)
 
 		if err == nil {
 			t.Error("SendMessage did not return an error")
@@ -69,10 +76,98 @@ func TestSendMessage(t *testing.T) {
 
 		url := ts.URL
 
-		err := b.SendMessage(wantKey, wantValue, url)
+		err := b.SendMessage(Message{Key: wantKey, Value: wantValue}, url)
 
 		if err != nil {
 			t.Errorf("SendMessage returned error: %s", err)
 		}
 	})
 }
+
+func TestSendMessageToken(t *testing.T) {
+	b := Broadcaster{Token: "s3cr3t"}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer s3cr3t" {
+			t.Errorf("expected bearer token, got %q", got)
+		}
+	}))
+	defer ts.Close()
+
+	if err := b.SendMessage(Message{Key: "region", Value: "eu-west-1"}, ts.URL); err != nil {
+		t.Errorf("SendMessage returned error: %s", err)
+	}
+}
+
+func TestSendMessageMetrics(t *testing.T) {
+	m := metrics.NewRegistry()
+	b := Broadcaster{Metrics: m}
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	b.SendMessage(Message{Key: "region", Value: "europe"}, up.URL)
+	b.SendMessage(Message{Key: "region", Value: "europe"}, down.URL)
+
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	got := buf.String()
+
+	for _, want := range []string{
+		fmt.Sprintf(`makhzen_replication_messages_total{peer="%s",result="success"} 1`, up.URL),
+		fmt.Sprintf(`makhzen_replication_messages_total{peer="%s",result="failure"} 1`, down.URL),
+		fmt.Sprintf(`makhzen_peer_up{peer="%s"} 1`, up.URL),
+		fmt.Sprintf(`makhzen_peer_up{peer="%s"} 0`, down.URL),
+		fmt.Sprintf(`makhzen_replication_in_flight{peer="%s"} 0`, up.URL),
+		fmt.Sprintf(`makhzen_replication_duration_seconds_count{peer="%s"} 1`, up.URL),
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestRequest(t *testing.T) {
+	secret := []byte("cluster-secret")
+	b := Broadcaster{Secret: secret, Token: "s3cr3t"}
+	v := NewVerifier(secret, time.Minute)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if err := v.Verify(r, body); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/cluster/digest" || r.Header.Get("Authorization") != "Bearer s3cr3t" {
+			http.Error(w, "unexpected request to "+r.URL.Path, http.StatusBadRequest)
+			return
+		}
+
+		fmt.Fprintf(w, `{"echo":%s}`, body)
+	}))
+	defer ts.Close()
+
+	t.Run("decodes the response", func(t *testing.T) {
+		var resp struct {
+			Echo map[string]int `json:"echo"`
+		}
+
+		err := b.Request(context.Background(), ts.URL, "/cluster/digest", map[string]int{"ranges": 8}, &resp)
+		if err != nil || resp.Echo["ranges"] != 8 {
+			t.Errorf("got %+v, %v", resp, err)
+		}
+	})
+
+	t.Run("returns an error for other statuses", func(t *testing.T) {
+		err := b.Request(context.Background(), ts.URL, "/elsewhere", nil, &struct{}{})
+		if err == nil || !strings.Contains(err.Error(), "unexpected request to /elsewhere") {
+			t.Errorf("got %v", err)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package broadcaster
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wolakec/makhzen/proto"
+)
+
+// Headers carrying the signature of a message.
+const (
+	HeaderTimestamp = "X-Makhzen-Timestamp"
+	HeaderNonce     = "X-Makhzen-Nonce"
+	HeaderSignature = "X-Makhzen-Signature"
+)
+
+var (
+	ErrUnsigned     = errors.New("message is not signed")
+	ErrBadSignature = errors.New("message signature is invalid")
+	ErrStale        = errors.New("message timestamp is outside the allowed window")
+	ErrReplayed     = errors.New("message nonce has already been used")
+)
+
+// Sign returns the signature of a request with body sent at timestamp (in
+// unix seconds) with nonce to method and uri: a hex encoded HMAC-SHA256
+// keyed with the cluster secret. The method and uri are signed so that a
+// request cannot be replayed to another route.
+func Sign(secret []byte, timestamp int64, nonce string, method string, uri string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(method))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(uri))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest adds a timestamp, a random nonce and their signature with
+// the method, URI and body of req.
+func signRequest(req *http.Request, secret []byte, body []byte) error {
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	ts := time.Now().Unix()
+
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, Sign(secret, ts, nonce, req.Method, req.URL.RequestURI(), body))
+
+	return nil
+}
+
+// signMessage signs m, streamed over Peer.Replicate, as it would be signed
+// were it posted alone to ReplicatePath, so that every message of a stream
+// is authenticated rather than only the call it is sent over.
+func signMessage(m *proto.Message, secret []byte) error {
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+
+	m.SentAt, m.Nonce, m.Signature = time.Now().Unix(), nonce, ""
+	m.Signature = Sign(secret, m.SentAt, m.Nonce, http.MethodPost, ReplicatePath, unsignedMessage(m))
+
+	return nil
+}
+
+// unsignedMessage returns m encoded without its signature, as it is signed.
+func unsignedMessage(m *proto.Message) []byte {
+	unsigned := *m
+	unsigned.SentAt, unsigned.Nonce, unsigned.Signature = 0, "", ""
+
+	return unsigned.Marshal()
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Verifier checks that messages were signed with the cluster secret, were
+// sent within Window of now, and have not been received before.
+type Verifier struct {
+	Secret []byte
+	Window time.Duration
+
+	mu sync.Mutex
+	// Nonces are remembered in two generations that are rotated every two
+	// windows, so each nonce is remembered for at least as long as a message
+	// carrying it could be accepted.
+	current  map[string]bool
+	previous map[string]bool
+	rotated  time.Time
+}
+
+// Verify checks the signature headers of r, whose body is body.
+func (v *Verifier) Verify(r *http.Request, body []byte) error {
+	tsHeader, nonce, sig := r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderNonce), r.Header.Get(HeaderSignature)
+	if tsHeader == "" || nonce == "" || sig == "" {
+		return ErrUnsigned
+	}
+
+	ts, err := strconv.ParseInt(tsHeader, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+
+	return v.verify(ts, nonce, sig, r.Method, r.URL.RequestURI(), body)
+}
+
+// VerifyMessage checks the signature of m, streamed over Peer.Replicate.
+func (v *Verifier) VerifyMessage(m *proto.Message) error {
+	if m.Nonce == "" || m.Signature == "" {
+		return ErrUnsigned
+	}
+
+	return v.verify(m.SentAt, m.Nonce, m.Signature, http.MethodPost, ReplicatePath, unsignedMessage(m))
+}
+
+// verify checks sig signs body, sent at ts with nonce to method and uri,
+// and that the message has been neither delayed nor received before.
+func (v *Verifier) verify(ts int64, nonce string, sig string, method string, uri string, body []byte) error {
+	want := Sign(v.Secret, ts, nonce, method, uri, body)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return ErrBadSignature
+	}
+
+	now := time.Now()
+	sent := time.Unix(ts, 0)
+	if sent.Before(now.Add(-v.Window)) || sent.After(now.Add(v.Window)) {
+		return ErrStale
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if now.Sub(v.rotated) > 2*v.Window {
+		v.previous = v.current
+		v.current = make(map[string]bool)
+		v.rotated = now
+	}
+
+	if v.current[nonce] || v.previous[nonce] {
+		return ErrReplayed
+	}
+	v.current[nonce] = true
+
+	return nil
+}
+
+// NewVerifier returns a verifier for messages signed with secret and sent
+// within window of their receipt.
+func NewVerifier(secret []byte, window time.Duration) *Verifier {
+	return &Verifier{
+		Secret:   secret,
+		Window:   window,
+		current:  make(map[string]bool),
+		previous: make(map[string]bool),
+		rotated:  time.Now(),
+	}
+}
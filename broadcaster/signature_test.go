@@ -0,0 +1,154 @@
+package broadcaster
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/proto"
+)
+
+func signedRequest(secret []byte, ts int64, nonce string, body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/message", nil)
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	r.Header.Set(HeaderNonce, nonce)
+	r.Header.Set(HeaderSignature, Sign(secret, ts, nonce, http.MethodPost, "/message", body))
+
+	return r
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte("cluster-secret")
+	body := []byte(`{"key": "region", "value": "europe"}`)
+	now := time.Now().Unix()
+
+	t.Run("accepts signed message", func(t *testing.T) {
+		v := NewVerifier(secret, time.Minute)
+
+		if err := v.Verify(signedRequest(secret, now, "n1", body), body); err != nil {
+			t.Errorf("Verify returned error: %s", err)
+		}
+	})
+
+	replayed := func(method string, uri string) *http.Request {
+		r := signedRequest(secret, now, "n1", body)
+		r.Method = method
+		r.URL, _ = url.Parse(uri)
+		return r
+	}
+
+	cases := []struct {
+		name    string
+		request *http.Request
+		body    []byte
+		want    error
+	}{
+		{"rejects unsigned message", httptest.NewRequest(http.MethodPost, "/message", nil), body, ErrUnsigned},
+		{"rejects wrong secret", signedRequest([]byte("other"), now, "n1", body), body, ErrBadSignature},
+		{"rejects changed body", signedRequest(secret, now, "n1", body), []byte(`{"key": "region", "value": "asia"}`), ErrBadSignature},
+		{"rejects another route", replayed(http.MethodPost, "/cluster/repair"), body, ErrBadSignature},
+		{"rejects another query", replayed(http.MethodPost, "/message?ns=team-a"), body, ErrBadSignature},
+		{"rejects another method", replayed(http.MethodPut, "/message"), body, ErrBadSignature},
+		{"rejects old message", signedRequest(secret, now-120, "n1", body), body, ErrStale},
+		{"rejects future message", signedRequest(secret, now+120, "n1", body), body, ErrStale},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v := NewVerifier(secret, time.Minute)
+
+			if err := v.Verify(c.request, c.body); err != c.want {
+				t.Errorf("got %v, want %v", err, c.want)
+			}
+		})
+	}
+
+	t.Run("rejects replayed message", func(t *testing.T) {
+		v := NewVerifier(secret, time.Minute)
+		r := signedRequest(secret, now, "n1", body)
+
+		v.Verify(r, body)
+
+		if err := v.Verify(r, body); err != ErrReplayed {
+			t.Errorf("got %v, want %v", err, ErrReplayed)
+		}
+	})
+}
+
+func TestSendMessageSigns(t *testing.T) {
+	secret := []byte("cluster-secret")
+	b := Broadcaster{Secret: secret}
+	v := NewVerifier(secret, time.Minute)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if err := v.Verify(r, body); err != nil {
+			t.Errorf("Verify returned error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	if err := b.SendMessage(Message{Key: "region", Value: "europe"}, ts.URL); err != nil {
+		t.Errorf("SendMessage returned error: %s", err)
+	}
+}
+
+func TestVerifyMessage(t *testing.T) {
+	secret := []byte("cluster-secret")
+
+	signed := func() *proto.Message {
+		m := Message{Op: OpPut, Key: "region", Value: "europe"}.Proto()
+		signMessage(m, secret)
+		return m
+	}
+
+	t.Run("accepts signed message", func(t *testing.T) {
+		v := NewVerifier(secret, time.Minute)
+
+		if err := v.VerifyMessage(signed()); err != nil {
+			t.Errorf("VerifyMessage returned error: %s", err)
+		}
+	})
+
+	t.Run("rejects bad messages", func(t *testing.T) {
+		tampered := signed()
+		tampered.Value = "asia"
+
+		stale := Message{Key: "region"}.Proto()
+		stale.SentAt, stale.Nonce = time.Now().Add(-time.Hour).Unix(), "n1"
+		stale.Signature = Sign(secret, stale.SentAt, stale.Nonce, http.MethodPost, ReplicatePath, unsignedMessage(stale))
+
+		cases := []struct {
+			name    string
+			message *proto.Message
+			want    error
+		}{
+			{"unsigned", Message{Key: "region"}.Proto(), ErrUnsigned},
+			{"tampered", tampered, ErrBadSignature},
+			{"stale", stale, ErrStale},
+		}
+
+		for _, c := range cases {
+			v := NewVerifier(secret, time.Minute)
+			if err := v.VerifyMessage(c.message); err != c.want {
+				t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+			}
+		}
+	})
+
+	t.Run("rejects replayed message", func(t *testing.T) {
+		v := NewVerifier(secret, time.Minute)
+		m := signed()
+
+		v.VerifyMessage(m)
+
+		if err := v.VerifyMessage(m); err != ErrReplayed {
+			t.Errorf("got %v, want %v", err, ErrReplayed)
+		}
+	})
+}
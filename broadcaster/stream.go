@@ -0,0 +1,355 @@
+package broadcaster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wolakec/makhzen/proto"
+)
+
+// ReplicatePath is the path of the gRPC Peer.Replicate call that messages
+// are streamed over when a Broadcaster is set to use gRPC.
+const ReplicatePath = "/makhzen.Peer/Replicate"
+
+var (
+	errStreamClosed = errors.New("node closed the replication stream")
+	errNoMessage    = errors.New("node acked a message that was not sent")
+	errAckTimeout   = errors.New("node did not ack the message in time")
+	errOpenTimeout  = errors.New("node did not answer the replication stream in time")
+	errNotTLS       = errors.New("gRPC needs HTTP/2 and so an https URL")
+)
+
+// Proto returns msg as the proto.Message sent over Peer.Replicate.
+func (msg Message) Proto() *proto.Message {
+	return &proto.Message{
+		Op:          msg.Op,
+		Namespace:   msg.Namespace,
+		Key:         msg.Key,
+		Value:       msg.Value,
+		Type:        msg.Type,
+		Data:        msg.Data,
+		ContentType: msg.ContentType,
+		Flags:       msg.Flags,
+		State:       msg.State,
+		TTL:         msg.TTL,
+		RequestID:   msg.RequestID,
+		Traceparent: msg.Traceparent,
+		Timestamp:   msg.Timestamp,
+		Since:       msg.Since,
+	}
+}
+
+// FromProto returns the Message m, received over Peer.Replicate, carries.
+func FromProto(m *proto.Message) Message {
+	return Message{
+		Op:          m.Op,
+		Namespace:   m.Namespace,
+		Key:         m.Key,
+		Value:       m.Value,
+		Type:        m.Type,
+		Data:        m.Data,
+		ContentType: m.ContentType,
+		Flags:       m.Flags,
+		State:       m.State,
+		TTL:         m.TTL,
+		RequestID:   m.RequestID,
+		Traceparent: m.Traceparent,
+		Timestamp:   m.Timestamp,
+		Since:       m.Since,
+	}
+}
+
+// peerStream holds the stream to one node, so that opening a stream to a
+// node that cannot be reached only holds up messages to that node.
+type peerStream struct {
+	mu     sync.Mutex
+	stream *stream
+}
+
+// stream is a Peer.Replicate call to one node. Messages are written to it
+// as they are sent and the node acks each in the order they were written,
+// so acks are handed to the senders waiting for them in that order. Once
+// the call fails every waiting sender is given the error, and the next
+// message opens a new call.
+type stream struct {
+	// secret signs each message, when it is set.
+	secret []byte
+	w      *io.PipeWriter
+	resp   *http.Response
+	cancel context.CancelFunc
+
+	// writing is held while a message is queued and written, so that
+	// messages are written in the order their acks are queued.
+	writing sync.Mutex
+
+	mu   sync.Mutex
+	acks []chan error
+	err  error
+}
+
+// sendStream sends msg to addr over the stream to it, opening one when
+// there is none, and waits for the node to ack it.
+func (b *Broadcaster) sendStream(msg Message, addr string) error {
+	st, err := b.stream(addr)
+	if err != nil {
+		return err
+	}
+
+	return st.send(msg, b.client().Timeout)
+}
+
+// stream returns the open stream to addr, opening a new one when there is
+// none or the last one failed.
+func (b *Broadcaster) stream(addr string) (*stream, error) {
+	b.mu.Lock()
+	if b.streams == nil {
+		b.streams = make(map[string]*peerStream)
+	}
+	ps, ok := b.streams[addr]
+	if !ok {
+		ps = new(peerStream)
+		b.streams[addr] = ps
+	}
+	b.mu.Unlock()
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.stream != nil && ps.stream.failed() == nil {
+		return ps.stream, nil
+	}
+
+	st, err := b.openStream(addr)
+	if err != nil {
+		return nil, err
+	}
+	ps.stream = st
+
+	return st, nil
+}
+
+// openStream calls Peer.Replicate on the node at addr, authenticated and
+// signed as messages are. The call is signed with an empty body, and each
+// message sent over it is signed again in its own fields.
+func (b *Broadcaster) openStream(addr string) (*stream, error) {
+	if !strings.HasPrefix(addr, "https://") {
+		return nil, errNotTLS
+	}
+
+	pr, pw := io.Pipe()
+
+	req, err := http.NewRequest(http.MethodPost, addr+ReplicatePath, pr)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", proto.ContentType)
+	req.Header.Set("TE", "trailers")
+	if err := b.authorize(req, nil); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req = req.WithContext(ctx)
+
+	// The call lasts for as long as the stream is used, so only opening it
+	// is bounded by the client's timeout. The body is closed along with the
+	// call, as the request is not given up while it is being written.
+	var timer *time.Timer
+	if timeout := b.client().Timeout; timeout > 0 {
+		timer = time.AfterFunc(timeout, func() {
+			cancel()
+			pw.CloseWithError(errOpenTimeout)
+		})
+	}
+
+	client := &http.Client{Transport: b.client().Transport}
+	resp, err := client.Do(req)
+
+	if err == nil && timer != nil && !timer.Stop() {
+		resp.Body.Close()
+		err = errOpenTimeout
+	}
+	if err == nil {
+		err = openError(resp)
+	}
+	if err != nil {
+		cancel()
+		pw.CloseWithError(err)
+		return nil, err
+	}
+
+	st := &stream{secret: b.Secret, w: pw, resp: resp, cancel: cancel}
+	go st.readAcks()
+
+	return st, nil
+}
+
+// openError returns why the response to a Peer.Replicate call shows it
+// could not be made, or nil when it was.
+func openError(resp *http.Response) error {
+	err := func() error {
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("node did not return 200 response: %s", resp.Status)
+		}
+
+		if resp.ProtoMajor != 2 {
+			return fmt.Errorf("node answered over %s, gRPC needs HTTP/2 and so TLS", resp.Proto)
+		}
+
+		if s, ok := proto.ParseStatus(resp.Header); ok && s.Code != proto.OK {
+			return s
+		}
+
+		return nil
+	}()
+
+	if err != nil {
+		resp.Body.Close()
+	}
+
+	return err
+}
+
+// send writes msg to the stream and waits up to timeout, or for as long as
+// it takes when timeout is zero, for the node to ack it. A message that is
+// not written and acked in time fails the stream, as its ack could no
+// longer be told apart from those of the messages sent after it.
+func (st *stream) send(msg Message, timeout time.Duration) error {
+	m := msg.Proto()
+	if len(st.secret) > 0 {
+		if err := signMessage(m, st.secret); err != nil {
+			return err
+		}
+	}
+
+	ack := make(chan error, 1)
+
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() { st.expire(ack) })
+		defer timer.Stop()
+	}
+
+	st.writing.Lock()
+	st.mu.Lock()
+	if st.err != nil {
+		st.mu.Unlock()
+		st.writing.Unlock()
+		return st.err
+	}
+	st.acks = append(st.acks, ack)
+	st.mu.Unlock()
+
+	_, err := st.w.Write(proto.Frame(m.Marshal()))
+	st.writing.Unlock()
+
+	if err != nil {
+		st.fail(err)
+	}
+
+	return <-ack
+}
+
+// expire fails the stream when the sender waiting on ack is still waiting.
+func (st *stream) expire(ack chan error) {
+	st.mu.Lock()
+	waiting := false
+	for _, a := range st.acks {
+		if a == ack {
+			waiting = true
+		}
+	}
+	st.mu.Unlock()
+
+	if waiting {
+		st.fail(errAckTimeout)
+	}
+}
+
+// readAcks hands each ack read from the stream to the sender waiting for
+// it, until the stream fails.
+func (st *stream) readAcks() {
+	defer st.resp.Body.Close()
+
+	for {
+		b, err := proto.ReadFrame(st.resp.Body)
+		if err == io.EOF {
+			err = errStreamClosed
+			if s, ok := proto.ParseStatus(st.resp.Trailer); ok && s.Code != proto.OK {
+				err = s
+			}
+		}
+		if err != nil {
+			st.fail(err)
+			return
+		}
+
+		var ack proto.Ack
+		if err := ack.Unmarshal(b); err != nil {
+			st.fail(err)
+			return
+		}
+
+		st.mu.Lock()
+		if len(st.acks) == 0 {
+			st.mu.Unlock()
+			st.fail(errNoMessage)
+			return
+		}
+		waiting := st.acks[0]
+		st.acks = st.acks[1:]
+		st.mu.Unlock()
+
+		if ack.Error != "" {
+			waiting <- fmt.Errorf("node could not apply message: %s", ack.Error)
+		} else {
+			waiting <- nil
+		}
+	}
+}
+
+// fail ends the stream with err, handing it to every sender still waiting
+// for an ack.
+func (st *stream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+		for _, waiting := range st.acks {
+			waiting <- err
+		}
+		st.acks = nil
+	}
+	st.mu.Unlock()
+
+	st.cancel()
+	st.w.CloseWithError(err)
+}
+
+// failed returns the error the stream failed with, or nil while it is open.
+func (st *stream) failed() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.err
+}
+
+// Close closes the streams to other nodes. Messages sent afterwards open
+// new ones.
+func (b *Broadcaster) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, ps := range b.streams {
+		ps.mu.Lock()
+		if ps.stream != nil {
+			ps.stream.fail(errStreamClosed)
+		}
+		ps.mu.Unlock()
+	}
+}
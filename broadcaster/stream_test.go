@@ -0,0 +1,183 @@
+package broadcaster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/proto"
+)
+
+// newReplicaServer serves Peer.Replicate over HTTP/2, answering each
+// message with the ack handle returns for it until handle returns nil,
+// and counting the calls made in calls.
+func newReplicaServer(calls *int32, handle func(r *http.Request, m *proto.Message) *proto.Ack) *httptest.Server {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+
+		w.Header().Set("Content-Type", proto.ContentType)
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for {
+			b, err := proto.ReadFrame(r.Body)
+			if err != nil {
+				break
+			}
+
+			var m proto.Message
+			m.Unmarshal(b)
+
+			ack := handle(r, &m)
+			if ack == nil {
+				break
+			}
+
+			w.Write(proto.Frame(ack.Marshal()))
+			w.(http.Flusher).Flush()
+		}
+
+		proto.SetStatus(w.Header(), proto.Status{Code: proto.OK})
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+
+	return ts
+}
+
+func TestSendStream(t *testing.T) {
+	t.Run("sends signed messages over one signed stream", func(t *testing.T) {
+		var calls int32
+		var got []Message
+
+		verifier := NewVerifier([]byte("secret"), time.Minute)
+		ts := newReplicaServer(&calls, func(r *http.Request, m *proto.Message) *proto.Ack {
+			if len(got) == 0 {
+				if err := verifier.Verify(r, nil); err != nil {
+					t.Errorf("could not verify stream: %s", err)
+				}
+				if r.Header.Get("Authorization") != "Bearer token" {
+					t.Errorf("got authorization %q", r.Header.Get("Authorization"))
+				}
+			}
+			if err := verifier.VerifyMessage(m); err != nil {
+				t.Errorf("could not verify message: %s", err)
+			}
+
+			got = append(got, FromProto(m))
+			return &proto.Ack{}
+		})
+		defer ts.Close()
+
+		b := &Broadcaster{Secret: []byte("secret"), Token: "token", Client: ts.Client(), GRPC: true}
+		defer b.Close()
+
+		want := []Message{
+			{Op: OpPut, Key: "region", Value: "eu-west", Timestamp: 1},
+			{Op: OpMerge, Namespace: "team-a", Key: "tags", Type: "set", State: []byte(`{}`), Since: 2},
+		}
+		for _, msg := range want {
+			if err := b.SendMessage(msg, ts.URL); err != nil {
+				t.Fatalf("could not send message: %s", err)
+			}
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+		if calls != 1 {
+			t.Errorf("got %d calls, want the messages sent over one", calls)
+		}
+	})
+
+	t.Run("returns the error a message is acked with", func(t *testing.T) {
+		var calls int32
+		ts := newReplicaServer(&calls, func(r *http.Request, m *proto.Message) *proto.Ack {
+			return &proto.Ack{Error: "store is full"}
+		})
+		defer ts.Close()
+
+		b := &Broadcaster{Client: ts.Client(), GRPC: true}
+		defer b.Close()
+
+		err := b.SendMessage(Message{Key: "region", Value: "eu-west"}, ts.URL)
+		if err == nil || !strings.Contains(err.Error(), "store is full") {
+			t.Errorf("got %v, want the ack's error", err)
+		}
+	})
+
+	t.Run("opens a new stream once the node ends one", func(t *testing.T) {
+		var calls int32
+		ts := newReplicaServer(&calls, func(r *http.Request, m *proto.Message) *proto.Ack {
+			if m.Key == "last" {
+				return nil
+			}
+			return &proto.Ack{}
+		})
+		defer ts.Close()
+
+		b := &Broadcaster{Client: ts.Client(), GRPC: true}
+		defer b.Close()
+
+		if err := b.SendMessage(Message{Key: "last"}, ts.URL); err == nil {
+			t.Error("expected an error for a message the node ended the stream on")
+		}
+
+		if err := b.SendMessage(Message{Key: "region"}, ts.URL); err != nil {
+			t.Fatalf("could not send message: %s", err)
+		}
+		if calls != 2 {
+			t.Errorf("got %d calls, want 2", calls)
+		}
+	})
+
+	t.Run("fails messages not acked in time", func(t *testing.T) {
+		var calls int32
+		release := make(chan struct{})
+		ts := newReplicaServer(&calls, func(r *http.Request, m *proto.Message) *proto.Ack {
+			<-release
+			return nil
+		})
+		defer ts.Close()
+		defer close(release)
+
+		client := ts.Client()
+		client.Timeout = 50 * time.Millisecond
+
+		b := &Broadcaster{Client: client, GRPC: true}
+		defer b.Close()
+
+		if err := b.SendMessage(Message{Key: "region"}, ts.URL); err != errAckTimeout {
+			t.Errorf("got %v, want %v", err, errAckTimeout)
+		}
+	})
+
+	t.Run("needs HTTP/2", func(t *testing.T) {
+		b := &Broadcaster{GRPC: true}
+		defer b.Close()
+
+		if err := b.SendMessage(Message{Key: "region"}, "http://127.0.0.1:5000"); err != errNotTLS {
+			t.Errorf("got %v, want %v", err, errNotTLS)
+		}
+
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", proto.ContentType)
+		}))
+		defer ts.Close()
+
+		// The test server only speaks HTTP/1.1.
+		client := ts.Client()
+		client.Timeout = 100 * time.Millisecond
+		b.Client = client
+
+		err := b.SendMessage(Message{Key: "region"}, ts.URL)
+		if err == nil {
+			t.Error("expected an error from a node that does not speak HTTP/2")
+		}
+	})
+}
@@ -0,0 +1,505 @@
+// Package client is a Go client for a Makhzen cluster. It spreads requests
+// across the nodes it knows of, fails over to another node when one cannot
+// be reached, and retries requests that are safe to repeat.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for a key that is not held by the cluster.
+var ErrNotFound = errors.New("key not found")
+
+// ErrNoNodes is returned when the client knows of no nodes to send to.
+var ErrNoNodes = errors.New("no nodes to send requests to")
+
+// Defaults for the Retries and Backoff of a Client returned by New.
+const (
+	DefaultRetries = 3
+	DefaultBackoff = 100 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+)
+
+// Client sends requests to the nodes of a cluster in turn. Token, when set,
+// is sent as a bearer token. HTTPClient, when set, is used to send requests,
+// for example over TLS; otherwise http.DefaultClient is. Namespace, when
+// set, reads and writes keys in that namespace rather than the default one.
+//
+// Requests that fail to reach a node, or that it fails with a 5xx response,
+// are retried on the next node up to Retries times, waiting Backoff before
+// the first retry and twice as long before each one after. Writes that
+// would be applied twice if retried, such as Incr, are not retried once
+// they may have been sent.
+type Client struct {
+	Token      string
+	HTTPClient *http.Client
+	Namespace  string
+	Retries    int
+	Backoff    time.Duration
+
+	mu    sync.Mutex
+	nodes []string
+	next  int
+}
+
+// New returns a client for the nodes at the given addresses, such as
+// http://127.0.0.1:3001.
+func New(addresses ...string) *Client {
+	c := &Client{
+		Retries: DefaultRetries,
+		Backoff: DefaultBackoff,
+	}
+	c.SetNodes(addresses)
+
+	return c
+}
+
+// Item is a value read from the cluster. Value holds the value in the form
+// the HTTP API returns it, Type its type, and ContentType the content type
+// a raw value was uploaded with.
+type Item struct {
+	Key         string
+	Value       string
+	Type        string
+	ContentType string
+}
+
+// StatusError is returned for a response the client does not expect.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("node returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+
+	return fmt.Sprintf("node returned %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Nodes returns the addresses of the nodes the client sends requests to.
+func (c *Client) Nodes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]string(nil), c.nodes...)
+}
+
+// SetNodes replaces the nodes the client sends requests to.
+func (c *Client) SetNodes(addresses []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nodes = nil
+	seen := make(map[string]bool)
+	for _, addr := range addresses {
+		addr = strings.TrimSuffix(addr, "/")
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		c.nodes = append(c.nodes, addr)
+	}
+}
+
+// Discover adds the nodes known to any of the client's nodes, from GET
+// /nodes, to those it sends requests to. Nodes list the addresses in their
+// -cluster setting, so this only finds nodes that serve clients on those
+// addresses, which is not the case when they are started with -peer-port.
+func (c *Client) Discover(ctx context.Context) error {
+	var nodes []struct {
+		Address string
+	}
+
+	err := c.do(ctx, true, func(node string) error {
+		resp, err := c.send(ctx, http.MethodGet, node+"/nodes", "", nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return statusError(resp)
+		}
+
+		return json.NewDecoder(resp.Body).Decode(&nodes)
+	})
+	if err != nil {
+		return err
+	}
+
+	addresses := c.Nodes()
+	for _, n := range nodes {
+		addresses = append(addresses, n.Address)
+	}
+	c.SetNodes(addresses)
+
+	return nil
+}
+
+// Get returns the item at key, or ErrNotFound.
+func (c *Client) Get(ctx context.Context, key string) (Item, error) {
+	var item Item
+
+	err := c.do(ctx, true, func(node string) error {
+		resp, err := c.send(ctx, http.MethodGet, node+c.path("items", key), "", nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusNotFound:
+			return ErrNotFound
+		default:
+			return statusError(resp)
+		}
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		item = Item{
+			Key:         key,
+			Value:       string(b),
+			Type:        resp.Header.Get("X-Makhzen-Type"),
+			ContentType: resp.Header.Get("Content-Type"),
+		}
+		if item.ContentType == "text/plain; charset=utf-8" {
+			item.ContentType = ""
+		}
+
+		return nil
+	})
+
+	return item, err
+}
+
+// Put stores value at key as a string, expiring it after ttl unless ttl is
+// zero. The ttl is rounded up to whole seconds.
+func (c *Client) Put(ctx context.Context, key string, value string, ttl time.Duration) error {
+	body, err := json.Marshal(struct {
+		Value string `json:"value"`
+		Type  string `json:"type"`
+		TTL   int64  `json:"ttl,omitempty"`
+	}{value, "string", seconds(ttl)})
+	if err != nil {
+		return err
+	}
+
+	return c.put(ctx, c.path("items", key), "application/json", body)
+}
+
+// PutRaw stores data at key exactly as given, to be returned with
+// contentType, expiring it after ttl unless ttl is zero.
+func (c *Client) PutRaw(ctx context.Context, key string, data []byte, contentType string, ttl time.Duration) error {
+	// Nodes read bodies of these content types as JSON values.
+	if t, _, _ := mime.ParseMediaType(contentType); t == "" || t == "application/json" || t == "application/x-www-form-urlencoded" {
+		return errors.New("a raw value needs a content type other than application/json or a form")
+	}
+
+	path := c.path("items", key)
+	if ttl > 0 {
+		path += "?ttl=" + strconv.FormatInt(seconds(ttl), 10)
+	}
+
+	return c.put(ctx, path, contentType, data)
+}
+
+func (c *Client) put(ctx context.Context, path string, contentType string, body []byte) error {
+	return c.do(ctx, true, func(node string) error {
+		resp, err := c.send(ctx, http.MethodPut, node+path, contentType, body)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusAccepted {
+			return statusError(resp)
+		}
+
+		return nil
+	})
+}
+
+// Delete deletes the value at key, returning ErrNotFound when there was
+// none. A delete that is retried after reaching a node may return
+// ErrNotFound for a value it deleted.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, true, func(node string) error {
+		resp, err := c.send(ctx, http.MethodDelete, node+c.path("items", key), "", nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusNoContent:
+			return nil
+		case http.StatusNotFound:
+			return ErrNotFound
+		default:
+			return statusError(resp)
+		}
+	})
+}
+
+// Incr adds delta, which may be negative, to the counter at key and returns
+// its new value. It is only sent to another node when it could not reach
+// the first, so that it is not applied twice.
+func (c *Client) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	var v int64
+
+	err := c.do(ctx, false, func(node string) error {
+		resp, err := c.send(ctx, http.MethodPost, node+c.path("incr", key)+"?by="+strconv.FormatInt(delta, 10), "", nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return statusError(resp)
+		}
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		v, err = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		return err
+	})
+
+	return v, err
+}
+
+// BatchGet returns the items at keys that are held by the cluster. The HTTP
+// API reads one key per request, so they are read concurrently.
+func (c *Client) BatchGet(ctx context.Context, keys []string) (map[string]Item, error) {
+	items := make(map[string]Item)
+	var mu sync.Mutex
+
+	err := c.batch(ctx, len(keys), func(i int) error {
+		item, err := c.Get(ctx, keys[i])
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		items[keys[i]] = item
+		mu.Unlock()
+
+		return nil
+	})
+
+	return items, err
+}
+
+// BatchPut stores each value in values at its key, concurrently, returning
+// the first error if any fail.
+func (c *Client) BatchPut(ctx context.Context, values map[string]string, ttl time.Duration) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	return c.batch(ctx, len(keys), func(i int) error {
+		return c.Put(ctx, keys[i], values[keys[i]], ttl)
+	})
+}
+
+// maxConcurrent is the most requests a batch sends at once.
+const maxConcurrent = 16
+
+func (c *Client) batch(ctx context.Context, n int, f func(i int) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	sem := make(chan struct{}, maxConcurrent)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f(i)
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// path returns the path of key under endpoint, in the client's namespace.
+func (c *Client) path(endpoint string, key string) string {
+	var p string
+	if c.Namespace != "" {
+		p = "/ns/" + url.PathEscape(c.Namespace)
+	}
+
+	return p + "/" + endpoint + "/" + escapeKey(key)
+}
+
+// escapeKey escapes each segment of key, keeping the slashes that keys such
+// as config/region are commonly made of.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// do calls f with each node in turn until it succeeds or fails in a way
+// that retrying would not change. When idempotent is false, f is only
+// retried when the request could not be sent.
+func (c *Client) do(ctx context.Context, idempotent bool, f func(node string) error) error {
+	backoff := c.Backoff
+
+	for attempt := 0; ; attempt++ {
+		node, ok := c.pick()
+		if !ok {
+			return ErrNoNodes
+		}
+
+		err := f(node)
+		if err == nil || !c.retryable(ctx, err, idempotent) || attempt >= c.Retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// pick returns the next node to send a request to.
+func (c *Client) pick() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.nodes) == 0 {
+		return "", false
+	}
+
+	node := c.nodes[c.next%len(c.nodes)]
+	c.next++
+
+	return node, true
+}
+
+func (c *Client) retryable(ctx context.Context, err error, idempotent bool) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if e, ok := err.(*StatusError); ok {
+		// A full store is not going to empty by trying again.
+		return idempotent && e.StatusCode >= 500 && e.StatusCode != http.StatusInsufficientStorage
+	}
+
+	if _, ok := err.(*sendError); ok {
+		return true
+	}
+
+	return idempotent && err != ErrNotFound
+}
+
+// sendError is returned when a request could not be sent, so that it is
+// safe to retry even if it is not idempotent.
+type sendError struct {
+	err error
+}
+
+func (e *sendError) Error() string {
+	return e.err.Error()
+}
+
+func (c *Client) send(ctx context.Context, method string, u string, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if isDialError(err) {
+			return nil, &sendError{err}
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// isDialError reports whether err means a connection to the node could not
+// be made, so the request was never sent.
+func isDialError(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+
+	e, ok := err.(*net.OpError)
+	return ok && e.Op == "dial"
+}
+
+func statusError(resp *http.Response) error {
+	b, _ := ioutil.ReadAll(resp.Body)
+
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(b)),
+	}
+}
+
+// seconds rounds d up to whole seconds.
+func seconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/namespace"
+	"github.com/wolakec/makhzen/registry"
+	"github.com/wolakec/makhzen/server"
+	"github.com/wolakec/makhzen/store"
+	"github.com/wolakec/makhzen/watch"
+)
+
+// newNode starts a node with no other nodes, that knows of the given
+// addresses.
+func newNode(addresses ...string) (*server.MakhzenServer, *httptest.Server) {
+	st := store.New()
+	hub := watch.New(100)
+	st.AddObserver(hub)
+
+	s := server.NewMakhzenServer(st, registry.New(addresses))
+	s.Watcher = hub
+	s.Namespaces = namespace.New()
+	s.Logger = logging.New(ioutil.Discard, logging.Info)
+
+	return s, httptest.NewServer(s)
+}
+
+// deadAddress returns the address of a server that is no longer running.
+func deadAddress() string {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+
+	return ts.URL
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("gets, puts and deletes values", func(t *testing.T) {
+		s, ts := newNode()
+		defer ts.Close()
+		defer s.Drain()
+		c := New(ts.URL)
+
+		if err := c.Put(ctx, "config/region", "eu-west-1", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		item, err := c.Get(ctx, "config/region")
+		want := Item{Key: "config/region", Value: "eu-west-1", Type: store.TypeString}
+		if err != nil || item != want {
+			t.Errorf("got %+v, %v, want %+v", item, err, want)
+		}
+
+		if ttl, _ := s.Store.(*store.Store).TTL("config/region"); ttl <= 59*time.Second {
+			t.Errorf("got TTL %s, want a minute", ttl)
+		}
+
+		if err := c.Delete(ctx, "config/region"); err != nil {
+			t.Errorf("got %v deleting", err)
+		}
+		if _, err := c.Get(ctx, "config/region"); err != ErrNotFound {
+			t.Errorf("got %v getting a deleted key, want ErrNotFound", err)
+		}
+		if err := c.Delete(ctx, "config/region"); err != ErrNotFound {
+			t.Errorf("got %v deleting a deleted key, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("puts raw values", func(t *testing.T) {
+		s, ts := newNode()
+		defer ts.Close()
+		defer s.Drain()
+		c := New(ts.URL)
+
+		if err := c.PutRaw(ctx, "logo", []byte{0x89, 'P', 'N', 'G'}, "image/png", 0); err != nil {
+			t.Fatal(err)
+		}
+
+		item, err := c.Get(ctx, "logo")
+		want := Item{Key: "logo", Value: "\x89PNG", Type: store.TypeBytes, ContentType: "image/png"}
+		if err != nil || item != want {
+			t.Errorf("got %+v, %v, want %+v", item, err, want)
+		}
+
+		for _, contentType := range []string{"", "application/json; charset=utf-8", "application/x-www-form-urlencoded"} {
+			if err := c.PutRaw(ctx, "logo", nil, contentType, 0); err == nil {
+				t.Errorf("expected an error for content type %q", contentType)
+			}
+		}
+	})
+
+	t.Run("increments counters", func(t *testing.T) {
+		s, ts := newNode()
+		defer ts.Close()
+		defer s.Drain()
+		c := New(ts.URL)
+
+		c.Incr(ctx, "visits", 5)
+		v, err := c.Incr(ctx, "visits", -2)
+		if err != nil || v != 3 {
+			t.Errorf("got %d, %v, want 3", v, err)
+		}
+	})
+
+	t.Run("reads and writes batches", func(t *testing.T) {
+		s, ts := newNode()
+		defer ts.Close()
+		defer s.Drain()
+		c := New(ts.URL)
+
+		if err := c.BatchPut(ctx, map[string]string{"a": "1", "b": "2"}, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		items, err := c.BatchGet(ctx, []string{"a", "b", "missing"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var keys []string
+		for key := range items {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		if !reflect.DeepEqual(keys, []string{"a", "b"}) || items["b"].Value != "2" {
+			t.Errorf("got %+v", items)
+		}
+	})
+
+	t.Run("uses a namespace", func(t *testing.T) {
+		s, ts := newNode()
+		defer ts.Close()
+		defer s.Drain()
+		s.Namespaces.Create(namespace.Settings{Name: "team-a"})
+
+		c := New(ts.URL)
+		c.Namespace = "team-a"
+		c.Put(ctx, "region", "eu-west-1", 0)
+
+		if _, err := c.Get(ctx, "region"); err != nil {
+			t.Errorf("got %v getting from the namespace", err)
+		}
+		if _, err := New(ts.URL).Get(ctx, "region"); err != ErrNotFound {
+			t.Errorf("got %v getting from the default namespace, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("fails over to a node that can be reached", func(t *testing.T) {
+		s, ts := newNode()
+		defer ts.Close()
+		defer s.Drain()
+
+		c := New(deadAddress(), ts.URL)
+		c.Backoff = time.Millisecond
+
+		for i := 0; i < 4; i++ {
+			if err := c.Put(ctx, "region", "eu-west-1", 0); err != nil {
+				t.Errorf("got %v putting", err)
+			}
+		}
+
+		// An increment that could not be sent is safe to send elsewhere.
+		if _, err := c.Incr(ctx, "visits", 1); err != nil {
+			t.Errorf("got %v incrementing", err)
+		}
+	})
+
+	t.Run("retries server errors for idempotent requests only", func(t *testing.T) {
+		var requests int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer ts.Close()
+
+		c := New(ts.URL)
+		c.Backoff = time.Millisecond
+
+		if _, err := c.Get(ctx, "region"); err != nil || requests != 3 {
+			t.Errorf("got %v after %d requests, want success after 3", err, requests)
+		}
+
+		atomic.StoreInt32(&requests, 0)
+		_, err := c.Incr(ctx, "visits", 1)
+		if e, ok := err.(*StatusError); !ok || e.StatusCode != http.StatusServiceUnavailable || requests != 1 {
+			t.Errorf("got %v after %d requests, want a 503 after 1", err, requests)
+		}
+
+		c.Retries = 0
+		atomic.StoreInt32(&requests, 0)
+		if _, err := c.Get(ctx, "region"); err == nil || requests != 1 {
+			t.Errorf("got %v after %d requests, want an error after 1", err, requests)
+		}
+	})
+
+	t.Run("stops retrying when the context is cancelled", func(t *testing.T) {
+		c := New(deadAddress())
+		c.Retries = 100
+		c.Backoff = time.Hour
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+
+		if _, err := c.Get(ctx, "region"); err != context.DeadlineExceeded {
+			t.Errorf("got %v, want context.DeadlineExceeded", err)
+		}
+	})
+
+	t.Run("sends a token", func(t *testing.T) {
+		var auth string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth = r.Header.Get("Authorization")
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer ts.Close()
+
+		c := New(ts.URL)
+		c.Token = "s3cret"
+		c.Delete(ctx, "region")
+
+		if auth != "Bearer s3cret" {
+			t.Errorf("got Authorization %q", auth)
+		}
+	})
+
+	t.Run("discovers nodes", func(t *testing.T) {
+		s, ts := newNode("http://10.0.0.2:5000", "http://10.0.0.3:5000")
+		defer ts.Close()
+		defer s.Drain()
+
+		c := New(ts.URL + "/")
+		if err := c.Discover(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{ts.URL, "http://10.0.0.2:5000", "http://10.0.0.3:5000"}
+		if got := c.Nodes(); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("needs a node", func(t *testing.T) {
+		if _, err := New().Get(ctx, "region"); err != ErrNoNodes {
+			t.Errorf("got %v, want ErrNoNodes", err)
+		}
+	})
+}
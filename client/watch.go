@@ -0,0 +1,179 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrCompacted is returned when a watch cannot resume because the node no
+// longer holds the events it missed. The caller should read the values it
+// is watching again and start a new watch.
+var ErrCompacted = errors.New("missed events are no longer held by the node")
+
+// Event is a change to a key, as sent by GET /watch. Type is put, delete,
+// expire or evict.
+type Event struct {
+	Revision uint64 `json:"revision"`
+	Type     string `json:"type"`
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+}
+
+// Watch streams events for the keys it was started with on Events, which
+// is closed when the watch ends. Err returns why once Events is closed.
+//
+// When the stream is cut, the watch resumes from the last event it received
+// on the same node. Revisions are local to each node, so when that node
+// cannot be reached the watch moves to another one from its latest event,
+// and changes made in between are missed.
+type Watch struct {
+	Events <-chan Event
+
+	client   *Client
+	key      string
+	prefix   string
+	revision uint64
+	err      error
+}
+
+// Watch starts watching for changes to key or, when key is empty, to keys
+// starting with prefix. It stops when ctx is cancelled. Watching is not
+// supported in namespaces.
+func (c *Client) Watch(ctx context.Context, key string, prefix string) (*Watch, error) {
+	if c.Namespace != "" {
+		return nil, errors.New("watching for changes is not supported in namespaces")
+	}
+
+	events := make(chan Event, 64)
+	w := &Watch{Events: events, client: c, key: key, prefix: prefix}
+
+	resp, node, err := w.connectAny(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	go w.run(ctx, events, resp, node)
+
+	return w, nil
+}
+
+// Err returns the reason the watch ended, once Events is closed.
+func (w *Watch) Err() error {
+	return w.err
+}
+
+func (w *Watch) run(ctx context.Context, events chan<- Event, resp *http.Response, node string) {
+	defer close(events)
+
+	for {
+		w.read(ctx, events, resp.Body)
+
+		select {
+		case <-ctx.Done():
+			w.err = ctx.Err()
+			return
+		case <-time.After(w.client.Backoff):
+		}
+
+		var err error
+		resp, err = w.connect(ctx, node, w.revision)
+		if err == ErrCompacted {
+			w.err = err
+			return
+		}
+		if err != nil {
+			resp, node, err = w.connectAny(ctx)
+		}
+		if err != nil {
+			w.err = err
+			return
+		}
+	}
+}
+
+// read sends the events read from body until the stream ends.
+func (w *Watch) read(ctx context.Context, events chan<- Event, body io.ReadCloser) {
+	defer body.Close()
+
+	r := bufio.NewReader(body)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		var ev Event
+		if err := json.Unmarshal([]byte(line[len("data: "):]), &ev); err != nil {
+			continue
+		}
+		w.revision = ev.Revision
+
+		select {
+		case events <- ev:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// connectAny starts watching on any node, from its latest event.
+func (w *Watch) connectAny(ctx context.Context) (*http.Response, string, error) {
+	var resp *http.Response
+	var node string
+
+	err := w.client.do(ctx, true, func(n string) error {
+		var err error
+		resp, err = w.connect(ctx, n, 0)
+		node = n
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	w.revision = 0
+
+	return resp, node, nil
+}
+
+// connect starts watching on node, after revision when it is not zero.
+func (w *Watch) connect(ctx context.Context, node string, revision uint64) (*http.Response, error) {
+	q := url.Values{}
+	if w.key != "" {
+		q.Set("key", w.key)
+	}
+	if w.prefix != "" {
+		q.Set("prefix", w.prefix)
+	}
+	if revision > 0 {
+		q.Set("since", strconv.FormatUint(revision, 10))
+	}
+
+	resp, err := w.client.send(ctx, http.MethodGet, node+"/watch?"+q.Encode(), "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusGone:
+		resp.Body.Close()
+		return nil, ErrCompacted
+	default:
+		defer resp.Body.Close()
+		return nil, statusError(resp)
+	}
+}
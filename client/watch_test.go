@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, w *Watch) Event {
+	t.Helper()
+
+	select {
+	case ev, ok := <-w.Events:
+		if !ok {
+			t.Fatalf("watch ended: %v", w.Err())
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+
+	return Event{}
+}
+
+func TestWatch(t *testing.T) {
+	t.Run("streams events", func(t *testing.T) {
+		s, ts := newNode()
+		defer ts.Close()
+		defer s.Drain()
+		c := New(ts.URL)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		w, err := c.Watch(ctx, "", "config/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Put(ctx, "other", "x", 0)
+		c.Put(ctx, "config/region", "eu-west-1", 0)
+		c.Delete(ctx, "config/region")
+
+		if ev := nextEvent(t, w); ev != (Event{Revision: 2, Type: "put", Key: "config/region", Value: "eu-west-1"}) {
+			t.Errorf("got %+v", ev)
+		}
+		if ev := nextEvent(t, w); ev.Type != "delete" || ev.Key != "config/region" {
+			t.Errorf("got %+v", ev)
+		}
+
+		cancel()
+		for range w.Events {
+		}
+		if w.Err() != context.Canceled {
+			t.Errorf("got %v, want context.Canceled", w.Err())
+		}
+	})
+
+	t.Run("resumes after the stream is cut", func(t *testing.T) {
+		s, node := newNode()
+		defer node.Close()
+		defer s.Drain()
+
+		var mu sync.Mutex
+		var queries []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/watch" {
+				mu.Lock()
+				queries = append(queries, r.URL.RawQuery)
+				mu.Unlock()
+			}
+			s.ServeHTTP(w, r)
+		}))
+		defer ts.Close()
+
+		c := New(ts.URL)
+		c.Backoff = time.Millisecond
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		w, err := c.Watch(ctx, "region", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Put(ctx, "region", "eu-west-1", 0)
+		nextEvent(t, w)
+
+		ts.CloseClientConnections()
+		c.Put(ctx, "region", "us-east-1", 0)
+
+		if ev := nextEvent(t, w); ev.Revision != 2 || ev.Value != "us-east-1" {
+			t.Errorf("got %+v", ev)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(queries) != 2 || queries[1] != "key=region&since=1" {
+			t.Errorf("got watch queries %q", queries)
+		}
+	})
+
+	t.Run("ends when missed events are gone", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("since") != "" {
+				w.WriteHeader(http.StatusGone)
+				return
+			}
+			fmt.Fprint(w, "id: 7\nevent: put\ndata: {\"revision\":7,\"type\":\"put\",\"key\":\"region\",\"value\":\"eu\"}\n\n")
+		}))
+		defer ts.Close()
+
+		c := New(ts.URL)
+		c.Backoff = time.Millisecond
+
+		w, err := c.Watch(context.Background(), "region", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ev := nextEvent(t, w); ev.Revision != 7 {
+			t.Errorf("got %+v", ev)
+		}
+
+		for range w.Events {
+		}
+		if w.Err() != ErrCompacted {
+			t.Errorf("got %v, want ErrCompacted", w.Err())
+		}
+	})
+
+	t.Run("is not supported in namespaces", func(t *testing.T) {
+		c := New("http://127.0.0.1:1")
+		c.Namespace = "team-a"
+
+		if _, err := c.Watch(context.Background(), "region", ""); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
@@ -0,0 +1,371 @@
+// Package clustertest runs clusters of Makhzen nodes in one process, for
+// testing replication between them. Each node serves its HTTP API on a
+// local port and replicates to the others over it, as it would in a real
+// cluster, signing its messages with a shared secret. Every node sends
+// through a faults.Transport, so that links between nodes can be cut and
+// messages lost, delayed, duplicated or reordered.
+package clustertest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/client"
+	"github.com/wolakec/makhzen/faults"
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/namespace"
+	"github.com/wolakec/makhzen/registry"
+	"github.com/wolakec/makhzen/server"
+	"github.com/wolakec/makhzen/store"
+	"github.com/wolakec/makhzen/watch"
+)
+
+// Secret signs the messages and requests nodes send each other.
+const Secret = "clustertest-secret"
+
+// DefaultTimeout is how long the Await helpers wait for nodes to converge,
+// unless the cluster's Timeout is set.
+const DefaultTimeout = 5 * time.Second
+
+// pollInterval is how often the Await helpers check the nodes.
+const pollInterval = 10 * time.Millisecond
+
+// Node is one node of a cluster. Its fields are wired together as main
+// wires a node, and may be changed before the cluster is used.
+type Node struct {
+	// ID identifies the node's entries in counters, and Address is the URL
+	// of its HTTP API.
+	ID      string
+	Address string
+
+	Server      *server.MakhzenServer
+	Store       *store.Store
+	Namespaces  *namespace.Manager
+	Registry    *registry.Registry
+	Broadcaster *broadcaster.Broadcaster
+	// Faults injects faults into the requests the node sends to the
+	// others. It is also served on the node's /admin/faults.
+	Faults *faults.Transport
+	// Client sends requests to this node only.
+	Client *client.Client
+
+	http *httptest.Server
+}
+
+// Cluster is a set of nodes, each replicating every write to the others.
+type Cluster struct {
+	Nodes []*Node
+	// Timeout is how long the Await helpers wait for the nodes to converge.
+	Timeout time.Duration
+}
+
+// New starts a cluster of n nodes. Each configure function is called with
+// every node once the nodes are wired together, before any request is
+// served.
+func New(n int, configure ...func(*Node)) *Cluster {
+	c := &Cluster{Timeout: DefaultTimeout}
+
+	for i := 0; i < n; i++ {
+		node := &Node{ID: fmt.Sprintf("node-%d", i)}
+		// Requests are only served once every node has been wired.
+		node.http = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			node.Server.ServeHTTP(w, r)
+		}))
+		node.Address = node.http.URL
+
+		c.Nodes = append(c.Nodes, node)
+	}
+
+	for _, node := range c.Nodes {
+		var peers []string
+		for _, other := range c.Nodes {
+			if other != node {
+				peers = append(peers, other.Address)
+			}
+		}
+
+		node.wire(peers)
+	}
+
+	for _, node := range c.Nodes {
+		for _, f := range configure {
+			f(node)
+		}
+	}
+
+	return c
+}
+
+func (n *Node) wire(peers []string) {
+	logger := logging.New(ioutil.Discard, logging.Info).With("node", n.ID)
+
+	n.Store = store.New()
+	n.Store.NodeID = n.ID
+
+	n.Namespaces = namespace.New()
+	n.Namespaces.NodeID = n.ID
+
+	n.Faults = &faults.Transport{}
+	n.Broadcaster = &broadcaster.Broadcaster{
+		Secret: []byte(Secret),
+		Client: &http.Client{Transport: n.Faults},
+		Logger: logger,
+	}
+
+	n.Registry = registry.New(peers)
+	n.Registry.Broadcaster = n.Broadcaster
+	n.Registry.Logger = logger
+
+	hub := watch.New(1000)
+	n.Store.AddObserver(hub)
+
+	n.Server = server.NewMakhzenServer(n.Store, n.Registry)
+	n.Server.Watcher = hub
+	n.Server.Namespaces = n.Namespaces
+	n.Server.Peers = n.Broadcaster
+	n.Server.Faults = n.Faults
+	n.Server.Verifier = broadcaster.NewVerifier([]byte(Secret), time.Minute)
+	n.Server.Logger = logger
+	n.Server.SetReady(true)
+
+	n.Client = client.New(n.Address)
+	n.Client.Retries = 0
+}
+
+// Close stops every node.
+func (c *Cluster) Close() {
+	for _, n := range c.Nodes {
+		n.Server.Drain()
+		n.http.Close()
+	}
+}
+
+// Addresses returns the address of every node.
+func (c *Cluster) Addresses() []string {
+	addresses := make([]string, len(c.Nodes))
+	for i, n := range c.Nodes {
+		addresses[i] = n.Address
+	}
+
+	return addresses
+}
+
+// Partition cuts the links between nodes in different groups, given by
+// their index in Nodes, in both directions. Nodes in no group are cut off
+// from every other node. Links that are not cut are left as they are.
+func (c *Cluster) Partition(groups ...[]int) {
+	group := make(map[int]int)
+	for g, nodes := range groups {
+		for _, i := range nodes {
+			group[i] = g
+		}
+	}
+
+	for i := range c.Nodes {
+		for j := range c.Nodes {
+			gi, iok := group[i]
+			gj, jok := group[j]
+
+			if i != j && (!iok || !jok || gi != gj) {
+				c.Cut(i, j)
+			}
+		}
+	}
+}
+
+// Cut cuts the link from the node at index from to the node at index to,
+// so that every request from one to the other fails.
+func (c *Cluster) Cut(from int, to int) {
+	c.Nodes[from].Faults.Set(c.Nodes[to].Address, faults.Rule{Cut: true})
+}
+
+// Heal removes every fault from every node and waits for the messages
+// that were delayed to be delivered. Messages lost while faults were
+// injected are not resent.
+func (c *Cluster) Heal() {
+	for _, n := range c.Nodes {
+		n.Faults.Reset()
+	}
+
+	for _, n := range c.Nodes {
+		n.Faults.Wait()
+	}
+}
+
+// Repair runs a consistency check on the node at index i, repairing the
+// keys that differ between the nodes in the default namespace, or the one
+// given, and returns its report.
+func (c *Cluster) Repair(t testing.TB, i int, ns ...string) server.CheckReport {
+	t.Helper()
+
+	u := c.Nodes[i].Address + "/admin/check"
+	if len(ns) > 0 {
+		u += "?ns=" + url.QueryEscape(ns[0])
+	}
+
+	var report server.CheckReport
+
+	resp, err := http.Post(u, "application/json", nil)
+	if err != nil {
+		t.Fatalf("could not repair through %s: %s", c.Nodes[i].ID, err)
+		return report
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("could not repair through %s: %s", c.Nodes[i].ID, resp.Status)
+		return report
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("could not read the report of %s: %s", c.Nodes[i].ID, err)
+	}
+
+	return report
+}
+
+// Put writes value at key through the node's HTTP API, failing t if the
+// write is not accepted.
+func (n *Node) Put(t testing.TB, key string, value string) {
+	t.Helper()
+
+	if err := n.Client.Put(context.Background(), key, value, 0); err != nil {
+		t.Fatalf("could not put %s on %s: %s", key, n.ID, err)
+	}
+}
+
+// Delete deletes key through the node's HTTP API, failing t if it could
+// not be deleted.
+func (n *Node) Delete(t testing.TB, key string) {
+	t.Helper()
+
+	if err := n.Client.Delete(context.Background(), key); err != nil {
+		t.Fatalf("could not delete %s on %s: %s", key, n.ID, err)
+	}
+}
+
+// Eventually calls cond until it returns nil, failing t with the last
+// error it returned if it has not within the cluster's Timeout.
+func (c *Cluster) Eventually(t testing.TB, cond func() error) {
+	t.Helper()
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := cond()
+		if err == nil {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("nodes did not converge within %s: %s", timeout, err)
+			return
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// AwaitValue waits until every node holds want at key in the default
+// namespace.
+func (c *Cluster) AwaitValue(t testing.TB, key string, want string) {
+	t.Helper()
+
+	c.Eventually(t, func() error {
+		for _, n := range c.Nodes {
+			v, ok := n.Store.GetValue(key)
+			if !ok {
+				return fmt.Errorf("%s is missing %s, want %q", n.ID, key, want)
+			}
+			if v != want {
+				return fmt.Errorf("%s holds %q at %s, want %q", n.ID, v, key, want)
+			}
+		}
+
+		return nil
+	})
+}
+
+// AwaitMissing waits until no node holds key in the default namespace.
+func (c *Cluster) AwaitMissing(t testing.TB, key string) {
+	t.Helper()
+
+	c.Eventually(t, func() error {
+		for _, n := range c.Nodes {
+			if v, ok := n.Store.GetValue(key); ok {
+				return fmt.Errorf("%s holds %q at %s, want it missing", n.ID, v, key)
+			}
+		}
+
+		return nil
+	})
+}
+
+// AwaitConverged waits until every node holds the same namespaces, and the
+// same values in each of them and in the default namespace.
+func (c *Cluster) AwaitConverged(t testing.TB) {
+	t.Helper()
+
+	c.Eventually(t, c.Converged)
+}
+
+// Converged returns an error naming a node that differs from the first,
+// unless every node holds the same namespaces and values. Expiry times are
+// not compared, as each node sets them from when it received a write.
+func (c *Cluster) Converged() error {
+	if len(c.Nodes) == 0 {
+		return nil
+	}
+
+	want := c.Nodes[0].digests()
+	for _, n := range c.Nodes[1:] {
+		got := n.digests()
+
+		for name, digest := range want {
+			if other, ok := got[name]; !ok || other != digest {
+				return fmt.Errorf("%s differs from %s in %s", n.ID, c.Nodes[0].ID, describe(name))
+			}
+		}
+		for name := range got {
+			if _, ok := want[name]; !ok {
+				return fmt.Errorf("%s has %s, which %s does not", n.ID, describe(name), c.Nodes[0].ID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// digests returns the digest of the default namespace, under the empty
+// name, and of every other namespace on the node.
+func (n *Node) digests() map[string]store.RangeDigest {
+	digests := map[string]store.RangeDigest{"": n.Store.Digests(1)[0]}
+
+	for _, settings := range n.Namespaces.List() {
+		if ns, ok := n.Namespaces.Get(settings.Name); ok {
+			digests[settings.Name] = ns.Store.Digests(1)[0]
+		}
+	}
+
+	return digests
+}
+
+func describe(namespace string) string {
+	if namespace == "" {
+		return "the default namespace"
+	}
+
+	return "namespace " + namespace
+}
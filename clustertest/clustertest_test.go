@@ -0,0 +1,291 @@
+package clustertest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/faults"
+	"github.com/wolakec/makhzen/namespace"
+)
+
+// recorder is a testing.TB that records the failures reported to it
+// rather than ending the test.
+type recorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func TestCluster(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("replicates writes to every node", func(t *testing.T) {
+		c := New(3)
+		defer c.Close()
+
+		c.Nodes[0].Put(t, "region", "eu-west-1")
+		c.AwaitValue(t, "region", "eu-west-1")
+
+		c.Nodes[2].Put(t, "region", "us-east-1")
+		c.AwaitValue(t, "region", "us-east-1")
+
+		c.Nodes[1].Delete(t, "region")
+		c.AwaitMissing(t, "region")
+		c.AwaitConverged(t)
+	})
+
+	t.Run("replicates expiry", func(t *testing.T) {
+		c := New(2)
+		defer c.Close()
+
+		if err := c.Nodes[0].Client.Put(ctx, "session", "x", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		c.AwaitValue(t, "session", "x")
+
+		if ttl, ok := c.Nodes[1].Store.TTL("session"); !ok || ttl <= 0 {
+			t.Errorf("got TTL %s on %s, want about a minute", ttl, c.Nodes[1].ID)
+		}
+	})
+
+	t.Run("merges counters incremented on every node", func(t *testing.T) {
+		c := New(3)
+		defer c.Close()
+
+		for i, n := range c.Nodes {
+			if _, err := n.Client.Incr(ctx, "visits", int64(i+1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c.AwaitValue(t, "visits", "6")
+		c.AwaitConverged(t)
+	})
+
+	t.Run("replicates namespaces and their values", func(t *testing.T) {
+		c := New(2)
+		defer c.Close()
+
+		body := strings.NewReader(`{"name": "team-a"}`)
+		resp, err := http.Post(c.Nodes[0].Address+"/admin/namespaces", "application/json", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("got %s creating a namespace", resp.Status)
+		}
+
+		c.Nodes[0].Client.Namespace = "team-a"
+		c.Nodes[0].Put(t, "region", "eu-west-1")
+
+		c.Eventually(t, func() error {
+			ns, ok := c.Nodes[1].Namespaces.Get("team-a")
+			if !ok {
+				return fmt.Errorf("%s does not have the namespace", c.Nodes[1].ID)
+			}
+			if v, _ := ns.Store.GetValue("region"); v != "eu-west-1" {
+				return fmt.Errorf("%s holds %q", c.Nodes[1].ID, v)
+			}
+			return nil
+		})
+		c.AwaitConverged(t)
+
+		if _, ok := c.Nodes[1].Store.GetValue("region"); ok {
+			t.Errorf("value was written to the default namespace")
+		}
+	})
+
+	t.Run("keeps local namespaces local", func(t *testing.T) {
+		c := New(2)
+		defer c.Close()
+
+		ns, _ := c.Nodes[0].Namespaces.Create(namespace.Settings{Name: "scratch", Replication: namespace.ReplicateNone})
+		ns.Store.Set("region", "eu-west-1")
+
+		if err := c.Converged(); err == nil || !strings.Contains(err.Error(), "namespace scratch") {
+			t.Errorf("got %v, want the namespace to differ", err)
+		}
+	})
+
+	t.Run("repairs writes a node missed", func(t *testing.T) {
+		c := New(3)
+		defer c.Close()
+
+		// node-0 stops replicating to node-2 while the value is written.
+		c.Nodes[0].Registry.SetNodes([]string{c.Nodes[1].Address})
+		c.Nodes[0].Put(t, "region", "eu-west-1")
+		c.Nodes[0].Registry.SetNodes([]string{c.Nodes[1].Address, c.Nodes[2].Address})
+
+		if err := c.Converged(); err == nil {
+			t.Fatalf("expected node-2 to have missed the write")
+		}
+
+		resp, err := http.Post(c.Nodes[1].Address+"/admin/check", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		c.AwaitValue(t, "region", "eu-west-1")
+		c.AwaitConverged(t)
+	})
+
+	t.Run("reports nodes that do not converge", func(t *testing.T) {
+		c := New(2)
+		defer c.Close()
+		c.Timeout = 50 * time.Millisecond
+
+		c.Nodes[1].Store.Set("region", "us-east-1")
+		c.Nodes[0].Store.Set("region", "eu-west-1")
+
+		r := &recorder{TB: t}
+		c.AwaitValue(r, "region", "eu-west-1")
+		c.AwaitConverged(r)
+
+		want := []string{
+			`nodes did not converge within 50ms: node-1 holds "us-east-1" at region, want "eu-west-1"`,
+			"nodes did not converge within 50ms: node-1 differs from node-0 in the default namespace",
+		}
+		if len(r.failures) != 2 || r.failures[0] != want[0] || r.failures[1] != want[1] {
+			t.Errorf("got failures %q, want %q", r.failures, want)
+		}
+	})
+
+	t.Run("configures every node once it is wired", func(t *testing.T) {
+		var configured []string
+		c := New(2, func(n *Node) {
+			if n.Server == nil || len(n.Registry.GetNodes()) != 1 {
+				t.Errorf("%s was configured before it was wired", n.ID)
+			}
+			configured = append(configured, n.ID)
+		})
+		defer c.Close()
+
+		if len(configured) != 2 || configured[0] != "node-0" || configured[1] != "node-1" {
+			t.Errorf("configured %v", configured)
+		}
+	})
+}
+
+func TestFaults(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("converges after a partition heals", func(t *testing.T) {
+		c := New(4)
+		defer c.Close()
+
+		c.Partition([]int{0, 1}, []int{2, 3})
+
+		c.Nodes[0].Put(t, "region", "eu-west-1")
+		c.Nodes[2].Put(t, "zone", "us-east-1a")
+		c.Nodes[1].Put(t, "colour", "red")
+		time.Sleep(5 * time.Millisecond)
+		c.Nodes[3].Put(t, "colour", "blue")
+		c.Nodes[0].Client.Incr(ctx, "visits", 2)
+		c.Nodes[3].Client.Incr(ctx, "visits", 3)
+
+		// Each side sees its own writes only.
+		if v, _ := c.Nodes[1].Store.GetValue("region"); v != "eu-west-1" {
+			t.Errorf("node-1 holds %q at region", v)
+		}
+		if _, ok := c.Nodes[2].Store.GetValue("region"); ok {
+			t.Errorf("node-2 received a write across the partition")
+		}
+
+		c.Heal()
+		if err := c.Converged(); err == nil {
+			t.Fatalf("expected the sides to differ until repaired")
+		}
+
+		report := c.Repair(t, 0)
+		if report.DifferingKeys != 4 || report.Repaired != 4 {
+			t.Errorf("got %+v", report)
+		}
+
+		c.AwaitConverged(t)
+		c.AwaitValue(t, "region", "eu-west-1")
+		c.AwaitValue(t, "zone", "us-east-1a")
+		c.AwaitValue(t, "colour", "blue")
+		c.AwaitValue(t, "visits", "5")
+	})
+
+	t.Run("converges despite lost, duplicated and reordered messages", func(t *testing.T) {
+		c := New(3)
+		defer c.Close()
+
+		for _, n := range c.Nodes {
+			n.Faults.Set(faults.All, faults.Rule{Drop: 0.3, Duplicate: 0.3, Jitter: 20 * time.Millisecond})
+		}
+
+		// Nodes accept writes whether or not their messages arrive.
+		for i := 0; i < 30; i++ {
+			n := c.Nodes[i%len(c.Nodes)]
+			n.Put(t, fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+			if _, err := n.Client.Incr(ctx, "visits", 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c.Heal()
+		c.Repair(t, 1)
+
+		c.AwaitConverged(t)
+		c.AwaitValue(t, "visits", "30")
+		for i := 0; i < 30; i++ {
+			c.AwaitValue(t, fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		}
+
+		var st faults.Stats
+		for _, n := range c.Nodes {
+			s := n.Faults.Status().Stats
+			st.Dropped += s.Dropped
+			st.Duplicated += s.Duplicated
+			st.Delayed += s.Delayed
+		}
+		if st.Dropped == 0 || st.Duplicated == 0 || st.Delayed == 0 {
+			t.Errorf("expected faults to be injected, got %+v", st)
+		}
+	})
+
+	t.Run("cuts links one way through the admin endpoint", func(t *testing.T) {
+		c := New(2)
+		defer c.Close()
+
+		rules := fmt.Sprintf(`{%q: {"cut": true}}`, c.Nodes[1].Address)
+		req, _ := http.NewRequest(http.MethodPut, c.Nodes[0].Address+"/admin/faults", strings.NewReader(rules))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		c.Nodes[0].Put(t, "region", "eu-west-1")
+		c.Nodes[1].Put(t, "zone", "eu-west-1a")
+
+		if _, ok := c.Nodes[1].Store.GetValue("region"); ok {
+			t.Errorf("node-1 received a write over a cut link")
+		}
+		if v, _ := c.Nodes[0].Store.GetValue("zone"); v != "eu-west-1a" {
+			t.Errorf("node-0 holds %q at zone, want the write from node-1", v)
+		}
+
+		// The check itself cannot reach node-1 until the link is healed.
+		if report := c.Repair(t, 0); report.Consistent || report.Nodes[1].Error == "" {
+			t.Errorf("got %+v", report)
+		}
+
+		c.Heal()
+		c.Repair(t, 0)
+		c.AwaitConverged(t)
+	})
+}
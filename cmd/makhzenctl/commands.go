@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wolakec/makhzen/client"
+	"github.com/wolakec/makhzen/server"
+)
+
+// usageError is returned by a command given the wrong arguments.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+var commands = map[string]func(ctx context.Context, c *ctl, args []string) error{
+	"get":     get,
+	"put":     put,
+	"delete":  del,
+	"watch":   watchKeys,
+	"nodes":   nodes,
+	"status":  status,
+	"backup":  backup,
+	"restore": restore,
+	"check":   check,
+}
+
+// parse parses the flags of a command, which must leave between min and
+// max arguments.
+func parse(fs *flag.FlagSet, args []string, min int, max int, use string) error {
+	fs.SetOutput(ioutil.Discard)
+
+	if err := fs.Parse(args); err != nil {
+		return usageError(err.Error() + "\nusage: makhzenctl " + use)
+	}
+
+	if fs.NArg() < min || fs.NArg() > max {
+		return usageError("usage: makhzenctl " + use)
+	}
+
+	return nil
+}
+
+func get(ctx context.Context, c *ctl, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	if err := parse(fs, args, 1, 1, "get <key>"); err != nil {
+		return err
+	}
+
+	item, err := c.client.Get(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		return c.json(struct {
+			Key         string `json:"key"`
+			Value       string `json:"value"`
+			Type        string `json:"type"`
+			ContentType string `json:"contentType,omitempty"`
+		}{item.Key, item.Value, item.Type, item.ContentType})
+	}
+
+	io.WriteString(c.stdout, item.Value)
+	if !strings.HasSuffix(item.Value, "\n") && item.ContentType == "" {
+		io.WriteString(c.stdout, "\n")
+	}
+
+	return nil
+}
+
+func put(ctx context.Context, c *ctl, args []string) error {
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	ttl := fs.Duration("ttl", 0, "")
+	contentType := fs.String("content-type", "", "")
+	if err := parse(fs, args, 1, 2, "put [-ttl d] [-content-type t] <key> [value]"); err != nil {
+		return err
+	}
+
+	var value []byte
+	if fs.NArg() == 2 {
+		value = []byte(fs.Arg(1))
+	} else {
+		var err error
+		if value, err = ioutil.ReadAll(c.stdin); err != nil {
+			return err
+		}
+	}
+
+	if *contentType != "" {
+		return c.client.PutRaw(ctx, fs.Arg(0), value, *contentType, *ttl)
+	}
+
+	return c.client.Put(ctx, fs.Arg(0), string(value), *ttl)
+}
+
+func del(ctx context.Context, c *ctl, args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	if err := parse(fs, args, 1, 1, "delete <key>"); err != nil {
+		return err
+	}
+
+	return c.client.Delete(ctx, fs.Arg(0))
+}
+
+func watchKeys(ctx context.Context, c *ctl, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	prefix := fs.Bool("prefix", false, "")
+	if err := parse(fs, args, 1, 1, "watch [-prefix] <key>"); err != nil {
+		return err
+	}
+
+	var w *client.Watch
+	var err error
+	if *prefix {
+		w, err = c.client.Watch(ctx, "", fs.Arg(0))
+	} else {
+		w, err = c.client.Watch(ctx, fs.Arg(0), "")
+	}
+	if err != nil {
+		return err
+	}
+
+	for ev := range w.Events {
+		if c.output == "json" {
+			c.json(ev)
+			continue
+		}
+		fmt.Fprintf(c.stdout, "%d\t%s\t%s\t%s\n", ev.Revision, ev.Type, ev.Key, ev.Value)
+	}
+
+	if err := w.Err(); err != context.Canceled {
+		return err
+	}
+
+	return nil
+}
+
+func nodes(ctx context.Context, c *ctl, args []string) error {
+	fs := flag.NewFlagSet("nodes", flag.ContinueOnError)
+	if err := parse(fs, args, 0, 0, "nodes"); err != nil {
+		return err
+	}
+
+	if err := c.client.Discover(ctx); err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		return c.json(c.client.Nodes())
+	}
+
+	for _, node := range c.client.Nodes() {
+		fmt.Fprintln(c.stdout, node)
+	}
+
+	return nil
+}
+
+// nodeStatus is the status reported by one node.
+type nodeStatus struct {
+	Node      string                `json:"node"`
+	Error     string                `json:"error,omitempty"`
+	Readiness *server.Readiness     `json:"readiness,omitempty"`
+	Cluster   *server.ClusterStatus `json:"cluster,omitempty"`
+}
+
+func status(ctx context.Context, c *ctl, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	if err := parse(fs, args, 0, 0, "status"); err != nil {
+		return err
+	}
+
+	var statuses []nodeStatus
+	failed := 0
+
+	for _, node := range c.nodes {
+		st := nodeStatus{Node: node}
+
+		// /readyz replies 503 with its checks when the node is not ready.
+		var readiness server.Readiness
+		err := c.getJSON(ctx, node+"/readyz", &readiness, http.StatusOK, http.StatusServiceUnavailable)
+		if err == nil {
+			st.Readiness = &readiness
+
+			var cluster server.ClusterStatus
+			err = c.getJSON(ctx, node+"/cluster/status", &cluster, http.StatusOK)
+			st.Cluster = &cluster
+		}
+
+		if err != nil {
+			st.Error = err.Error()
+			failed++
+		}
+
+		statuses = append(statuses, st)
+	}
+
+	if c.output == "json" {
+		c.json(statuses)
+	} else {
+		printStatus(c.stdout, statuses)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d nodes did not report their status", failed, len(statuses))
+	}
+
+	return nil
+}
+
+func printStatus(out io.Writer, statuses []nodeStatus) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tREADY\tPEER\tREACHABLE\tLAST CONTACT\tSENT\tERRORS\tMISSED\tLAG")
+
+	for _, st := range statuses {
+		switch {
+		case st.Error != "":
+			fmt.Fprintf(w, "%s\t%s\t\t\t\t\t\t\t\n", st.Node, st.Error)
+			continue
+		case len(st.Cluster.Peers) == 0:
+			fmt.Fprintf(w, "%s\t%s\t-\t\t\t\t\t\t\n", st.Node, ready(st.Readiness))
+			continue
+		}
+
+		for i, p := range st.Cluster.Peers {
+			node, r := st.Node, ready(st.Readiness)
+			if i > 0 {
+				node, r = "", ""
+			}
+
+			lastContact := "never"
+			if !p.LastContact.IsZero() {
+				lastContact = p.LastContact.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%d\t%d\t%d\t%.1fs\n",
+				node, r, p.Address, p.Reachable, lastContact, p.Sent, p.Errors, p.Missed, p.LagSeconds)
+		}
+	}
+
+	w.Flush()
+}
+
+// ready summarises a node's readiness, naming the checks that failed.
+func ready(r *server.Readiness) string {
+	if r.Ready {
+		return "yes"
+	}
+
+	var failing []string
+	for name, result := range r.Checks {
+		if result != "ok" {
+			failing = append(failing, name+": "+result)
+		}
+	}
+	sort.Strings(failing)
+
+	return "no (" + strings.Join(failing, ", ") + ")"
+}
+
+// getJSON decodes the response to a GET of u into v, when its status is one
+// of those expected.
+func (c *ctl) getJSON(ctx context.Context, u string, v interface{}, expected ...int) error {
+	resp, err := c.request(ctx, http.MethodGet, u, nil, expected...)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// request sends a request with the token, returning an error unless its
+// response has one of the expected statuses.
+func (c *ctl) request(ctx context.Context, method string, u string, body io.Reader, expected ...int) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+
+	defer resp.Body.Close()
+
+	b, _ := ioutil.ReadAll(resp.Body)
+	if msg := strings.TrimSpace(string(b)); msg != "" {
+		return nil, errors.New(resp.Status + ": " + msg)
+	}
+
+	return nil, errors.New(resp.Status)
+}
+
+func (c *ctl) json(v interface{}) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
+
+// backupQuery returns the query naming the namespace to back up or restore.
+func (c *ctl) backupQuery() url.Values {
+	q := url.Values{}
+	if c.client.Namespace != "" {
+		q.Set("ns", c.client.Namespace)
+	}
+
+	return q
+}
+
+func backup(ctx context.Context, c *ctl, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	if err := parse(fs, args, 1, 1, "backup <file>"); err != nil {
+		return err
+	}
+
+	resp, err := c.request(ctx, http.MethodGet, c.nodes[0]+"/admin/export?"+c.backupQuery().Encode(), nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if fs.Arg(0) == "-" {
+		_, err = io.Copy(c.stdout, resp.Body)
+		return err
+	}
+
+	f, err := os.Create(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(fs.Arg(0))
+		return err
+	}
+
+	return f.Close()
+}
+
+func restore(ctx context.Context, c *ctl, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	merge := fs.Bool("merge", false, "")
+	replicate := fs.Bool("replicate", false, "")
+	if err := parse(fs, args, 1, 1, "restore [-merge] [-replicate] <file>"); err != nil {
+		return err
+	}
+
+	in := c.stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	q := c.backupQuery()
+	if *merge {
+		q.Set("mode", "merge")
+	}
+	if *replicate {
+		q.Set("replicate", "true")
+	}
+
+	resp, err := c.request(ctx, http.MethodPost, c.nodes[0]+"/admin/import?"+q.Encode(), in, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result server.ImportResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		c.json(result)
+	} else {
+		fmt.Fprintf(c.stdout, "%d entries: %d imported, %d skipped, %d failed\n", result.Entries, result.Imported, result.Skipped, result.Failed)
+		keys := make([]string, 0, len(result.Errors))
+		for key := range result.Errors {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(c.stdout, "%s: %s\n", key, result.Errors[key])
+		}
+	}
+
+	if result.Failed > 0 {
+		return fmt.Errorf("%d entries could not be imported", result.Failed)
+	}
+
+	return nil
+}
+
+func check(ctx context.Context, c *ctl, args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	repair := fs.Bool("repair", false, "")
+	ranges := fs.Int("ranges", 0, "")
+	if err := parse(fs, args, 0, 0, "check [-repair] [-ranges n]"); err != nil {
+		return err
+	}
+
+	q := c.backupQuery()
+	if *ranges != 0 {
+		q.Set("ranges", strconv.Itoa(*ranges))
+	}
+
+	method := http.MethodGet
+	if *repair {
+		method = http.MethodPost
+	}
+
+	resp, err := c.request(ctx, method, c.nodes[0]+"/admin/check?"+q.Encode(), nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var report server.CheckReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		c.json(report)
+	} else {
+		printCheck(c.stdout, report)
+	}
+
+	if !report.Consistent {
+		return errors.New("the nodes are not consistent")
+	}
+
+	return nil
+}
+
+func printCheck(out io.Writer, report server.CheckReport) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(w, "NODE\tKEYS\tERROR")
+	for _, n := range report.Nodes {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", n.Node, n.Keys, n.Error)
+	}
+
+	if len(report.Differences) > 0 {
+		fmt.Fprintln(w, "\nKEY\tNODE\tTYPE\tVERSION\tMODIFIED")
+	}
+	for _, d := range report.Differences {
+		key := d.Key
+		for _, v := range d.Versions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", key, v.Node, v.Type, v.Version, v.Modified.Format(time.RFC3339))
+			key = ""
+		}
+		for _, node := range d.Missing {
+			fmt.Fprintf(w, "%s\t%s\tmissing\t\t\n", key, node)
+			key = ""
+		}
+	}
+
+	w.Flush()
+
+	fmt.Fprintf(out, "\n%d of %d ranges and %d keys differ", report.DifferingRanges, report.Ranges, report.DifferingKeys)
+	if len(report.Differences) < report.DifferingKeys {
+		fmt.Fprintf(out, ", the first %d listed", len(report.Differences))
+	}
+	if report.Repaired > 0 {
+		fmt.Fprintf(out, ", %d repaired", report.Repaired)
+	}
+	fmt.Fprintln(out)
+}
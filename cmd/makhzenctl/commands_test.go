@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/registry"
+	"github.com/wolakec/makhzen/server"
+	"github.com/wolakec/makhzen/store"
+)
+
+func newNode(addresses ...string) (*server.MakhzenServer, *httptest.Server) {
+	s := server.NewMakhzenServer(store.New(), registry.New(addresses))
+	s.Logger = logging.New(ioutil.Discard, logging.Info)
+
+	return s, httptest.NewServer(s)
+}
+
+// makhzenctl runs makhzenctl against node with args, returning what it
+// printed and its exit code.
+func makhzenctl(node string, stdin string, args ...string) (string, string, int) {
+	var stdout, stderr bytes.Buffer
+
+	getenv := func(name string) string {
+		if name == "MAKHZEN_NODES" {
+			return node
+		}
+		return ""
+	}
+
+	code := run(context.Background(), args, getenv, strings.NewReader(stdin), &stdout, &stderr)
+
+	return stdout.String(), stderr.String(), code
+}
+
+func TestCommands(t *testing.T) {
+	t.Run("gets, puts and deletes values", func(t *testing.T) {
+		s, ts := newNode()
+		defer ts.Close()
+		defer s.Drain()
+
+		if _, stderr, code := makhzenctl(ts.URL, "", "put", "-ttl", "1m", "region", "eu-west-1"); code != 0 {
+			t.Fatalf("put exited %d: %s", code, stderr)
+		}
+
+		if stdout, _, code := makhzenctl(ts.URL, "", "get", "region"); code != 0 || stdout != "eu-west-1\n" {
+			t.Errorf("get printed %q and exited %d", stdout, code)
+		}
+
+		stdout, _, _ := makhzenctl(ts.URL, "", "-output", "json", "get", "region")
+		var item map[string]string
+		if err := json.Unmarshal([]byte(stdout), &item); err != nil || item["value"] != "eu-west-1" || item["type"] != store.TypeString {
+			t.Errorf("get printed %q", stdout)
+		}
+
+		makhzenctl(ts.URL, "", "delete", "region")
+		if _, stderr, code := makhzenctl(ts.URL, "", "get", "region"); code != 1 || !strings.Contains(stderr, "key not found") {
+			t.Errorf("get of a deleted key exited %d: %s", code, stderr)
+		}
+	})
+
+	t.Run("puts standard input", func(t *testing.T) {
+		s, ts := newNode()
+		defer ts.Close()
+		defer s.Drain()
+
+		makhzenctl(ts.URL, "a,b\n1,2\n", "put", "-content-type", "text/csv", "report")
+
+		stdout, _, _ := makhzenctl(ts.URL, "", "get", "report")
+		if stdout != "a,b\n1,2\n" {
+			t.Errorf("get printed %q", stdout)
+		}
+	})
+
+	t.Run("lists nodes", func(t *testing.T) {
+		s, ts := newNode("http://10.0.0.2:5000")
+		defer ts.Close()
+		defer s.Drain()
+
+		stdout, _, _ := makhzenctl(ts.URL, "", "nodes")
+		if want := ts.URL + "\nhttp://10.0.0.2:5000\n"; stdout != want {
+			t.Errorf("got %q, want %q", stdout, want)
+		}
+	})
+
+	t.Run("reports status", func(t *testing.T) {
+		s, ts := newNode("http://127.0.0.1:1")
+		defer ts.Close()
+		defer s.Drain()
+		s.SetReady(true)
+		s.MinPeers = 1
+
+		stdout, stderr, code := makhzenctl(ts.URL+",http://127.0.0.1:1", "", "status")
+		if code != 1 || !strings.Contains(stderr, "1 of 2 nodes") {
+			t.Errorf("status exited %d: %s", code, stderr)
+		}
+
+		lines := strings.Split(stdout, "\n")
+		if len(lines) != 4 || !strings.HasPrefix(lines[0], "NODE") ||
+			!strings.Contains(lines[1], "no (peers: 0 reachable, need 1)") || !strings.Contains(lines[1], "never") ||
+			!strings.Contains(lines[2], "connection refused") {
+			t.Errorf("status printed:\n%s", stdout)
+		}
+
+		stdout, _, _ = makhzenctl(ts.URL, "", "-output", "json", "status")
+		var statuses []nodeStatus
+		if err := json.Unmarshal([]byte(stdout), &statuses); err != nil || len(statuses) != 1 || len(statuses[0].Cluster.Peers) != 1 {
+			t.Errorf("status printed %q", stdout)
+		}
+	})
+
+	t.Run("backs up and restores", func(t *testing.T) {
+		s, ts := newNode()
+		defer ts.Close()
+		defer s.Drain()
+		makhzenctl(ts.URL, "", "put", "region", "eu-west-1")
+
+		dir, err := ioutil.TempDir("", "makhzenctl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "dump.ndjson")
+
+		if _, stderr, code := makhzenctl(ts.URL, "", "backup", file); code != 0 {
+			t.Fatalf("backup exited %d: %s", code, stderr)
+		}
+
+		other, ots := newNode()
+		defer ots.Close()
+		defer other.Drain()
+
+		stdout, stderr, code := makhzenctl(ots.URL, "", "restore", file)
+		if code != 0 || stdout != "1 entries: 1 imported, 0 skipped, 0 failed\n" {
+			t.Errorf("restore printed %q and exited %d: %s", stdout, code, stderr)
+		}
+
+		if v, _ := other.Store.GetValue("region"); v != "eu-west-1" {
+			t.Errorf("restored %q", v)
+		}
+
+		dump, _, _ := makhzenctl(ts.URL, "", "backup", "-")
+		stdout, _, _ = makhzenctl(ots.URL, dump, "-output", "json", "restore", "-merge", "-")
+		if !strings.Contains(stdout, `"skipped": 1`) {
+			t.Errorf("merging restore printed %q", stdout)
+		}
+	})
+
+	t.Run("checks and repairs the nodes", func(t *testing.T) {
+		other, ots := newNode()
+		defer ots.Close()
+		defer other.Drain()
+
+		s, ts := newNode(ots.URL)
+		defer ts.Close()
+		defer s.Drain()
+		s.Peers = &broadcaster.Broadcaster{}
+		s.Store.Set("region", "eu-west-1")
+
+		stdout, _, code := makhzenctl(ts.URL, "", "check")
+		if code != 1 || !strings.Contains(stdout, ots.URL+"  missing") || !strings.Contains(stdout, "and 1 keys differ\n") {
+			t.Errorf("check printed %q and exited %d", stdout, code)
+		}
+
+		stdout, _, _ = makhzenctl(ts.URL, "", "check", "-repair")
+		if !strings.Contains(stdout, "1 repaired") {
+			t.Errorf("check -repair printed %q", stdout)
+		}
+
+		stdout, stderr, code := makhzenctl(ts.URL, "", "-output", "json", "check", "-ranges", "4")
+		if code != 0 || !strings.Contains(stdout, `"consistent": true`) {
+			t.Errorf("check printed %q and exited %d after repairing: %s", stdout, code, stderr)
+		}
+	})
+
+	t.Run("rejects bad usage", func(t *testing.T) {
+		cases := [][]string{
+			{},
+			{"list"},
+			{"get"},
+			{"get", "a", "b"},
+			{"put", "-ttl", "soon", "region", "eu"},
+			{"-output", "yaml", "get", "region"},
+		}
+
+		for _, args := range cases {
+			if _, _, code := makhzenctl("http://127.0.0.1:1", "", args...); code != 2 {
+				t.Errorf("%q exited %d, want 2", args, code)
+			}
+		}
+	})
+}
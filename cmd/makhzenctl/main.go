@@ -0,0 +1,159 @@
+// Command makhzenctl reads and writes values in a Makhzen cluster and
+// reports on its nodes, over their HTTP API.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/wolakec/makhzen/client"
+	"github.com/wolakec/makhzen/tlsconfig"
+)
+
+const usage = `usage: makhzenctl [flags] <command> [arguments]
+
+Commands:
+  get <key>                    print the value at key
+  put [-ttl d] [-content-type t] <key> [value]
+                               store value at key, or standard input when
+                               no value is given
+  delete <key>                 delete the value at key
+  watch [-prefix] <key>        print changes to key, or to keys starting
+                               with it when -prefix is given
+  nodes                        list the nodes of the cluster
+  status                       report on each node and the nodes it sends
+                               writes to
+  backup <file>                write a dump of the first node's values to
+                               file, or standard output when it is -
+  restore [-merge] [-replicate] <file>
+                               load a dump from file, or standard input
+                               when it is -, into the first node
+  check [-repair] [-ranges n]  compare the values held by the first node
+                               and the nodes it sends writes to, and
+                               repair those that differ when -repair is
+                               given
+
+Flags:
+`
+
+// ctl holds the settings given to makhzenctl, shared by its commands.
+type ctl struct {
+	nodes   []string
+	token   string
+	output  string
+	timeout time.Duration
+
+	client *client.Client
+	http   *http.Client
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	os.Exit(run(ctx, os.Args[1:], os.Getenv, os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command given by args and returns the exit code: 0 when it
+// succeeded, 1 when it failed and 2 when it was not used correctly.
+func run(ctx context.Context, args []string, getenv func(string) string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("makhzenctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+
+	nodes := getenv("MAKHZEN_NODES")
+	if nodes == "" {
+		nodes = "http://127.0.0.1:5000"
+	}
+
+	c := &ctl{stdin: stdin, stdout: stdout}
+	var namespace, ca string
+
+	fs.StringVar(&nodes, "nodes", nodes, "the nodes to send requests to, as a comma separated list, or $MAKHZEN_NODES")
+	fs.StringVar(&c.token, "token", getenv("MAKHZEN_TOKEN"), "a token to send to the nodes, or $MAKHZEN_TOKEN")
+	fs.StringVar(&c.output, "output", "table", "the output format, table or json")
+	fs.StringVar(&namespace, "namespace", "", "the namespace of the keys, leave empty for the default namespace")
+	fs.StringVar(&ca, "ca", "", "a PEM file of CA certificates to verify nodes with, leave empty to use the system's")
+	fs.DurationVar(&c.timeout, "timeout", 10*time.Second, "how long to wait for each command, other than watch, backup, restore and check")
+
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	if c.output != "table" && c.output != "json" {
+		fmt.Fprintf(stderr, "makhzenctl: unknown output format %q\n", c.output)
+		return 2
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	c.http = &http.Client{}
+	if ca != "" {
+		pool, err := tlsconfig.LoadCertPool(ca)
+		if err != nil {
+			fmt.Fprintf(stderr, "makhzenctl: %s\n", err)
+			return 1
+		}
+		c.http.Transport = &http.Transport{TLSClientConfig: tlsconfig.ClientConfig(nil, pool)}
+	}
+
+	for _, node := range strings.Split(nodes, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			c.nodes = append(c.nodes, strings.TrimSuffix(node, "/"))
+		}
+	}
+
+	c.client = client.New(c.nodes...)
+	c.client.Token = c.token
+	c.client.HTTPClient = c.http
+	c.client.Namespace = namespace
+
+	name, args := fs.Arg(0), fs.Args()[1:]
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "makhzenctl: unknown command %q\n", name)
+		fs.Usage()
+		return 2
+	}
+
+	if name != "watch" && name != "backup" && name != "restore" && name != "check" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	if err := cmd(ctx, c, args); err != nil {
+		fmt.Fprintf(stderr, "makhzenctl %s: %s\n", name, err)
+		if _, ok := err.(usageError); ok {
+			return 2
+		}
+		return 1
+	}
+
+	return 0
+}
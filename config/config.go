@@ -0,0 +1,519 @@
+// Package config loads the configuration of a node from a JSON, TOML or
+// YAML file, environment variables and command line flags.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/store"
+)
+
+// EnvPrefix starts the name of the environment variable of every flag: the
+// flag -log-level is read from MAKHZEN_LOG_LEVEL.
+const EnvPrefix = "MAKHZEN_"
+
+// Config is the configuration of a node. Values are taken, from lowest to
+// highest precedence, from Default, the file named by -config, the
+// environment and the command line. Each setting is named after its flag
+// in files of every format, and in the JSON it is printed as.
+type Config struct {
+	// Config is the file the rest of the configuration was read from.
+	Config string `json:"-"`
+	// PrintConfig prints the configuration rather than starting the node.
+	PrintConfig bool `json:"-"`
+
+	Port          string   `json:"port"`
+	PeerPort      string   `json:"peer-port"`
+	RedisPort     string   `json:"redis-port"`
+	MemcachedPort string   `json:"memcached-port"`
+	ID            string   `json:"id"`
+	Cluster       []string `json:"cluster"`
+
+	MaxKeys   int    `json:"max-keys"`
+	MaxMemory int64  `json:"max-memory"`
+	Eviction  string `json:"eviction"`
+
+	DataDir          string   `json:"data-dir"`
+	SnapshotInterval Duration `json:"snapshot-interval"`
+
+	ACL           string `json:"acl"`
+	PeerToken     string `json:"peer-token"`
+	ClusterSecret string `json:"cluster-secret"`
+	TLSCert       string `json:"tls-cert"`
+	TLSKey        string `json:"tls-key"`
+	PeerCert      string `json:"peer-cert"`
+	PeerKey       string `json:"peer-key"`
+	PeerCA        string `json:"peer-ca"`
+	PeerProtocol  string `json:"peer-protocol"`
+
+	MinPeers           int      `json:"min-peers"`
+	ProbeInterval      Duration `json:"probe-interval"`
+	MessageWindow      Duration `json:"message-window"`
+	ReplicationTimeout Duration `json:"replication-timeout"`
+
+	FaultInjection bool `json:"fault-injection"`
+
+	LogLevel  string `json:"log-level"`
+	LogValues bool   `json:"log-values"`
+	TraceFile string `json:"trace-file"`
+}
+
+// Default returns the configuration used for anything not set elsewhere.
+func Default() Config {
+	return Config{
+		Port:               "5000",
+		Cluster:            []string{},
+		Eviction:           "lru",
+		PeerProtocol:       "http",
+		SnapshotInterval:   Duration(time.Minute),
+		ProbeInterval:      Duration(5 * time.Second),
+		MessageWindow:      Duration(30 * time.Second),
+		ReplicationTimeout: Duration(10 * time.Second),
+		LogLevel:           "info",
+	}
+}
+
+// flags defines a flag in fs for every setting of c.
+func flags(fs *flag.FlagSet, c *Config) {
+	fs.StringVar(&c.Config, "config", c.Config, "a JSON file, or a TOML file ending in .toml or YAML file ending in .yaml or .yml, of settings named after their flags, overridden by the environment and flags, and reloaded on SIGHUP")
+	fs.BoolVar(&c.PrintConfig, "print-config", c.PrintConfig, "print the configuration as JSON and exit")
+
+	fs.StringVar(&c.Port, "port", c.Port, "a port number")
+	fs.StringVar(&c.PeerPort, "peer-port", c.PeerPort, "a port for messages from the other nodes, leave empty to use -port")
+	fs.StringVar(&c.RedisPort, "redis-port", c.RedisPort, "a port to serve the Redis protocol on, leave empty to disable it")
+	fs.StringVar(&c.MemcachedPort, "memcached-port", c.MemcachedPort, "a port to serve the memcached text protocol on, leave empty to disable it")
+	fs.StringVar(&c.ID, "id", c.ID, "a unique id for this node, defaults to hostname:port")
+	fs.Var((*list)(&c.Cluster), "cluster", "the other nodes, as a comma separated list such as http://127.0.0.1:3001,http://127.0.0.1:3002")
+
+	fs.IntVar(&c.MaxKeys, "max-keys", c.MaxKeys, "the most keys to hold, 0 for no limit")
+	fs.Int64Var(&c.MaxMemory, "max-memory", c.MaxMemory, "the most bytes of values to hold, 0 for no limit")
+	fs.StringVar(&c.Eviction, "eviction", c.Eviction, "what to do when full: lru, lfu, ttl or reject")
+
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "a directory to save snapshots of the values held in and load them from on start, leave empty to only hold values in memory")
+	fs.Var(&c.SnapshotInterval, "snapshot-interval", "how often to save a snapshot to -data-dir")
+
+	fs.StringVar(&c.ACL, "acl", c.ACL, "a JSON file of tokens and roles, leave empty to allow all requests")
+	fs.StringVar(&c.PeerToken, "peer-token", c.PeerToken, "a token with the admin role sent to the other nodes")
+	fs.StringVar(&c.ClusterSecret, "cluster-secret", c.ClusterSecret, "a secret shared by every node to sign messages between them")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "a PEM certificate file to serve clients over TLS")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "the PEM key file for -tls-cert")
+	fs.StringVar(&c.PeerCert, "peer-cert", c.PeerCert, "a PEM certificate file to serve and connect to the other nodes over TLS, requires -peer-port")
+	fs.StringVar(&c.PeerKey, "peer-key", c.PeerKey, "the PEM key file for -peer-cert")
+	fs.StringVar(&c.PeerCA, "peer-ca", c.PeerCA, "a PEM file of the CAs that sign the certificates of the other nodes, to require mutual TLS between nodes")
+	fs.StringVar(&c.PeerProtocol, "peer-protocol", c.PeerProtocol, "how to send messages to the other nodes: http, posting each, or grpc, streaming them over one call to each node, which requires -peer-cert")
+
+	fs.IntVar(&c.MinPeers, "min-peers", c.MinPeers, "how many other nodes must be reachable for the node to be ready")
+	fs.Var(&c.ProbeInterval, "probe-interval", "how often to ping the other nodes")
+	fs.Var(&c.MessageWindow, "message-window", "how far the timestamp of a signed message may be from this node's clock")
+	fs.Var(&c.ReplicationTimeout, "replication-timeout", "how long to wait for another node to accept a message")
+	fs.BoolVar(&c.FaultInjection, "fault-injection", c.FaultInjection, "serve /admin/faults to inject faults into messages to the other nodes, for testing only")
+
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "the least severe level to log: debug, info, warn or error")
+	fs.BoolVar(&c.LogValues, "log-values", c.LogValues, "log stored values rather than redacting them")
+	fs.StringVar(&c.TraceFile, "trace-file", c.TraceFile, "a file to write trace spans to as JSON lines, leave empty to disable tracing")
+}
+
+// Load returns the configuration given by args, the command line without
+// the program name, by the environment variables returned by getenv and by
+// the file named by -config or MAKHZEN_CONFIG.
+func Load(name string, args []string, getenv func(string) string) (Config, error) {
+	c := Default()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags(fs, &c)
+
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	if fs.NArg() > 0 {
+		return c, fmt.Errorf("unexpected argument %s", fs.Arg(0))
+	}
+
+	// The flags are parsed first to find -config, then set again over the
+	// file and the environment.
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+
+	path := c.Config
+	if _, ok := set["config"]; !ok {
+		path = getenv(EnvPrefix + "CONFIG")
+	}
+
+	c = Default()
+	c.Config = path
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+
+		if err := parseFile(fs, path, data); err != nil {
+			return c, fmt.Errorf("could not parse %s: %s", path, err)
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := set[f.Name]; ok || err != nil || f.Name == "config" {
+			return
+		}
+
+		env := EnvPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if v := getenv(env); v != "" {
+			if e := f.Value.Set(v); e != nil {
+				err = fmt.Errorf("invalid %s: %s", env, e)
+			}
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+
+	for name, v := range set {
+		fs.Set(name, v)
+	}
+
+	return c, nil
+}
+
+// parseFile sets the flags in fs from data, the file at path: TOML when
+// path ends in .toml, YAML when it ends in .yaml or .yml and JSON
+// otherwise. In every format each setting is named after its flag.
+func parseFile(fs *flag.FlagSet, path string, data []byte) error {
+	var settings []setting
+	var err error
+
+	switch filepath.Ext(path) {
+	case ".toml":
+		settings, err = parseTOML(string(data))
+	case ".yaml", ".yml":
+		settings, err = parseYAML(string(data))
+	default:
+		settings, err = parseJSON(data)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, s := range settings {
+		if fs.Lookup(s.key) == nil || s.key == "config" || s.key == "print-config" {
+			return s.errorf("unknown setting %s", s.key)
+		}
+
+		if err := fs.Set(s.key, s.value); err != nil {
+			return s.errorf("invalid %s: %s", s.key, err)
+		}
+	}
+
+	return nil
+}
+
+// parseJSON reads the settings of a JSON object, whose values may be
+// strings, numbers, booleans or arrays of strings.
+func parseJSON(data []byte) ([]setting, error) {
+	var values map[string]interface{}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&values); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var settings []setting
+	for _, k := range keys {
+		v, err := jsonValue(values[k])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", k, err)
+		}
+
+		settings = append(settings, setting{key: k, value: v})
+	}
+
+	return settings, nil
+}
+
+// jsonValue returns a JSON value as it would be given to a flag. The
+// strings of an array are joined by commas.
+func jsonValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return "", errors.New("arrays may only hold strings")
+			}
+			values[i] = s
+		}
+		return strings.Join(values, ","), nil
+	}
+
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// Validate reports every setting of c that is not valid.
+func (c Config) Validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if !validPort(c.Port) {
+		invalid("port %q is not a port number", c.Port)
+	}
+
+	if c.PeerPort != "" && !validPort(c.PeerPort) {
+		invalid("peer port %q is not a port number", c.PeerPort)
+	}
+
+	if c.PeerPort == c.Port {
+		invalid("peer port must differ from port")
+	}
+
+	if c.RedisPort != "" && !validPort(c.RedisPort) {
+		invalid("redis port %q is not a port number", c.RedisPort)
+	}
+
+	if c.RedisPort == c.Port || (c.RedisPort != "" && c.RedisPort == c.PeerPort) {
+		invalid("redis port must differ from port and peer port")
+	}
+
+	if c.MemcachedPort != "" && !validPort(c.MemcachedPort) {
+		invalid("memcached port %q is not a port number", c.MemcachedPort)
+	}
+
+	if c.MemcachedPort == c.Port || (c.MemcachedPort != "" && (c.MemcachedPort == c.PeerPort || c.MemcachedPort == c.RedisPort)) {
+		invalid("memcached port must differ from port, peer port and redis port")
+	}
+
+	if c.MemcachedPort != "" && c.ACL != "" {
+		invalid("memcached port cannot be used with an acl, as memcached clients cannot authenticate")
+	}
+
+	seen := make(map[string]bool)
+	for _, peer := range c.Cluster {
+		if err := c.validPeer(peer); err != nil {
+			invalid("peer %q %s", peer, err)
+		}
+
+		if seen[peer] {
+			invalid("peer %q is given twice", peer)
+		}
+		seen[peer] = true
+	}
+
+	if c.MaxKeys < 0 || c.MaxMemory < 0 {
+		invalid("limits must not be negative")
+	}
+
+	if _, err := store.PolicyByName(c.Eviction); err != nil {
+		invalid("%s", err)
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		invalid("tls cert and key must be given together")
+	}
+
+	if (c.PeerCert == "") != (c.PeerKey == "") {
+		invalid("peer cert and key must be given together")
+	}
+
+	if c.PeerCert != "" && c.PeerPort == "" {
+		invalid("peer cert requires a peer port")
+	}
+
+	switch c.PeerProtocol {
+	case "http":
+	case "grpc":
+		if c.PeerCert == "" {
+			invalid("peer protocol grpc requires a peer cert, as gRPC needs HTTP/2 and so TLS")
+		}
+
+		for _, peer := range c.Cluster {
+			if !strings.HasPrefix(peer, "https://") {
+				invalid("peer %q must be an https URL to use peer protocol grpc", peer)
+			}
+		}
+	default:
+		invalid("peer protocol %q is not http or grpc", c.PeerProtocol)
+	}
+
+	if c.PeerPort != "" && c.ClusterSecret == "" {
+		invalid("peer port requires a cluster secret, so that messages to it are signed")
+	}
+
+	if c.MinPeers < 0 || c.MinPeers > len(c.Cluster) {
+		invalid("min peers must be between 0 and the %d other nodes", len(c.Cluster))
+	}
+
+	if c.ProbeInterval <= 0 || c.MessageWindow <= 0 || c.ReplicationTimeout <= 0 || c.SnapshotInterval <= 0 {
+		invalid("durations must be positive")
+	}
+
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		invalid("%s", err)
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// validPeer checks that peer is the base URL of another node.
+func (c Config) validPeer(peer string) error {
+	u, err := url.Parse(peer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("is not an http or https URL")
+	}
+
+	if u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		return errors.New("must not have a path")
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	if (port == c.Port || port == c.PeerPort) && c.isLocal(u.Hostname()) {
+		return errors.New("is this node")
+	}
+
+	return nil
+}
+
+// isLocal reports whether host is an address of this machine.
+func (c Config) isLocal(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	if name, err := os.Hostname(); err == nil && host == name {
+		return true
+	}
+
+	if i := strings.LastIndex(c.ID, ":"); i > 0 && host == c.ID[:i] {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Redacted returns a copy of c with its secrets replaced, to be printed.
+func (c Config) Redacted() Config {
+	if c.PeerToken != "" {
+		c.PeerToken = "[redacted]"
+	}
+
+	if c.ClusterSecret != "" {
+		c.ClusterSecret = "[redacted]"
+	}
+
+	return c
+}
+
+// list is a comma separated flag. Empty entries are left out, so that an
+// empty flag is an empty list.
+type list []string
+
+func (l *list) String() string {
+	if l == nil {
+		return ""
+	}
+
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(s string) error {
+	*l = []string{}
+
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+
+	return nil
+}
+
+// Duration is a time.Duration written as a string such as "5s" in JSON and
+// flags.
+type Duration time.Duration
+
+func (d *Duration) String() string {
+	if d == nil {
+		return ""
+	}
+
+	return time.Duration(*d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
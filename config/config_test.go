@@ -0,0 +1,265 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+func writeFile(t *testing.T, dir string, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "makhzen.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("uses defaults", func(t *testing.T) {
+		c, err := Load("makhzen", nil, env(nil))
+		if err != nil {
+			t.Fatalf("Load returned error: %s", err)
+		}
+
+		if !reflect.DeepEqual(c, Default()) {
+			t.Errorf("got %+v, want %+v", c, Default())
+		}
+	})
+
+	t.Run("an empty cluster has no nodes", func(t *testing.T) {
+		c, _ := Load("makhzen", []string{"-cluster", ""}, env(nil))
+
+		if len(c.Cluster) != 0 {
+			t.Errorf("got %q, want no nodes", c.Cluster)
+		}
+	})
+
+	t.Run("flags override the environment which overrides the file", func(t *testing.T) {
+		path := writeFile(t, dir, `{"port": "3001", "log-level": "warn", "max-keys": 10, "cluster": ["http://10.0.0.2:3001"], "probe-interval": "1m"}`)
+
+		c, err := Load("makhzen", []string{"-config", path, "-port", "3003"}, env(map[string]string{
+			"MAKHZEN_PORT":      "3002",
+			"MAKHZEN_LOG_LEVEL": "debug",
+		}))
+		if err != nil {
+			t.Fatalf("Load returned error: %s", err)
+		}
+
+		if c.Port != "3003" || c.LogLevel != "debug" || c.MaxKeys != 10 || c.Eviction != "lru" {
+			t.Errorf("got %+v", c)
+		}
+
+		if !reflect.DeepEqual(c.Cluster, []string{"http://10.0.0.2:3001"}) || time.Duration(c.ProbeInterval) != time.Minute {
+			t.Errorf("got %+v", c)
+		}
+	})
+
+	t.Run("reads the file named in the environment", func(t *testing.T) {
+		path := writeFile(t, dir, `{"eviction": "lfu"}`)
+
+		c, err := Load("makhzen", nil, env(map[string]string{"MAKHZEN_CONFIG": path}))
+		if err != nil {
+			t.Fatalf("Load returned error: %s", err)
+		}
+
+		if c.Eviction != "lfu" || c.Config != path {
+			t.Errorf("got %+v", c)
+		}
+	})
+
+	t.Run("reads a TOML file", func(t *testing.T) {
+		path := filepath.Join(dir, "makhzen.toml")
+		ioutil.WriteFile(path, []byte(`
+# makhzen.toml
+port = "3001"
+max-memory = 104_857_600
+log-values = true
+data-dir = "/var/lib/makhzen"
+snapshot-interval = "30s"
+cluster = [
+	"http://10.0.0.2:3001", # node b
+	"http://10.0.0.3:3001",
+]
+`), 0600)
+
+		c, err := Load("makhzen", []string{"-config", path}, env(map[string]string{"MAKHZEN_PORT": "3002"}))
+		if err != nil {
+			t.Fatalf("Load returned error: %s", err)
+		}
+
+		if c.Port != "3002" || c.MaxMemory != 104857600 || !c.LogValues || c.DataDir != "/var/lib/makhzen" || time.Duration(c.SnapshotInterval) != 30*time.Second {
+			t.Errorf("got %+v", c)
+		}
+		if !reflect.DeepEqual(c.Cluster, []string{"http://10.0.0.2:3001", "http://10.0.0.3:3001"}) {
+			t.Errorf("got %q", c.Cluster)
+		}
+
+		for _, contents := range []string{`ports = "3001"`, `config = "other.toml"`, `max-keys = "many"`} {
+			ioutil.WriteFile(path, []byte(contents), 0600)
+			if _, err := Load("makhzen", []string{"-config", path}, env(nil)); err == nil {
+				t.Errorf("expected an error for %s", contents)
+			}
+		}
+	})
+
+	t.Run("reads a YAML file", func(t *testing.T) {
+		path := filepath.Join(dir, "makhzen.yaml")
+		ioutil.WriteFile(path, []byte(`
+# makhzen.yaml
+port: "3001"
+max-memory: 104857600
+log-values: true
+data-dir: /var/lib/makhzen
+snapshot-interval: 30s
+cluster:
+  - http://10.0.0.2:3001 # node b
+  - http://10.0.0.3:3001
+`), 0600)
+
+		c, err := Load("makhzen", []string{"-config", path}, env(map[string]string{"MAKHZEN_PORT": "3002"}))
+		if err != nil {
+			t.Fatalf("Load returned error: %s", err)
+		}
+
+		if c.Port != "3002" || c.MaxMemory != 104857600 || !c.LogValues || c.DataDir != "/var/lib/makhzen" || time.Duration(c.SnapshotInterval) != 30*time.Second {
+			t.Errorf("got %+v", c)
+		}
+		if !reflect.DeepEqual(c.Cluster, []string{"http://10.0.0.2:3001", "http://10.0.0.3:3001"}) {
+			t.Errorf("got %q", c.Cluster)
+		}
+
+		for _, contents := range []string{`ports: "3001"`, `print-config: true`, `max-keys: many`} {
+			ioutil.WriteFile(path, []byte(contents), 0600)
+			if _, err := Load("makhzen", []string{"-config", path}, env(nil)); err == nil {
+				t.Errorf("expected an error for %s", contents)
+			}
+		}
+	})
+
+	t.Run("reads the printed configuration", func(t *testing.T) {
+		want := Default()
+		want.Cluster = []string{"http://10.0.0.2:3001", "http://10.0.0.3:3001"}
+		want.MaxMemory = 104857600
+		want.PeerCA = "ca.pem"
+		want.LogValues = true
+
+		b, err := json.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := writeFile(t, dir, string(b))
+		want.Config = path
+
+		c, err := Load("makhzen", []string{"-config", path}, env(nil))
+		if err != nil {
+			t.Fatalf("Load returned error: %s", err)
+		}
+
+		if !reflect.DeepEqual(c, want) {
+			t.Errorf("got %+v, want %+v", c, want)
+		}
+	})
+
+	t.Run("rejects invalid input", func(t *testing.T) {
+		for _, contents := range []string{`{"port": {"number": 3001}}`, `{"maxKeys": 10}`, `{"config": "other.json"}`, `{"max-keys": "many"}`, `{"port": `} {
+			if _, err := Load("makhzen", []string{"-config", writeFile(t, dir, contents)}, env(nil)); err == nil {
+				t.Errorf("expected an error for %s", contents)
+			}
+		}
+
+		if _, err := Load("makhzen", nil, env(map[string]string{"MAKHZEN_MAX_KEYS": "many"})); err == nil {
+			t.Error("expected an error for a bad environment variable")
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	valid := Default()
+	valid.ID = "node-a:5000"
+	valid.Cluster = []string{"http://10.0.0.2:5000", "https://node-b"}
+	valid.MinPeers = 1
+
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("got %s for a valid config", err)
+	}
+
+	cases := []struct {
+		name   string
+		change func(c *Config)
+		want   string
+	}{
+		{"bad port", func(c *Config) { c.Port = "http" }, "not a port number"},
+		{"same ports", func(c *Config) { c.PeerPort = c.Port }, "peer port must differ"},
+		{"same redis port", func(c *Config) { c.RedisPort = c.Port }, "redis port must differ"},
+		{"same memcached port", func(c *Config) { c.RedisPort, c.MemcachedPort = "6379", "6379" }, "memcached port must differ"},
+		{"memcached with acl", func(c *Config) { c.MemcachedPort, c.ACL = "11211", "acl.json" }, "cannot be used with an acl"},
+		{"bad peer url", func(c *Config) { c.Cluster = []string{"10.0.0.2:5000"} }, "not an http or https URL"},
+		{"peer url with path", func(c *Config) { c.Cluster = []string{"http://10.0.0.2:5000/items"} }, "must not have a path"},
+		{"self reference", func(c *Config) { c.Cluster = []string{"http://127.0.0.1:5000"} }, "is this node"},
+		{"self reference by id", func(c *Config) { c.Cluster = []string{"http://node-a:5000"} }, "is this node"},
+		{"duplicate peer", func(c *Config) { c.Cluster = []string{"http://10.0.0.2:5000", "http://10.0.0.2:5000"} }, "given twice"},
+		{"too many min peers", func(c *Config) { c.MinPeers = 3 }, "min peers"},
+		{"bad eviction", func(c *Config) { c.Eviction = "fifo" }, "unknown eviction policy"},
+		{"bad log level", func(c *Config) { c.LogLevel = "loud" }, "unknown log level"},
+		{"cert without key", func(c *Config) { c.TLSCert = "cert.pem" }, "tls cert and key"},
+		{"peer cert without peer port", func(c *Config) { c.PeerCert, c.PeerKey = "cert.pem", "key.pem" }, "requires a peer port"},
+		{"peer port without secret", func(c *Config) { c.PeerPort = "5001" }, "requires a cluster secret"},
+		{"bad peer protocol", func(c *Config) { c.PeerProtocol = "tcp" }, "is not http or grpc"},
+		{"grpc without peer cert", func(c *Config) { c.PeerProtocol = "grpc" }, "requires a peer cert"},
+		{"grpc to http peer", func(c *Config) {
+			c.PeerProtocol, c.PeerPort, c.ClusterSecret = "grpc", "5001", "secret"
+			c.PeerCert, c.PeerKey = "cert.pem", "key.pem"
+			c.Cluster = []string{"http://10.0.0.2:5001"}
+		}, "must be an https URL"},
+		{"negative duration", func(c *Config) { c.ProbeInterval = -1 }, "durations must be positive"},
+		{"no snapshot interval", func(c *Config) { c.SnapshotInterval = 0 }, "durations must be positive"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := valid
+			tc.change(&c)
+
+			err := c.Validate()
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := Default()
+	c.PeerToken = "token"
+	c.ClusterSecret = "secret"
+
+	r := c.Redacted()
+	if r.PeerToken != "[redacted]" || r.ClusterSecret != "[redacted]" {
+		t.Errorf("got %+v", r)
+	}
+
+	if c.PeerToken != "token" {
+		t.Errorf("Redacted changed the original config")
+	}
+}
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// setting is a key and value read from a config file, with the value as it
+// would be given to the flag of the same name. Line is zero for formats
+// whose settings are not read line by line.
+type setting struct {
+	key   string
+	value string
+	line  int
+}
+
+// errorf returns an error about s, giving its line when known.
+func (s setting) errorf(format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	if s.line == 0 {
+		return err
+	}
+
+	return fmt.Errorf("line %d: %s", s.line, err)
+}
+
+// parseTOML reads the subset of TOML a config file needs: comments, and
+// bare or quoted keys set to a string, an integer, a boolean or an array of
+// strings, such as
+//
+//	# the other nodes
+//	cluster = ["http://10.0.0.2:3001", "http://10.0.0.3:3001"]
+//	max-memory = 104_857_600
+//	"probe-interval" = "5s"
+//
+// Arrays may span several lines. Tables, inline tables, dotted keys,
+// floats, dates and multi-line strings are not supported.
+func parseTOML(data string) ([]setting, error) {
+	var settings []setting
+
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		n := i + 1
+		line := strings.TrimSpace(stripComment(lines[i]))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: tables are not supported", n)
+		}
+
+		key, rest, err := parseKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+
+		if !strings.HasPrefix(rest, "=") {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+
+		raw := strings.TrimSpace(rest[1:])
+		for strings.HasPrefix(raw, "[") && !closed(raw) && i+1 < len(lines) {
+			i++
+			raw += " " + strings.TrimSpace(stripComment(lines[i]))
+		}
+
+		value, err := parseValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+
+		settings = append(settings, setting{key: key, value: value, line: n})
+	}
+
+	return settings, nil
+}
+
+// parseValue returns a TOML value as it would be given to a flag. The
+// strings of an array are joined by commas.
+func parseValue(raw string) (string, error) {
+	switch {
+	case raw == "":
+		return "", fmt.Errorf("missing value")
+	case raw == "true", raw == "false":
+		return raw, nil
+	case raw[0] == '"' || raw[0] == '\'':
+		s, rest, err := parseString(raw)
+		if err != nil {
+			return "", err
+		}
+		if rest != "" {
+			return "", fmt.Errorf("unexpected %q after string", rest)
+		}
+		return s, nil
+	case raw[0] == '[':
+		return parseArray(raw)
+	case raw[0] == '{':
+		return "", fmt.Errorf("inline tables are not supported")
+	}
+
+	digits := strings.Replace(raw, "_", "", -1)
+	if _, err := strconv.ParseInt(digits, 10, 64); err != nil {
+		return "", fmt.Errorf("unsupported value %s", raw)
+	}
+
+	return digits, nil
+}
+
+// parseKey reads the bare or quoted key at the start of line, returning it
+// and what follows it.
+func parseKey(line string) (string, string, error) {
+	if line[0] == '"' || line[0] == '\'' {
+		return parseString(line)
+	}
+
+	end := strings.IndexAny(line, "= \t")
+	if end < 0 {
+		end = len(line)
+	}
+
+	key := line[:end]
+	if !bareKey(key) {
+		return "", "", fmt.Errorf("invalid key %q", key)
+	}
+
+	return key, strings.TrimSpace(line[end:]), nil
+}
+
+// parseString reads the basic or literal string at the start of raw,
+// returning it and what follows it.
+func parseString(raw string) (string, string, error) {
+	quote := raw[0]
+
+	for i := 1; i < len(raw); i++ {
+		switch {
+		case quote == '"' && raw[i] == '\\':
+			i++
+		case raw[i] == quote:
+			rest := strings.TrimSpace(raw[i+1:])
+			if quote == '\'' {
+				return raw[1:i], rest, nil
+			}
+
+			s, err := strconv.Unquote(raw[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("invalid string %s", raw[:i+1])
+			}
+			return s, rest, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("unterminated string %s", raw)
+}
+
+func parseArray(raw string) (string, error) {
+	rest := strings.TrimSpace(raw[1:])
+	var values []string
+
+	for {
+		if strings.HasPrefix(rest, "]") {
+			if rest = strings.TrimSpace(rest[1:]); rest != "" {
+				return "", fmt.Errorf("unexpected %q after array", rest)
+			}
+			return strings.Join(values, ","), nil
+		}
+
+		if rest == "" || (rest[0] != '"' && rest[0] != '\'') {
+			return "", fmt.Errorf("arrays may only hold strings")
+		}
+
+		s, r, err := parseString(rest)
+		if err != nil {
+			return "", err
+		}
+		values = append(values, s)
+
+		rest = r
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") {
+			return "", fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+// stripComment removes a comment from line, leaving # in strings alone.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == 0 && c == '#':
+			return line[:i]
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case c == quote:
+			quote = 0
+		}
+	}
+
+	return line
+}
+
+// closed reports whether the array at the start of raw is closed, outside
+// of the strings it holds.
+func closed(raw string) bool {
+	var quote byte
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case quote == 0 && c == ']':
+			return true
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case c == quote:
+			quote = 0
+		}
+	}
+
+	return false
+}
+
+func bareKey(key string) bool {
+	if key == "" {
+		return false
+	}
+
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	t.Run("reads keys and values", func(t *testing.T) {
+		got, err := parseTOML(`
+# comment
+port = "3001" # trailing comment
+"log-level" = 'debug'
+'data-dir' = 'C:\data'
+max-memory=104_857_600
+log-values = true
+trace-file = "spans #1.jsonl"
+peer-token = "a \"quoted\" token"
+`)
+		if err != nil {
+			t.Fatalf("parseTOML returned error: %s", err)
+		}
+
+		want := []setting{
+			{key: "port", value: "3001", line: 3},
+			{key: "log-level", value: "debug", line: 4},
+			{key: "data-dir", value: `C:\data`, line: 5},
+			{key: "max-memory", value: "104857600", line: 6},
+			{key: "log-values", value: "true", line: 7},
+			{key: "trace-file", value: "spans #1.jsonl", line: 8},
+			{key: "peer-token", value: `a "quoted" token`, line: 9},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("reads arrays", func(t *testing.T) {
+		cases := []struct {
+			toml string
+			want string
+		}{
+			{`cluster = []`, ""},
+			{`cluster = ["a", 'b']`, "a,b"},
+			{"cluster = [\n\t\"a\", # first\n\t\"b\",\n]", "a,b"},
+			{`cluster = ["a]", "#b"]`, "a],#b"},
+		}
+
+		for _, tc := range cases {
+			got, err := parseTOML(tc.toml)
+			if err != nil {
+				t.Errorf("parseTOML(%q) returned error: %s", tc.toml, err)
+				continue
+			}
+
+			if len(got) != 1 || got[0].value != tc.want {
+				t.Errorf("parseTOML(%q) got %+v, want %q", tc.toml, got, tc.want)
+			}
+		}
+	})
+
+	cases := []struct {
+		name string
+		toml string
+		want string
+	}{
+		{"table", "[server]\nport = \"3001\"", "tables are not supported"},
+		{"array of tables", "[[nodes]]", "tables are not supported"},
+		{"inline table", `server = { port = "3001" }`, "inline tables are not supported"},
+		{"dotted key", `server.port = "3001"`, "invalid key"},
+		{"missing value", `port =`, "missing value"},
+		{"missing equals", `port "3001"`, "expected key = value"},
+		{"float", `max-memory = 1.5`, "unsupported value"},
+		{"array of integers", `cluster = [1, 2]`, "arrays may only hold strings"},
+		{"unclosed array", `cluster = ["a"`, "expected , or ]"},
+		{"array without commas", `cluster = ["a" "b"]`, "expected , or ]"},
+		{"unterminated string", `port = "3001`, "unterminated string"},
+		{"text after string", `port = "3001" x`, "after string"},
+		{"unterminated key", `"port = 3001`, "unterminated string"},
+	}
+
+	for _, tc := range cases {
+		t.Run("rejects "+tc.name, func(t *testing.T) {
+			_, err := parseTOML(tc.toml)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML reads the subset of YAML a config file needs: comments, and
+// top-level keys set to a scalar or a list of scalars, given in brackets or
+// one item to a line, such as
+//
+//	# the other nodes
+//	cluster:
+//	  - http://10.0.0.2:3001
+//	  - http://10.0.0.3:3001
+//	max-memory: 104857600
+//	probe-interval: 5s
+//
+// Nested mappings, block scalars, anchors, aliases, tags and more than one
+// document are not supported.
+func parseYAML(data string) ([]setting, error) {
+	var settings []setting
+
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		n := i + 1
+		raw := strings.TrimRight(yamlComment(lines[i]), " \t\r")
+		line := strings.TrimSpace(raw)
+
+		switch {
+		case line == "":
+			continue
+		case line == "---" && len(settings) == 0:
+			continue
+		case line == "---" || line == "...":
+			return nil, fmt.Errorf("line %d: only one document is supported", n)
+		case raw[0] == ' ' || raw[0] == '\t':
+			return nil, fmt.Errorf("line %d: nested mappings are not supported", n)
+		}
+
+		key, rest, err := yamlKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+
+		var value string
+		if rest == "" {
+			var items []string
+			items, i, err = yamlList(lines, i)
+			if err != nil {
+				return nil, err
+			}
+			if items == nil {
+				return nil, fmt.Errorf("line %d: missing value", n)
+			}
+			value = strings.Join(items, ",")
+		} else {
+			value, err = yamlValue(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+		}
+
+		settings = append(settings, setting{key: key, value: value, line: n})
+	}
+
+	return settings, nil
+}
+
+// yamlKey reads the key at the start of line, returning it and the value
+// following its colon.
+func yamlKey(line string) (string, string, error) {
+	if line[0] == '"' || line[0] == '\'' {
+		key, rest, err := yamlString(line)
+		if err != nil {
+			return "", "", err
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("expected key: value")
+		}
+		return key, strings.TrimSpace(rest[1:]), nil
+	}
+
+	colon := strings.Index(line, ":")
+	if colon < 0 || (colon+1 < len(line) && line[colon+1] != ' ' && line[colon+1] != '\t') {
+		return "", "", fmt.Errorf("expected key: value")
+	}
+
+	key := line[:colon]
+	if !bareKey(key) {
+		return "", "", fmt.Errorf("invalid key %q", key)
+	}
+
+	return key, strings.TrimSpace(line[colon+1:]), nil
+}
+
+// yamlList reads the items of the list following line i, one to a line
+// and each starting with a dash, returning them and the last line read.
+// It returns no items when no list follows.
+func yamlList(lines []string, i int) ([]string, int, error) {
+	var items []string
+
+	for i+1 < len(lines) {
+		line := strings.TrimSpace(yamlComment(lines[i+1]))
+		if line == "" {
+			i++
+			continue
+		}
+
+		if line != "-" && !strings.HasPrefix(line, "- ") {
+			if next := lines[i+1]; next[0] == ' ' || next[0] == '\t' {
+				return nil, i, fmt.Errorf("line %d: nested mappings are not supported", i+2)
+			}
+			break
+		}
+		i++
+
+		item := strings.TrimSpace(line[1:])
+		if item == "" || item[0] == '[' {
+			return nil, i, fmt.Errorf("line %d: lists may only hold scalars", i+1)
+		}
+
+		v, err := yamlScalar(item)
+		if err != nil {
+			return nil, i, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		items = append(items, v)
+	}
+
+	return items, i, nil
+}
+
+// yamlValue returns a YAML value as it would be given to a flag. The
+// items of a list are joined by commas.
+func yamlValue(raw string) (string, error) {
+	if raw[0] != '[' {
+		return yamlScalar(raw)
+	}
+
+	if !strings.HasSuffix(raw, "]") {
+		return "", fmt.Errorf("lists in brackets must end on the same line")
+	}
+
+	inner := strings.TrimSpace(raw[1 : len(raw)-1])
+	if inner == "" {
+		return "", nil
+	}
+
+	var items []string
+	for inner != "" {
+		var item string
+		if inner[0] == '"' || inner[0] == '\'' {
+			s, rest, err := yamlString(inner)
+			if err != nil {
+				return "", err
+			}
+			item, inner = s, rest
+		} else {
+			end := strings.Index(inner, ",")
+			if end < 0 {
+				end = len(inner)
+			}
+
+			s, err := yamlScalar(strings.TrimSpace(inner[:end]))
+			if err != nil {
+				return "", err
+			}
+			item, inner = s, inner[end:]
+		}
+		items = append(items, item)
+
+		if inner != "" && inner[0] != ',' {
+			return "", fmt.Errorf("expected , or ] in list")
+		}
+		if inner != "" {
+			inner = strings.TrimSpace(inner[1:])
+		}
+	}
+
+	return strings.Join(items, ","), nil
+}
+
+// yamlScalar returns the plain or quoted scalar raw.
+func yamlScalar(raw string) (string, error) {
+	switch {
+	case raw == "":
+		return "", fmt.Errorf("missing value")
+	case raw == "~" || raw == "null":
+		return "", fmt.Errorf("null values are not supported")
+	case raw[0] == '"' || raw[0] == '\'':
+		s, rest, err := yamlString(raw)
+		if err != nil {
+			return "", err
+		}
+		if rest != "" {
+			return "", fmt.Errorf("unexpected %q after string", rest)
+		}
+		return s, nil
+	case strings.ContainsRune("&*!|>{[]}%@`", rune(raw[0])):
+		return "", fmt.Errorf("unsupported value %s", raw)
+	case strings.Contains(raw, ": ") || strings.HasSuffix(raw, ":"):
+		return "", fmt.Errorf("nested mappings are not supported")
+	}
+
+	return raw, nil
+}
+
+// yamlString reads the double or single quoted string at the start of raw,
+// returning it and what follows it. In single quoted strings a quote is
+// written twice.
+func yamlString(raw string) (string, string, error) {
+	quote := raw[0]
+
+	for i := 1; i < len(raw); i++ {
+		switch {
+		case quote == '"' && raw[i] == '\\':
+			i++
+		case quote == '\'' && raw[i] == '\'' && i+1 < len(raw) && raw[i+1] == '\'':
+			i++
+		case raw[i] == quote:
+			rest := strings.TrimSpace(raw[i+1:])
+			if quote == '\'' {
+				return strings.Replace(raw[1:i], "''", "'", -1), rest, nil
+			}
+
+			s, err := strconv.Unquote(raw[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("invalid string %s", raw[:i+1])
+			}
+			return s, rest, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("unterminated string %s", raw)
+}
+
+// yamlComment removes a comment from line. A comment starts with a # at
+// the start of the line or after a space, outside of quoted strings.
+func yamlComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == 0 && c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		case quote == 0 && (c == '"' || c == '\'') && startsScalar(line[:i]):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case quote == '\'' && c == '\'' && i+1 < len(line) && line[i+1] == '\'':
+			i++
+		case c == quote:
+			quote = 0
+		}
+	}
+
+	return line
+}
+
+// startsScalar reports whether a scalar starts after before, the part of a
+// line preceding it, so that a quote there opens a quoted string rather
+// than being part of a plain one.
+func startsScalar(before string) bool {
+	before = strings.TrimRight(before, " \t")
+
+	return before == "" || strings.ContainsRune(":-[,", rune(before[len(before)-1]))
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	t.Run("reads keys and values", func(t *testing.T) {
+		got, err := parseYAML(`---
+# comment
+port: "3001" # trailing comment
+"log-level": 'debug'
+data-dir: /var/lib/it's here
+max-memory: 104857600
+log-values: true
+trace-file: spans#1.jsonl
+peer-token: 'it''s # not a comment'
+cluster:
+  - http://10.0.0.2:3001
+
+  - "http://10.0.0.3:3001" # node c
+`)
+		if err != nil {
+			t.Fatalf("parseYAML returned error: %s", err)
+		}
+
+		want := []setting{
+			{key: "port", value: "3001", line: 3},
+			{key: "log-level", value: "debug", line: 4},
+			{key: "data-dir", value: "/var/lib/it's here", line: 5},
+			{key: "max-memory", value: "104857600", line: 6},
+			{key: "log-values", value: "true", line: 7},
+			{key: "trace-file", value: "spans#1.jsonl", line: 8},
+			{key: "peer-token", value: "it's # not a comment", line: 9},
+			{key: "cluster", value: "http://10.0.0.2:3001,http://10.0.0.3:3001", line: 10},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("reads lists", func(t *testing.T) {
+		cases := []struct {
+			yaml string
+			want string
+		}{
+			{`cluster: []`, ""},
+			{`cluster: [a, "b", 'c']`, "a,b,c"},
+			{"cluster:\n- a\n- b", "a,b"},
+			{`cluster: ["a,b", c]`, "a,b,c"},
+		}
+
+		for _, tc := range cases {
+			got, err := parseYAML(tc.yaml)
+			if err != nil {
+				t.Errorf("parseYAML(%q) returned error: %s", tc.yaml, err)
+				continue
+			}
+
+			if len(got) != 1 || got[0].value != tc.want {
+				t.Errorf("parseYAML(%q) got %+v, want %q", tc.yaml, got, tc.want)
+			}
+		}
+	})
+
+	cases := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{"nested mapping", "server:\n  port: 3001", "nested mappings are not supported"},
+		{"mapping in a list", "cluster:\n  - url: a", "nested mappings are not supported"},
+		{"list of lists", "cluster:\n  - [a]", "lists may only hold scalars"},
+		{"flow mapping", `server: {port: 3001}`, "unsupported value"},
+		{"block scalar", "peer-token: |\n  token", "unsupported value"},
+		{"anchor", `port: &port 3001`, "unsupported value"},
+		{"alias", `port: *port`, "unsupported value"},
+		{"tag", `port: !!str 3001`, "unsupported value"},
+		{"null", `port: ~`, "null values are not supported"},
+		{"missing value", `port:`, "missing value"},
+		{"missing colon", `port 3001`, "expected key: value"},
+		{"second document", "port: 3001\n---\nport: 3002", "only one document"},
+		{"unclosed list", `cluster: [a, b`, "must end on the same line"},
+		{"unterminated string", `port: "3001`, "unterminated string"},
+		{"text after string", `port: "3001" x`, "after string"},
+	}
+
+	for _, tc := range cases {
+		t.Run("rejects "+tc.name, func(t *testing.T) {
+			_, err := parseYAML(tc.yaml)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
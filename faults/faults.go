@@ -0,0 +1,354 @@
+// Package faults injects faults into the requests nodes send each other,
+// for testing how a cluster behaves when messages are lost, delayed,
+// duplicated or reordered, or when nodes are cut off from each other.
+package faults
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// All is the address of the rule for every node without a rule of its own.
+const All = "*"
+
+// messagePath is the route replication messages are sent to.
+const messagePath = "/message"
+
+var (
+	ErrCut     = errors.New("faults: link to node is cut")
+	ErrDropped = errors.New("faults: message dropped")
+)
+
+// Rule describes the faults injected into requests to a node. Cut fails
+// every request, as if the node could not be reached. Drop and Duplicate
+// are the probabilities that a message is lost or delivered twice.
+// Messages are delayed by Delay and a random part of Jitter, so jitter
+// reorders them.
+type Rule struct {
+	Cut       bool
+	Drop      float64
+	Duplicate float64
+	Delay     time.Duration
+	Jitter    time.Duration
+}
+
+// ruleJSON is a Rule as it is written in JSON, with durations such as "5s".
+type ruleJSON struct {
+	Cut       bool    `json:"cut,omitempty"`
+	Drop      float64 `json:"drop,omitempty"`
+	Duplicate float64 `json:"duplicate,omitempty"`
+	Delay     string  `json:"delay,omitempty"`
+	Jitter    string  `json:"jitter,omitempty"`
+}
+
+func (r Rule) MarshalJSON() ([]byte, error) {
+	j := ruleJSON{Cut: r.Cut, Drop: r.Drop, Duplicate: r.Duplicate}
+	if r.Delay != 0 {
+		j.Delay = r.Delay.String()
+	}
+	if r.Jitter != 0 {
+		j.Jitter = r.Jitter.String()
+	}
+
+	return json.Marshal(j)
+}
+
+func (r *Rule) UnmarshalJSON(b []byte) error {
+	var j ruleJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+
+	rule := Rule{Cut: j.Cut, Drop: j.Drop, Duplicate: j.Duplicate}
+
+	var err error
+	if j.Delay != "" {
+		if rule.Delay, err = time.ParseDuration(j.Delay); err != nil {
+			return err
+		}
+	}
+	if j.Jitter != "" {
+		if rule.Jitter, err = time.ParseDuration(j.Jitter); err != nil {
+			return err
+		}
+	}
+
+	*r = rule
+	return nil
+}
+
+// Validate checks that probabilities are between 0 and 1 and that
+// durations are not negative.
+func (r Rule) Validate() error {
+	if r.Drop < 0 || r.Drop > 1 || r.Duplicate < 0 || r.Duplicate > 1 {
+		return errors.New("drop and duplicate must be between 0 and 1")
+	}
+
+	if r.Delay < 0 || r.Jitter < 0 {
+		return errors.New("delay and jitter must not be negative")
+	}
+
+	return nil
+}
+
+// Stats counts the requests sent through a Transport and the faults
+// injected into them.
+type Stats struct {
+	Sent       uint64 `json:"sent"`
+	Cut        uint64 `json:"cut"`
+	Dropped    uint64 `json:"dropped"`
+	Delayed    uint64 `json:"delayed"`
+	Duplicated uint64 `json:"duplicated"`
+}
+
+// Status is the body of a response to a GET of a Transport.
+type Status struct {
+	Rules map[string]Rule `json:"rules"`
+	Stats Stats           `json:"stats"`
+}
+
+// Transport is an http.RoundTripper that injects faults into requests to
+// other nodes, by the rule for the address of each node: its scheme and
+// host, such as http://127.0.0.1:3002. Cut links fail every request. The
+// other faults are only injected into messages, as other requests between
+// nodes wait for an answer. A delayed message is accepted at once and
+// delivered later, as if it were still on its way.
+type Transport struct {
+	// Base sends the requests that are let through, or
+	// http.DefaultTransport when it is nil.
+	Base http.RoundTripper
+
+	mu      sync.Mutex
+	rules   map[string]Rule
+	rand    *rand.Rand
+	stats   Stats
+	pending sync.WaitGroup
+}
+
+// Set sets the rule for requests to the node at addr, or to every node
+// without a rule of its own when addr is All.
+func (t *Transport) Set(addr string, r Rule) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.rules == nil {
+		t.rules = make(map[string]Rule)
+	}
+	t.rules[addr] = r
+
+	return nil
+}
+
+// Clear removes the rule for requests to the node at addr.
+func (t *Transport) Clear(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.rules, addr)
+}
+
+// Reset removes every rule, so requests are sent unchanged.
+func (t *Transport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rules = nil
+}
+
+// Status returns the rules and counts of the transport.
+func (t *Transport) Status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rules := make(map[string]Rule, len(t.rules))
+	for addr, r := range t.rules {
+		rules[addr] = r
+	}
+
+	return Status{Rules: rules, Stats: t.stats}
+}
+
+// Wait blocks until every delayed or duplicated message has been
+// delivered.
+func (t *Transport) Wait() {
+	t.pending.Wait()
+}
+
+// fault decides what happens to a request to addr, counting it.
+func (t *Transport) fault(addr string, message bool) (cut bool, drop bool, duplicate bool, delay time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, ok := t.rules[addr]
+	if !ok {
+		r = t.rules[All]
+	}
+
+	if t.rand == nil {
+		t.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	switch {
+	case r.Cut:
+		t.stats.Cut++
+		return true, false, false, 0
+	case !message:
+		t.stats.Sent++
+		return false, false, false, 0
+	case r.Drop > 0 && t.rand.Float64() < r.Drop:
+		t.stats.Dropped++
+		return false, true, false, 0
+	}
+
+	t.stats.Sent++
+
+	duplicate = r.Duplicate > 0 && t.rand.Float64() < r.Duplicate
+	if duplicate {
+		t.stats.Duplicated++
+	}
+
+	delay = r.Delay
+	if r.Jitter > 0 {
+		delay += time.Duration(t.rand.Int63n(int64(r.Jitter)))
+	}
+	if delay > 0 {
+		t.stats.Delayed++
+	}
+
+	return false, false, duplicate, delay
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	addr := req.URL.Scheme + "://" + req.URL.Host
+
+	cut, drop, duplicate, delay := t.fault(addr, req.Method == http.MethodPost && req.URL.Path == messagePath)
+	if cut || drop {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		if cut {
+			return nil, ErrCut
+		}
+		return nil, ErrDropped
+	}
+
+	if !duplicate && delay == 0 {
+		return t.base().RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if duplicate {
+		t.deliver(req, body, delay)
+	}
+
+	if delay > 0 {
+		t.deliver(req, body, delay)
+		return accepted(req), nil
+	}
+
+	return t.base().RoundTrip(copyRequest(req, body))
+}
+
+// deliver sends a copy of req with body after delay, in the background.
+func (t *Transport) deliver(req *http.Request, body []byte, delay time.Duration) {
+	t.pending.Add(1)
+
+	go func() {
+		defer t.pending.Done()
+
+		time.Sleep(delay)
+
+		resp, err := t.base().RoundTrip(copyRequest(req, body))
+		if err == nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}()
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+
+	return t.Base
+}
+
+// copyRequest returns a copy of req with body, not bound to its context,
+// so that it can be sent after req has been answered.
+func copyRequest(req *http.Request, body []byte) *http.Request {
+	c, _ := http.NewRequest(req.Method, req.URL.String(), bytes.NewReader(body))
+	for k, v := range req.Header {
+		c.Header[k] = v
+	}
+
+	return c
+}
+
+// accepted returns the response of a node that accepted req.
+func accepted(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		Request:    req,
+	}
+}
+
+// ServeHTTP serves the rules of the transport: a GET returns its Status, a
+// PUT replaces its rules with a JSON object of rules by address, and a
+// DELETE removes them.
+func (t *Transport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var rules map[string]Rule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for addr, rule := range rules {
+			if err := rule.Validate(); err != nil {
+				http.Error(w, fmt.Sprintf("%s: %s", addr, err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		t.mu.Lock()
+		t.rules = rules
+		t.mu.Unlock()
+	case http.MethodDelete:
+		t.Reset()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.Status())
+}
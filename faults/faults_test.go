@@ -0,0 +1,210 @@
+package faults
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver records the bodies of the requests it receives, in order.
+type receiver struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	b, _ := ioutil.ReadAll(req.Body)
+
+	r.mu.Lock()
+	r.bodies = append(r.bodies, string(b))
+	r.mu.Unlock()
+}
+
+func (r *receiver) reset() {
+	r.mu.Lock()
+	r.bodies = nil
+	r.mu.Unlock()
+}
+
+func (r *receiver) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string{}, r.bodies...)
+}
+
+func send(t *testing.T, c *http.Client, url string, body string) error {
+	t.Helper()
+
+	resp, err := c.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %s", resp.Status)
+	}
+
+	return nil
+}
+
+func TestTransport(t *testing.T) {
+	rec := &receiver{}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	tr := &Transport{}
+	c := &http.Client{Transport: tr}
+
+	t.Run("sends requests unchanged without a rule", func(t *testing.T) {
+		if err := send(t, c, ts.URL+"/message", "1"); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := rec.received(); len(got) != 1 || got[0] != "1" {
+			t.Errorf("received %q", got)
+		}
+	})
+
+	t.Run("cuts links", func(t *testing.T) {
+		rec.reset()
+		tr.Set(ts.URL, Rule{Cut: true})
+		defer tr.Reset()
+
+		if err := send(t, c, ts.URL+"/message", "1"); err == nil || !strings.Contains(err.Error(), ErrCut.Error()) {
+			t.Errorf("got %v, want ErrCut", err)
+		}
+		if err := send(t, c, ts.URL+"/cluster/digest", "{}"); err == nil {
+			t.Errorf("expected other requests to fail too")
+		}
+
+		if got := rec.received(); len(got) != 0 {
+			t.Errorf("received %q through a cut link", got)
+		}
+	})
+
+	t.Run("applies the rule for every node", func(t *testing.T) {
+		tr.Set(All, Rule{Drop: 1})
+		defer tr.Reset()
+
+		if err := send(t, c, ts.URL+"/message", "1"); err == nil || !strings.Contains(err.Error(), ErrDropped.Error()) {
+			t.Errorf("got %v, want ErrDropped", err)
+		}
+
+		// Only messages are dropped.
+		rec.reset()
+		if err := send(t, c, ts.URL+"/cluster/digest", "{}"); err != nil || len(rec.received()) != 1 {
+			t.Errorf("got %v", err)
+		}
+
+		tr.Set(ts.URL, Rule{})
+		if err := send(t, c, ts.URL+"/message", "1"); err != nil {
+			t.Errorf("got %v, want the node's own rule to apply", err)
+		}
+	})
+
+	t.Run("duplicates messages", func(t *testing.T) {
+		rec.reset()
+		tr.Set(ts.URL, Rule{Duplicate: 1})
+		defer tr.Reset()
+
+		send(t, c, ts.URL+"/message", "1")
+		tr.Wait()
+
+		if got := rec.received(); len(got) != 2 || got[0] != "1" || got[1] != "1" {
+			t.Errorf("received %q", got)
+		}
+	})
+
+	t.Run("delays and reorders messages", func(t *testing.T) {
+		rec.reset()
+		tr.Set(ts.URL, Rule{Delay: 50 * time.Millisecond})
+
+		start := time.Now()
+		send(t, c, ts.URL+"/message", "1")
+		if time.Since(start) > 25*time.Millisecond {
+			t.Errorf("sending a delayed message took %s, want it accepted at once", time.Since(start))
+		}
+
+		tr.Set(ts.URL, Rule{})
+		send(t, c, ts.URL+"/message", "2")
+		tr.Wait()
+
+		if got := rec.received(); len(got) != 2 || got[0] != "2" || got[1] != "1" {
+			t.Errorf("received %q, want the delayed message last", got)
+		}
+
+		st := tr.Status().Stats
+		if st.Delayed != 1 || st.Duplicated != 1 || st.Dropped != 1 || st.Cut != 2 {
+			t.Errorf("got stats %+v", st)
+		}
+	})
+}
+
+func TestRule(t *testing.T) {
+	t.Run("is written in JSON with durations", func(t *testing.T) {
+		b, _ := json.Marshal(Rule{Drop: 0.5, Delay: 100 * time.Millisecond})
+		if string(b) != `{"drop":0.5,"delay":"100ms"}` {
+			t.Errorf("got %s", b)
+		}
+
+		var r Rule
+		if err := json.Unmarshal([]byte(`{"cut":true,"jitter":"1s"}`), &r); err != nil || r != (Rule{Cut: true, Jitter: time.Second}) {
+			t.Errorf("got %+v, %v", r, err)
+		}
+
+		if err := json.Unmarshal([]byte(`{"delay":"soon"}`), &r); err == nil {
+			t.Errorf("expected an error for a bad duration")
+		}
+	})
+
+	t.Run("is validated", func(t *testing.T) {
+		for _, r := range []Rule{{Drop: 1.5}, {Duplicate: -1}, {Delay: -time.Second}} {
+			if err := (&Transport{}).Set(All, r); err == nil {
+				t.Errorf("expected an error for %+v", r)
+			}
+		}
+	})
+}
+
+func TestServeHTTP(t *testing.T) {
+	tr := &Transport{}
+
+	serve := func(method string, body string) (int, Status) {
+		req := httptest.NewRequest(method, "/admin/faults", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		tr.ServeHTTP(w, req)
+
+		var st Status
+		json.Unmarshal(w.Body.Bytes(), &st)
+
+		return w.Code, st
+	}
+
+	code, st := serve(http.MethodPut, `{"http://127.0.0.1:3002": {"cut": true}, "*": {"delay": "10ms"}}`)
+	if code != http.StatusOK || len(st.Rules) != 2 || !st.Rules["http://127.0.0.1:3002"].Cut || st.Rules[All].Delay != 10*time.Millisecond {
+		t.Errorf("got %d, %+v", code, st)
+	}
+
+	if code, _ := serve(http.MethodPut, `{"*": {"drop": 2}}`); code != http.StatusBadRequest {
+		t.Errorf("got %d for an invalid rule", code)
+	}
+
+	if code, st := serve(http.MethodGet, ""); code != http.StatusOK || len(st.Rules) != 2 {
+		t.Errorf("got %d, %+v", code, st)
+	}
+
+	if code, st := serve(http.MethodDelete, ""); code != http.StatusOK || len(st.Rules) != 0 {
+		t.Errorf("got %d, %+v after deleting", code, st)
+	}
+
+	if code, _ := serve(http.MethodPost, ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("got %d", code)
+	}
+}
@@ -0,0 +1,466 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wolakec/makhzen/client"
+)
+
+// Result is the result of checking a history. When it is not valid, Key
+// is the first key whose operations break the model, and Reason says how.
+type Result struct {
+	Valid  bool   `json:"valid"`
+	Key    string `json:"key,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// register is the model every key is checked against: a single value that
+// writes replace, deletes remove and reads return.
+type register struct {
+	value   string
+	present bool
+}
+
+// step applies op to s, reporting whether what op observed is consistent
+// with s. Writes and deletes whose outcome is unknown observed nothing.
+func step(s register, op Op) (register, bool) {
+	switch op.Kind {
+	case Write:
+		return register{value: op.Value, present: true}, true
+	case Delete:
+		return register{}, op.Outcome != Ok || op.Found == s.present
+	default:
+		if !op.Found {
+			return s, !s.present
+		}
+		return s, s.present && s.value == op.Value
+	}
+}
+
+// relevant returns the operations on key that matter to a check.
+func relevant(ops []Op, key string) []Op {
+	var kept []Op
+	for _, op := range ops {
+		if op.Key == key && observed(op) {
+			kept = append(kept, op)
+		}
+	}
+
+	return kept
+}
+
+// observed reports whether op matters to a check: whether it took effect
+// or may have. Reads that did not return observed nothing, and failed
+// operations did not take effect.
+func observed(op Op) bool {
+	return op.Outcome != Failed && (op.Kind != Read || op.Outcome == Ok)
+}
+
+// Linearizable checks that the operations on every key can be ordered so
+// that each takes effect at once, at some point between its call and its
+// return, and observes the operations before it. A write or delete whose
+// outcome is unknown may take effect at any point after its call, or
+// never. Keys are independent registers, so each is checked on its own.
+func Linearizable(ops []Op) Result {
+	for _, key := range keys(ops) {
+		if r := linearizable(key, relevant(ops, key)); !r.Valid {
+			return r
+		}
+	}
+
+	return Result{Valid: true}
+}
+
+// event is the call or the return of an operation, in a list of events
+// ordered by time. The event of a call points to that of its return.
+type event struct {
+	op     int
+	time   time.Duration
+	ret    *event
+	prev   *event
+	next   *event
+	isCall bool
+}
+
+// linearizable searches for a linearization of the operations on one key,
+// as in "Testing for Linearizability" by Lowe, after the algorithm of
+// Wing and Gong. It walks the events in order, linearizing the operation
+// of each call it reaches if the model allows, and backtracks when it
+// reaches the return of an operation it has not linearized. Each set of
+// linearized operations and the state it leads to are searched from once.
+func linearizable(key string, ops []Op) Result {
+	events := make([]*event, 0, 2*len(ops))
+	for i, op := range ops {
+		ret := &event{op: i, time: op.Return}
+		if op.Outcome == Unknown {
+			ret.time = math.MaxInt64
+		}
+		events = append(events, &event{op: i, time: op.Call, ret: ret, isCall: true}, ret)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].isCall && !events[j].isCall
+	})
+
+	head := &event{}
+	prev := head
+	for _, e := range events {
+		prev.next, e.prev = e, prev
+		prev = e
+	}
+
+	type frame struct {
+		call  *event
+		state register
+	}
+	var (
+		stack      []frame
+		state      register
+		linearized = make(bitset, (len(ops)+63)/64)
+		seen       = make(map[cacheKey]bool)
+		stuck      = -1
+		deepest    = -1
+	)
+
+	e := head.next
+	for head.next != nil {
+		if e.isCall {
+			next, ok := step(state, ops[e.op])
+			if ok {
+				linearized.set(e.op)
+				k := cacheKey{linearized.String(), next}
+				if !seen[k] {
+					seen[k] = true
+					stack = append(stack, frame{e, state})
+					state = next
+					e.lift()
+					e = head.next
+					continue
+				}
+				linearized.clear(e.op)
+			}
+			e = e.next
+			continue
+		}
+
+		// The operation returning here could not be linearized after
+		// those that were, so the last of them is undone.
+		if len(stack) > deepest {
+			deepest, stuck = len(stack), e.op
+		}
+		if len(stack) == 0 {
+			break
+		}
+
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = f.state
+		linearized.clear(f.call.op)
+		f.call.unlift()
+		e = f.call.next
+	}
+
+	if head.next == nil {
+		return Result{Valid: true}
+	}
+
+	return Result{
+		Key:    key,
+		Reason: fmt.Sprintf("%s cannot be ordered with the other %d operations on %s", describe(ops[stuck]), len(ops)-1, key),
+	}
+}
+
+// lift removes the call and the return of an operation from the list.
+func (e *event) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+
+	r := e.ret
+	r.prev.next = r.next
+	if r.next != nil {
+		r.next.prev = r.prev
+	}
+}
+
+// unlift puts back the call and the return lift removed.
+func (e *event) unlift() {
+	r := e.ret
+	r.prev.next = r
+	if r.next != nil {
+		r.next.prev = r
+	}
+
+	e.prev.next = e
+	e.next.prev = e
+}
+
+type cacheKey struct {
+	linearized string
+	state      register
+}
+
+// bitset is a set of operations, by index.
+type bitset []uint64
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << uint(i%64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << uint(i%64) }
+
+func (b bitset) String() string {
+	buf := make([]byte, 0, 8*len(b))
+	for _, w := range b {
+		for i := uint(0); i < 64; i += 8 {
+			buf = append(buf, byte(w>>i))
+		}
+	}
+
+	return string(buf)
+}
+
+// Sequential checks that the operations on every key can be put in one
+// order that keeps the order each client performed them in, but not their
+// order in time, and that each observes the operations before it: a client
+// may observe a write after another client has observed a later one. A
+// write or delete whose outcome is unknown may take effect in its place, or
+// never. Unlike linearizability, sequential consistency does not hold of a
+// history because it holds of each key, so every key is checked in the
+// same order.
+func Sequential(ops []Op) Result {
+	keys := keys(ops)
+	index := make(map[string]int, len(keys))
+	for i, key := range keys {
+		index[key] = i
+	}
+
+	var kept []Op
+	for _, op := range ops {
+		if observed(op) {
+			kept = append(kept, op)
+		}
+	}
+
+	return sequential(keys, index, kept)
+}
+
+// sequential searches the interleavings of the operations of each client,
+// depth first, for one the model of every key allows. Each position in the
+// operations of every client and the state of every key reached there are
+// searched from once.
+func sequential(keys []string, index map[string]int, ops []Op) Result {
+	byClient := make(map[int][]Op)
+	var clients []int
+	for _, op := range ops {
+		if _, ok := byClient[op.Client]; !ok {
+			clients = append(clients, op.Client)
+		}
+		byClient[op.Client] = append(byClient[op.Client], op)
+	}
+	sort.Ints(clients)
+
+	seqs := make([][]Op, len(clients))
+	for i, c := range clients {
+		seqs[i] = byClient[c]
+	}
+
+	var (
+		pos     = make([]int, len(seqs))
+		seen    = make(map[string]bool)
+		deepest = -1
+		stuck   Op
+	)
+
+	var search func(s []register, done int) bool
+	search = func(s []register, done int) bool {
+		if done == len(ops) {
+			return true
+		}
+
+		k := positions(pos) + registers(s)
+		if seen[k] {
+			return false
+		}
+		seen[k] = true
+
+		for c, seq := range seqs {
+			if pos[c] == len(seq) {
+				continue
+			}
+			op := seq[pos[c]]
+			key := index[op.Key]
+
+			var next [][]register
+			if n, ok := step(s[key], op); ok {
+				next = append(next, assign(s, key, n))
+			} else if done > deepest {
+				deepest, stuck = done, op
+			}
+			if op.Outcome == Unknown {
+				next = append(next, s)
+			}
+
+			for _, n := range next {
+				pos[c]++
+				found := search(n, done+1)
+				pos[c]--
+				if found {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	if search(make([]register, len(keys)), 0) {
+		return Result{Valid: true}
+	}
+
+	return Result{
+		Key:    stuck.Key,
+		Reason: fmt.Sprintf("no order of the %d operations on %s that keeps each client's order explains what they observed", len(ops), strings.Join(keys, ", ")),
+	}
+}
+
+// assign returns a copy of s with the register at i set to r.
+func assign(s []register, i int, r register) []register {
+	next := make([]register, len(s))
+	copy(next, s)
+	next[i] = r
+
+	return next
+}
+
+// registers encodes the registers of every key for the cache of a search.
+func registers(s []register) string {
+	buf := make([]byte, 0, 8*len(s))
+	for _, r := range s {
+		if r.present {
+			buf = strconv.AppendQuote(buf, r.value)
+		}
+		buf = append(buf, ';')
+	}
+
+	return string(buf)
+}
+
+func positions(pos []int) string {
+	buf := make([]byte, 0, 4*len(pos))
+	for _, p := range pos {
+		buf = strconv.AppendInt(buf, int64(p), 10)
+		buf = append(buf, ',')
+	}
+
+	return string(buf)
+}
+
+// State is the values a node holds at the keys of a history.
+type State map[string]string
+
+// ReadState reads every one of keys through c.
+func ReadState(ctx context.Context, c Client, keys []string) (State, error) {
+	s := make(State)
+
+	for _, key := range keys {
+		item, err := c.Get(ctx, key)
+		switch {
+		case err == client.ErrNotFound:
+		case err != nil:
+			return nil, err
+		default:
+			s[key] = item.Value
+		}
+	}
+
+	return s, nil
+}
+
+// Converged checks that every node holds the same value at every key once
+// writes have stopped, given the State of each node, and that the value is
+// one a write wrote. A key may only be missing if it was deleted, or if no
+// write to it is known to have taken effect.
+func Converged(ops []Op, states []State) Result {
+	all := ops
+	for _, s := range states {
+		for key := range s {
+			all = append(all, Op{Key: key})
+		}
+	}
+
+	for _, key := range keys(all) {
+		if r := converged(key, relevant(ops, key), states); !r.Valid {
+			return r
+		}
+	}
+
+	return Result{Valid: true}
+}
+
+func converged(key string, ops []Op, states []State) Result {
+	if len(states) == 0 {
+		return Result{Valid: true}
+	}
+
+	want, present := states[0][key]
+	for i, s := range states[1:] {
+		if v, ok := s[key]; ok != present || v != want {
+			return Result{Key: key, Reason: fmt.Sprintf("node %d holds %s at %s, but node 0 holds %s", i+1, holds(v, ok), key, holds(want, present))}
+		}
+	}
+
+	written, deleted, acknowledged := false, false, false
+	for _, op := range ops {
+		switch {
+		case op.Kind == Write && op.Value == want:
+			written = true
+		case op.Kind == Write && op.Outcome == Ok:
+			acknowledged = true
+		case op.Kind == Delete:
+			deleted = true
+		}
+	}
+
+	switch {
+	case present && !written:
+		return Result{Key: key, Reason: fmt.Sprintf("every node holds %q at %s, which no write wrote", want, key)}
+	case !present && acknowledged && !deleted:
+		return Result{Key: key, Reason: fmt.Sprintf("no node holds %s, which was written and never deleted", key)}
+	}
+
+	return Result{Valid: true}
+}
+
+func holds(v string, ok bool) string {
+	if !ok {
+		return "nothing"
+	}
+
+	return strconv.Quote(v)
+}
+
+// describe names an operation in a reason.
+func describe(op Op) string {
+	var what string
+	switch {
+	case op.Kind == Write:
+		what = fmt.Sprintf("write of %q", op.Value)
+	case op.Outcome != Ok:
+		what = string(op.Kind)
+	case op.Kind == Read && op.Found:
+		what = fmt.Sprintf("read of %q", op.Value)
+	case op.Kind == Read:
+		what = "read of nothing"
+	case op.Found:
+		what = "delete"
+	default:
+		what = "delete of nothing"
+	}
+
+	return fmt.Sprintf("%s by client %d at %s", what, op.Client, op.Call)
+}
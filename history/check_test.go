@@ -0,0 +1,300 @@
+package history
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ms(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+func write(client int, key string, value string, call int, ret int) Op {
+	return Op{Client: client, Kind: Write, Key: key, Value: value, Outcome: Ok, Call: ms(call), Return: ms(ret)}
+}
+
+func read(client int, key string, value string, call int, ret int) Op {
+	return Op{Client: client, Kind: Read, Key: key, Value: value, Found: value != "", Outcome: Ok, Call: ms(call), Return: ms(ret)}
+}
+
+func del(client int, key string, found bool, call int, ret int) Op {
+	return Op{Client: client, Kind: Delete, Key: key, Found: found, Outcome: Ok, Call: ms(call), Return: ms(ret)}
+}
+
+func with(op Op, outcome Outcome) Op {
+	op.Outcome = outcome
+	return op
+}
+
+func TestLinearizable(t *testing.T) {
+	cases := []struct {
+		name  string
+		ops   []Op
+		valid bool
+	}{
+		{"reads follow writes", []Op{
+			write(0, "a", "1", 0, 1),
+			read(1, "a", "1", 2, 3),
+			write(1, "a", "2", 4, 5),
+			read(0, "a", "2", 6, 7),
+		}, true},
+		{"a read misses a write that returned", []Op{
+			write(0, "a", "1", 0, 1),
+			read(1, "a", "", 2, 3),
+		}, false},
+		{"a read returns an old value", []Op{
+			write(0, "a", "1", 0, 1),
+			write(0, "a", "2", 2, 3),
+			read(1, "a", "1", 4, 5),
+		}, false},
+		{"reads observe a concurrent write in order", []Op{
+			write(0, "a", "1", 0, 10),
+			read(1, "a", "", 1, 2),
+			read(1, "a", "1", 3, 4),
+		}, true},
+		{"reads observe a concurrent write out of order", []Op{
+			write(0, "a", "1", 0, 10),
+			read(1, "a", "1", 1, 2),
+			read(1, "a", "", 3, 4),
+		}, false},
+		{"concurrent writes take effect in either order", []Op{
+			write(0, "a", "1", 0, 10),
+			write(1, "a", "2", 0, 10),
+			read(2, "a", "2", 1, 2),
+			read(2, "a", "1", 3, 4),
+		}, true},
+		{"a write of unknown outcome takes effect late", []Op{
+			with(write(0, "a", "1", 0, 1), Unknown),
+			read(1, "a", "", 2, 3),
+			read(1, "a", "1", 4, 5),
+		}, true},
+		{"a write of unknown outcome takes effect once", []Op{
+			with(write(0, "a", "1", 0, 1), Unknown),
+			read(1, "a", "1", 2, 3),
+			read(1, "a", "", 4, 5),
+		}, false},
+		{"a failed write is never read", []Op{
+			with(write(0, "a", "1", 0, 1), Failed),
+			read(1, "a", "1", 2, 3),
+		}, false},
+		{"reads that did not return are ignored", []Op{
+			write(0, "a", "1", 0, 1),
+			with(read(1, "a", "", 2, 3), Unknown),
+		}, true},
+		{"deletes remove values", []Op{
+			write(0, "a", "1", 0, 1),
+			del(1, "a", true, 2, 3),
+			read(0, "a", "", 4, 5),
+			del(1, "a", false, 6, 7),
+		}, true},
+		{"a delete finds a value that was deleted", []Op{
+			write(0, "a", "1", 0, 1),
+			del(1, "a", true, 2, 3),
+			del(0, "a", true, 4, 5),
+		}, false},
+		{"keys are independent", []Op{
+			write(0, "a", "1", 0, 1),
+			write(0, "b", "2", 2, 3),
+			read(1, "b", "2", 4, 5),
+			read(1, "a", "1", 6, 7),
+		}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := Linearizable(c.ops)
+			if r.Valid != c.valid {
+				t.Errorf("got %+v, want valid %t", r, c.valid)
+			}
+			if !r.Valid && (r.Key == "" || r.Reason == "") {
+				t.Errorf("got %+v, want the key and the reason", r)
+			}
+		})
+	}
+
+	t.Run("names the operation that cannot be ordered", func(t *testing.T) {
+		r := Linearizable([]Op{
+			write(0, "a", "1", 0, 1),
+			write(0, "b", "1", 0, 1),
+			read(1, "b", "", 2, 3),
+		})
+
+		want := "read of nothing by client 1 at 2ms cannot be ordered with the other 1 operations on b"
+		if r.Key != "b" || r.Reason != want {
+			t.Errorf("got %+v, want %q", r, want)
+		}
+	})
+
+	t.Run("checks long histories", func(t *testing.T) {
+		ops := simulate(rand.New(rand.NewSource(1)), 5, 1000)
+
+		start := time.Now()
+		if r := Linearizable(ops); !r.Valid {
+			t.Fatalf("got %+v", r)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("checking took %s", time.Since(start))
+		}
+
+		// A read of a value that was never written breaks it.
+		for i, op := range ops {
+			if op.Kind == Read && op.Found {
+				ops[i].Value = "never written"
+				break
+			}
+		}
+		if r := Linearizable(ops); r.Valid {
+			t.Errorf("expected a read of a value never written to be found")
+		}
+	})
+}
+
+// simulate returns a linearizable history of clients performing ops
+// operations between them on one key. Each operation takes effect at a
+// point in time between its call and its return, concurrently with those
+// of other clients.
+func simulate(rnd *rand.Rand, clients int, ops int) []Op {
+	var history []Op
+	var s register
+
+	returned := make([]int, clients)
+	for n := 0; n < ops; n++ {
+		at := (n + 2) * 10
+
+		c := rnd.Intn(clients)
+		for returned[c] >= at {
+			c = rnd.Intn(clients)
+		}
+
+		call := at - rnd.Intn(15)
+		if call <= returned[c] {
+			call = returned[c] + 1
+		}
+		returned[c] = at + rnd.Intn(15)
+
+		op := Op{Client: c, Key: "a", Outcome: Ok, Call: ms(call), Return: ms(returned[c])}
+		switch rnd.Intn(3) {
+		case 0:
+			op.Kind, op.Value = Write, fmt.Sprintf("%d", n)
+		case 1:
+			op.Kind, op.Value, op.Found = Read, s.value, s.present
+		default:
+			op.Kind, op.Found = Delete, s.present
+		}
+		s, _ = step(s, op)
+
+		history = append(history, op)
+	}
+
+	return history
+}
+
+func TestSequential(t *testing.T) {
+	t.Run("allows a client to read an old value", func(t *testing.T) {
+		ops := []Op{
+			write(0, "a", "1", 0, 1),
+			read(1, "a", "", 2, 3),
+			read(1, "a", "1", 4, 5),
+		}
+
+		if r := Sequential(ops); !r.Valid {
+			t.Errorf("got %+v", r)
+		}
+		if r := Linearizable(ops); r.Valid {
+			t.Errorf("expected the history not to be linearizable")
+		}
+	})
+
+	t.Run("keeps the order of each client", func(t *testing.T) {
+		r := Sequential([]Op{
+			write(0, "a", "1", 0, 1),
+			write(0, "a", "2", 2, 3),
+			read(1, "a", "2", 4, 5),
+			read(1, "a", "1", 6, 7),
+		})
+
+		want := "no order of the 4 operations on a that keeps each client's order explains what they observed"
+		if r.Valid || r.Key != "a" || r.Reason != want {
+			t.Errorf("got %+v, want %q", r, want)
+		}
+	})
+
+	t.Run("orders every key in the same order", func(t *testing.T) {
+		// Each client writes one key, then reads the other as it was before
+		// the other client's write. Each key on its own can be ordered, but
+		// not both, as one of the writes must come first.
+		ops := []Op{
+			write(0, "a", "1", 0, 1),
+			read(0, "b", "", 2, 3),
+			write(1, "b", "1", 0, 1),
+			read(1, "a", "", 2, 3),
+		}
+
+		for _, key := range []string{"a", "b"} {
+			if r := Sequential(relevant(ops, key)); !r.Valid {
+				t.Errorf("got %+v for %s on its own", r, key)
+			}
+		}
+
+		want := "no order of the 4 operations on a, b that keeps each client's order explains what they observed"
+		if r := Sequential(ops); r.Valid || r.Reason != want {
+			t.Errorf("got %+v, want %q", r, want)
+		}
+	})
+
+	t.Run("lets writes of unknown outcome take effect or not", func(t *testing.T) {
+		ops := []Op{
+			with(write(0, "a", "1", 0, 1), Unknown),
+			write(0, "a", "2", 2, 3),
+			read(1, "a", "2", 4, 5),
+		}
+		if r := Sequential(ops); !r.Valid {
+			t.Errorf("got %+v", r)
+		}
+
+		ops = append(ops, read(1, "a", "1", 6, 7))
+		if r := Sequential(ops); r.Valid {
+			t.Errorf("expected a write to take effect before the client's next one")
+		}
+	})
+}
+
+func TestConverged(t *testing.T) {
+	ops := []Op{
+		write(0, "a", "1", 0, 1),
+		write(1, "a", "2", 0, 1),
+		write(0, "b", "3", 2, 3),
+		del(1, "b", true, 4, 5),
+		with(write(0, "c", "4", 6, 7), Unknown),
+		with(write(0, "d", "5", 6, 7), Failed),
+	}
+
+	cases := []struct {
+		name   string
+		states []State
+		reason string
+	}{
+		{"nodes agree", []State{{"a": "2"}, {"a": "2"}}, ""},
+		{"nodes differ", []State{{"a": "2"}, {"a": "1"}}, `node 1 holds "1" at a, but node 0 holds "2"`},
+		{"a node misses a key", []State{{"a": "2", "c": "4"}, {"a": "2"}}, `node 1 holds nothing at c, but node 0 holds "4"`},
+		{"nodes hold a value never written", []State{{"a": "3"}, {"a": "3"}}, `every node holds "3" at a, which no write wrote`},
+		{"nodes hold a failed write", []State{{"a": "1", "d": "5"}, {"a": "1", "d": "5"}}, `every node holds "5" at d, which no write wrote`},
+		{"nodes hold a key never written", []State{{"a": "1", "e": "6"}, {"a": "1", "e": "6"}}, `every node holds "6" at e, which no write wrote`},
+		{"nodes lose a write", []State{{}, {}}, "no node holds a, which was written and never deleted"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := Converged(ops, c.states)
+			if c.reason == "" && !r.Valid {
+				t.Errorf("got %+v", r)
+			}
+			if c.reason != "" && (r.Valid || !strings.Contains(r.Reason, c.reason)) {
+				t.Errorf("got %+v, want %q", r, c.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+// Package history records the operations clients perform against a
+// cluster, with when each was called and returned, and checks the
+// histories it records against a register model: for linearizability, for
+// sequential consistency, or for the nodes converging once writes stop.
+package history
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wolakec/makhzen/client"
+)
+
+// Kind is the kind of an operation.
+type Kind string
+
+const (
+	Read   Kind = "read"
+	Write  Kind = "write"
+	Delete Kind = "delete"
+)
+
+// Outcome is what a client knows of whether an operation took effect.
+type Outcome string
+
+const (
+	// Ok operations took effect, and returned what they observed.
+	Ok Outcome = "ok"
+	// Failed operations were refused, and did not take effect.
+	Failed Outcome = "failed"
+	// Unknown operations may or may not have taken effect, as the client
+	// did not get an answer it understood.
+	Unknown Outcome = "unknown"
+)
+
+// Op is an operation a client performed on a key. Value is the value a
+// write wrote, or a read returned. Found is whether a read or a delete
+// found a value at the key. Call and Return are when the client sent the
+// operation and got its answer, since the history began.
+type Op struct {
+	Client  int           `json:"client"`
+	Kind    Kind          `json:"kind"`
+	Key     string        `json:"key"`
+	Value   string        `json:"value,omitempty"`
+	Found   bool          `json:"found,omitempty"`
+	Outcome Outcome       `json:"outcome"`
+	Error   string        `json:"error,omitempty"`
+	Call    time.Duration `json:"call"`
+	Return  time.Duration `json:"return"`
+}
+
+// Client is the part of a client.Client a history records operations on.
+type Client interface {
+	Get(ctx context.Context, key string) (client.Item, error)
+	Put(ctx context.Context, key string, value string, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+// History is a record of the operations of any number of clients. It is
+// safe for concurrent use.
+type History struct {
+	start time.Time
+
+	mu  sync.Mutex
+	ops []Op
+}
+
+// New returns an empty history beginning now.
+func New() *History {
+	return &History{start: time.Now()}
+}
+
+// Ops returns the operations recorded so far, in the order they were
+// called.
+func (h *History) Ops() []Op {
+	h.mu.Lock()
+	ops := append([]Op{}, h.ops...)
+	h.mu.Unlock()
+
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+
+	return ops
+}
+
+// Keys returns every key an operation was recorded on, sorted.
+func (h *History) Keys() []string {
+	return keys(h.Ops())
+}
+
+// Client returns a recorder of the operations client id performs through
+// c. A client must perform one operation at a time.
+func (h *History) Client(id int, c Client) *Recorder {
+	return &Recorder{ID: id, client: c, history: h}
+}
+
+func (h *History) since() time.Duration {
+	return time.Since(h.start)
+}
+
+func (h *History) add(op Op) {
+	h.mu.Lock()
+	h.ops = append(h.ops, op)
+	h.mu.Unlock()
+}
+
+// Recorder performs operations through a client, recording each of them
+// in a history.
+type Recorder struct {
+	ID int
+
+	client  Client
+	history *History
+}
+
+// Get reads the value at key.
+func (r *Recorder) Get(ctx context.Context, key string) (string, bool, error) {
+	op := r.begin(Read, key)
+
+	item, err := r.client.Get(ctx, key)
+	if err == nil {
+		op.Value, op.Found = item.Value, true
+	}
+	r.end(op, err)
+
+	return op.Value, op.Found, ignoreNotFound(err)
+}
+
+// Put writes value at key. Values should be unique within a history, so
+// that the write a read observed is known.
+func (r *Recorder) Put(ctx context.Context, key string, value string) error {
+	op := r.begin(Write, key)
+	op.Value = value
+
+	err := r.client.Put(ctx, key, value, 0)
+	r.end(op, err)
+
+	return err
+}
+
+// Delete deletes the value at key, returning whether there was one.
+func (r *Recorder) Delete(ctx context.Context, key string) (bool, error) {
+	op := r.begin(Delete, key)
+
+	err := r.client.Delete(ctx, key)
+	op.Found = err == nil
+	r.end(op, err)
+
+	return op.Found, ignoreNotFound(err)
+}
+
+func (r *Recorder) begin(kind Kind, key string) Op {
+	return Op{Client: r.ID, Kind: kind, Key: key, Call: r.history.since()}
+}
+
+func (r *Recorder) end(op Op, err error) {
+	op.Return = r.history.since()
+	op.Outcome = outcome(err)
+	if op.Outcome != Ok {
+		op.Error = err.Error()
+	}
+
+	r.history.add(op)
+}
+
+// outcome returns the outcome of an operation that returned err. A key
+// that was not found is an answer like any other. Requests a node refused
+// as malformed did not take effect; other errors, such as a request that
+// timed out, leave the outcome unknown.
+func outcome(err error) Outcome {
+	if err == nil || err == client.ErrNotFound {
+		return Ok
+	}
+
+	if e, ok := err.(*client.StatusError); ok && e.StatusCode >= http.StatusBadRequest && e.StatusCode < http.StatusInternalServerError {
+		return Failed
+	}
+
+	return Unknown
+}
+
+func ignoreNotFound(err error) error {
+	if err == client.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+func keys(ops []Op) []string {
+	seen := make(map[string]bool)
+	var keys []string
+
+	for _, op := range ops {
+		if !seen[op.Key] {
+			seen[op.Key] = true
+			keys = append(keys, op.Key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
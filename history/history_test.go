@@ -0,0 +1,129 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/client"
+)
+
+// stubClient holds values in a map, returning err instead when it is set.
+type stubClient struct {
+	values map[string]string
+	err    error
+}
+
+func (c *stubClient) Get(ctx context.Context, key string) (client.Item, error) {
+	if c.err != nil {
+		return client.Item{}, c.err
+	}
+
+	v, ok := c.values[key]
+	if !ok {
+		return client.Item{}, client.ErrNotFound
+	}
+
+	return client.Item{Key: key, Value: v}, nil
+}
+
+func (c *stubClient) Put(ctx context.Context, key string, value string, ttl time.Duration) error {
+	if c.err != nil {
+		return c.err
+	}
+
+	c.values[key] = value
+	return nil
+}
+
+func (c *stubClient) Delete(ctx context.Context, key string) error {
+	if c.err != nil {
+		return c.err
+	}
+
+	if _, ok := c.values[key]; !ok {
+		return client.ErrNotFound
+	}
+
+	delete(c.values, key)
+	return nil
+}
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("records operations and what they observed", func(t *testing.T) {
+		h := New()
+		stub := &stubClient{values: map[string]string{}}
+		r := h.Client(2, stub)
+
+		r.Put(ctx, "region", "eu-west-1")
+		if v, found, err := r.Get(ctx, "region"); v != "eu-west-1" || !found || err != nil {
+			t.Errorf("got %q, %t, %v", v, found, err)
+		}
+		if found, err := r.Delete(ctx, "region"); !found || err != nil {
+			t.Errorf("got %t, %v deleting", found, err)
+		}
+		if found, err := r.Delete(ctx, "region"); found || err != nil {
+			t.Errorf("got %t, %v deleting a missing key", found, err)
+		}
+		if _, found, err := r.Get(ctx, "region"); found || err != nil {
+			t.Errorf("got %t, %v reading a missing key", found, err)
+		}
+
+		want := []Op{
+			{Client: 2, Kind: Write, Key: "region", Value: "eu-west-1", Outcome: Ok},
+			{Client: 2, Kind: Read, Key: "region", Value: "eu-west-1", Found: true, Outcome: Ok},
+			{Client: 2, Kind: Delete, Key: "region", Found: true, Outcome: Ok},
+			{Client: 2, Kind: Delete, Key: "region", Outcome: Ok},
+			{Client: 2, Kind: Read, Key: "region", Outcome: Ok},
+		}
+
+		ops := h.Ops()
+		if len(ops) != len(want) {
+			t.Fatalf("got %d operations, want %d", len(ops), len(want))
+		}
+
+		for i, op := range ops {
+			if op.Return < op.Call || (i > 0 && op.Call < ops[i-1].Return) {
+				t.Errorf("operation %d was called at %s and returned at %s", i, op.Call, op.Return)
+			}
+
+			op.Call, op.Return = 0, 0
+			if op != want[i] {
+				t.Errorf("got %+v, want %+v", op, want[i])
+			}
+		}
+
+		if keys := h.Keys(); len(keys) != 1 || keys[0] != "region" {
+			t.Errorf("got keys %v", keys)
+		}
+	})
+
+	t.Run("records what is known of failed operations", func(t *testing.T) {
+		cases := []struct {
+			err  error
+			want Outcome
+		}{
+			{&client.StatusError{StatusCode: http.StatusBadRequest}, Failed},
+			{&client.StatusError{StatusCode: http.StatusServiceUnavailable}, Unknown},
+			{context.DeadlineExceeded, Unknown},
+			{errors.New("connection reset"), Unknown},
+		}
+
+		for _, c := range cases {
+			h := New()
+			r := h.Client(0, &stubClient{err: c.err})
+
+			if err := r.Put(ctx, "region", "eu-west-1"); err != c.err {
+				t.Errorf("got %v, want %v", err, c.err)
+			}
+
+			if op := h.Ops()[0]; op.Outcome != c.want || op.Error != c.err.Error() {
+				t.Errorf("got %+v for %v, want %s", op, c.err, c.want)
+			}
+		}
+	})
+}
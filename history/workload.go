@@ -0,0 +1,92 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Defaults for the Keys and Ops of a Workload.
+const (
+	DefaultKeys = 3
+	DefaultOps  = 100
+)
+
+// Workload is a random mix of reads, writes and deletes that several
+// clients perform at once on a few shared keys, each waiting for the
+// answer to one operation before performing the next.
+type Workload struct {
+	// Keys is how many keys the clients share, named key-0, key-1 and so
+	// on, and Ops how many operations each client performs.
+	Keys int
+	Ops  int
+	// Reads and Deletes are the proportions of operations that read and
+	// delete. The rest write values unique to the workload.
+	Reads   float64
+	Deletes float64
+	// Pause is the longest a client waits between operations, for a random
+	// part of it, and Timeout the longest it waits for an answer.
+	Pause   time.Duration
+	Timeout time.Duration
+	// Seed seeds the choices of every client, so that a workload can be
+	// repeated.
+	Seed int64
+}
+
+// Run performs the workload through clients, one for each client of the
+// workload, until each has performed its operations or ctx is done, and
+// returns the history of what they did.
+func (w Workload) Run(ctx context.Context, clients []Client) *History {
+	h := New()
+
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(r *Recorder) {
+			defer wg.Done()
+			w.run(ctx, r)
+		}(h.Client(i, c))
+	}
+	wg.Wait()
+
+	return h
+}
+
+func (w Workload) run(ctx context.Context, r *Recorder) {
+	keys, ops := w.Keys, w.Ops
+	if keys <= 0 {
+		keys = DefaultKeys
+	}
+	if ops <= 0 {
+		ops = DefaultOps
+	}
+
+	rnd := rand.New(rand.NewSource(w.Seed + int64(r.ID)))
+
+	for n := 0; n < ops && ctx.Err() == nil; n++ {
+		if w.Pause > 0 {
+			time.Sleep(time.Duration(rnd.Int63n(int64(w.Pause))))
+		}
+
+		key := fmt.Sprintf("key-%d", rnd.Intn(keys))
+		p := rnd.Float64()
+
+		opCtx, cancel := ctx, context.CancelFunc(func() {})
+		if w.Timeout > 0 {
+			opCtx, cancel = context.WithTimeout(ctx, w.Timeout)
+		}
+
+		switch {
+		case p < w.Reads:
+			r.Get(opCtx, key)
+		case p < w.Reads+w.Deletes:
+			r.Delete(opCtx, key)
+		default:
+			r.Put(opCtx, key, fmt.Sprintf("%d-%d", r.ID, n))
+		}
+
+		cancel()
+	}
+}
@@ -0,0 +1,142 @@
+package history
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/clustertest"
+	"github.com/wolakec/makhzen/faults"
+)
+
+// clients returns a client for each node of c, in turn, for n clients.
+func clients(c *clustertest.Cluster, n int) []Client {
+	var clients []Client
+	for i := 0; i < n; i++ {
+		clients = append(clients, c.Nodes[i%len(c.Nodes)].Client)
+	}
+
+	return clients
+}
+
+// states reads the keys of h from every node of c.
+func states(t *testing.T, c *clustertest.Cluster, h *History) []State {
+	t.Helper()
+
+	var states []State
+	for _, n := range c.Nodes {
+		s, err := ReadState(context.Background(), n.Client, h.Keys())
+		if err != nil {
+			t.Fatalf("could not read %s: %s", n.ID, err)
+		}
+		states = append(states, s)
+	}
+
+	return states
+}
+
+func TestWorkload(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("performs the operations it is given", func(t *testing.T) {
+		w := Workload{Keys: 2, Ops: 20, Reads: 0.5, Deletes: 0.2, Seed: 7}
+
+		run := func() []Op {
+			ops := w.Run(ctx, []Client{&stubClient{values: map[string]string{}}}).Ops()
+			for i := range ops {
+				ops[i].Call, ops[i].Return = 0, 0
+			}
+			return ops
+		}
+
+		first, second := run(), run()
+		if len(first) != 20 {
+			t.Fatalf("got %d operations", len(first))
+		}
+
+		kinds := make(map[Kind]int)
+		for i, op := range first {
+			if op != second[i] {
+				t.Errorf("got %+v, then %+v with the same seed", op, second[i])
+			}
+			if op.Key != "key-0" && op.Key != "key-1" {
+				t.Errorf("got an operation on %s", op.Key)
+			}
+			kinds[op.Kind]++
+		}
+		if len(kinds) != 3 {
+			t.Errorf("got %v, want every kind of operation", kinds)
+		}
+	})
+
+	t.Run("stops when its context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		if ops := (Workload{}).Run(ctx, []Client{&stubClient{}}).Ops(); len(ops) != 0 {
+			t.Errorf("got %d operations", len(ops))
+		}
+	})
+
+	t.Run("is linearizable on a single node", func(t *testing.T) {
+		c := clustertest.New(1)
+		defer c.Close()
+
+		h := Workload{Keys: 2, Ops: 50, Reads: 0.5, Deletes: 0.1, Seed: 1}.Run(ctx, clients(c, 4))
+
+		if r := Linearizable(h.Ops()); !r.Valid {
+			t.Errorf("got %+v", r)
+		}
+		if r := Sequential(h.Ops()); !r.Valid {
+			t.Errorf("got %+v", r)
+		}
+	})
+
+	t.Run("reads stale values across a cut link", func(t *testing.T) {
+		c := clustertest.New(2)
+		defer c.Close()
+		c.Cut(0, 1)
+
+		h := New()
+		writer, reader := h.Client(0, c.Nodes[0].Client), h.Client(1, c.Nodes[1].Client)
+
+		writer.Put(ctx, "region", "eu-west-1")
+		reader.Get(ctx, "region")
+
+		r := Linearizable(h.Ops())
+		if r.Valid || r.Key != "region" {
+			t.Errorf("got %+v, want the read to miss the write", r)
+		}
+		if r := Sequential(h.Ops()); !r.Valid {
+			t.Errorf("got %+v", r)
+		}
+
+		c.Heal()
+		c.Repair(t, 0)
+		c.AwaitConverged(t)
+
+		if r := Converged(h.Ops(), states(t, c, h)); !r.Valid {
+			t.Errorf("got %+v", r)
+		}
+	})
+
+	t.Run("converges despite lost, duplicated and reordered messages", func(t *testing.T) {
+		c := clustertest.New(3)
+		defer c.Close()
+
+		for _, n := range c.Nodes {
+			n.Faults.Set(faults.All, faults.Rule{Drop: 0.2, Duplicate: 0.2, Jitter: 10 * time.Millisecond})
+		}
+
+		w := Workload{Keys: 3, Ops: 30, Reads: 0.4, Deletes: 0.1, Timeout: time.Second, Seed: 3}
+		h := w.Run(ctx, clients(c, 6))
+
+		c.Heal()
+		c.Repair(t, 0)
+		c.AwaitConverged(t)
+
+		if r := Converged(h.Ops(), states(t, c, h)); !r.Valid {
+			t.Errorf("got %+v", r)
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log entry. Entries below a logger's level are
+// discarded.
+type Level int32
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+
+	return levelNames[l]
+}
+
+// ParseLevel returns the level called name, as given by its String.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return Level(i), nil
+		}
+	}
+
+	return Info, errors.New("unknown log level " + name)
+}
+
+// Value wraps a stored value, such as the value of an item, so that it is
+// redacted unless the logger is set to show values.
+type Value string
+
+const redacted = "[redacted]"
+
+// Logger writes entries as JSON objects, one per line, with the time, the
+// level, the message and the logger's fields followed by the entry's own.
+// Fields are given as alternating keys and values. A nil Logger discards
+// everything.
+type Logger struct {
+	out        *output
+	level      *int32
+	showValues *int32
+	fields     []interface{}
+}
+
+// output serialises writes from a logger and the loggers derived from it.
+type output struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// New returns a logger writing entries of level or above to w, with values
+// redacted.
+func New(w io.Writer, level Level) *Logger {
+	l := &Logger{
+		out:        &output{w: w},
+		level:      new(int32),
+		showValues: new(int32),
+	}
+	l.SetLevel(level)
+
+	return l
+}
+
+// With returns a logger that adds the given fields to every entry. It
+// shares its output and settings with l.
+func (l *Logger) With(fields ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+
+	c := *l
+	c.fields = append(append([]interface{}{}, l.fields...), fields...)
+
+	return &c
+}
+
+// SetLevel changes the level of l and every logger derived from it.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(l.level))
+}
+
+// ShowValues sets whether Values are written in full rather than redacted.
+func (l *Logger) ShowValues(show bool) {
+	var v int32
+	if show {
+		v = 1
+	}
+
+	atomic.StoreInt32(l.showValues, v)
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) { l.log(Debug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...interface{})  { l.log(Info, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...interface{})  { l.log(Warn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...interface{}) { l.log(Error, msg, fields) }
+
+func (l *Logger) log(level Level, msg string, fields []interface{}) {
+	if l == nil || level < l.Level() {
+		return
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, msg)
+
+	show := atomic.LoadInt32(l.showValues) == 1
+
+	all := append(append([]interface{}{}, l.fields...), fields...)
+	for i := 0; i < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+
+		var v interface{} = "(missing)"
+		if i+1 < len(all) {
+			v = all[i+1]
+		}
+
+		buf.WriteByte(',')
+		writeJSON(&buf, key)
+		buf.WriteByte(':')
+		writeJSON(&buf, fieldValue(v, show))
+	}
+
+	buf.WriteString("}\n")
+
+	l.out.mu.Lock()
+	l.out.w.Write(buf.Bytes())
+	l.out.mu.Unlock()
+}
+
+func fieldValue(v interface{}, show bool) interface{} {
+	switch v := v.(type) {
+	case Value:
+		if show {
+			return string(v)
+		}
+		return redacted
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return v
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+
+	buf.Write(b)
+}
+
+// RequestIDHeader carries the ID of a request, so that a write can be
+// followed across nodes through replication.
+const RequestIDHeader = "X-Request-ID"
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// NewContext returns a copy of ctx carrying l and the request ID it logs.
+func NewContext(ctx context.Context, l *Logger, requestID string) context.Context {
+	ctx = context.WithValue(ctx, loggerKey, l)
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// FromContext returns the logger carried by ctx, or fallback when there is
+// none.
+func FromContext(ctx context.Context, fallback *Logger) *Logger {
+	if l, ok := ctx.Value(loggerKey).(*Logger); ok {
+		return l
+	}
+
+	return fallback
+}
+
+// RequestID returns the request ID carried by ctx, or an empty string.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
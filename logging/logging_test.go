@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func entries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var list []map[string]interface{}
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("could not parse %q: %s", line, err)
+		}
+		list = append(list, e)
+	}
+
+	return list
+}
+
+func TestLogger(t *testing.T) {
+	t.Run("writes JSON with fields", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := New(&buf, Info).With("node", "a")
+
+		l.Info("stored item", "key", "region", "err", errors.New("boom"))
+
+		got := entries(t, &buf)
+		if len(got) != 1 {
+			t.Fatalf("got %d entries, want 1", len(got))
+		}
+
+		e := got[0]
+		if e["level"] != "info" || e["msg"] != "stored item" || e["node"] != "a" || e["key"] != "region" || e["err"] != "boom" {
+			t.Errorf("got %v", e)
+		}
+
+		if _, ok := e["time"]; !ok {
+			t.Errorf("entry has no time: %v", e)
+		}
+	})
+
+	t.Run("discards entries below level", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := New(&buf, Warn)
+
+		l.Info("ignored")
+		l.Warn("kept")
+
+		l.SetLevel(Debug)
+		l.Debug("kept")
+
+		if got := len(entries(t, &buf)); got != 2 {
+			t.Errorf("got %d entries, want 2", got)
+		}
+	})
+
+	t.Run("redacts values by default", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := New(&buf, Info)
+
+		l.Info("stored item", "value", Value("hunter2"))
+		l.ShowValues(true)
+		l.Info("stored item", "value", Value("hunter2"))
+
+		got := entries(t, &buf)
+		if got[0]["value"] != redacted || got[1]["value"] != "hunter2" {
+			t.Errorf("got %v", got)
+		}
+	})
+
+	t.Run("nil logger discards entries", func(t *testing.T) {
+		var l *Logger
+		l.With("node", "a").Info("ignored")
+	})
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, name := range []string{"debug", "info", "WARN", "error"} {
+		level, err := ParseLevel(name)
+		if err != nil || !strings.EqualFold(level.String(), name) {
+			t.Errorf("ParseLevel(%s) got %v, %v", name, level, err)
+		}
+	}
+
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Errorf("expected an error for unknown level")
+	}
+}
+
+func TestContext(t *testing.T) {
+	l := New(&bytes.Buffer{}, Info)
+	ctx := NewContext(context.Background(), l, "abc")
+
+	if FromContext(ctx, nil) != l || RequestID(ctx) != "abc" {
+		t.Errorf("context did not carry logger and request ID")
+	}
+
+	if FromContext(context.Background(), l) != l || RequestID(context.Background()) != "" {
+		t.Errorf("empty context did not return fallbacks")
+	}
+}
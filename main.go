@@ -1,34 +1,360 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
-	"fmt"
-	"log"
+	"net"
 	"net/http"
-	"strings"
+	"os"
+	"time"
 
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/config"
+	"github.com/wolakec/makhzen/faults"
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/metrics"
+	"github.com/wolakec/makhzen/namespace"
 	"github.com/wolakec/makhzen/registry"
 	"github.com/wolakec/makhzen/server"
 	"github.com/wolakec/makhzen/store"
+	"github.com/wolakec/makhzen/tlsconfig"
+	"github.com/wolakec/makhzen/tracing"
+	"github.com/wolakec/makhzen/watch"
 )
 
+// certReloadInterval is how often certificate files are checked for
+// changes.
+const certReloadInterval = 10 * time.Second
+
+// watchHistory is how many events each watch hub keeps for clients that
+// resume a stream.
+const watchHistory = 1000
+
 func main() {
 
-	port := flag.String("port", "5000", "a port number")
-	cluster := flag.String("cluster", "", "http://127.0.0.1:3001,http://127.0.0.1:3002")
-	flag.Parse()
+	logger := logging.New(os.Stderr, logging.Info)
+
+	c, err := loadConfig()
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fatal(logger, "invalid config", "err", err)
+	}
+
+	if c.PrintConfig {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(c.Redacted())
+		return
+	}
 
-	formattedPort := ":" + *port
-	instances := strings.Split(*cluster, ",")
+	logger.ShowValues(c.LogValues)
+	logger = logger.With("node", c.ID)
 
 	itemStore := store.New()
-	r := registry.New(instances)
+	itemStore.NodeID = c.ID
+
+	namespaces := namespace.New()
+	namespaces.NodeID = c.ID
+	namespaces.WatchHistory = watchHistory
+
+	r := registry.New(nil)
+
+	if err := apply(c, logger, itemStore, namespaces, r); err != nil {
+		fatal(logger, "invalid config", "err", err)
+	}
+
+	clientCerts := loadCerts(logger, c.TLSCert, c.TLSKey)
+	peerCerts := loadCerts(logger, c.PeerCert, c.PeerKey)
+
+	var peerCAs *x509.CertPool
+	if c.PeerCA != "" {
+		var err error
+		peerCAs, err = tlsconfig.LoadCertPool(c.PeerCA)
+		if err != nil {
+			fatal(logger, "could not load peer CAs", "err", err)
+		}
+	}
+
+	m := metrics.NewRegistry()
+
+	var tracer *tracing.Tracer
+	if c.TraceFile != "" {
+		f, err := os.OpenFile(c.TraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fatal(logger, "could not open trace file", "err", err)
+		}
+		defer f.Close()
+
+		tracer = &tracing.Tracer{Exporter: &tracing.JSONExporter{W: f}}
+	}
+
+	r.Logger = logger
+	r.Tracer = tracer
+	// HTTP/2 is not attempted by default with a TLS config of our own, and
+	// gRPC replication needs it.
+	var transport http.RoundTripper = &http.Transport{
+		TLSClientConfig:   tlsconfig.ClientConfig(peerCerts, peerCAs),
+		ForceAttemptHTTP2: true,
+	}
+
+	var injector *faults.Transport
+	if c.FaultInjection {
+		logger.Warn("fault injection is enabled, messages to other nodes can be changed through /admin/faults")
+		injector = &faults.Transport{Base: transport}
+		transport = injector
+	}
+
+	peers := &broadcaster.Broadcaster{
+		Secret: []byte(c.ClusterSecret),
+		Token:  c.PeerToken,
+		Client: &http.Client{
+			Timeout:   time.Duration(c.ReplicationTimeout),
+			Transport: transport,
+		},
+		Metrics: m,
+		Logger:  logger,
+		Tracer:  tracer,
+		GRPC:    c.PeerProtocol == "grpc",
+	}
+	r.Broadcaster = peers
+
+	hub := watch.New(watchHistory)
+	itemStore.AddObserver(hub)
+
+	m.OnCollect(func() {
+		m.Gauge("makhzen_watch_subscribers", "Open watch streams.").With().Set(float64(hub.Subscribers()))
+		m.Gauge("makhzen_watch_queued_events", "Events waiting to be sent to watch streams.").With().Set(float64(hub.Queued()))
+	})
+
+	go func() {
+		for range time.Tick(time.Second) {
+			itemStore.Sweep()
+			namespaces.Sweep()
+		}
+	}()
+
+	probes := time.NewTicker(time.Duration(c.ProbeInterval))
+	go func() {
+		for range probes.C {
+			r.Probe()
+		}
+	}()
+
+	go func() {
+		for range time.Tick(certReloadInterval) {
+			reloadCerts(logger, clientCerts)
+			reloadCerts(logger, peerCerts)
+		}
+	}()
 
 	s := server.NewMakhzenServer(itemStore, r)
+	s.Watcher = hub
+	s.Namespaces = namespaces
+	s.Metrics = m
+	s.MinPeers = c.MinPeers
+	s.Logger = logger
+	s.Tracer = tracer
+	s.Peers = peers
+	s.Faults = injector
+
+	if c.ClusterSecret != "" {
+		s.Verifier = broadcaster.NewVerifier([]byte(c.ClusterSecret), time.Duration(c.MessageWindow))
+	}
+
+	if c.ACL != "" {
+		acl, err := server.LoadACL(c.ACL)
+		if err != nil {
+			fatal(logger, "could not load acl", "err", err)
+		}
+		s.ACL = acl
+	}
+
+	if c.DataDir != "" {
+		loaded, err := s.LoadSnapshot(c.DataDir)
+		if err != nil {
+			fatal(logger, "could not load snapshot", "dir", c.DataDir, "err", err)
+		}
+		logger.Info("loaded snapshot", "dir", c.DataDir, "entries", loaded)
+
+		go func() {
+			for range time.Tick(time.Duration(c.SnapshotInterval)) {
+				saveSnapshot(logger, s, c.DataDir)
+			}
+		}()
+	}
+
+	servers := []*http.Server{newServer(":"+c.Port, http.HandlerFunc(s.ServeHTTP), clientCerts, nil)}
+
+	if c.PeerPort != "" {
+		s.PeerOnly = true
+		servers = append(servers, newServer(":"+c.PeerPort, s.PeerHandler, peerCerts, peerCAs))
+	}
+
+	if c.RedisPort != "" {
+		l, err := net.Listen("tcp", ":"+c.RedisPort)
+		if err != nil {
+			fatal(logger, "could not listen", "addr", ":"+c.RedisPort, "err", err)
+		}
+
+		if clientCerts != nil {
+			l = tls.NewListener(l, tlsconfig.ServerConfig(clientCerts, nil))
+		}
+
+		go func() {
+			logger.Info("listening for redis clients", "addr", l.Addr().String())
+			if err := s.ServeRedis(l); err != nil {
+				fatal(logger, "could not serve redis clients", "err", err)
+			}
+		}()
+	}
+
+	if c.MemcachedPort != "" {
+		l, err := net.Listen("tcp", ":"+c.MemcachedPort)
+		if err != nil {
+			fatal(logger, "could not listen", "addr", ":"+c.MemcachedPort, "err", err)
+		}
+
+		if clientCerts != nil {
+			l = tls.NewListener(l, tlsconfig.ServerConfig(clientCerts, nil))
+		}
 
-	handler := http.HandlerFunc(s.ServeHTTP)
-	fmt.Printf("listening on port %s \n", *port)
-	if err := http.ListenAndServe(formattedPort, handler); err != nil {
-		log.Fatalf("could not listen on port %v %v", *port, err)
+		go func() {
+			logger.Info("listening for memcached clients", "addr", l.Addr().String())
+			if err := s.ServeMemcached(l); err != nil {
+				fatal(logger, "could not serve memcached clients", "err", err)
+			}
+		}()
 	}
+
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			logger.Info("listening", "addr", srv.Addr)
+			if err := listen(srv); err != nil {
+				fatal(logger, "could not listen", "addr", srv.Addr, "err", err)
+			}
+		}(srv)
+	}
+
+	s.SetReady(true)
+
+	waitForSignals(logger, func() {
+		c, err := loadConfig()
+		if err == nil {
+			err = apply(c, logger, itemStore, namespaces, r)
+		}
+		if err != nil {
+			logger.Error("could not reload config", "file", c.Config, "err", err)
+			return
+		}
+
+		logger.Info("reloaded config", "file", c.Config)
+	})
+
+	probes.Stop()
+	shutdown(logger, s, r, peers, servers, c.DataDir)
+}
+
+// loadConfig loads the configuration from the command line, the environment
+// and the config file, and checks it is valid.
+func loadConfig() (config.Config, error) {
+	c, err := config.Load(os.Args[0], os.Args[1:], os.Getenv)
+	if err != nil {
+		return c, err
+	}
+
+	if c.ID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return c, err
+		}
+		c.ID = host + ":" + c.Port
+	}
+
+	return c, c.Validate()
+}
+
+// fatal logs msg as an error and exits.
+func fatal(logger *logging.Logger, msg string, fields ...interface{}) {
+	logger.Error(msg, fields...)
+	os.Exit(1)
+}
+
+// newServer returns a server for handler on addr, over TLS when certs is
+// set. When clientCAs is set, clients must present a certificate signed by
+// one of them.
+func newServer(addr string, handler http.Handler, certs *tlsconfig.Reloader, clientCAs *x509.CertPool) *http.Server {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+
+	if certs != nil {
+		srv.TLSConfig = tlsconfig.ServerConfig(certs, clientCAs)
+	}
+
+	return srv
+}
+
+// listen serves srv until it is shut down.
+func listen(srv *http.Server) error {
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// loadCerts loads the certificate and key in certFile and keyFile, or
+// returns nil when no certificate is configured.
+func loadCerts(logger *logging.Logger, certFile string, keyFile string) *tlsconfig.Reloader {
+	if certFile == "" {
+		return nil
+	}
+
+	certs, err := tlsconfig.NewReloader(certFile, keyFile)
+	if err != nil {
+		fatal(logger, "could not load certificate", "file", certFile, "err", err)
+	}
+
+	return certs
+}
+
+func reloadCerts(logger *logging.Logger, certs *tlsconfig.Reloader) {
+	if certs == nil {
+		return
+	}
+
+	reloaded, err := certs.Reload()
+	if err != nil {
+		logger.Error("could not reload certificate", "file", certs.CertFile, "err", err)
+		return
+	}
+
+	if reloaded {
+		logger.Info("reloaded certificate", "file", certs.CertFile)
+	}
+}
+
+// saveSnapshot saves a snapshot of the values held by s to dir.
+func saveSnapshot(logger *logging.Logger, s *server.MakhzenServer, dir string) {
+	start := time.Now()
+
+	saved, err := s.SaveSnapshot(dir)
+	if err != nil {
+		logger.Error("could not save snapshot", "dir", dir, "err", err)
+		return
+	}
+
+	logger.Debug("saved snapshot", "dir", dir, "entries", saved, "duration", time.Since(start))
 }
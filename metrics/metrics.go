@@ -0,0 +1,375 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets used for
+// latency histograms.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds a node's metrics and writes them in the Prometheus text
+// format. Metrics are looked up by name, so the same metric can be fetched
+// from anywhere it is recorded without being passed around.
+type Registry struct {
+	mu         sync.Mutex
+	metrics    map[string]metric
+	names      []string
+	collectors []func()
+}
+
+type metric interface {
+	write(w io.Writer, name string)
+}
+
+// vec holds the series of a metric, one for each combination of label
+// values.
+type vec struct {
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+	newFn  func() *series
+}
+
+type series struct {
+	values []string
+
+	mu      sync.Mutex
+	value   float64
+	buckets []float64
+	counts  []uint64
+	count   uint64
+}
+
+// with returns the series for the given label values, creating it if it
+// does not exist.
+func (v *vec) with(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: got %d label values, want %d", len(values), len(v.labels)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s, ok := v.series[key]
+	if !ok {
+		s = v.newFn()
+		s.values = append([]string(nil), values...)
+		v.series[key] = s
+	}
+
+	return s
+}
+
+// sorted returns the series ordered by their label values.
+func (v *vec) sorted() []*series {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	list := make([]*series, len(keys))
+	for i, k := range keys {
+		list[i] = v.series[k]
+	}
+
+	return list
+}
+
+func (v *vec) header(w io.Writer, name string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, v.typ)
+}
+
+// labelPairs formats the labels of s, followed by any extra pairs.
+func (v *vec) labelPairs(s *series, extra ...string) string {
+	pairs := []string{}
+
+	for i, l := range v.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l, escapeLabel(s.values[i])))
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (v *vec) writeValues(w io.Writer, name string) {
+	v.header(w, name)
+
+	for _, s := range v.sorted() {
+		s.mu.Lock()
+		fmt.Fprintf(w, "%s%s %s\n", name, v.labelPairs(s), formatFloat(s.value))
+		s.mu.Unlock()
+	}
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct{ vec }
+
+// Counter is a value that only goes up.
+type Counter struct{ s *series }
+
+func (c *CounterVec) With(values ...string) Counter {
+	return Counter{c.with(values)}
+}
+
+func (c *CounterVec) write(w io.Writer, name string) {
+	c.writeValues(w, name)
+}
+
+func (c Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increases the counter by v, which must not be negative.
+func (c Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+
+	c.s.mu.Lock()
+	c.s.value += v
+	c.s.mu.Unlock()
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct{ vec }
+
+// Gauge is a value that can go up and down.
+type Gauge struct{ s *series }
+
+func (g *GaugeVec) With(values ...string) Gauge {
+	return Gauge{g.with(values)}
+}
+
+// Reset removes every series, for gauges whose label values are set anew
+// each time they are collected.
+func (g *GaugeVec) Reset() {
+	g.mu.Lock()
+	g.series = make(map[string]*series)
+	g.mu.Unlock()
+}
+
+func (g *GaugeVec) write(w io.Writer, name string) {
+	g.writeValues(w, name)
+}
+
+func (g Gauge) Set(v float64) {
+	g.s.mu.Lock()
+	g.s.value = v
+	g.s.mu.Unlock()
+}
+
+func (g Gauge) Add(v float64) {
+	g.s.mu.Lock()
+	g.s.value += v
+	g.s.mu.Unlock()
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct{ vec }
+
+// Histogram counts observations into buckets.
+type Histogram struct{ s *series }
+
+func (h *HistogramVec) With(values ...string) Histogram {
+	return Histogram{h.with(values)}
+}
+
+func (h Histogram) Observe(v float64) {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	for i, upper := range h.s.buckets {
+		if v <= upper {
+			h.s.counts[i]++
+		}
+	}
+
+	h.s.value += v
+	h.s.count++
+}
+
+func (h *HistogramVec) write(w io.Writer, name string) {
+	h.header(w, name)
+
+	for _, s := range h.sorted() {
+		s.mu.Lock()
+
+		for i, upper := range s.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, h.labelPairs(s, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, h.labelPairs(s, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, h.labelPairs(s), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, h.labelPairs(s), s.count)
+
+		s.mu.Unlock()
+	}
+}
+
+// lookup returns the metric registered as name, registering the one made
+// by fn if there is none.
+func (r *Registry) lookup(name string, fn func() metric) metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.metrics[name]; ok {
+		return m
+	}
+
+	m := fn()
+	r.metrics[name] = m
+	r.names = append(r.names, name)
+
+	return m
+}
+
+func newVec(help string, typ string, labels []string, newFn func() *series) vec {
+	return vec{
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]*series),
+		newFn:  newFn,
+	}
+}
+
+func newSeries() *series {
+	return &series{}
+}
+
+// Counter returns the counter called name, registering it with the given
+// help text and label names the first time.
+func (r *Registry) Counter(name string, help string, labels ...string) *CounterVec {
+	return r.lookup(name, func() metric {
+		return &CounterVec{newVec(help, "counter", labels, newSeries)}
+	}).(*CounterVec)
+}
+
+// Gauge returns the gauge called name, registering it with the given help
+// text and label names the first time.
+func (r *Registry) Gauge(name string, help string, labels ...string) *GaugeVec {
+	return r.lookup(name, func() metric {
+		return &GaugeVec{newVec(help, "gauge", labels, newSeries)}
+	}).(*GaugeVec)
+}
+
+// Histogram returns the histogram called name, registering it with the
+// given help text, bucket upper bounds and label names the first time.
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return r.lookup(name, func() metric {
+		return &HistogramVec{newVec(help, "histogram", labels, func() *series {
+			return &series{buckets: buckets, counts: make([]uint64, len(buckets))}
+		})}
+	}).(*HistogramVec)
+}
+
+// OnCollect registers fn to be called before the metrics are written, to
+// update gauges that are read from elsewhere rather than recorded as they
+// change.
+func (r *Registry) OnCollect(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, fn)
+}
+
+// WriteTo writes every metric, in the order they were registered, in the
+// Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]func(){}, r.collectors...)
+	r.mu.Unlock()
+
+	for _, fn := range collectors {
+		fn()
+	}
+
+	r.mu.Lock()
+	names := append([]string{}, r.names...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	for _, name := range names {
+		r.mu.Lock()
+		m := r.metrics[name]
+		r.mu.Unlock()
+
+		m.write(cw, name)
+	}
+
+	return cw.n, cw.w.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func NewRegistry() *Registry {
+	var r Registry
+	r.metrics = make(map[string]metric)
+
+	return &r
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func output(r *Registry) string {
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+
+	return buf.String()
+}
+
+func assertContains(t *testing.T, got string, want string) {
+	t.Helper()
+
+	if !strings.Contains(got, want) {
+		t.Errorf("output does not contain %q:\n%s", want, got)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+
+	r.Counter("requests_total", "Requests served.", "route", "code").With("/items/", "200").Inc()
+	r.Counter("requests_total", "Requests served.", "route", "code").With("/items/", "200").Add(2)
+	r.Counter("requests_total", "Requests served.", "route", "code").With("/nodes", "404").Inc()
+
+	want := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="/items/",code="200"} 3
+requests_total{route="/nodes",code="404"} 1
+`
+
+	if got := output(r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	r := NewRegistry()
+	keys := r.Gauge("keys", "Keys held.", "namespace")
+
+	t.Run("writes value set by collector", func(t *testing.T) {
+		n := 0
+		r.OnCollect(func() {
+			n++
+			keys.With("team-a").Set(float64(n * 10))
+		})
+
+		assertContains(t, output(r), `keys{namespace="team-a"} 10`)
+		assertContains(t, output(r), `keys{namespace="team-a"} 20`)
+	})
+
+	t.Run("escapes label values", func(t *testing.T) {
+		keys.With("a\"b\\c\nd").Set(1)
+
+		assertContains(t, output(r), `keys{namespace="a\"b\\c\nd"} 1`)
+	})
+
+	t.Run("reset removes series", func(t *testing.T) {
+		keys.Reset()
+		keys.With("team-b").Add(-1)
+
+		got := output(r)
+		assertContains(t, got, `keys{namespace="team-b"} -1`)
+		if strings.Contains(got, `a\"b`) {
+			t.Errorf("reset series still written:\n%s", got)
+		}
+	})
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "peer")
+
+	h.With("a").Observe(0.05)
+	h.With("a").Observe(0.5)
+	h.With("a").Observe(2)
+
+	want := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{peer="a",le="0.1"} 1
+latency_seconds_bucket{peer="a",le="1"} 2
+latency_seconds_bucket{peer="a",le="+Inf"} 3
+latency_seconds_sum{peer="a"} 2.55
+latency_seconds_count{peer="a"} 3
+`
+
+	if got := output(r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("up", "Up.").With().Inc()
+
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if got := response.Header().Get("Content-Type"); got != "text/plain; version=0.0.4" {
+		t.Errorf("got content type %s", got)
+	}
+
+	assertContains(t, response.Body.String(), "up 1\n")
+}
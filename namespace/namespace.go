@@ -0,0 +1,199 @@
+package namespace
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/wolakec/makhzen/store"
+	"github.com/wolakec/makhzen/watch"
+)
+
+// Replication modes for a namespace. Writes to a local namespace stay on
+// the node they were made on.
+const (
+	ReplicateAll  = "all"
+	ReplicateNone = "none"
+)
+
+var (
+	ErrInvalidName = errors.New("namespace names must be 1 to 64 letters, digits, '-' or '_'")
+	ErrExists      = errors.New("namespace already exists")
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Settings configure a namespace. DefaultTTL, in seconds, applies to
+// writes that do not give their own TTL. MaxKeys, MaxBytes and Eviction
+// bound the namespace as described by store.Limits; a MaxKeys or MaxBytes
+// of zero takes the node's limit, as set by Manager.SetLimits.
+type Settings struct {
+	Name        string `json:"name"`
+	DefaultTTL  int64  `json:"defaultTTL,omitempty"`
+	MaxKeys     int    `json:"maxKeys,omitempty"`
+	MaxBytes    int64  `json:"maxBytes,omitempty"`
+	Eviction    string `json:"eviction,omitempty"`
+	Replication string `json:"replication,omitempty"`
+}
+
+// Validate checks the settings and fills in defaults.
+func (s *Settings) Validate() error {
+	if !validName.MatchString(s.Name) {
+		return ErrInvalidName
+	}
+
+	if s.DefaultTTL < 0 || s.MaxKeys < 0 || s.MaxBytes < 0 {
+		return errors.New("limits must not be negative")
+	}
+
+	if s.Eviction == "" {
+		s.Eviction = store.LRU.Name()
+	}
+	if _, err := store.PolicyByName(s.Eviction); err != nil {
+		return err
+	}
+
+	switch s.Replication {
+	case "":
+		s.Replication = ReplicateAll
+	case ReplicateAll, ReplicateNone:
+	default:
+		return errors.New("replication must be all or none")
+	}
+
+	return nil
+}
+
+// Namespace is a keyspace with its own store, and a Hub of the changes
+// made to it when the Manager keeps one for each namespace.
+type Namespace struct {
+	Settings Settings
+	Store    *store.Store
+	Hub      *watch.Hub
+}
+
+// Replicated reports whether writes to the namespace are sent to other
+// nodes.
+func (n *Namespace) Replicated() bool {
+	return n.Settings.Replication != ReplicateNone
+}
+
+// Manager holds the namespaces on a node.
+type Manager struct {
+	// NodeID is given to the store of every namespace created after it is
+	// set.
+	NodeID string
+
+	// WatchHistory, when set, gives every namespace created after it is set
+	// a Hub keeping that many events.
+	WatchHistory int
+
+	mu         sync.RWMutex
+	limits     store.Limits
+	namespaces map[string]*Namespace
+}
+
+// SetLimits sets the node's limits, which apply to every namespace that
+// does not set its own MaxKeys or MaxBytes, including those that exist.
+func (m *Manager) SetLimits(l store.Limits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.limits = l
+	for _, n := range m.namespaces {
+		n.Store.SetLimits(m.storeLimits(n.Settings))
+	}
+}
+
+// storeLimits returns the limits of a namespace with settings s.
+func (m *Manager) storeLimits(s Settings) store.Limits {
+	policy, _ := store.PolicyByName(s.Eviction)
+	l := store.Limits{
+		MaxKeys:  s.MaxKeys,
+		MaxBytes: s.MaxBytes,
+		Policy:   policy,
+	}
+
+	if l.MaxKeys == 0 {
+		l.MaxKeys = m.limits.MaxKeys
+	}
+	if l.MaxBytes == 0 {
+		l.MaxBytes = m.limits.MaxBytes
+	}
+
+	return l
+}
+
+// Create adds a namespace with the given settings.
+func (m *Manager) Create(s Settings) (*Namespace, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.namespaces[s.Name]; ok {
+		return nil, ErrExists
+	}
+
+	st := store.New()
+	st.NodeID = m.NodeID
+	st.SetLimits(m.storeLimits(s))
+
+	n := &Namespace{Settings: s, Store: st}
+	if m.WatchHistory > 0 {
+		n.Hub = watch.New(m.WatchHistory)
+		st.AddObserver(n.Hub)
+	}
+	m.namespaces[s.Name] = n
+
+	return n, nil
+}
+
+func (m *Manager) Get(name string) (*Namespace, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	n, ok := m.namespaces[name]
+	return n, ok
+}
+
+// List returns the settings of every namespace, ordered by name.
+func (m *Manager) List() []Settings {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := []Settings{}
+	for _, n := range m.namespaces {
+		list = append(list, n.Settings)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list
+}
+
+// Sweep removes expired items from every namespace and returns how many
+// were removed.
+func (m *Manager) Sweep() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	n := 0
+	for _, ns := range m.namespaces {
+		n += ns.Store.Sweep()
+	}
+
+	return n
+}
+
+func New() *Manager {
+	var m Manager
+	m.namespaces = make(map[string]*Namespace)
+
+	return &m
+}
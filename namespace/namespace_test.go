@@ -0,0 +1,123 @@
+package namespace
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wolakec/makhzen/store"
+)
+
+func TestCreate(t *testing.T) {
+	t.Run("applies defaults and limits", func(t *testing.T) {
+		m := New()
+		m.NodeID = "a"
+
+		n, err := m.Create(Settings{Name: "team-a", MaxKeys: 1, Eviction: "reject"})
+		if err != nil {
+			t.Fatalf("Create returned error: %s", err)
+		}
+
+		if n.Settings.Replication != ReplicateAll || !n.Replicated() {
+			t.Errorf("expected namespace to be replicated, got %+v", n.Settings)
+		}
+
+		n.Store.SetTyped("a", "1", store.TypeString, 0)
+		if _, err := n.Store.SetTyped("b", "2", store.TypeString, 0); err != store.ErrFull {
+			t.Errorf("expected %v, got %v", store.ErrFull, err)
+		}
+
+		if n.Store.NodeID != "a" {
+			t.Errorf("expected node id a, got %s", n.Store.NodeID)
+		}
+	})
+
+	t.Run("rejects invalid settings", func(t *testing.T) {
+		cases := []Settings{
+			{Name: ""},
+			{Name: "has/slash"},
+			{Name: "ok", Eviction: "random"},
+			{Name: "ok", Replication: "some"},
+			{Name: "ok", MaxKeys: -1},
+		}
+
+		for _, c := range cases {
+			if _, err := New().Create(c); err == nil {
+				t.Errorf("expected error for %+v", c)
+			}
+		}
+	})
+
+	t.Run("rejects duplicate names", func(t *testing.T) {
+		m := New()
+		m.Create(Settings{Name: "team-a"})
+
+		if _, err := m.Create(Settings{Name: "team-a"}); err != ErrExists {
+			t.Errorf("expected %v, got %v", ErrExists, err)
+		}
+	})
+}
+
+func TestNamespacesAreSeparate(t *testing.T) {
+	m := New()
+	a, _ := m.Create(Settings{Name: "team-a"})
+	b, _ := m.Create(Settings{Name: "team-b"})
+
+	a.Store.Set("region", "europe")
+
+	if _, ok := b.Store.GetValue("region"); ok {
+		t.Errorf("expected key written to team-a to be missing from team-b")
+	}
+
+	got, _ := m.Get("team-a")
+	if v, _ := got.Store.GetValue("region"); v != "europe" {
+		t.Errorf("expected europe, got %s", v)
+	}
+}
+
+func TestList(t *testing.T) {
+	m := New()
+	m.Create(Settings{Name: "team-b"})
+	m.Create(Settings{Name: "team-a", Replication: ReplicateNone})
+
+	got := m.List()
+	want := []Settings{
+		{Name: "team-a", Eviction: "lru", Replication: ReplicateNone},
+		{Name: "team-b", Eviction: "lru", Replication: ReplicateAll},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	m := New()
+	own, _ := m.Create(Settings{Name: "team-a", MaxKeys: 2, Eviction: "reject"})
+	m.SetLimits(store.Limits{MaxKeys: 1, Policy: store.RejectWrites})
+	later, _ := m.Create(Settings{Name: "team-b", Eviction: "reject"})
+
+	own.Store.SetTyped("a", "1", store.TypeString, 0)
+	if _, err := own.Store.SetTyped("b", "2", store.TypeString, 0); err != nil {
+		t.Errorf("expected team-a to keep its own limit, got %v", err)
+	}
+
+	later.Store.SetTyped("a", "1", store.TypeString, 0)
+	if _, err := later.Store.SetTyped("b", "2", store.TypeString, 0); err != store.ErrFull {
+		t.Errorf("expected team-b to take the node's limit, got %v", err)
+	}
+}
+
+func TestWatchHistory(t *testing.T) {
+	m := New()
+	if n, _ := m.Create(Settings{Name: "team-a"}); n.Hub != nil {
+		t.Errorf("expected no hub without a watch history")
+	}
+
+	m.WatchHistory = 10
+	n, _ := m.Create(Settings{Name: "team-b"})
+	n.Store.Set("region", "europe")
+
+	if n.Hub == nil || n.Hub.Revision() != 1 {
+		t.Errorf("expected the hub of team-b to see its write, got %v", n.Hub)
+	}
+}
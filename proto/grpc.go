@@ -0,0 +1,143 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ContentType is the content type of gRPC requests and responses.
+const ContentType = "application/grpc"
+
+// MaxMessageSize is the largest message ReadFrame reads.
+const MaxMessageSize = 64 << 20
+
+// Code is a gRPC status code.
+type Code uint32
+
+// The status codes Makhzen answers with.
+const (
+	OK                 Code = 0
+	InvalidArgument    Code = 3
+	NotFound           Code = 5
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	OutOfRange         Code = 11
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+	Unauthenticated    Code = 16
+)
+
+// Status is the outcome of a call, sent in the grpc-status and
+// grpc-message trailers.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("rpc error: code = %d desc = %s", s.Code, s.Message)
+}
+
+// Errorf returns a Status with code and a formatted message.
+func Errorf(code Code, format string, args ...interface{}) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// SetStatus sets the grpc-status and grpc-message of h, which are sent
+// as trailers, or as headers when a call fails before any message is
+// sent.
+func SetStatus(h http.Header, s Status) {
+	h.Set("Grpc-Status", strconv.FormatUint(uint64(s.Code), 10))
+	if s.Message != "" {
+		h.Set("Grpc-Message", encodeMessage(s.Message))
+	}
+}
+
+// ParseStatus returns the status set in h, reporting whether there is one.
+func ParseStatus(h http.Header) (*Status, bool) {
+	v := h.Get("Grpc-Status")
+	if v == "" {
+		return nil, false
+	}
+
+	code, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return &Status{Code: Internal, Message: "invalid grpc-status " + v}, true
+	}
+
+	return &Status{Code: Code(code), Message: decodeMessage(h.Get("Grpc-Message"))}, true
+}
+
+// encodeMessage percent-encodes s as gRPC requires of grpc-message.
+func encodeMessage(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+func decodeMessage(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// Frame returns msg framed as gRPC sends it: a byte saying it is not
+// compressed, its length as four big endian bytes and then msg.
+func Frame(msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+
+	return append(b, msg...)
+}
+
+// ReadFrame reads the message in the next frame from r. It returns io.EOF
+// when r ends between frames.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	if header[0] != 0 {
+		return nil, Errorf(Unimplemented, "compressed messages are not supported")
+	}
+
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > MaxMessageSize {
+		return nil, Errorf(ResourceExhausted, "message of %d bytes is larger than %d", n, MaxMessageSize)
+	}
+
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,77 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestFrames(t *testing.T) {
+	t.Run("reads the frames written", func(t *testing.T) {
+		var buf bytes.Buffer
+		buf.Write(Frame([]byte("first")))
+		buf.Write(Frame(nil))
+
+		for _, want := range []string{"first", ""} {
+			got, err := ReadFrame(&buf)
+			if err != nil {
+				t.Fatalf("could not read frame: %s", err)
+			}
+			if string(got) != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		}
+
+		if _, err := ReadFrame(&buf); err != io.EOF {
+			t.Errorf("got %v at the end, want io.EOF", err)
+		}
+	})
+
+	t.Run("rejects a frame cut short", func(t *testing.T) {
+		frame := Frame([]byte("message"))
+
+		if _, err := ReadFrame(bytes.NewReader(frame[:8])); err != io.ErrUnexpectedEOF {
+			t.Errorf("got %v, want io.ErrUnexpectedEOF", err)
+		}
+	})
+
+	t.Run("rejects compressed frames", func(t *testing.T) {
+		frame := Frame([]byte("message"))
+		frame[0] = 1
+
+		_, err := ReadFrame(bytes.NewReader(frame))
+		if s, ok := err.(*Status); !ok || s.Code != Unimplemented {
+			t.Errorf("got %v, want an unimplemented status", err)
+		}
+	})
+
+	t.Run("rejects frames that are too large", func(t *testing.T) {
+		_, err := ReadFrame(bytes.NewReader([]byte{0, 0xff, 0xff, 0xff, 0xff}))
+		if s, ok := err.(*Status); !ok || s.Code != ResourceExhausted {
+			t.Errorf("got %v, want a resource exhausted status", err)
+		}
+	})
+}
+
+func TestStatus(t *testing.T) {
+	t.Run("reads the status set", func(t *testing.T) {
+		h := http.Header{}
+		SetStatus(h, Status{Code: NotFound, Message: "namespace 100% not found\n"})
+
+		if got := h.Get("Grpc-Message"); got != "namespace 100%25 not found%0A" {
+			t.Errorf("got grpc-message %q", got)
+		}
+
+		s, ok := ParseStatus(h)
+		if !ok || *s != (Status{Code: NotFound, Message: "namespace 100% not found\n"}) {
+			t.Errorf("got %+v", s)
+		}
+	})
+
+	t.Run("reports when there is no status", func(t *testing.T) {
+		if _, ok := ParseStatus(http.Header{}); ok {
+			t.Error("expected no status")
+		}
+	})
+}
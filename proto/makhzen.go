@@ -0,0 +1,533 @@
+package proto
+
+import "sort"
+
+// The types below are the messages of makhzen.proto, with the same fields.
+// Marshal encodes a message and Unmarshal replaces a message with the one
+// encoded in b, skipping fields it does not know of.
+
+type Item struct {
+	Key         string
+	Value       string
+	Type        string
+	Data        []byte
+	ContentType string
+}
+
+func (m *Item) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Key)
+	b = appendString(b, 2, m.Value)
+	b = appendString(b, 3, m.Type)
+	b = appendBytes(b, 4, m.Data)
+	b = appendString(b, 5, m.ContentType)
+	return b
+}
+
+func (m *Item) Unmarshal(b []byte) error {
+	*m = Item{}
+	return fields(b, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			m.Key, err = f.string()
+		case 2:
+			m.Value, err = f.string()
+		case 3:
+			m.Type, err = f.string()
+		case 4:
+			m.Data, err = f.bytes()
+		case 5:
+			m.ContentType, err = f.string()
+		}
+		return err
+	})
+}
+
+// unmarshalItem decodes the item in field f.
+func unmarshalItem(f field) (*Item, error) {
+	b, err := f.bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	item := new(Item)
+	return item, item.Unmarshal(b)
+}
+
+// appendItem appends item as field num unless it is nil.
+func appendItem(b []byte, num int, item *Item) []byte {
+	if item == nil {
+		return b
+	}
+
+	return appendMessage(b, num, item.Marshal())
+}
+
+type GetRequest struct {
+	Namespace string
+	Key       string
+}
+
+func (m *GetRequest) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Namespace)
+	b = appendString(b, 2, m.Key)
+	return b
+}
+
+func (m *GetRequest) Unmarshal(b []byte) error {
+	*m = GetRequest{}
+	return fields(b, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			m.Namespace, err = f.string()
+		case 2:
+			m.Key, err = f.string()
+		}
+		return err
+	})
+}
+
+type GetResponse struct {
+	Found bool
+	Item  *Item
+}
+
+func (m *GetResponse) Marshal() []byte {
+	var b []byte
+	b = appendBool(b, 1, m.Found)
+	b = appendItem(b, 2, m.Item)
+	return b
+}
+
+func (m *GetResponse) Unmarshal(b []byte) error {
+	*m = GetResponse{}
+	return fields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			v, err := f.uint()
+			m.Found = v != 0
+			return err
+		case 2:
+			item, err := unmarshalItem(f)
+			m.Item = item
+			return err
+		}
+		return nil
+	})
+}
+
+type PutRequest struct {
+	Namespace string
+	Item      *Item
+	// TTL is in seconds, with 0 for no expiry.
+	TTL int64
+}
+
+func (m *PutRequest) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Namespace)
+	b = appendItem(b, 2, m.Item)
+	b = appendUint(b, 3, uint64(m.TTL))
+	return b
+}
+
+func (m *PutRequest) Unmarshal(b []byte) error {
+	*m = PutRequest{}
+	return fields(b, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			m.Namespace, err = f.string()
+		case 2:
+			m.Item, err = unmarshalItem(f)
+		case 3:
+			var v uint64
+			v, err = f.uint()
+			m.TTL = int64(v)
+		}
+		return err
+	})
+}
+
+type PutResponse struct{}
+
+func (m *PutResponse) Marshal() []byte { return nil }
+
+func (m *PutResponse) Unmarshal(b []byte) error {
+	return fields(b, func(f field) error { return nil })
+}
+
+type DeleteRequest struct {
+	Namespace string
+	Key       string
+}
+
+func (m *DeleteRequest) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Namespace)
+	b = appendString(b, 2, m.Key)
+	return b
+}
+
+func (m *DeleteRequest) Unmarshal(b []byte) error {
+	*m = DeleteRequest{}
+	return fields(b, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			m.Namespace, err = f.string()
+		case 2:
+			m.Key, err = f.string()
+		}
+		return err
+	})
+}
+
+type DeleteResponse struct {
+	Deleted bool
+}
+
+func (m *DeleteResponse) Marshal() []byte {
+	return appendBool(nil, 1, m.Deleted)
+}
+
+func (m *DeleteResponse) Unmarshal(b []byte) error {
+	*m = DeleteResponse{}
+	return fields(b, func(f field) error {
+		if f.num == 1 {
+			v, err := f.uint()
+			m.Deleted = v != 0
+			return err
+		}
+		return nil
+	})
+}
+
+type BatchGetRequest struct {
+	Namespace string
+	Keys      []string
+}
+
+func (m *BatchGetRequest) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Namespace)
+	for _, k := range m.Keys {
+		// Repeated strings are appended even when empty, so that they keep
+		// their place.
+		b = appendMessage(b, 2, []byte(k))
+	}
+	return b
+}
+
+func (m *BatchGetRequest) Unmarshal(b []byte) error {
+	*m = BatchGetRequest{}
+	return fields(b, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			m.Namespace, err = f.string()
+		case 2:
+			var k string
+			k, err = f.string()
+			m.Keys = append(m.Keys, k)
+		}
+		return err
+	})
+}
+
+type BatchGetResponse struct {
+	// Items holds the keys that were found.
+	Items []*Item
+}
+
+func (m *BatchGetResponse) Marshal() []byte {
+	var b []byte
+	for _, item := range m.Items {
+		b = appendItem(b, 1, item)
+	}
+	return b
+}
+
+func (m *BatchGetResponse) Unmarshal(b []byte) error {
+	*m = BatchGetResponse{}
+	return fields(b, func(f field) error {
+		if f.num == 1 {
+			item, err := unmarshalItem(f)
+			m.Items = append(m.Items, item)
+			return err
+		}
+		return nil
+	})
+}
+
+type BatchPutRequest struct {
+	Namespace string
+	Puts      []*PutRequest
+}
+
+func (m *BatchPutRequest) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Namespace)
+	for _, put := range m.Puts {
+		b = appendMessage(b, 2, put.Marshal())
+	}
+	return b
+}
+
+func (m *BatchPutRequest) Unmarshal(b []byte) error {
+	*m = BatchPutRequest{}
+	return fields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			var err error
+			m.Namespace, err = f.string()
+			return err
+		case 2:
+			data, err := f.bytes()
+			if err != nil {
+				return err
+			}
+			put := new(PutRequest)
+			m.Puts = append(m.Puts, put)
+			return put.Unmarshal(data)
+		}
+		return nil
+	})
+}
+
+type BatchPutResponse struct {
+	// Errors holds an error for each put that failed, by its index.
+	Errors map[int32]string
+}
+
+// Marshal encodes Errors in order of index, so that a response is always
+// encoded the same way. As protobuf-go does, each entry holds its index
+// and message even when they are the default values.
+func (m *BatchPutResponse) Marshal() []byte {
+	indexes := make([]int, 0, len(m.Errors))
+	for i := range m.Errors {
+		indexes = append(indexes, int(i))
+	}
+	sort.Ints(indexes)
+
+	var b []byte
+	for _, i := range indexes {
+		var entry []byte
+		entry = appendVarint(appendTag(entry, 1, wireVarint), uint64(int64(i)))
+		entry = appendMessage(entry, 2, []byte(m.Errors[int32(i)]))
+		b = appendMessage(b, 1, entry)
+	}
+	return b
+}
+
+func (m *BatchPutResponse) Unmarshal(b []byte) error {
+	*m = BatchPutResponse{}
+	return fields(b, func(f field) error {
+		if f.num != 1 {
+			return nil
+		}
+
+		data, err := f.bytes()
+		if err != nil {
+			return err
+		}
+
+		var (
+			index int32
+			msg   string
+		)
+		err = fields(data, func(f field) (err error) {
+			switch f.num {
+			case 1:
+				var v uint64
+				v, err = f.uint()
+				index = int32(v)
+			case 2:
+				msg, err = f.string()
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if m.Errors == nil {
+			m.Errors = make(map[int32]string)
+		}
+		m.Errors[index] = msg
+		return nil
+	})
+}
+
+type WatchRequest struct {
+	Namespace string
+	// Either Key or Prefix is given.
+	Key    string
+	Prefix string
+	Since  uint64
+}
+
+func (m *WatchRequest) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Namespace)
+	b = appendString(b, 2, m.Key)
+	b = appendString(b, 3, m.Prefix)
+	b = appendUint(b, 4, m.Since)
+	return b
+}
+
+func (m *WatchRequest) Unmarshal(b []byte) error {
+	*m = WatchRequest{}
+	return fields(b, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			m.Namespace, err = f.string()
+		case 2:
+			m.Key, err = f.string()
+		case 3:
+			m.Prefix, err = f.string()
+		case 4:
+			m.Since, err = f.uint()
+		}
+		return err
+	})
+}
+
+type Event struct {
+	Revision uint64
+	// Type is put, delete, expire or evict.
+	Type string
+	Item *Item
+}
+
+func (m *Event) Marshal() []byte {
+	var b []byte
+	b = appendUint(b, 1, m.Revision)
+	b = appendString(b, 2, m.Type)
+	b = appendItem(b, 3, m.Item)
+	return b
+}
+
+func (m *Event) Unmarshal(b []byte) error {
+	*m = Event{}
+	return fields(b, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			m.Revision, err = f.uint()
+		case 2:
+			m.Type, err = f.string()
+		case 3:
+			m.Item, err = unmarshalItem(f)
+		}
+		return err
+	})
+}
+
+// Message is a broadcaster.Message.
+type Message struct {
+	Op          string
+	Namespace   string
+	Key         string
+	Value       string
+	Type        string
+	Data        []byte
+	ContentType string
+	Flags       uint32
+	State       []byte
+	TTL         int64
+	RequestID   string
+	Traceparent string
+	Timestamp   int64
+	Since       int64
+	SentAt      int64
+	Nonce       string
+	Signature   string
+}
+
+func (m *Message) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Op)
+	b = appendString(b, 2, m.Namespace)
+	b = appendString(b, 3, m.Key)
+	b = appendString(b, 4, m.Value)
+	b = appendString(b, 5, m.Type)
+	b = appendBytes(b, 6, m.Data)
+	b = appendString(b, 7, m.ContentType)
+	b = appendUint(b, 8, uint64(m.Flags))
+	b = appendBytes(b, 9, m.State)
+	b = appendUint(b, 10, uint64(m.TTL))
+	b = appendString(b, 11, m.RequestID)
+	b = appendString(b, 12, m.Traceparent)
+	b = appendUint(b, 13, uint64(m.Timestamp))
+	b = appendUint(b, 14, uint64(m.Since))
+	b = appendUint(b, 15, uint64(m.SentAt))
+	b = appendString(b, 16, m.Nonce)
+	b = appendString(b, 17, m.Signature)
+	return b
+}
+
+func (m *Message) Unmarshal(b []byte) error {
+	*m = Message{}
+	return fields(b, func(f field) (err error) {
+		var v uint64
+		switch f.num {
+		case 1:
+			m.Op, err = f.string()
+		case 2:
+			m.Namespace, err = f.string()
+		case 3:
+			m.Key, err = f.string()
+		case 4:
+			m.Value, err = f.string()
+		case 5:
+			m.Type, err = f.string()
+		case 6:
+			m.Data, err = f.bytes()
+		case 7:
+			m.ContentType, err = f.string()
+		case 8:
+			v, err = f.uint()
+			m.Flags = uint32(v)
+		case 9:
+			m.State, err = f.bytes()
+		case 10:
+			v, err = f.uint()
+			m.TTL = int64(v)
+		case 11:
+			m.RequestID, err = f.string()
+		case 12:
+			m.Traceparent, err = f.string()
+		case 13:
+			v, err = f.uint()
+			m.Timestamp = int64(v)
+		case 14:
+			v, err = f.uint()
+			m.Since = int64(v)
+		case 15:
+			v, err = f.uint()
+			m.SentAt = int64(v)
+		case 16:
+			m.Nonce, err = f.string()
+		case 17:
+			m.Signature, err = f.string()
+		}
+		return err
+	})
+}
+
+type Ack struct {
+	// Error is empty when the message was applied.
+	Error string
+}
+
+func (m *Ack) Marshal() []byte {
+	return appendString(nil, 1, m.Error)
+}
+
+func (m *Ack) Unmarshal(b []byte) error {
+	*m = Ack{}
+	return fields(b, func(f field) (err error) {
+		if f.num == 1 {
+			m.Error, err = f.string()
+		}
+		return err
+	})
+}
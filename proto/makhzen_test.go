@@ -0,0 +1,93 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+type message interface {
+	Marshal() []byte
+	Unmarshal(b []byte) error
+}
+
+func TestMessages(t *testing.T) {
+	item := &Item{Key: "avatar", Type: "bytes", Data: []byte{0, 0xff}, ContentType: "image/png"}
+
+	// golden is the encoding of in made by the protobuf-go encoder, with
+	// proto.MarshalOptions{Deterministic: true}, from a dynamic message of
+	// the type in makhzen.proto.
+	cases := []struct {
+		name   string
+		in     message
+		out    message
+		golden string
+	}{
+		{"Item", &Item{Key: "region", Value: "eu-west", Type: "string"}, new(Item), "0a06726567696f6e120765752d776573741a06737472696e67"},
+		{"GetRequest", &GetRequest{Namespace: "team-a", Key: "region"}, new(GetRequest), "0a067465616d2d611206726567696f6e"},
+		{"GetResponse", &GetResponse{Found: true, Item: item}, new(GetResponse), "0801121e0a066176617461721a056279746573220200ff2a09696d6167652f706e67"},
+		{"PutRequest", &PutRequest{Namespace: "team-a", Item: item, TTL: 60}, new(PutRequest), "0a067465616d2d61121e0a066176617461721a056279746573220200ff2a09696d6167652f706e67183c"},
+		{"DeleteRequest", &DeleteRequest{Key: "region"}, new(DeleteRequest), "1206726567696f6e"},
+		{"DeleteResponse", &DeleteResponse{Deleted: true}, new(DeleteResponse), "0801"},
+		{"BatchGetRequest", &BatchGetRequest{Keys: []string{"a", "", "c"}}, new(BatchGetRequest), "1201611200120163"},
+		{"BatchGetResponse", &BatchGetResponse{Items: []*Item{item, {Key: "b", Value: "2"}}}, new(BatchGetResponse), "0a1e0a066176617461721a056279746573220200ff2a09696d6167652f706e670a060a0162120132"},
+		{"BatchPutRequest", &BatchPutRequest{Namespace: "team-a", Puts: []*PutRequest{{Item: item}, {Item: &Item{Key: "b"}, TTL: 5}}}, new(BatchPutRequest), "0a067465616d2d611220121e0a066176617461721a056279746573220200ff2a09696d6167652f706e67120712030a01621805"},
+		{"BatchPutResponse", &BatchPutResponse{Errors: map[int32]string{0: "store is full", 3: "wrong type", -1: "odd"}}, new(BatchPutResponse), "0a1008ffffffffffffffffff0112036f64640a110800120d73746f72652069732066756c6c0a0e0803120a77726f6e672074797065"},
+		{"WatchRequest", &WatchRequest{Prefix: "config/", Since: 1 << 40}, new(WatchRequest), "1a07636f6e6669672f20808080808020"},
+		{"Event", &Event{Revision: 7, Type: "put", Item: &Item{Key: "config/region", Value: "eu"}}, new(Event), "080712037075741a130a0d636f6e6669672f726567696f6e12026575"},
+		{"Message", &Message{
+			Op: "merge", Namespace: "team-a", Key: "tags", Type: "set", Flags: 1 << 31,
+			State: []byte(`{"adds":{}}`), TTL: -1, RequestID: "abc", Traceparent: "00-x",
+			Timestamp: 1700000000000000000, Since: 1600000000000000000,
+			SentAt: 1700000000, Nonce: "n1", Signature: "ab",
+		}, new(Message), "0a056d6572676512067465616d2d611a04746167732a037365744080808080084a0b7b2261646473223a7b7d7d50ffffffffffffffffff015a03616263620430302d78688080a8b1e39fe7cb1770808080c5ddf0959a167880e2cfaa068201026e318a01026162"},
+		{"Ack", &Ack{Error: "store is full"}, new(Ack), "0a0d73746f72652069732066756c6c"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.out.Unmarshal(tc.in.Marshal()); err != nil {
+				t.Fatalf("could not unmarshal: %s", err)
+			}
+
+			if !reflect.DeepEqual(tc.out, tc.in) {
+				t.Errorf("got %+v, want %+v", tc.out, tc.in)
+			}
+
+			if got := hex.EncodeToString(tc.in.Marshal()); got != tc.golden {
+				t.Errorf("encoded as %s, protobuf-go encodes %s", got, tc.golden)
+			}
+		})
+	}
+
+	t.Run("encodes as protoc does", func(t *testing.T) {
+		got := (&PutRequest{Namespace: "ns", Item: &Item{Key: "k", Value: "v"}, TTL: 300}).Marshal()
+		want := []byte{
+			0x0a, 2, 'n', 's',
+			0x12, 6, 0x0a, 1, 'k', 0x12, 1, 'v',
+			0x18, 0xac, 0x02,
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Errorf("got % x, want % x", got, want)
+		}
+	})
+
+	t.Run("leaves out default values", func(t *testing.T) {
+		if b := (&Message{}).Marshal(); len(b) != 0 {
+			t.Errorf("got % x for an empty message", b)
+		}
+	})
+
+	t.Run("replaces what was held", func(t *testing.T) {
+		m := &GetRequest{Namespace: "team-a", Key: "old"}
+		if err := m.Unmarshal((&GetRequest{Key: "new"}).Marshal()); err != nil {
+			t.Fatalf("could not unmarshal: %s", err)
+		}
+
+		if *m != (GetRequest{Key: "new"}) {
+			t.Errorf("got %+v", m)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+// Package proto holds the messages described by makhzen.proto, encoded in
+// the protocol buffer wire format by hand, and the framing gRPC sends them
+// in, so that Makhzen can serve gRPC with the standard library alone.
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Wire types of the protocol buffer encoding.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("proto: message is truncated")
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+
+	return append(b, byte(v))
+}
+
+func appendTag(b []byte, num int, wire int) []byte {
+	return appendVarint(b, uint64(num)<<3|uint64(wire))
+}
+
+// appendString appends s as field num unless it is empty, the default
+// value proto3 leaves out.
+func appendString(b []byte, num int, s string) []byte {
+	if s == "" {
+		return b
+	}
+
+	b = appendTag(b, num, wireBytes)
+	b = appendVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendBytes(b []byte, num int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+
+	b = appendTag(b, num, wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendUint appends v as the varint field num unless it is zero. Signed
+// integers are appended as their two's complement, as int32 and int64
+// fields are encoded.
+func appendUint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = appendTag(b, num, wireVarint)
+	return appendVarint(b, v)
+}
+
+func appendBool(b []byte, num int, v bool) []byte {
+	if !v {
+		return b
+	}
+
+	return appendUint(b, num, 1)
+}
+
+// appendMessage appends the encoded message m as field num. Unlike scalar
+// fields it is appended when empty, so that it reads back as present.
+func appendMessage(b []byte, num int, m []byte) []byte {
+	b = appendTag(b, num, wireBytes)
+	b = appendVarint(b, uint64(len(m)))
+	return append(b, m...)
+}
+
+// field is a field read from an encoded message: its number and wire type,
+// with its value as an integer or, for length-delimited fields, as bytes.
+type field struct {
+	num  int
+	wire int
+	n    uint64
+	data []byte
+}
+
+func (f field) wrongType() error {
+	return fmt.Errorf("proto: field %d has wire type %d", f.num, f.wire)
+}
+
+func (f field) string() (string, error) {
+	b, err := f.bytes()
+	return string(b), err
+}
+
+func (f field) bytes() ([]byte, error) {
+	if f.wire != wireBytes {
+		return nil, f.wrongType()
+	}
+
+	return f.data, nil
+}
+
+func (f field) uint() (uint64, error) {
+	if f.wire != wireVarint {
+		return 0, f.wrongType()
+	}
+
+	return f.n, nil
+}
+
+// fields calls fn with every field of the encoded message b, in order.
+// Fields fn does not know of are to be skipped, as proto3 requires.
+func fields(b []byte, fn func(f field) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+
+		f := field{num: int(tag >> 3), wire: int(tag & 7)}
+		if f.num <= 0 {
+			return fmt.Errorf("proto: invalid field number %d", f.num)
+		}
+
+		switch f.wire {
+		case wireVarint:
+			f.n, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			f.n = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errTruncated
+			}
+			f.data = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			f.n = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return fmt.Errorf("proto: field %d has unsupported wire type %d", f.num, f.wire)
+		}
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
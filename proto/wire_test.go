@@ -0,0 +1,51 @@
+package proto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFields(t *testing.T) {
+	t.Run("skips fields it does not know of", func(t *testing.T) {
+		b := []byte{
+			0x10, 0x96, 0x01, // field 2, varint 150
+			0x19, 1, 2, 3, 4, 5, 6, 7, 8, // field 3, fixed64
+			0x25, 1, 2, 3, 4, // field 4, fixed32
+			0x2a, 1, 'x', // field 5, bytes
+		}
+
+		var ack Ack
+		if err := ack.Unmarshal(append(b, 0x0a, 2, 'o', 'k')); err != nil {
+			t.Fatalf("could not unmarshal: %s", err)
+		}
+
+		if ack.Error != "ok" {
+			t.Errorf("got %q, want %q", ack.Error, "ok")
+		}
+	})
+
+	cases := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"truncated tag", []byte{0x80}, "truncated"},
+		{"truncated varint", []byte{0x08, 0x80}, "truncated"},
+		{"truncated bytes", []byte{0x0a, 5, 'a'}, "truncated"},
+		{"truncated fixed64", []byte{0x09, 1, 2}, "truncated"},
+		{"field zero", []byte{0x02, 0}, "invalid field number"},
+		{"group", []byte{0x0b}, "unsupported wire type"},
+		{"wrong wire type", []byte{0x08, 1}, "has wire type 0"},
+	}
+
+	for _, tc := range cases {
+		t.Run("rejects "+tc.name, func(t *testing.T) {
+			var ack Ack
+			err := ack.Unmarshal(tc.b)
+
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
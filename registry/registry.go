@@ -1,33 +1,257 @@
 package registry
 
-import "github.com/wolakec/makhzen/broadcaster"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/tracing"
+)
 
 type Registry struct {
 	Nodes       []Node
 	Broadcaster MessageBroadcaster
+	// Logger logs messages that could not be sent and nodes becoming
+	// reachable or unreachable.
+	Logger *logging.Logger
+	// Tracer traces the replication of every write.
+	Tracer *tracing.Tracer
+
+	mu       sync.Mutex
+	statuses map[string]*PeerStatus
+	sending  int64
 }
 
 type MessageBroadcaster interface {
-	SendMessage(key string, value string, addr string) error
+	SendMessage(msg broadcaster.Message, addr string) error
 }
 
 type Node struct {
 	Address string
 }
 
+// PeerStatus summarises the messages sent to a node. Messages that fail are
+// not retried, so Missed counts the writes that could not be sent to the
+// node and that it has not been found to hold since, whether or not it has
+// been reached again, and LagSeconds how long it has been missing the
+// oldest of them.
+type PeerStatus struct {
+	Address     string    `json:"address"`
+	Reachable   bool      `json:"reachable"`
+	LastContact time.Time `json:"lastContact"`
+	LastError   string    `json:"lastError,omitempty"`
+	Sent        uint64    `json:"sent"`
+	Errors      uint64    `json:"errors"`
+	Missed      uint64    `json:"missed"`
+	LagSeconds  float64   `json:"lagSeconds"`
+
+	missed map[string]*missedWrites
+}
+
+// missedWrites are the writes to one namespace that could not be sent to a
+// node, and when the first and last of them failed.
+type missedWrites struct {
+	count uint64
+	first time.Time
+	last  time.Time
+}
+
 func (r *Registry) AddNode(node Node) Node {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	r.Nodes = append(r.Nodes, node)
 	return node
 }
 
 func (r *Registry) GetNodes() []Node {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	return r.Nodes
 }
 
-func (r *Registry) Broadcast(key string, value string) {
+// SetNodes replaces the nodes messages are sent to with the nodes at
+// addresses. The status of nodes that are kept is carried over.
+func (r *Registry) SetNodes(addresses []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	nodes := []Node{}
+	kept := make(map[string]*PeerStatus)
+
+	for _, addr := range addresses {
+		nodes = append(nodes, Node{Address: addr})
+
+		if s, ok := r.statuses[addr]; ok {
+			kept[addr] = s
+		}
+	}
+
+	r.Nodes = nodes
+	r.statuses = kept
+}
+
+// Wait blocks until every message being sent has been sent, or until
+// timeout has passed, reporting whether they were all sent.
+func (r *Registry) Wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for atomic.LoadInt64(&r.sending) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+func (r *Registry) Broadcast(msg broadcaster.Message) {
+	atomic.AddInt64(&r.sending, 1)
+	defer atomic.AddInt64(&r.sending, -1)
+
+	if msg.Op != broadcaster.OpPing {
+		_, span := r.Tracer.StartRemote(msg.Traceparent, "replication.broadcast")
+		span.SetAttribute("op", msg.Op)
+		span.SetAttribute("key", msg.Key)
+		defer span.End()
+
+		if sc := span.Context(); sc.Valid() {
+			msg.Traceparent = sc.Traceparent()
+		}
+	}
+
+	for _, node := range r.GetNodes() {
+		err := r.Broadcaster.SendMessage(msg, node.Address)
+		changed := r.record(node.Address, err, msg)
+
+		logger := r.Logger.With("peer", node.Address)
+
+		if err != nil && msg.Op != broadcaster.OpPing {
+			logger.Warn("could not send message", "request_id", msg.RequestID, "op", msg.Op,
+				"namespace", msg.Namespace, "key", msg.Key, "err", err)
+		}
+
+		switch {
+		case changed && err == nil:
+			logger.Info("node reachable")
+		case changed:
+			logger.Warn("node unreachable", "err", err)
+		}
+	}
+}
+
+// Probe pings every node, so that their status is known even when there are
+// no writes to send.
+func (r *Registry) Probe() {
+	r.Broadcast(broadcaster.Message{Op: broadcaster.OpPing})
+}
+
+// record updates the status of the node at addr after msg was sent to it,
+// reporting whether the node became reachable or unreachable. Only writes
+// count towards Sent and Missed.
+func (r *Registry) record(addr string, err error, msg broadcaster.Message) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.statuses == nil {
+		r.statuses = make(map[string]*PeerStatus)
+	}
+
+	s, ok := r.statuses[addr]
+	if !ok {
+		s = &PeerStatus{Address: addr}
+		r.statuses[addr] = s
+	}
+
+	write := msg.Op != broadcaster.OpPing
+	if write {
+		s.Sent++
+	}
+
+	changed := !ok || s.Reachable != (err == nil)
+
+	if err == nil {
+		s.Reachable = true
+		s.LastContact = time.Now()
+		s.LastError = ""
+		return changed
+	}
+
+	s.Reachable = false
+	s.LastError = err.Error()
+	s.Errors++
+
+	if write {
+		if s.missed == nil {
+			s.missed = make(map[string]*missedWrites)
+		}
+
+		m, ok := s.missed[msg.Namespace]
+		if !ok {
+			m = &missedWrites{first: time.Now()}
+			s.missed[msg.Namespace] = m
+		}
+		m.count++
+		m.last = time.Now()
+	}
+
+	return changed
+}
+
+// Synced records that the node at addr was found to hold the same values
+// in namespace as this node, as of asOf, so that the writes to namespace
+// it missed before then are no longer counted as missed. Writes it missed
+// after asOf may not have been held by this node when it was compared, so
+// they are kept.
+func (r *Registry) Synced(namespace string, addr string, asOf time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.statuses[addr]
+	if !ok {
+		return
+	}
+
+	if m, ok := s.missed[namespace]; ok && m.last.Before(asOf) {
+		delete(s.missed, namespace)
+	}
+}
+
+// Status returns the status of every node, in the order they were added.
+// Nodes that have not been sent anything yet are reported unreachable.
+func (r *Registry) Status() []PeerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := []PeerStatus{}
+
 	for _, node := range r.Nodes {
-		r.Broadcaster.SendMessage(key, value, node.Address)
+		s := PeerStatus{Address: node.Address}
+		if status, ok := r.statuses[node.Address]; ok {
+			s = *status
+		}
+
+		var oldest time.Time
+		for _, m := range s.missed {
+			s.Missed += m.count
+			if oldest.IsZero() || m.first.Before(oldest) {
+				oldest = m.first
+			}
+		}
+		if !oldest.IsZero() {
+			s.LagSeconds = time.Since(oldest).Seconds()
+		}
+		s.missed = nil
+
+		list = append(list, s)
 	}
+
+	return list
 }
 
 func New(addresses []string) *Registry {
@@ -1,17 +1,31 @@
 package registry
 
 import (
+	"errors"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/broadcaster"
 )
 
 type BroadcasterSpy struct {
 	noCalls int
+	down    map[string]bool
+	block   chan struct{}
 }
 
-func (b *BroadcasterSpy) SendMessage(key string, value string, addr string) error {
+func (b *BroadcasterSpy) SendMessage(msg broadcaster.Message, addr string) error {
 	b.noCalls = b.noCalls + 1
 
+	if b.block != nil {
+		<-b.block
+	}
+
+	if b.down[addr] {
+		return errors.New("connection refused")
+	}
+
 	return nil
 }
 
@@ -70,20 +84,20 @@ func TestAddNodeReturnsValue(t *testing.T) {
 
 func TestBroadcast(t *testing.T) {
 	t.Run("Test broadcast sends 1 message", func(t *testing.T) {
-		broadcaster := BroadcasterSpy{}
+		spy := BroadcasterSpy{}
 		r := &Registry{
 			Nodes: []Node{
 				{
 					Address: "127.0.0.1:4000",
 				},
 			},
-			Broadcaster: &broadcaster,
+			Broadcaster: &spy,
 		}
 
-		r.Broadcast("key", "val")
+		r.Broadcast(broadcaster.Message{Key: "key", Value: "val"})
 
 		expectedCalls := 1
-		got := broadcaster.noCalls
+		got := spy.noCalls
 
 		if got != expectedCalls {
 			t.Errorf("expected %d calls, got %d", expectedCalls, got)
@@ -91,7 +105,7 @@ func TestBroadcast(t *testing.T) {
 	})
 
 	t.Run("Test broadcast sends 2 messages", func(t *testing.T) {
-		broadcaster := BroadcasterSpy{}
+		spy := BroadcasterSpy{}
 		r := &Registry{
 			Nodes: []Node{
 				{
@@ -101,13 +115,13 @@ func TestBroadcast(t *testing.T) {
 					Address: "127.0.0.1:4002",
 				},
 			},
-			Broadcaster: &broadcaster,
+			Broadcaster: &spy,
 		}
 
-		r.Broadcast("key", "val")
+		r.Broadcast(broadcaster.Message{Key: "key", Value: "val"})
 
 		expectedCalls := 2
-		got := broadcaster.noCalls
+		got := spy.noCalls
 
 		if got != expectedCalls {
 			t.Errorf("expected %d calls, got %d", expectedCalls, got)
@@ -236,3 +250,124 @@ func TestGetNodes(t *testing.T) {
 		}
 	})
 }
+
+func TestStatus(t *testing.T) {
+	spy := BroadcasterSpy{down: map[string]bool{}}
+	r := New([]string{"127.0.0.1:4000", "127.0.0.1:4002"})
+	r.Broadcaster = &spy
+
+	t.Run("reports nodes not yet contacted as unreachable", func(t *testing.T) {
+		for _, s := range r.Status() {
+			if s.Reachable {
+				t.Errorf("got %+v, want unreachable", s)
+			}
+		}
+	})
+
+	t.Run("probe marks nodes reachable without counting writes", func(t *testing.T) {
+		r.Probe()
+
+		for _, s := range r.Status() {
+			if !s.Reachable || s.LastContact.IsZero() || s.Sent != 0 {
+				t.Errorf("got %+v, want reachable with no writes", s)
+			}
+		}
+	})
+
+	t.Run("counts writes missed by an unreachable node", func(t *testing.T) {
+		spy.down["127.0.0.1:4002"] = true
+
+		r.Broadcast(broadcaster.Message{Key: "key", Value: "val"})
+		r.Broadcast(broadcaster.Message{Key: "key", Value: "val"})
+		r.Probe()
+
+		status := r.Status()
+
+		if up := status[0]; !up.Reachable || up.Sent != 2 || up.Missed != 0 {
+			t.Errorf("got %+v, want reachable with 2 writes sent", up)
+		}
+
+		down := status[1]
+		if down.Reachable || down.Errors != 3 || down.Missed != 2 || down.LastError != "connection refused" || down.LagSeconds <= 0 {
+			t.Errorf("got %+v, want unreachable with 2 missed writes", down)
+		}
+	})
+
+	t.Run("keeps missed writes once reached", func(t *testing.T) {
+		spy.down["127.0.0.1:4002"] = false
+
+		r.Probe()
+		r.Broadcast(broadcaster.Message{Key: "key", Value: "val"})
+
+		if s := r.Status()[1]; !s.Reachable || s.Missed != 2 || s.LagSeconds <= 0 || s.Errors != 3 {
+			t.Errorf("got %+v, want reachable with 2 missed writes", s)
+		}
+	})
+
+	t.Run("clears missed writes once synced", func(t *testing.T) {
+		spy.down["127.0.0.1:4002"] = true
+		r.Broadcast(broadcaster.Message{Namespace: "team-a", Key: "key", Value: "val"})
+		spy.down["127.0.0.1:4002"] = false
+
+		r.Synced("team-a", "127.0.0.1:4002", time.Now().Add(-time.Hour))
+		if s := r.Status()[1]; s.Missed != 3 {
+			t.Errorf("got %+v, want writes missed after the sync to be kept", s)
+		}
+
+		r.Synced("", "127.0.0.1:4002", time.Now())
+		if s := r.Status()[1]; s.Missed != 1 || s.LagSeconds <= 0 {
+			t.Errorf("got %+v, want the write missed in team-a to be kept", s)
+		}
+
+		r.Synced("team-a", "127.0.0.1:4002", time.Now())
+		if s := r.Status()[1]; s.Missed != 0 || s.LagSeconds != 0 {
+			t.Errorf("got %+v, want no missed writes", s)
+		}
+	})
+}
+
+func TestSetNodes(t *testing.T) {
+	spy := BroadcasterSpy{down: map[string]bool{}}
+	r := New([]string{"127.0.0.1:4000", "127.0.0.1:4002"})
+	r.Broadcaster = &spy
+
+	r.Broadcast(broadcaster.Message{Key: "key", Value: "val"})
+	r.SetNodes([]string{"127.0.0.1:4002", "127.0.0.1:4004"})
+
+	want := []Node{{Address: "127.0.0.1:4002"}, {Address: "127.0.0.1:4004"}}
+	if got := r.GetNodes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	status := r.Status()
+	if status[0].Sent != 1 || status[1].Sent != 0 {
+		t.Errorf("got %+v, want status of kept node carried over", status)
+	}
+}
+
+func TestWait(t *testing.T) {
+	spy := BroadcasterSpy{block: make(chan struct{})}
+	r := New([]string{"127.0.0.1:4000"})
+	r.Broadcaster = &spy
+
+	done := make(chan struct{})
+	go func() {
+		r.Broadcast(broadcaster.Message{Key: "key", Value: "val"})
+		close(done)
+	}()
+
+	for r.Wait(0) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if r.Wait(20 * time.Millisecond) {
+		t.Errorf("Wait returned true while a message was being sent")
+	}
+
+	close(spy.block)
+	<-done
+
+	if !r.Wait(time.Second) {
+		t.Errorf("Wait returned false after messages were sent")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/config"
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/namespace"
+	"github.com/wolakec/makhzen/registry"
+	"github.com/wolakec/makhzen/server"
+	"github.com/wolakec/makhzen/store"
+)
+
+// shutdownTimeout is how long requests and messages being sent are given
+// to finish when the node is stopped.
+const shutdownTimeout = 30 * time.Second
+
+// apply changes the running node to use the settings of c that can be
+// changed while it runs: the other nodes, the log level and the limits,
+// both of st and of the namespaces that do not set their own.
+func apply(c config.Config, logger *logging.Logger, st *store.Store, namespaces *namespace.Manager, r *registry.Registry) error {
+	level, err := logging.ParseLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	policy, err := store.PolicyByName(c.Eviction)
+	if err != nil {
+		return err
+	}
+
+	logger.SetLevel(level)
+	limits := store.Limits{
+		MaxKeys:  c.MaxKeys,
+		MaxBytes: c.MaxMemory,
+		Policy:   policy,
+	}
+	st.SetLimits(limits)
+	namespaces.SetLimits(limits)
+	r.SetNodes(c.Cluster)
+
+	return nil
+}
+
+// waitForSignals calls reload on SIGHUP, and returns on SIGTERM or SIGINT.
+func waitForSignals(logger *logging.Logger, reload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			reload()
+			continue
+		}
+
+		logger.Info("stopping", "signal", sig)
+		return
+	}
+}
+
+// shutdown stops the node: it stops accepting connections, waits for the
+// requests and Redis and memcached commands being served and the messages
+// being sent to other nodes to finish, or for shutdownTimeout to pass,
+// closes the streams to other nodes and saves a last snapshot to dataDir
+// when it is set.
+func shutdown(logger *logging.Logger, s *server.MakhzenServer, r *registry.Registry, peers *broadcaster.Broadcaster, servers []*http.Server, dataDir string) {
+	s.Drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Warn("could not finish serving requests", "addr", srv.Addr, "err", err)
+		}
+	}
+
+	deadline, _ := ctx.Deadline()
+	if !s.WaitForConns(time.Until(deadline)) {
+		logger.Warn("could not finish serving redis and memcached clients")
+	}
+	if !r.Wait(time.Until(deadline)) {
+		logger.Warn("could not finish sending messages to other nodes")
+	}
+	peers.Close()
+
+	if dataDir != "" {
+		saveSnapshot(logger, s, dataDir)
+	}
+
+	logger.Info("stopped")
+}
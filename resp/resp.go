@@ -0,0 +1,198 @@
+// Package resp reads commands and writes replies in the Redis serialization
+// protocol, RESP2 and RESP3.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits on the commands read, so that a client cannot make the server
+// allocate without bound.
+const (
+	MaxArgs       = 1024 * 1024
+	MaxBulkLength = 512 * 1024 * 1024
+	maxLineLength = 64 * 1024
+)
+
+var ErrProtocol = errors.New("protocol error")
+
+// Reader reads commands sent by a client.
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// ReadCommand reads the next command, either an array of bulk strings or
+// an inline command of space separated words. Empty inline commands are
+// skipped.
+func (r *Reader) ReadCommand() ([]string, error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if line[0] != '*' {
+			if args := strings.Fields(line); len(args) > 0 {
+				return args, nil
+			}
+			continue
+		}
+
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > MaxArgs {
+			return nil, ErrProtocol
+		}
+
+		if n <= 0 {
+			continue
+		}
+
+		args := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			arg, err := r.readBulk()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+
+		return args, nil
+	}
+}
+
+// Buffered reports whether more of a command has been received, so that
+// replies to pipelined commands can be sent together.
+func (r *Reader) Buffered() bool {
+	return r.r.Buffered() > 0
+}
+
+func (r *Reader) readBulk() (string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return "", err
+	}
+
+	if len(line) == 0 || line[0] != '$' {
+		return "", ErrProtocol
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > MaxBulkLength {
+		return "", ErrProtocol
+	}
+
+	b := make([]byte, n+2)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return "", err
+	}
+
+	if b[n] != '\r' || b[n+1] != '\n' {
+		return "", ErrProtocol
+	}
+
+	return string(b[:n]), nil
+}
+
+// readLine reads a line ending in \r\n, or \n for inline commands typed by
+// hand, without its ending.
+func (r *Reader) readLine() (string, error) {
+	var line []byte
+
+	for {
+		b, more, err := r.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+
+		line = append(line, b...)
+		if len(line) > maxLineLength {
+			return "", ErrProtocol
+		}
+
+		if !more {
+			return string(line), nil
+		}
+	}
+}
+
+// Writer writes replies to a client. Proto is the protocol version the
+// client asked for with HELLO, 2 unless it asked for 3; it decides how
+// nulls and maps are written.
+type Writer struct {
+	Proto int
+
+	w *bufio.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{Proto: 2, w: bufio.NewWriter(w)}
+}
+
+func (w *Writer) SimpleString(s string) {
+	w.line('+', s)
+}
+
+// Error writes an error reply. msg starts with an error code, such as ERR
+// or WRONGTYPE.
+func (w *Writer) Error(msg string) {
+	w.line('-', strings.NewReplacer("\r", " ", "\n", " ").Replace(msg))
+}
+
+func (w *Writer) Integer(n int64) {
+	w.line(':', strconv.FormatInt(n, 10))
+}
+
+func (w *Writer) Bulk(s string) {
+	w.line('$', strconv.Itoa(len(s)))
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+// Null writes a missing value.
+func (w *Writer) Null() {
+	if w.Proto >= 3 {
+		w.w.WriteString("_\r\n")
+		return
+	}
+
+	w.w.WriteString("$-1\r\n")
+}
+
+// Array starts an array of n elements, to be written next.
+func (w *Writer) Array(n int) {
+	w.line('*', strconv.Itoa(n))
+}
+
+// Map starts a map of n keys each followed by its value, to be written
+// next. Clients using RESP2 are sent an array of the keys and values.
+func (w *Writer) Map(n int) {
+	if w.Proto >= 3 {
+		w.line('%', strconv.Itoa(n))
+		return
+	}
+
+	w.Array(2 * n)
+}
+
+// Flush sends the replies written so far.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+func (w *Writer) line(prefix byte, s string) {
+	w.w.WriteByte(prefix)
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
@@ -0,0 +1,77 @@
+package resp
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	t.Run("reads arrays and inline commands", func(t *testing.T) {
+		r := NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$6\r\nregion\r\n$8\r\neu\r\nwest\r\n\r\nPING  hello\n*0\r\nGET region\r\n"))
+
+		want := [][]string{
+			{"SET", "region", "eu\r\nwest"},
+			{"PING", "hello"},
+			{"GET", "region"},
+		}
+
+		for _, w := range want {
+			got, err := r.ReadCommand()
+			if err != nil {
+				t.Fatalf("ReadCommand returned error: %s", err)
+			}
+
+			if !reflect.DeepEqual(got, w) {
+				t.Errorf("got %q, want %q", got, w)
+			}
+		}
+
+		if _, err := r.ReadCommand(); err != io.EOF {
+			t.Errorf("got %v, want EOF", err)
+		}
+	})
+
+	for _, input := range []string{
+		"*1\r\n:3\r\n",
+		"*1\r\n$3\r\nGETX\r\n",
+		"*x\r\n",
+		"*1\r\n$-1\r\n",
+	} {
+		t.Run("rejects "+strings.Replace(input, "\r\n", " ", -1), func(t *testing.T) {
+			if _, err := NewReader(strings.NewReader(input)).ReadCommand(); err != ErrProtocol {
+				t.Errorf("got %v, want %v", err, ErrProtocol)
+			}
+		})
+	}
+}
+
+func TestWriter(t *testing.T) {
+	write := func(proto int) string {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.Proto = proto
+
+		w.SimpleString("OK")
+		w.Error("ERR bad\r\nthing")
+		w.Integer(-3)
+		w.Bulk("eu")
+		w.Null()
+		w.Map(1)
+		w.Bulk("proto")
+		w.Integer(int64(proto))
+		w.Flush()
+
+		return buf.String()
+	}
+
+	if got, want := write(2), "+OK\r\n-ERR bad  thing\r\n:-3\r\n$2\r\neu\r\n$-1\r\n*2\r\n$5\r\nproto\r\n:2\r\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got, want := write(3), "+OK\r\n-ERR bad  thing\r\n:-3\r\n$2\r\neu\r\n_\r\n%1\r\n$5\r\nproto\r\n:3\r\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Rule grants read and/or write access to the keys starting with Prefix in
+// Namespace. An empty Namespace is the default namespace and "*" matches
+// every namespace.
+type Rule struct {
+	Namespace string `json:"namespace"`
+	Prefix    string `json:"prefix"`
+	Read      bool   `json:"read"`
+	Write     bool   `json:"write"`
+}
+
+// Role is a set of rules. Admin roles can do anything, including managing
+// nodes and namespaces.
+type Role struct {
+	Admin bool   `json:"admin"`
+	Rules []Rule `json:"rules"`
+}
+
+// ACL maps bearer tokens to the roles they hold. It is read from a JSON
+// file of the form:
+//
+//	{
+//		"roles": {
+//			"ops": {"admin": true},
+//			"reader": {"rules": [{"prefix": "config/", "read": true}]}
+//		},
+//		"tokens": {"s3cr3t": ["reader"]}
+//	}
+type ACL struct {
+	Roles  map[string]Role     `json:"roles"`
+	Tokens map[string][]string `json:"tokens"`
+}
+
+// LoadACL reads an ACL from the file at path.
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var acl ACL
+	if err := json.NewDecoder(f).Decode(&acl); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+
+	if err := acl.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &acl, nil
+}
+
+// Validate checks that no token is empty and that every role given to a
+// token exists.
+func (a *ACL) Validate() error {
+	for token, roles := range a.Tokens {
+		if token == "" {
+			return fmt.Errorf("tokens must not be empty")
+		}
+
+		for _, role := range roles {
+			if _, ok := a.Roles[role]; !ok {
+				return fmt.Errorf("unknown role %s", role)
+			}
+		}
+	}
+
+	return nil
+}
+
+// access is what a request needs to be allowed. A gRPC call to the
+// Makhzen service only needs to be authenticated to be served, as the keys
+// it needs access to are named in its messages and checked by the call.
+type access struct {
+	admin     bool
+	write     bool
+	rpc       bool
+	namespace string
+	key       string
+}
+
+func (r Rule) allows(a access) bool {
+	if (a.write && !r.Write) || (!a.write && !r.Read) {
+		return false
+	}
+
+	if r.Namespace != "*" && r.Namespace != a.namespace {
+		return false
+	}
+
+	return strings.HasPrefix(a.key, r.Prefix)
+}
+
+// roles returns the roles of token, comparing it with every known token in
+// constant time so that how long a check takes does not reveal how much of
+// a token was right.
+func (a *ACL) roles(token string) ([]string, bool) {
+	var (
+		roles []string
+		found bool
+	)
+	for t, r := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			roles, found = r, true
+		}
+	}
+
+	return roles, found
+}
+
+// authenticated reports whether token is known.
+func (a *ACL) authenticated(token string) bool {
+	_, ok := a.roles(token)
+	return ok
+}
+
+// allows reports whether token holds a role granting a.
+func (a *ACL) allows(token string, acc access) bool {
+	roles, _ := a.roles(token)
+	for _, name := range roles {
+		role := a.Roles[name]
+
+		if role.Admin {
+			return true
+		}
+
+		if acc.admin {
+			continue
+		}
+
+		for _, rule := range role.Rules {
+			if rule.allows(acc) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// publicRoutes are the paths served without a token, so that load
+// balancers and orchestrators can check a node.
+var publicRoutes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// requiredAccess returns the access r needs. Routes it does not know of,
+// including those that do not exist, need an admin token.
+func requiredAccess(r *http.Request) access {
+	path := r.URL.Path
+	write := r.Method != http.MethodGet && r.Method != http.MethodHead
+
+	switch {
+	case strings.HasPrefix(path, "/items/"):
+		return access{write: write, key: path[len("/items/"):]}
+	case strings.HasPrefix(path, "/incr/"), strings.HasPrefix(path, "/decr/"):
+		return access{write: true, key: path[len("/incr/"):]}
+	case strings.HasPrefix(path, "/ns/"):
+		parts := strings.SplitN(path[len("/ns/"):], "/", 3)
+		if len(parts) == 2 && parts[1] == "watch" {
+			return access{namespace: parts[0], key: watched(r)}
+		}
+		if len(parts) == 3 {
+			return access{write: write || parts[1] != "items", namespace: parts[0], key: parts[2]}
+		}
+	case path == "/watch":
+		return access{key: watched(r)}
+	case strings.HasPrefix(path, makhzenService):
+		return access{rpc: true}
+	}
+
+	return access{admin: true}
+}
+
+// watched returns the key or prefix a watch request is for. A rule covers
+// a watched prefix when its own prefix is a prefix of it, which is the same
+// check as for a single key.
+func watched(r *http.Request) string {
+	q := r.URL.Query()
+	if q.Get("key") != "" {
+		return q.Get("key")
+	}
+
+	return q.Get("prefix")
+}
+
+// withAuth checks the bearer token of every request other than those to
+// publicRoutes against s.ACL, when one is set, before passing it to next.
+func (s *MakhzenServer) withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.ACL == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if publicRoutes[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		acc := requiredAccess(r)
+		token := bearerToken(r)
+
+		if !s.ACL.authenticated(token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="makhzen"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		if !acc.rpc && !s.ACL.allows(token, acc) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(h[len("Bearer "):])
+}
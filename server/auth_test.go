@@ -0,0 +1,162 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wolakec/makhzen/namespace"
+)
+
+const testACL = `{
+	"roles": {
+		"ops": {"admin": true},
+		"reader": {"rules": [{"prefix": "config/", "read": true}]},
+		"writer": {"rules": [{"prefix": "config/", "read": true, "write": true}]},
+		"team-a": {"rules": [{"namespace": "team-a", "read": true, "write": true}]}
+	},
+	"tokens": {
+		"ops-token": ["ops"],
+		"reader-token": ["reader"],
+		"writer-token": ["writer"],
+		"team-a-token": ["team-a"]
+	}
+}`
+
+func newAuthServer(t *testing.T) *MakhzenServer {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "acl.json")
+	ioutil.WriteFile(path, []byte(testACL), 0600)
+
+	acl, err := LoadACL(path)
+	if err != nil {
+		t.Fatalf("LoadACL returned error: %s", err)
+	}
+
+	server, _ := newNamespaceServer()
+	server.ACL = acl
+	server.Namespaces.Create(namespace.Settings{Name: "team-a"})
+
+	return server
+}
+
+func TestAuth(t *testing.T) {
+	server := newAuthServer(t)
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		token  string
+		want   int
+	}{
+		{"GET item without token", http.MethodGet, "/items/config/region", "", "", http.StatusUnauthorized},
+		{"GET item with unknown token", http.MethodGet, "/items/config/region", "", "nope", http.StatusUnauthorized},
+		{"GET item with token prefix", http.MethodGet, "/items/config/region", "", "reader", http.StatusUnauthorized},
+		{"GET item with reader", http.MethodGet, "/items/config/region", "", "reader-token", http.StatusNotFound},
+		{"GET item outside prefix", http.MethodGet, "/items/secret", "", "reader-token", http.StatusForbidden},
+		{"PUT item with reader", http.MethodPut, "/items/config/region", `{"value": "europe"}`, "reader-token", http.StatusForbidden},
+		{"PUT item with writer", http.MethodPut, "/items/config/region", `{"value": "europe"}`, "writer-token", http.StatusAccepted},
+		{"POST item with writer", http.MethodPost, "/items/config/zones", `{"op": "add", "element": "a"}`, "writer-token", http.StatusOK},
+		{"DELETE item with reader", http.MethodDelete, "/items/config/region", "", "reader-token", http.StatusForbidden},
+		{"DELETE item with writer", http.MethodDelete, "/items/config/region", "", "writer-token", http.StatusNoContent},
+		{"POST incr with reader", http.MethodPost, "/incr/config/hits", "", "reader-token", http.StatusForbidden},
+		{"POST decr with writer", http.MethodPost, "/decr/config/hits", "", "writer-token", http.StatusOK},
+		{"PUT namespace item with team", http.MethodPut, "/ns/team-a/items/region", `{"value": "europe"}`, "team-a-token", http.StatusAccepted},
+		{"PUT namespace item with writer", http.MethodPut, "/ns/team-a/items/config/region", `{"value": "europe"}`, "writer-token", http.StatusForbidden},
+		{"PUT default item with team", http.MethodPut, "/items/region", `{"value": "europe"}`, "team-a-token", http.StatusForbidden},
+		{"POST namespace incr with team", http.MethodPost, "/ns/team-a/incr/hits", "", "team-a-token", http.StatusOK},
+		{"GET watch outside prefix", http.MethodGet, "/watch?prefix=", "", "reader-token", http.StatusForbidden},
+		{"GET nodes with writer", http.MethodGet, "/nodes", "", "writer-token", http.StatusForbidden},
+		{"GET nodes with admin", http.MethodGet, "/nodes", "", "ops-token", http.StatusOK},
+		{"POST nodes with team", http.MethodPost, "/nodes", "", "team-a-token", http.StatusForbidden},
+		{"POST message without token", http.MethodPost, "/message", `{"key": "a", "value": "b"}`, "", http.StatusUnauthorized},
+		{"POST message with writer", http.MethodPost, "/message", `{"key": "a", "value": "b"}`, "writer-token", http.StatusForbidden},
+		{"POST message with admin", http.MethodPost, "/message", `{"key": "a", "value": "b"}`, "ops-token", http.StatusOK},
+		{"GET stats with reader", http.MethodGet, "/admin/stats", "", "reader-token", http.StatusForbidden},
+		{"GET stats with admin", http.MethodGet, "/admin/stats", "", "ops-token", http.StatusOK},
+		{"GET unknown route without token", http.MethodGet, "/unknown", "", "", http.StatusUnauthorized},
+		{"GET unknown route with reader", http.MethodGet, "/unknown", "", "reader-token", http.StatusForbidden},
+		{"GET unknown route with admin", http.MethodGet, "/unknown", "", "ops-token", http.StatusNotFound},
+		{"GET namespace route with team", http.MethodGet, "/ns/team-a", "", "team-a-token", http.StatusForbidden},
+		{"GET namespace watch outside namespace", http.MethodGet, "/ns/team-a/watch?prefix=config/", "", "reader-token", http.StatusForbidden},
+		{"GET metrics with reader", http.MethodGet, "/metrics", "", "reader-token", http.StatusForbidden},
+		{"GET healthz without token", http.MethodGet, "/healthz", "", "", http.StatusOK},
+		{"GET readyz without token", http.MethodGet, "/readyz", "", "", http.StatusServiceUnavailable},
+		{"GET cluster status with reader", http.MethodGet, "/cluster/status", "", "reader-token", http.StatusForbidden},
+		{"GET cluster status with admin", http.MethodGet, "/cluster/status", "", "ops-token", http.StatusOK},
+		{"POST namespaces with team", http.MethodPost, "/admin/namespaces", `{"name": "team-b"}`, "team-a-token", http.StatusForbidden},
+		{"POST namespaces with admin", http.MethodPost, "/admin/namespaces", `{"name": "team-b"}`, "ops-token", http.StatusCreated},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			request, _ := http.NewRequest(c.method, c.path, strings.NewReader(c.body))
+			request.Header.Set("Content-Type", "application/json")
+			if c.token != "" {
+				request.Header.Set("Authorization", "Bearer "+c.token)
+			}
+
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertStatus(t, response.Code, c.want)
+
+			if c.want == http.StatusUnauthorized && response.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("expected WWW-Authenticate header on 401")
+			}
+		})
+	}
+}
+
+func TestPeerHandlerAuth(t *testing.T) {
+	server := newAuthServer(t)
+
+	cases := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"without token", "", http.StatusUnauthorized},
+		{"with writer", "writer-token", http.StatusForbidden},
+		{"with admin", "ops-token", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/message", strings.NewReader(`{"key": "a", "value": "b"}`))
+			if c.token != "" {
+				request.Header.Set("Authorization", "Bearer "+c.token)
+			}
+
+			response := httptest.NewRecorder()
+			server.PeerHandler.ServeHTTP(response, request)
+
+			assertStatus(t, response.Code, c.want)
+		})
+	}
+}
+
+func TestLoadACLRejectsUnknownRole(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "acl")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "acl.json")
+	ioutil.WriteFile(path, []byte(`{"roles": {}, "tokens": {"t": ["missing"]}}`), 0600)
+
+	if _, err := LoadACL(path); err == nil {
+		t.Errorf("expected error for unknown role")
+	}
+}
@@ -0,0 +1,369 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/store"
+)
+
+// DumpFormat and DumpVersion identify a dump written by GET /admin/export.
+const (
+	DumpFormat  = "makhzen-dump"
+	DumpVersion = 1
+)
+
+// maxImportErrors is the most errors an import reports by key.
+const maxImportErrors = 100
+
+// importSenders is how many of the values imported with ?replicate=true
+// are sent to the other nodes at a time.
+const importSenders = 8
+
+// DumpHeader is the first line of a dump. It is followed by Entries lines,
+// each a store.Entry, so that a dump cut short can be told apart from a
+// complete one.
+type DumpHeader struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	Namespace  string    `json:"namespace,omitempty"`
+	ExportedAt time.Time `json:"exportedAt"`
+	Entries    int       `json:"entries"`
+}
+
+// ImportResult summarises an import: how many entries were imported, how
+// many were skipped as expired or, when merging, no newer than the values
+// held, and the errors for those that failed, by key.
+type ImportResult struct {
+	Entries  int               `json:"entries"`
+	Imported int               `json:"imported"`
+	Skipped  int               `json:"skipped"`
+	Failed   int               `json:"failed"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
+
+// exportHandler streams every value in the default namespace, or the one
+// given by ?ns=, as it was when the request was received, as newline
+// delimited JSON: a DumpHeader followed by one store.Entry per line.
+func (s *MakhzenServer) exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ks, ok := s.adminKeyspace(w, r.URL.Query().Get("ns"))
+	if !ok {
+		return
+	}
+
+	span := s.storeSpan(r.Context(), ks, "export", "")
+	header, entries, err := dump(ks)
+	span.SetError(err)
+	span.End()
+
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", dumpName(header)))
+
+	if err := writeDump(w, header, entries); err != nil {
+		s.logger(r).Warn("export cut short", "namespace", ks.name, "err", err)
+		return
+	}
+
+	s.logger(r).Info("exported items", "namespace", ks.name, "entries", len(entries))
+}
+
+// dump returns every value in ks, as it is now, and the header of a dump
+// of them.
+func dump(ks keyspace) (DumpHeader, []store.Entry, error) {
+	digests, err := digestStore(ks.store)
+	if err != nil {
+		return DumpHeader{}, nil, err
+	}
+	entries := digests.Export()
+
+	return DumpHeader{
+		Format:     DumpFormat,
+		Version:    DumpVersion,
+		Namespace:  ks.name,
+		ExportedAt: time.Now().UTC(),
+		Entries:    len(entries),
+	}, entries, nil
+}
+
+// writeDump writes header and entries to w as newline delimited JSON.
+func writeDump(w io.Writer, header DumpHeader, entries []store.Entry) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+func dumpName(h DumpHeader) string {
+	name := "makhzen"
+	if h.Namespace != "" {
+		name += "-" + h.Namespace
+	}
+
+	return name + "-" + h.ExportedAt.Format("20060102T150405Z") + ".ndjson"
+}
+
+// importHandler loads a dump written by exportHandler into the default
+// namespace, or the one given by ?ns=. The whole dump is read before any
+// of it is loaded, so a dump that is cut short or not valid changes
+// nothing. With ?mode=merge values are merged rather than replaced, as
+// described by store.Import, and with ?replicate=true the values imported
+// are sent to the other nodes once the dump is loaded.
+//
+// Replacing values writes them anew, so they are stamped with when they
+// were imported rather than when they were last written. Otherwise the
+// other nodes, and consistency checks, would order them before the writes
+// they replaced and keep those.
+func (s *MakhzenServer) importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ks, ok := s.adminKeyspace(w, r.URL.Query().Get("ns"))
+	if !ok {
+		return
+	}
+
+	var merge bool
+	switch r.URL.Query().Get("mode") {
+	case "", "replace":
+	case "merge":
+		merge = true
+	default:
+		http.Error(w, "mode must be replace or merge", http.StatusBadRequest)
+		return
+	}
+	replicate := r.URL.Query().Get("replicate") == "true"
+
+	entries, err := readDump(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := ImportResult{Entries: len(entries)}
+	importedAt := time.Now()
+
+	var imported []store.Entry
+
+	span := s.storeSpan(r.Context(), ks, "import", "")
+	for _, e := range entries {
+		if !merge {
+			e = restamp(e, importedAt)
+		}
+
+		ok, err := ks.store.Import(e, merge)
+		switch {
+		case err != nil:
+			result.Failed++
+			if len(result.Errors) < maxImportErrors {
+				if result.Errors == nil {
+					result.Errors = make(map[string]string)
+				}
+				result.Errors[e.Key] = err.Error()
+			}
+			continue
+		case !ok:
+			result.Skipped++
+			continue
+		}
+
+		result.Imported++
+
+		if replicate {
+			imported = append(imported, e)
+		}
+	}
+	span.End()
+
+	s.sendImported(r.Context(), ks, imported)
+
+	s.logger(r).Info("imported items", "namespace", ks.name, "merge", merge, "replicate", replicate,
+		"entries", result.Entries, "imported", result.Imported, "skipped", result.Skipped, "failed", result.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// restamp returns e as it is written by an import made at t, which
+// replaces the value held rather than merging with it.
+func restamp(e store.Entry, t time.Time) store.Entry {
+	e.Modified = t
+	if e.State != nil {
+		e.Since = &t
+	}
+
+	return e
+}
+
+// sendImported sends the entries an import loaded to the other nodes
+// replicating ks, importSenders at a time, and waits for them to be sent.
+// Each key is imported once, so sending them out of order cannot reorder
+// the writes to a key.
+func (s *MakhzenServer) sendImported(ctx context.Context, ks keyspace, entries []store.Entry) {
+	pending := make(chan store.Entry)
+
+	var wg sync.WaitGroup
+	for i := 0; i < importSenders && i < len(entries); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range pending {
+				s.broadcast(ctx, ks, entryMessage(e))
+			}
+		}()
+	}
+
+	for _, e := range entries {
+		pending <- e
+	}
+	close(pending)
+
+	wg.Wait()
+}
+
+// readDump reads the entries of a dump, checking that it is complete.
+func readDump(r io.Reader) ([]store.Entry, error) {
+	dec := json.NewDecoder(r)
+
+	var header DumpHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("could not read dump header: %s", err)
+	}
+
+	if header.Format != DumpFormat || header.Version != DumpVersion {
+		return nil, fmt.Errorf("not a %s version %d dump", DumpFormat, DumpVersion)
+	}
+
+	entries := make([]store.Entry, 0, header.Entries)
+	for {
+		var e store.Entry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read entry %d: %s", len(entries)+1, err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	if len(entries) != header.Entries {
+		return nil, fmt.Errorf("dump has %d of its %d entries", len(entries), header.Entries)
+	}
+
+	return entries, nil
+}
+
+// entryMessage returns the message replicating e, stamped with when it was
+// written so that other nodes order it among their own writes to its key.
+func entryMessage(e store.Entry) broadcaster.Message {
+	msg := broadcaster.Message{
+		Key:         e.Key,
+		Type:        e.Type,
+		Value:       e.Value,
+		Data:        e.Data,
+		ContentType: e.ContentType,
+		Flags:       e.Flags,
+		Timestamp:   timestamp(e.Modified),
+	}
+
+	if e.Deleted {
+		msg.Op = broadcaster.OpDelete
+		return msg
+	}
+
+	if e.State != nil {
+		msg.Op = broadcaster.OpMerge
+		msg.State = e.State
+		if e.Since != nil {
+			msg.Since = timestamp(*e.Since)
+		}
+		return msg
+	}
+
+	msg.Op = broadcaster.OpPut
+	if e.ExpiresAt != nil {
+		msg.TTL = ttlSeconds(time.Until(*e.ExpiresAt))
+	}
+
+	return msg
+}
+
+// messageEntry returns the entry written by a message from another node,
+// as of when the write was made there. Messages from nodes that do not
+// stamp them are written as if they were made now.
+func messageEntry(msg broadcaster.Message) store.Entry {
+	e := store.Entry{
+		Key:         msg.Key,
+		Type:        msg.Type,
+		Value:       msg.Value,
+		Data:        msg.Data,
+		ContentType: msg.ContentType,
+		Flags:       msg.Flags,
+		State:       msg.State,
+		Modified:    time.Now(),
+	}
+
+	if msg.Timestamp != 0 {
+		e.Modified = time.Unix(0, msg.Timestamp)
+	}
+	if msg.Since != 0 {
+		since := time.Unix(0, msg.Since)
+		e.Since = &since
+	}
+
+	switch msg.Op {
+	case broadcaster.OpDelete:
+		e.Deleted = true
+	case broadcaster.OpMerge:
+	default:
+		if e.Type == "" {
+			e.Type = store.TypeString
+		}
+		if msg.TTL > 0 {
+			expiresAt := time.Now().Add(time.Duration(msg.TTL) * time.Second)
+			e.ExpiresAt = &expiresAt
+		}
+	}
+
+	return e
+}
+
+// timestamp returns t in the nanoseconds since the Unix epoch a Message
+// carries, or zero when t is not set.
+func timestamp(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/namespace"
+	"github.com/wolakec/makhzen/store"
+)
+
+func exportDump(t *testing.T, server *MakhzenServer, query string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	request, _ := http.NewRequest(http.MethodGet, "/admin/export"+query, nil)
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+
+	return response
+}
+
+func importDump(t *testing.T, server *MakhzenServer, query string, dump string) (*httptest.ResponseRecorder, ImportResult) {
+	t.Helper()
+
+	request, _ := http.NewRequest(http.MethodPost, "/admin/import"+query, strings.NewReader(dump))
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+
+	var result ImportResult
+	json.Unmarshal(response.Body.Bytes(), &result)
+
+	return response, result
+}
+
+func TestExport(t *testing.T) {
+	st := store.New()
+	st.SetWithTTL("region", "eu-west-1", time.Hour)
+	st.Incr("visits", 3)
+	server := NewMakhzenServer(st, &StubRegistry{})
+
+	response := exportDump(t, server, "")
+	assertStatus(t, response.Code, http.StatusOK)
+
+	if ct := response.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("got content type %q", ct)
+	}
+
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want a header and 2 entries:\n%s", len(lines), response.Body)
+	}
+
+	var header DumpHeader
+	json.Unmarshal([]byte(lines[0]), &header)
+	if header.Format != DumpFormat || header.Version != DumpVersion || header.Entries != 2 {
+		t.Errorf("got header %+v", header)
+	}
+
+	var e store.Entry
+	json.Unmarshal([]byte(lines[1]), &e)
+	if e.Key != "region" || e.Value != "eu-west-1" || e.ExpiresAt == nil {
+		t.Errorf("got entry %+v", e)
+	}
+
+	t.Run("exports a namespace", func(t *testing.T) {
+		server.Namespaces = namespace.New()
+		n, _ := server.Namespaces.Create(namespace.Settings{Name: "team-a"})
+		n.Store.Set("owner", "ops")
+
+		response := exportDump(t, server, "?ns=team-a")
+		if !strings.Contains(response.Body.String(), `"namespace":"team-a"`) || !strings.Contains(response.Body.String(), `"key":"owner"`) {
+			t.Errorf("got %s", response.Body)
+		}
+
+		assertStatus(t, exportDump(t, server, "?ns=team-b").Code, http.StatusNotFound)
+	})
+}
+
+func TestImport(t *testing.T) {
+	src := store.New()
+	src.SetWithTTL("region", "eu-west-1", time.Hour)
+	src.SetContent("logo", "\x89PNG", "image/png", 0)
+	src.Incr("visits", 3)
+	dump := exportDump(t, NewMakhzenServer(src, &StubRegistry{}), "").Body.String()
+
+	t.Run("loads a dump", func(t *testing.T) {
+		dst := store.New()
+		reg := &StubRegistry{}
+		server := NewMakhzenServer(dst, reg)
+
+		response, result := importDump(t, server, "", dump)
+		assertStatus(t, response.Code, http.StatusOK)
+
+		if !reflect.DeepEqual(result, ImportResult{Entries: 3, Imported: 3}) {
+			t.Errorf("got %+v", result)
+		}
+
+		if item, _ := dst.GetItem("logo"); item.Value != "\x89PNG" || item.ContentType != "image/png" {
+			t.Errorf("got %+v", item)
+		}
+
+		if len(reg.messages) != 0 {
+			t.Errorf("replicated %d messages without being asked to", len(reg.messages))
+		}
+	})
+
+	t.Run("replicates a dump", func(t *testing.T) {
+		reg := &StubRegistry{}
+		server := NewMakhzenServer(store.New(), reg)
+
+		before := time.Now().UnixNano()
+		importDump(t, server, "?replicate=true", dump)
+
+		if len(reg.messages) != 3 {
+			t.Fatalf("got %d messages, want 3", len(reg.messages))
+		}
+
+		sent := make(map[string]broadcaster.Message)
+		for _, msg := range reg.messages {
+			sent[msg.Key] = msg
+			if msg.Timestamp < before {
+				t.Errorf("%s was sent stamped %d, before it was imported", msg.Key, msg.Timestamp)
+			}
+		}
+
+		logo, region, visits := sent["logo"], sent["region"], sent["visits"]
+		if visits.Since < before {
+			t.Errorf("visits was sent created at %d, before it was imported", visits.Since)
+		}
+		if logo.Op != broadcaster.OpPut || !bytes.Equal(logo.Data, []byte("\x89PNG")) || logo.ContentType != "image/png" {
+			t.Errorf("got %+v", logo)
+		}
+		if region.Op != broadcaster.OpPut || region.Value != "eu-west-1" || region.TTL != 3600 {
+			t.Errorf("got %+v", region)
+		}
+		if visits.Op != broadcaster.OpMerge || visits.Type != store.TypeCounter || len(visits.State) == 0 {
+			t.Errorf("got %+v", visits)
+		}
+	})
+
+	t.Run("replicates a merged dump as it was written", func(t *testing.T) {
+		reg := &StubRegistry{}
+		server := NewMakhzenServer(store.New(), reg)
+
+		importDump(t, server, "?mode=merge&replicate=true", dump)
+
+		if len(reg.messages) != 3 {
+			t.Fatalf("got %d messages, want 3", len(reg.messages))
+		}
+
+		for _, msg := range reg.messages {
+			written := src.ExportKeys([]string{msg.Key})[0].Modified.UnixNano()
+			if msg.Timestamp != written {
+				t.Errorf("%s was sent stamped %d, want %d", msg.Key, msg.Timestamp, written)
+			}
+		}
+	})
+
+	t.Run("merges a dump", func(t *testing.T) {
+		dst := store.New()
+		server := NewMakhzenServer(dst, &StubRegistry{})
+		importDump(t, server, "", dump)
+		dst.Set("region", "us-east-1")
+
+		_, result := importDump(t, server, "?mode=merge", dump)
+		if !reflect.DeepEqual(result, ImportResult{Entries: 3, Skipped: 3}) {
+			t.Errorf("got %+v", result)
+		}
+
+		if v, _ := dst.GetValue("region"); v != "us-east-1" {
+			t.Errorf("merge replaced a newer value with %q", v)
+		}
+	})
+
+	t.Run("reports entries that fail", func(t *testing.T) {
+		server := NewMakhzenServer(store.New(), &StubRegistry{})
+		bad := `{"format":"makhzen-dump","version":1,"entries":2}
+{"key":"a","type":"int","value":"three","modified":"2019-01-01T00:00:00Z"}
+{"key":"b","type":"string","value":"ok","modified":"2019-01-01T00:00:00Z"}
+`
+
+		_, result := importDump(t, server, "", bad)
+		if result.Imported != 1 || result.Failed != 1 || result.Errors["a"] != store.ErrInvalidValue.Error() {
+			t.Errorf("got %+v", result)
+		}
+	})
+
+	t.Run("rejects dumps that are not complete", func(t *testing.T) {
+		dst := store.New()
+		server := NewMakhzenServer(dst, &StubRegistry{})
+
+		cases := []string{
+			"",
+			"not json",
+			`{"format":"other","version":1,"entries":0}`,
+			dump[:strings.LastIndex(strings.TrimSpace(dump), "\n")],
+			dump + "{",
+		}
+
+		for _, c := range cases {
+			response, _ := importDump(t, server, "", c)
+			assertStatus(t, response.Code, http.StatusBadRequest)
+		}
+
+		if keys := dst.Keys(); len(keys) != 0 {
+			t.Errorf("a rejected dump loaded %v", keys)
+		}
+	})
+
+	t.Run("rejects an unknown mode", func(t *testing.T) {
+		server := NewMakhzenServer(store.New(), &StubRegistry{})
+
+		response, _ := importDump(t, server, "?mode=append", dump)
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+}
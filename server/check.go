@@ -0,0 +1,495 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/wolakec/makhzen/store"
+)
+
+// localNode names the node a check is run on in its report.
+const localNode = "local"
+
+// Checks compare defaultCheckRanges ranges of keys unless told otherwise,
+// and report at most maxCheckDifferences keys.
+const (
+	defaultCheckRanges  = 64
+	maxCheckRanges      = 4096
+	maxCheckDifferences = 1000
+)
+
+var errNoPeers = errors.New("requests to other nodes are not enabled")
+
+// PeerRequester sends requests to the routes nodes serve for each other,
+// other than /message. It is implemented by *broadcaster.Broadcaster.
+type PeerRequester interface {
+	Request(ctx context.Context, addr string, path string, body interface{}, v interface{}) error
+}
+
+// DigestRequest is the body of a request to /cluster/digest. It asks for
+// the digest of each of Ranges ranges of the keys in Namespace or, when
+// Keys is set, the version of every key in the ranges it lists.
+type DigestRequest struct {
+	Namespace string `json:"namespace,omitempty"`
+	Ranges    int    `json:"ranges"`
+	Keys      []int  `json:"keys,omitempty"`
+}
+
+// DigestResponse is the body of a response from /cluster/digest.
+type DigestResponse struct {
+	Ranges []store.RangeDigest `json:"ranges,omitempty"`
+	Keys   []store.KeyVersion  `json:"keys,omitempty"`
+}
+
+// RepairRequest is the body of a request to /cluster/repair, asking a node
+// to send the values it holds at Keys to the other nodes.
+type RepairRequest struct {
+	Namespace string   `json:"namespace,omitempty"`
+	Keys      []string `json:"keys"`
+}
+
+// RepairResponse is the body of a response from /cluster/repair.
+type RepairResponse struct {
+	Sent int `json:"sent"`
+}
+
+// CheckReport is the body of a response from /admin/check. The cluster is
+// Consistent when every node was checked and no key differs between them.
+// Differences lists at most the first 1000 of the DifferingKeys, by key.
+// Repaired counts the keys whose values were sent to other nodes to repair
+// them.
+type CheckReport struct {
+	Namespace       string          `json:"namespace,omitempty"`
+	CheckedAt       time.Time       `json:"checkedAt"`
+	Consistent      bool            `json:"consistent"`
+	Ranges          int             `json:"ranges"`
+	DifferingRanges int             `json:"differingRanges"`
+	DifferingKeys   int             `json:"differingKeys"`
+	Repaired        int             `json:"repaired"`
+	Nodes           []NodeCheck     `json:"nodes"`
+	Differences     []KeyDifference `json:"differences"`
+}
+
+// NodeCheck reports on one node in a check. Error is set when the node
+// could not be checked or repaired.
+type NodeCheck struct {
+	Node  string `json:"node"`
+	Keys  int    `json:"keys"`
+	Error string `json:"error,omitempty"`
+}
+
+// KeyDifference is a key that is not the same on every node checked: the
+// version each node holding it or its tombstone has, and the nodes missing
+// it.
+type KeyDifference struct {
+	Key      string        `json:"key"`
+	Versions []NodeVersion `json:"versions"`
+	Missing  []string      `json:"missing,omitempty"`
+}
+
+// NodeVersion is the version of a key held by Node. Deleted is set when
+// Node holds the tombstone of the key.
+type NodeVersion struct {
+	Node     string    `json:"node"`
+	Type     string    `json:"type"`
+	Version  string    `json:"version"`
+	Modified time.Time `json:"modified"`
+	Deleted  bool      `json:"deleted,omitempty"`
+}
+
+// checkHandler compares the values held by this node and every node it
+// replicates to, in the default namespace or the one given by ?ns=. A POST
+// also repairs the keys that differ.
+func (s *MakhzenServer) checkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ks, ok := s.adminKeyspace(w, r.URL.Query().Get("ns"))
+	if !ok {
+		return
+	}
+
+	if !ks.replicated {
+		http.Error(w, "namespace is not replicated", http.StatusBadRequest)
+		return
+	}
+
+	ranges := defaultCheckRanges
+	if v := r.URL.Query().Get("ranges"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxCheckRanges {
+			http.Error(w, fmt.Sprintf("ranges must be between 1 and %d", maxCheckRanges), http.StatusBadRequest)
+			return
+		}
+		ranges = n
+	}
+
+	report, differences := s.check(r.Context(), ks, ranges)
+	if r.Method == http.MethodPost {
+		s.repair(r.Context(), ks, &report, differences)
+	}
+
+	failed := 0
+	for _, n := range report.Nodes {
+		if n.Error != "" {
+			failed++
+		}
+	}
+
+	if s.Metrics != nil {
+		s.Metrics.Gauge("makhzen_check_differing_keys", "Keys that differed between nodes at the last consistency check, by namespace.", "namespace").
+			With(ks.name).Set(float64(report.DifferingKeys))
+		s.Metrics.Gauge("makhzen_check_failed_nodes", "Nodes that could not be checked or repaired at the last consistency check, by namespace.", "namespace").
+			With(ks.name).Set(float64(failed))
+		s.Metrics.Gauge("makhzen_check_timestamp_seconds", "When the last consistency check was run, by namespace.", "namespace").
+			With(ks.name).Set(float64(report.CheckedAt.Unix()))
+	}
+
+	s.logger(r).Info("checked consistency", "namespace", ks.name, "nodes", len(report.Nodes), "failed", failed,
+		"differing_ranges", report.DifferingRanges, "differing_keys", report.DifferingKeys, "repaired", report.Repaired)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// check compares ks on this node and every node it replicates to. Only the
+// ranges whose digests differ are compared key by key. It returns every
+// key that differs, as well as the report listing the first of them.
+func (s *MakhzenServer) check(ctx context.Context, ks keyspace, ranges int) (CheckReport, []KeyDifference) {
+	report := CheckReport{
+		Namespace:   ks.name,
+		CheckedAt:   time.Now().UTC(),
+		Ranges:      ranges,
+		Differences: []KeyDifference{},
+	}
+
+	nodes := []string{localNode}
+	for _, n := range s.Registry.GetNodes() {
+		nodes = append(nodes, n.Address)
+	}
+
+	// Nodes are only compared while they answer.
+	digests := make(map[string][]store.RangeDigest)
+	report.Nodes = make([]NodeCheck, len(nodes))
+
+	for i, node := range nodes {
+		report.Nodes[i].Node = node
+
+		resp, err := s.requestDigest(ctx, ks, node, DigestRequest{Namespace: ks.name, Ranges: ranges})
+		if err == nil && len(resp.Ranges) != ranges {
+			err = fmt.Errorf("node returned %d ranges, want %d", len(resp.Ranges), ranges)
+		}
+		if err != nil {
+			report.Nodes[i].Error = err.Error()
+			continue
+		}
+
+		digests[node] = resp.Ranges
+		for _, d := range resp.Ranges {
+			report.Nodes[i].Keys += d.Keys
+		}
+	}
+
+	s.recordSynced(ks, report.CheckedAt, digests)
+
+	var differing []int
+	for r := 0; r < ranges; r++ {
+		var first *store.RangeDigest
+		for _, node := range nodes {
+			d, ok := digests[node]
+			if !ok {
+				continue
+			}
+
+			if first == nil {
+				first = &d[r]
+			} else if d[r] != *first {
+				differing = append(differing, r)
+				break
+			}
+		}
+	}
+	report.DifferingRanges = len(differing)
+
+	if len(differing) == 0 {
+		report.Consistent = len(digests) == len(nodes)
+		return report, nil
+	}
+
+	held := make(map[string]map[string]store.KeyVersion)
+	for i, node := range nodes {
+		if _, ok := digests[node]; !ok {
+			continue
+		}
+
+		resp, err := s.requestDigest(ctx, ks, node, DigestRequest{Namespace: ks.name, Ranges: ranges, Keys: differing})
+		if err != nil {
+			report.Nodes[i].Error = err.Error()
+			delete(digests, node)
+			continue
+		}
+
+		for _, v := range resp.Keys {
+			if held[v.Key] == nil {
+				held[v.Key] = make(map[string]store.KeyVersion)
+			}
+			held[v.Key][node] = v
+		}
+	}
+
+	keys := make([]string, 0, len(held))
+	for key := range held {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var differences []KeyDifference
+	for _, key := range keys {
+		d := KeyDifference{Key: key}
+		same, deleted := true, true
+
+		for _, node := range nodes {
+			if _, ok := digests[node]; !ok {
+				continue
+			}
+
+			v, ok := held[key][node]
+			if !ok {
+				d.Missing = append(d.Missing, node)
+				continue
+			}
+
+			if len(d.Versions) > 0 && d.Versions[0].Version != v.Version {
+				same = false
+			}
+			deleted = deleted && v.Deleted
+			d.Versions = append(d.Versions, NodeVersion{Node: node, Type: v.Type, Version: v.Version, Modified: v.Modified, Deleted: v.Deleted})
+		}
+
+		// A key deleted on some nodes is the same on those that have
+		// already dropped its tombstone, or never held it.
+		if deleted || (same && len(d.Missing) == 0) {
+			continue
+		}
+
+		differences = append(differences, d)
+		if len(report.Differences) < maxCheckDifferences {
+			report.Differences = append(report.Differences, d)
+		}
+	}
+
+	report.DifferingKeys = len(differences)
+	report.Consistent = len(differences) == 0 && len(digests) == len(nodes)
+
+	return report, differences
+}
+
+// requestDigest sends req to node, answering it directly when node is this
+// one.
+func (s *MakhzenServer) requestDigest(ctx context.Context, ks keyspace, node string, req DigestRequest) (DigestResponse, error) {
+	if node == localNode {
+		return digest(ks, req)
+	}
+
+	if s.Peers == nil {
+		return DigestResponse{}, errNoPeers
+	}
+
+	var resp DigestResponse
+	err := s.Peers.Request(ctx, node, "/cluster/digest", req, &resp)
+
+	return resp, err
+}
+
+func digest(ks keyspace, req DigestRequest) (DigestResponse, error) {
+	digests, err := digestStore(ks.store)
+	if err != nil {
+		return DigestResponse{}, err
+	}
+
+	if len(req.Keys) > 0 {
+		return DigestResponse{Keys: digests.Versions(req.Ranges, req.Keys)}, nil
+	}
+
+	return DigestResponse{Ranges: digests.Digests(req.Ranges)}, nil
+}
+
+// repair has the nodes holding the right value of each key that differs
+// send it to the other nodes, as they would send a write.
+func (s *MakhzenServer) repair(ctx context.Context, ks keyspace, report *CheckReport, differences []KeyDifference) {
+	sources := make(map[string][]string)
+	for _, d := range differences {
+		for _, node := range repairSources(d) {
+			sources[node] = append(sources[node], d.Key)
+		}
+	}
+
+	repaired := make(map[string]bool)
+	for i := range report.Nodes {
+		n := &report.Nodes[i]
+
+		keys := sources[n.Node]
+		if len(keys) == 0 {
+			continue
+		}
+
+		if err := s.requestRepair(ctx, ks, n.Node, keys); err != nil {
+			n.Error = "could not repair: " + err.Error()
+			continue
+		}
+
+		for _, key := range keys {
+			repaired[key] = true
+		}
+	}
+
+	report.Repaired = len(repaired)
+}
+
+// recordSynced tells the registry which nodes hold the same values in ks
+// as this node, going by their digests, so that the writes they missed
+// before the check began are no longer counted as missed.
+func (s *MakhzenServer) recordSynced(ks keyspace, asOf time.Time, digests map[string][]store.RangeDigest) {
+	local, ok := digests[localNode]
+	if !ok {
+		return
+	}
+
+	for node, d := range digests {
+		if node != localNode && sameDigests(d, local) {
+			s.Registry.Synced(ks.name, node, asOf)
+		}
+	}
+}
+
+func sameDigests(a []store.RangeDigest, b []store.RangeDigest) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// repairSources returns the nodes that send the right value of a key that
+// differs. The last write to the key wins, as it does when nodes apply
+// writes, whether it wrote a value or deleted the key, and is sent by the
+// node holding it. When the value is of a replicated type, every node
+// holding that type sends its state, as merging the states converges.
+func repairSources(d KeyDifference) []string {
+	latest := d.Versions[0]
+	for _, v := range d.Versions[1:] {
+		if v.Modified.After(latest.Modified) || (v.Modified.Equal(latest.Modified) && v.Version > latest.Version) {
+			latest = v
+		}
+	}
+
+	switch latest.Type {
+	case store.TypeCounter, store.TypeSet, store.TypeMap, store.TypeRegister:
+		var nodes []string
+		for _, v := range d.Versions {
+			if v.Type == latest.Type {
+				nodes = append(nodes, v.Node)
+			}
+		}
+		return nodes
+	}
+
+	return []string{latest.Node}
+}
+
+// requestRepair asks node to send its values at keys to the other nodes,
+// sending them directly when node is this one.
+func (s *MakhzenServer) requestRepair(ctx context.Context, ks keyspace, node string, keys []string) error {
+	if node == localNode {
+		s.sendEntries(ctx, ks, keys)
+		return nil
+	}
+
+	if s.Peers == nil {
+		return errNoPeers
+	}
+
+	var resp RepairResponse
+	return s.Peers.Request(ctx, node, "/cluster/repair", RepairRequest{Namespace: ks.name, Keys: keys}, &resp)
+}
+
+// sendEntries sends the values at keys, or their tombstones, to the other
+// nodes, returning how many were sent.
+func (s *MakhzenServer) sendEntries(ctx context.Context, ks keyspace, keys []string) int {
+	entries := ks.store.ExportKeys(keys)
+	for _, e := range entries {
+		s.broadcast(ctx, ks, entryMessage(e))
+	}
+
+	return len(entries)
+}
+
+func (s *MakhzenServer) digestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req DigestRequest
+	if !s.readPeerBody(w, r, s.logger(r).With("node", r.RemoteAddr), &req) {
+		return
+	}
+
+	if req.Ranges < 1 || req.Ranges > maxCheckRanges {
+		http.Error(w, fmt.Sprintf("ranges must be between 1 and %d", maxCheckRanges), http.StatusBadRequest)
+		return
+	}
+
+	ks, ok := s.adminKeyspace(w, req.Namespace)
+	if !ok {
+		return
+	}
+
+	resp, err := digest(ks, req)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *MakhzenServer) repairHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger := s.logger(r).With("node", r.RemoteAddr)
+
+	var req RepairRequest
+	if !s.readPeerBody(w, r, logger, &req) {
+		return
+	}
+
+	ks, ok := s.adminKeyspace(w, req.Namespace)
+	if !ok {
+		return
+	}
+
+	sent := s.sendEntries(r.Context(), ks, req.Keys)
+	logger.Info("sent values to repair", "namespace", ks.name, "keys", len(req.Keys), "sent", sent)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RepairResponse{Sent: sent})
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/namespace"
+	"github.com/wolakec/makhzen/registry"
+	"github.com/wolakec/makhzen/store"
+)
+
+// newCheckCluster starts n nodes that replicate to each other, signing
+// their messages and requests with a cluster secret.
+func newCheckCluster(n int) ([]*MakhzenServer, []*httptest.Server) {
+	secret := []byte("cluster-secret")
+	servers := make([]*MakhzenServer, n)
+	nodes := make([]*httptest.Server, n)
+
+	for i := range nodes {
+		i := i
+		nodes[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			servers[i].ServeHTTP(w, r)
+		}))
+	}
+
+	for i := range servers {
+		var others []string
+		for j, node := range nodes {
+			if j != i {
+				others = append(others, node.URL)
+			}
+		}
+
+		b := &broadcaster.Broadcaster{Secret: secret}
+		reg := registry.New(others)
+		reg.Broadcaster = b
+
+		st := store.New()
+		st.NodeID = fmt.Sprintf("node-%d", i)
+
+		s := NewMakhzenServer(st, reg)
+		s.Peers = b
+		s.Verifier = broadcaster.NewVerifier(secret, time.Minute)
+		s.Logger = logging.New(ioutil.Discard, logging.Info)
+		servers[i] = s
+	}
+
+	return servers, nodes
+}
+
+func runCheck(t *testing.T, server *MakhzenServer, method string, query string) CheckReport {
+	t.Helper()
+
+	request, _ := http.NewRequest(method, "/admin/check"+query, nil)
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	assertStatus(t, response.Code, http.StatusOK)
+
+	var report CheckReport
+	if err := json.Unmarshal(response.Body.Bytes(), &report); err != nil {
+		t.Fatalf("could not decode report: %s", err)
+	}
+
+	return report
+}
+
+func TestCheck(t *testing.T) {
+	servers, nodes := newCheckCluster(3)
+	for _, node := range nodes {
+		defer node.Close()
+	}
+
+	stores := make([]*store.Store, len(servers))
+	for i, s := range servers {
+		stores[i] = s.Store.(*store.Store)
+		stores[i].Set("region", "eu-west-1")
+		stores[i].Set("zone", "eu-west-1a")
+	}
+
+	t.Run("reports a consistent cluster", func(t *testing.T) {
+		report := runCheck(t, servers[0], http.MethodGet, "?ranges=8")
+
+		if !report.Consistent || report.Ranges != 8 || report.DifferingRanges != 0 || len(report.Differences) != 0 {
+			t.Errorf("got %+v", report)
+		}
+
+		if len(report.Nodes) != 3 || report.Nodes[0].Node != localNode || report.Nodes[1].Node != nodes[1].URL {
+			t.Fatalf("got nodes %+v", report.Nodes)
+		}
+		for _, n := range report.Nodes {
+			if n.Keys != 2 || n.Error != "" {
+				t.Errorf("got %+v", n)
+			}
+		}
+	})
+
+	t.Run("reports the keys that differ", func(t *testing.T) {
+		stores[1].Delete("zone")
+		stores[2].Set("region", "us-east-1")
+
+		report := runCheck(t, servers[0], http.MethodGet, "")
+
+		if report.Consistent || report.Ranges != defaultCheckRanges || report.DifferingKeys != 2 || len(report.Differences) != 2 {
+			t.Fatalf("got %+v", report)
+		}
+
+		region, zone := report.Differences[0], report.Differences[1]
+		if region.Key != "region" || len(region.Versions) != 3 || len(region.Missing) != 0 {
+			t.Errorf("got %+v", region)
+		} else if region.Versions[0].Version != region.Versions[1].Version || region.Versions[0].Version == region.Versions[2].Version {
+			t.Errorf("got versions %+v", region.Versions)
+		}
+
+		if zone.Key != "zone" || len(zone.Versions) != 3 || len(zone.Missing) != 0 || !zone.Versions[1].Deleted {
+			t.Errorf("got %+v", zone)
+		}
+	})
+
+	t.Run("repairs the keys that differ", func(t *testing.T) {
+		// Counters are repaired by merging the state of every node.
+		stores[0].Incr("visits", 2)
+		stores[2].Incr("visits", 3)
+
+		report := runCheck(t, servers[0], http.MethodPost, "")
+		if report.DifferingKeys != 3 || report.Repaired != 3 {
+			t.Fatalf("got %+v", report)
+		}
+
+		if report := runCheck(t, servers[1], http.MethodGet, ""); !report.Consistent {
+			t.Fatalf("got %+v after repairing", report)
+		}
+
+		for i, st := range stores {
+			if v, _ := st.GetValue("region"); v != "us-east-1" {
+				t.Errorf("node %d has region %q, want the value last written", i, v)
+			}
+			if v, _ := st.GetValue("visits"); v != "5" {
+				t.Errorf("node %d has visits %q, want 5", i, v)
+			}
+			if _, ok := st.GetValue("zone"); ok {
+				t.Errorf("node %d still has zone, want the delete to win", i)
+			}
+		}
+	})
+
+	t.Run("reports nodes that cannot be checked", func(t *testing.T) {
+		st := store.New()
+		server := NewMakhzenServer(st, registry.New([]string{nodes[1].URL}))
+
+		report := runCheck(t, server, http.MethodGet, "")
+		if report.Consistent || report.Nodes[1].Error != errNoPeers.Error() {
+			t.Errorf("got %+v", report)
+		}
+
+		server.Peers = &broadcaster.Broadcaster{}
+		report = runCheck(t, server, http.MethodGet, "")
+		if report.Consistent || !strings.Contains(report.Nodes[1].Error, broadcaster.ErrUnsigned.Error()) {
+			t.Errorf("got %+v", report)
+		}
+	})
+
+	t.Run("rejects bad requests", func(t *testing.T) {
+		server := NewMakhzenServer(store.New(), &StubRegistry{})
+		server.Namespaces = namespace.New()
+		server.Namespaces.Create(namespace.Settings{Name: "scratch", Replication: namespace.ReplicateNone})
+
+		for _, query := range []string{"?ranges=0", "?ranges=x", "?ranges=100000", "?ns=scratch"} {
+			request, _ := http.NewRequest(http.MethodGet, "/admin/check"+query, nil)
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+			assertStatus(t, response.Code, http.StatusBadRequest)
+		}
+
+		request, _ := http.NewRequest(http.MethodGet, "/admin/check?ns=missing", nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		assertStatus(t, response.Code, http.StatusNotFound)
+	})
+}
+
+func TestCheckClearsMissedWrites(t *testing.T) {
+	servers, nodes := newCheckCluster(2)
+	for _, node := range nodes {
+		defer node.Close()
+	}
+	missed := func() uint64 {
+		return servers[0].Registry.Status()[0].Missed
+	}
+
+	servers[1].Verifier = broadcaster.NewVerifier([]byte("other-secret"), time.Minute)
+	servers[0].ServeHTTP(httptest.NewRecorder(), newPutValueRequest("region", "eu-west-1"))
+	servers[1].Verifier = broadcaster.NewVerifier([]byte("cluster-secret"), time.Minute)
+
+	servers[0].ServeHTTP(httptest.NewRecorder(), newPutValueRequest("zone", "eu-west-1a"))
+	if got := missed(); got != 1 {
+		t.Fatalf("got %d missed writes once the node was reached again, want 1", got)
+	}
+
+	t.Run("keeps writes the node does not hold", func(t *testing.T) {
+		runCheck(t, servers[0], http.MethodGet, "")
+
+		if got := missed(); got != 1 {
+			t.Errorf("got %d missed writes, want 1", got)
+		}
+	})
+
+	t.Run("clears writes the node holds once repaired", func(t *testing.T) {
+		runCheck(t, servers[0], http.MethodPost, "")
+		runCheck(t, servers[0], http.MethodGet, "")
+
+		if got := missed(); got != 0 {
+			t.Errorf("got %d missed writes, want 0", got)
+		}
+	})
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/store"
+	"github.com/wolakec/makhzen/tracing"
+)
+
+// The Redis and memcached listeners serve the default namespace through
+// the operations in this file, which apply a write to the store and
+// replicate it as the HTTP API does.
+
+// acceptUntilDrained passes every connection accepted on l to serve, until
+// the server is drained, counting the connections being served for
+// WaitForConns.
+func (s *MakhzenServer) acceptUntilDrained(l net.Listener, serve func(conn net.Conn)) error {
+	go func() {
+		<-s.draining
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.draining:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		atomic.AddInt64(&s.conns, 1)
+		go func() {
+			defer atomic.AddInt64(&s.conns, -1)
+			serve(conn)
+		}()
+	}
+}
+
+// WaitForConns blocks until every Redis and memcached connection has been
+// closed, or until timeout has passed, reporting whether they all were.
+// Once the server is drained, connections close when the command they are
+// running has finished.
+func (s *MakhzenServer) WaitForConns(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for atomic.LoadInt64(&s.conns) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+// interruptOnDrain interrupts waiting for the next command on conn when
+// the server is drained, but lets the command being run finish. The
+// returned function stops it once conn is done with.
+func (s *MakhzenServer) interruptOnDrain(conn net.Conn) func() {
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-s.draining:
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// commandContext returns the context for a command called name, carrying
+// a request ID and a span that must be ended once the command has run.
+func (s *MakhzenServer) commandContext(name string) (context.Context, *tracing.Span) {
+	id := logging.NewRequestID()
+	ctx := logging.NewContext(context.Background(), s.Logger.With("request_id", id), id)
+
+	return s.Tracer.Start(ctx, name)
+}
+
+// valueType is the type a value is stored as: a string unless it is not
+// valid UTF-8, in which case it is replicated as bytes so that it survives
+// JSON encoding unchanged.
+func valueType(v string) string {
+	if utf8.ValidString(v) {
+		return store.TypeString
+	}
+
+	return store.TypeBytes
+}
+
+// putValue stores value under key with flags when key meets cond, and
+// replicates it.
+func (s *MakhzenServer) putValue(ctx context.Context, key string, value string, flags uint32, ttl time.Duration, cond store.Condition) (store.Item, error) {
+	ks := s.defaultKeyspace()
+	typ := valueType(value)
+
+	span := s.storeSpan(ctx, ks, broadcaster.OpPut, key)
+	item, err := s.Store.SetIf(key, value, typ, flags, ttl, cond)
+	if err != store.ErrPresent && err != store.ErrMissing && err != store.ErrChanged {
+		span.SetError(err)
+	}
+	span.End()
+
+	if err != nil {
+		return item, err
+	}
+
+	logging.FromContext(ctx, s.Logger).Info("put item", "namespace", ks.name, "key", key, "type", typ, "value", logging.Value(value))
+
+	s.replicate(ctx, ks, key)
+
+	return item, nil
+}
+
+// deleteKey deletes key and replicates the deletion, reporting whether key
+// was present.
+func (s *MakhzenServer) deleteKey(ctx context.Context, key string) bool {
+	ks := s.defaultKeyspace()
+
+	span := s.storeSpan(ctx, ks, broadcaster.OpDelete, key)
+	ok := s.Store.Delete(key)
+	span.End()
+
+	if !ok {
+		return false
+	}
+
+	logging.FromContext(ctx, s.Logger).Info("deleted item", "namespace", ks.name, "key", key)
+
+	s.replicate(ctx, ks, key)
+
+	return true
+}
+
+// incrKey adds delta to the counter at key and replicates it, returning the
+// new total.
+func (s *MakhzenServer) incrKey(ctx context.Context, key string, delta int64) (int64, error) {
+	var v int64
+
+	err := s.changeCounter(ctx, key, delta, func(crdts CRDTStore) (string, store.PNCounter, error) {
+		n, entries, err := crdts.Incr(key, delta)
+		v = n
+		return strconv.FormatInt(n, 10), entries, err
+	})
+
+	return v, err
+}
+
+// incrUnsigned adds delta to, or with decr subtracts it from, the unsigned
+// counter at key as memcached does, and replicates it, returning the new
+// total.
+func (s *MakhzenServer) incrUnsigned(ctx context.Context, key string, delta uint64, decr bool) (uint64, error) {
+	var v uint64
+
+	change := interface{}(delta)
+	if decr {
+		change = "-" + strconv.FormatUint(delta, 10)
+	}
+
+	err := s.changeCounter(ctx, key, change, func(crdts CRDTStore) (string, store.PNCounter, error) {
+		n, entries, err := crdts.IncrUnsigned(key, delta, decr)
+		v = n
+		return strconv.FormatUint(n, 10), entries, err
+	})
+
+	return v, err
+}
+
+// changeCounter applies incr, which changes the counter at key by delta
+// and returns its new total and entries, and replicates the entries.
+func (s *MakhzenServer) changeCounter(ctx context.Context, key string, delta interface{}, incr func(crdts CRDTStore) (string, store.PNCounter, error)) error {
+	ks := s.defaultKeyspace()
+
+	crdts, err := crdtStore(s.Store)
+	if err != nil {
+		return err
+	}
+
+	span := s.storeSpan(ctx, ks, "incr", key)
+	v, entries, err := incr(crdts)
+	span.SetError(err)
+	span.End()
+
+	if err != nil {
+		return err
+	}
+
+	state, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx, s.Logger).Info("updated counter", "namespace", ks.name, "key", key, "delta", delta, "value", logging.Value(v))
+
+	s.replicateDelta(ctx, ks, broadcaster.Message{
+		Op:    broadcaster.OpMerge,
+		Key:   key,
+		Type:  store.TypeCounter,
+		State: state,
+	})
+
+	return nil
+}
+
+// expireKey sets the TTL of key, or removes its expiry when ttl is zero,
+// and replicates it, reporting whether key was present.
+func (s *MakhzenServer) expireKey(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	ks := s.defaultKeyspace()
+
+	ttls, err := ttlStore(s.Store)
+	if err != nil {
+		return false, err
+	}
+
+	span := s.storeSpan(ctx, ks, broadcaster.OpExpire, key)
+	ok := ttls.Expire(key, ttl)
+	span.End()
+
+	if !ok {
+		return false, nil
+	}
+
+	logging.FromContext(ctx, s.Logger).Info("expired item", "namespace", ks.name, "key", key, "ttl", ttl)
+
+	s.broadcast(ctx, ks, broadcaster.Message{
+		Op:  broadcaster.OpExpire,
+		Key: key,
+		TTL: ttlSeconds(ttl),
+	})
+
+	return true, nil
+}
+
+// ttlSeconds rounds ttl up to the whole seconds replicated to other nodes.
+func ttlSeconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// countCommand records a command received by the listener for protocol,
+// and whether it ran or was rejected.
+func (s *MakhzenServer) countCommand(protocol string, name string, ran bool) {
+	if s.Metrics == nil {
+		return
+	}
+
+	result := "ok"
+	if !ran {
+		result = "error"
+	}
+
+	s.Metrics.Counter("makhzen_"+protocol+"_commands_total", "Commands received over the "+protocol+" protocol.", "command", "result").With(name, result).Inc()
+}
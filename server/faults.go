@@ -0,0 +1,18 @@
+package server
+
+import "net/http"
+
+// faultsHandler serves the rules of s.Faults, so that faults can be
+// injected into the messages this node sends while testing a cluster.
+func (s *MakhzenServer) faultsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Faults == nil {
+		http.Error(w, "fault injection is not enabled on this node", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		s.logger(r).Warn("changed injected faults", "method", r.Method)
+	}
+
+	s.Faults.ServeHTTP(w, r)
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wolakec/makhzen/faults"
+)
+
+func TestFaults(t *testing.T) {
+	server := NewMakhzenServer(&StubItemStore{map[string]string{}}, &StubRegistry{})
+
+	t.Run("is not served unless enabled", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/admin/faults", nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusNotFound)
+	})
+
+	t.Run("sets the rules of the transport", func(t *testing.T) {
+		server.Faults = &faults.Transport{}
+		defer func() { server.Faults = nil }()
+
+		request, _ := http.NewRequest(http.MethodPut, "/admin/faults", strings.NewReader(`{"*": {"cut": true}}`))
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		if !server.Faults.Status().Rules[faults.All].Cut {
+			t.Errorf("got %+v", server.Faults.Status())
+		}
+	})
+}
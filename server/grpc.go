@@ -0,0 +1,511 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/proto"
+	"github.com/wolakec/makhzen/store"
+	"github.com/wolakec/makhzen/watch"
+)
+
+// The gRPC services of makhzen.proto are served over the HTTP/2 the
+// listeners speak when they serve TLS, framed and encoded by package proto.
+
+// makhzenService is the path prefix of the calls of the Makhzen service.
+const makhzenService = "/makhzen.Makhzen/"
+
+// rpcMessage is a message of makhzen.proto.
+type rpcMessage interface {
+	Marshal() []byte
+	Unmarshal(b []byte) error
+}
+
+// rpcCall reads the messages of a gRPC call and writes its response: the
+// messages it sends and then its status.
+type rpcCall struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	started bool
+}
+
+// newRPCCall returns the gRPC call r makes, writing an error and returning
+// false when r is not one.
+func newRPCCall(w http.ResponseWriter, r *http.Request) (*rpcCall, bool) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC needs HTTP/2, which is only served over TLS", http.StatusHTTPVersionNotSupported)
+		return nil, false
+	}
+
+	ct := r.Header.Get("Content-Type")
+	if ct != proto.ContentType && !strings.HasPrefix(ct, proto.ContentType+"+") && !strings.HasPrefix(ct, proto.ContentType+";") {
+		http.Error(w, "content type must be "+proto.ContentType, http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	return &rpcCall{w: w, r: r}, true
+}
+
+// start writes the headers of the response, if they have not been.
+func (c *rpcCall) start() {
+	if c.started {
+		return
+	}
+	c.started = true
+
+	c.w.Header().Set("Content-Type", proto.ContentType)
+	c.w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	c.w.WriteHeader(http.StatusOK)
+	c.flush()
+}
+
+func (c *rpcCall) flush() {
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// receive reads the next message of the call into m, returning io.EOF
+// once the caller has sent every message.
+func (c *rpcCall) receive(m rpcMessage) error {
+	b, err := proto.ReadFrame(c.r.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := m.Unmarshal(b); err != nil {
+		return proto.Errorf(proto.InvalidArgument, "%s", err)
+	}
+
+	return nil
+}
+
+// send writes m as the next message of the response.
+func (c *rpcCall) send(m rpcMessage) error {
+	c.start()
+
+	if _, err := c.w.Write(proto.Frame(m.Marshal())); err != nil {
+		return err
+	}
+	c.flush()
+
+	return nil
+}
+
+// finish ends the call with the status of err, which is OK when err is
+// nil. A call that fails before sending a message has its status sent in
+// the headers alone.
+func (c *rpcCall) finish(err error) {
+	status := rpcStatus(err)
+
+	if !c.started {
+		c.started = true
+		c.w.Header().Set("Content-Type", proto.ContentType)
+		proto.SetStatus(c.w.Header(), status)
+		c.w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	proto.SetStatus(c.w.Header(), status)
+}
+
+// unary serves a call that takes one message into req and answers with
+// the one message handle returns.
+func (c *rpcCall) unary(req rpcMessage, handle func() (rpcMessage, error)) {
+	err := c.receive(req)
+	if err == io.EOF {
+		err = proto.Errorf(proto.InvalidArgument, "no request was sent")
+	}
+	if err != nil {
+		c.finish(err)
+		return
+	}
+
+	resp, err := handle()
+	if err == nil {
+		err = c.send(resp)
+	}
+
+	c.finish(err)
+}
+
+// rpcStatus returns the status a call that failed with err ends with.
+func rpcStatus(err error) proto.Status {
+	switch err {
+	case nil:
+		return proto.Status{Code: proto.OK}
+	case errUnknownNamespace, errNamespacesDisabled, store.ErrMissing:
+		return proto.Status{Code: proto.NotFound, Message: err.Error()}
+	case store.ErrInvalidValue, store.ErrUnknownType:
+		return proto.Status{Code: proto.InvalidArgument, Message: err.Error()}
+	case store.ErrWrongType, store.ErrNotInteger:
+		return proto.Status{Code: proto.FailedPrecondition, Message: err.Error()}
+	case store.ErrFull:
+		return proto.Status{Code: proto.ResourceExhausted, Message: err.Error()}
+	case watch.ErrCompacted:
+		return proto.Status{Code: proto.OutOfRange, Message: err.Error()}
+	}
+
+	if s, ok := err.(*proto.Status); ok {
+		return *s
+	}
+
+	return proto.Status{Code: proto.Internal, Message: err.Error()}
+}
+
+// rpcHandler serves the calls of the Makhzen service.
+func (s *MakhzenServer) rpcHandler(w http.ResponseWriter, r *http.Request) {
+	call, ok := newRPCCall(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.URL.Path[len(makhzenService):] {
+	case "Get":
+		req := new(proto.GetRequest)
+		call.unary(req, func() (rpcMessage, error) { return s.rpcGet(r, req) })
+	case "Put":
+		req := new(proto.PutRequest)
+		call.unary(req, func() (rpcMessage, error) { return &proto.PutResponse{}, s.rpcPut(r, "", req) })
+	case "Delete":
+		req := new(proto.DeleteRequest)
+		call.unary(req, func() (rpcMessage, error) { return s.rpcDelete(r, req) })
+	case "BatchGet":
+		req := new(proto.BatchGetRequest)
+		call.unary(req, func() (rpcMessage, error) { return s.rpcBatchGet(r, req) })
+	case "BatchPut":
+		req := new(proto.BatchPutRequest)
+		call.unary(req, func() (rpcMessage, error) { return s.rpcBatchPut(r, req), nil })
+	case "Watch":
+		call.finish(s.rpcWatch(call))
+	default:
+		call.finish(proto.Errorf(proto.Unimplemented, "unknown method %s", r.URL.Path))
+	}
+}
+
+// rpcAllowed checks that the token r was made with is allowed acc. Calls
+// are only authenticated by withAuth, as the keys they need access to are
+// named in their messages.
+func (s *MakhzenServer) rpcAllowed(r *http.Request, acc access) error {
+	if s.ACL == nil || s.ACL.allows(bearerToken(r), acc) {
+		return nil
+	}
+
+	return proto.Errorf(proto.PermissionDenied, "forbidden")
+}
+
+// rpcKeyspace returns the namespace called name, or the default one when
+// name is empty.
+func (s *MakhzenServer) rpcKeyspace(name string) (keyspace, error) {
+	if name == "" {
+		return s.defaultKeyspace(), nil
+	}
+
+	ks, ok := s.namespaceKeyspace(name)
+	if !ok {
+		return keyspace{}, errUnknownNamespace
+	}
+
+	return ks, nil
+}
+
+// rpcItem returns item, held at key, as it is sent over gRPC: in Data for
+// values of type bytes and in Value for the rest.
+func rpcItem(key string, item store.Item) *proto.Item {
+	m := &proto.Item{Key: key, Type: item.Type, ContentType: item.ContentType}
+	if item.Type == store.TypeBytes {
+		m.Data = []byte(item.Value)
+	} else {
+		m.Value = item.Value
+	}
+
+	return m
+}
+
+func (s *MakhzenServer) rpcGet(r *http.Request, req *proto.GetRequest) (rpcMessage, error) {
+	if err := s.rpcAllowed(r, access{namespace: req.Namespace, key: req.Key}); err != nil {
+		return nil, err
+	}
+
+	ks, err := s.rpcKeyspace(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	item, ok := ks.store.GetItem(req.Key)
+	s.logger(r).Debug("get item", "namespace", ks.name, "key", req.Key, "found", ok, "value", logging.Value(item.Value))
+
+	if !ok {
+		return &proto.GetResponse{}, nil
+	}
+
+	return &proto.GetResponse{Found: true, Item: rpcItem(req.Key, item)}, nil
+}
+
+// rpcPut stores the item put gives and replicates it, in the namespace put
+// names or else in namespace.
+func (s *MakhzenServer) rpcPut(r *http.Request, namespace string, put *proto.PutRequest) error {
+	if put.Item == nil {
+		return proto.Errorf(proto.InvalidArgument, "put has no item")
+	}
+	if put.TTL < 0 {
+		return proto.Errorf(proto.InvalidArgument, "ttl must not be negative")
+	}
+	if put.Namespace != "" {
+		namespace = put.Namespace
+	}
+
+	key := put.Item.Key
+	if err := s.rpcAllowed(r, access{write: true, namespace: namespace, key: key}); err != nil {
+		return err
+	}
+
+	ks, err := s.rpcKeyspace(namespace)
+	if err != nil {
+		return err
+	}
+
+	typ := put.Item.Type
+	if typ == "" {
+		typ = store.TypeString
+	}
+	ttl := time.Duration(ks.ttl(put.TTL)) * time.Second
+
+	span := s.storeSpan(r.Context(), ks, broadcaster.OpPut, key)
+	if typ == store.TypeBytes {
+		_, err = ks.store.SetContent(key, string(put.Item.Data), put.Item.ContentType, ttl)
+	} else {
+		_, err = ks.store.SetTyped(key, put.Item.Value, typ, ttl)
+	}
+	span.SetError(err)
+	span.End()
+
+	if err != nil {
+		return err
+	}
+
+	s.logger(r).Info("put item", "namespace", ks.name, "key", key, "type", typ, "value", logging.Value(put.Item.Value))
+
+	s.replicate(r.Context(), ks, key)
+
+	return nil
+}
+
+func (s *MakhzenServer) rpcDelete(r *http.Request, req *proto.DeleteRequest) (rpcMessage, error) {
+	if err := s.rpcAllowed(r, access{write: true, namespace: req.Namespace, key: req.Key}); err != nil {
+		return nil, err
+	}
+
+	ks, err := s.rpcKeyspace(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	span := s.storeSpan(r.Context(), ks, broadcaster.OpDelete, req.Key)
+	ok := ks.store.Delete(req.Key)
+	span.End()
+
+	if ok {
+		s.logger(r).Info("deleted item", "namespace", ks.name, "key", req.Key)
+		s.replicate(r.Context(), ks, req.Key)
+	}
+
+	return &proto.DeleteResponse{Deleted: ok}, nil
+}
+
+// rpcBatchGet answers with the keys req names that are found, once the
+// caller is allowed to read every one of them.
+func (s *MakhzenServer) rpcBatchGet(r *http.Request, req *proto.BatchGetRequest) (rpcMessage, error) {
+	for _, key := range req.Keys {
+		if err := s.rpcAllowed(r, access{namespace: req.Namespace, key: key}); err != nil {
+			return nil, err
+		}
+	}
+
+	ks, err := s.rpcKeyspace(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(proto.BatchGetResponse)
+	for _, key := range req.Keys {
+		if item, ok := ks.store.GetItem(key); ok {
+			resp.Items = append(resp.Items, rpcItem(key, item))
+		}
+	}
+
+	s.logger(r).Debug("get items", "namespace", ks.name, "keys", len(req.Keys), "found", len(resp.Items))
+
+	return resp, nil
+}
+
+// rpcBatchPut applies each put of req in turn, answering with why those
+// that failed did.
+func (s *MakhzenServer) rpcBatchPut(r *http.Request, req *proto.BatchPutRequest) rpcMessage {
+	resp := new(proto.BatchPutResponse)
+
+	for i, put := range req.Puts {
+		if err := s.rpcPut(r, req.Namespace, put); err != nil {
+			if resp.Errors == nil {
+				resp.Errors = make(map[int32]string)
+			}
+			resp.Errors[int32(i)] = rpcStatus(err).Message
+		}
+	}
+
+	return resp
+}
+
+// rpcWatch streams the events GET /watch would, until the caller goes away
+// or the node is drained.
+func (s *MakhzenServer) rpcWatch(call *rpcCall) error {
+	var req proto.WatchRequest
+	err := call.receive(&req)
+	if err == io.EOF {
+		err = proto.Errorf(proto.InvalidArgument, "no request was sent")
+	}
+	if err != nil {
+		return err
+	}
+
+	watched := req.Key
+	if watched == "" {
+		watched = req.Prefix
+	}
+
+	if err := s.rpcAllowed(call.r, access{namespace: req.Namespace, key: watched}); err != nil {
+		return err
+	}
+
+	ks, err := s.rpcKeyspace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	if ks.watcher == nil {
+		return proto.Errorf(proto.FailedPrecondition, "watch is not enabled on this node")
+	}
+
+	sub, err := ks.watcher.Subscribe(watch.Filter{Key: req.Key, Prefix: req.Prefix}, req.Since)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	call.start()
+
+	for {
+		select {
+		case <-call.r.Context().Done():
+			return nil
+		case <-s.draining:
+			return proto.Errorf(proto.Unavailable, "node is shutting down")
+		case ev, ok := <-sub.Events:
+			if !ok {
+				return proto.Errorf(proto.Unavailable, "watch fell behind, resume from the last revision received")
+			}
+
+			item := store.Item{Value: ev.Value, Type: ev.ValueType, ContentType: ev.ContentType}
+			err := call.send(&proto.Event{
+				Revision: ev.Revision,
+				Type:     ev.Type,
+				Item:     rpcItem(ev.Key, item),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replicateHandler serves Peer.Replicate, applying each message another
+// node streams to it and acking them in the order they were sent. As with
+// messageHandler, a message is only acked without an error once it has
+// been applied. When messages are signed, the call is checked when it is
+// opened and each message as it is read, and one that fails the check
+// ends the call.
+func (s *MakhzenServer) replicateHandler(w http.ResponseWriter, r *http.Request) {
+	call, ok := newRPCCall(w, r)
+	if !ok {
+		return
+	}
+
+	logger := s.logger(r).With("node", r.RemoteAddr)
+
+	if s.Verifier != nil {
+		if err := s.Verifier.Verify(r, nil); err != nil {
+			logger.Warn("rejected message", "path", r.URL.Path, "err", err)
+			call.finish(proto.Errorf(proto.Unauthenticated, "%s", err))
+			return
+		}
+	}
+
+	// The sender waits for the headers before sending any message.
+	call.start()
+
+	messages := make(chan *proto.Message)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			m := new(proto.Message)
+			if err := call.receive(m); err != nil {
+				errs <- err
+				return
+			}
+
+			select {
+			case messages <- m:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-s.draining:
+			call.finish(proto.Errorf(proto.Unavailable, "node is shutting down"))
+			return
+		case err := <-errs:
+			if err == io.EOF {
+				err = nil
+			}
+			call.finish(err)
+			return
+		case m := <-messages:
+			if s.Verifier != nil {
+				if err := s.Verifier.VerifyMessage(m); err != nil {
+					logger.Warn("rejected message", "path", r.URL.Path, "err", err)
+					call.finish(proto.Errorf(proto.Unauthenticated, "%s", err))
+					return
+				}
+			}
+
+			msg := broadcaster.FromProto(m)
+
+			ctx, span := s.Tracer.StartRemote(msg.Traceparent, "replication.apply")
+			msgLogger := logger.With("request_id", msg.RequestID)
+			ctx = logging.NewContext(ctx, msgLogger, msg.RequestID)
+
+			var ack proto.Ack
+			if err := s.applyMessage(ctx, msgLogger, msg); err != nil {
+				ack.Error = err.Error()
+				span.SetError(err)
+			}
+			span.End()
+
+			if err := call.send(&ack); err != nil {
+				return
+			}
+		}
+	}
+}
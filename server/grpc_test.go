@@ -0,0 +1,431 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/proto"
+	"github.com/wolakec/makhzen/store"
+	"github.com/wolakec/makhzen/watch"
+)
+
+// newRPCServer serves server over TLS and HTTP/2, as gRPC needs.
+func newRPCServer(server *MakhzenServer) *httptest.Server {
+	ts := httptest.NewUnstartedServer(server)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+
+	return ts
+}
+
+// openRPC makes the gRPC call path with reqs, authenticated with token
+// when it is set.
+func openRPC(t *testing.T, ts *httptest.Server, path string, token string, reqs ...rpcMessage) *http.Response {
+	t.Helper()
+
+	var body bytes.Buffer
+	for _, req := range reqs {
+		body.Write(proto.Frame(req.Marshal()))
+	}
+
+	request, _ := http.NewRequest(http.MethodPost, ts.URL+path, &body)
+	request.Header.Set("Content-Type", proto.ContentType)
+	request.Header.Set("TE", "trailers")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := ts.Client().Do(request)
+	if err != nil {
+		t.Fatalf("could not call %s: %s", path, err)
+	}
+
+	return resp
+}
+
+// callRPC makes the unary gRPC call path with req, decoding the answer
+// into resp, and returns the status the call ended with.
+func callRPC(t *testing.T, ts *httptest.Server, path string, token string, req rpcMessage, resp rpcMessage) proto.Status {
+	t.Helper()
+
+	r := openRPC(t, ts, path, token, req)
+	defer r.Body.Close()
+
+	assertStatus(t, r.StatusCode, http.StatusOK)
+
+	b, err := proto.ReadFrame(r.Body)
+	if err == nil {
+		if err := resp.Unmarshal(b); err != nil {
+			t.Fatalf("could not decode answer: %s", err)
+		}
+		_, err = proto.ReadFrame(r.Body)
+	}
+	if err != io.EOF {
+		t.Fatalf("could not read answer: %s", err)
+	}
+
+	return rpcTrailer(t, r)
+}
+
+// rpcTrailer returns the status of the call r answers, once its body has
+// been read.
+func rpcTrailer(t *testing.T, r *http.Response) proto.Status {
+	t.Helper()
+
+	if s, ok := proto.ParseStatus(r.Trailer); ok {
+		return *s
+	}
+	if s, ok := proto.ParseStatus(r.Header); ok {
+		return *s
+	}
+
+	t.Fatal("call did not end with a status")
+	return proto.Status{}
+}
+
+func assertCode(t *testing.T, got proto.Status, want proto.Code) {
+	t.Helper()
+	if got.Code != want {
+		t.Errorf("call ended with %+v, want code %d", got, want)
+	}
+}
+
+func TestRPC(t *testing.T) {
+	server, reg := newNamespaceServer()
+	createNamespace(t, server, `{"name": "team-a", "defaultTTL": 60}`)
+
+	ts := newRPCServer(server)
+	defer ts.Close()
+
+	t.Run("puts and gets a value", func(t *testing.T) {
+		put := &proto.PutRequest{Item: &proto.Item{Key: "region", Value: "eu-west"}}
+		assertCode(t, callRPC(t, ts, "/makhzen.Makhzen/Put", "", put, new(proto.PutResponse)), proto.OK)
+
+		msg := reg.messages[len(reg.messages)-1]
+		if msg.Key != "region" || msg.Value != "eu-west" {
+			t.Errorf("got %v, want region to be replicated", msg)
+		}
+
+		var got proto.GetResponse
+		assertCode(t, callRPC(t, ts, "/makhzen.Makhzen/Get", "", &proto.GetRequest{Key: "region"}, &got), proto.OK)
+
+		want := &proto.Item{Key: "region", Value: "eu-west", Type: store.TypeString}
+		if !got.Found || !reflect.DeepEqual(got.Item, want) {
+			t.Errorf("got %+v, want %+v", got.Item, want)
+		}
+	})
+
+	t.Run("puts and gets bytes", func(t *testing.T) {
+		item := &proto.Item{Key: "avatar", Type: store.TypeBytes, Data: []byte{0, 0xff}, ContentType: "image/png"}
+		assertCode(t, callRPC(t, ts, "/makhzen.Makhzen/Put", "", &proto.PutRequest{Item: item}, new(proto.PutResponse)), proto.OK)
+
+		var got proto.GetResponse
+		callRPC(t, ts, "/makhzen.Makhzen/Get", "", &proto.GetRequest{Key: "avatar"}, &got)
+
+		if got.Item == nil || !bytes.Equal(got.Item.Data, item.Data) || got.Item.ContentType != "image/png" || got.Item.Value != "" {
+			t.Errorf("got %+v, want %+v", got.Item, item)
+		}
+	})
+
+	t.Run("answers missing keys as not found", func(t *testing.T) {
+		var got proto.GetResponse
+		assertCode(t, callRPC(t, ts, "/makhzen.Makhzen/Get", "", &proto.GetRequest{Key: "missing"}, &got), proto.OK)
+
+		if got.Found {
+			t.Errorf("got %+v, want not found", got)
+		}
+	})
+
+	t.Run("puts into a namespace with its default ttl", func(t *testing.T) {
+		put := &proto.PutRequest{Namespace: "team-a", Item: &proto.Item{Key: "region", Value: "us-east"}}
+		assertCode(t, callRPC(t, ts, "/makhzen.Makhzen/Put", "", put, new(proto.PutResponse)), proto.OK)
+
+		msg := reg.messages[len(reg.messages)-1]
+		if msg.Namespace != "team-a" || msg.TTL != 60 {
+			t.Errorf("got %v, want team-a message with ttl 60", msg)
+		}
+
+		if v, _ := server.Store.GetValue("region"); v != "eu-west" {
+			t.Errorf("expected the default namespace to keep eu-west, got %s", v)
+		}
+	})
+
+	t.Run("deletes a value", func(t *testing.T) {
+		var got proto.DeleteResponse
+		callRPC(t, ts, "/makhzen.Makhzen/Delete", "", &proto.DeleteRequest{Key: "region"}, &got)
+		if !got.Deleted {
+			t.Error("expected region to be deleted")
+		}
+
+		callRPC(t, ts, "/makhzen.Makhzen/Delete", "", &proto.DeleteRequest{Key: "region"}, &got)
+		if got.Deleted {
+			t.Error("expected nothing left to delete")
+		}
+	})
+
+	t.Run("puts and gets in batches", func(t *testing.T) {
+		batch := &proto.BatchPutRequest{Puts: []*proto.PutRequest{
+			{Item: &proto.Item{Key: "a", Value: "1"}},
+			{Item: &proto.Item{Key: "b", Value: "2", Type: "nope"}},
+			{Item: &proto.Item{Key: "c", Value: "3"}},
+			{Namespace: "team-z", Item: &proto.Item{Key: "d", Value: "4"}},
+		}}
+
+		var put proto.BatchPutResponse
+		assertCode(t, callRPC(t, ts, "/makhzen.Makhzen/BatchPut", "", batch, &put), proto.OK)
+
+		if len(put.Errors) != 2 || put.Errors[1] != store.ErrUnknownType.Error() || put.Errors[3] != errUnknownNamespace.Error() {
+			t.Errorf("got errors %v, want puts 1 and 3 to fail", put.Errors)
+		}
+
+		var got proto.BatchGetResponse
+		callRPC(t, ts, "/makhzen.Makhzen/BatchGet", "", &proto.BatchGetRequest{Keys: []string{"a", "b", "c"}}, &got)
+
+		if len(got.Items) != 2 || got.Items[0].Value != "1" || got.Items[1].Value != "3" {
+			t.Errorf("got %+v, want a and c", got.Items)
+		}
+	})
+
+	t.Run("fails calls to unknown namespaces", func(t *testing.T) {
+		status := callRPC(t, ts, "/makhzen.Makhzen/Get", "", &proto.GetRequest{Namespace: "team-z", Key: "region"}, new(proto.GetResponse))
+		assertCode(t, status, proto.NotFound)
+	})
+
+	t.Run("fails puts the store refuses", func(t *testing.T) {
+		put := &proto.PutRequest{Item: &proto.Item{Key: "region", Value: "eu", Type: "nope"}}
+		assertCode(t, callRPC(t, ts, "/makhzen.Makhzen/Put", "", put, new(proto.PutResponse)), proto.InvalidArgument)
+	})
+
+	t.Run("fails unknown methods", func(t *testing.T) {
+		status := callRPC(t, ts, "/makhzen.Makhzen/Scan", "", &proto.GetRequest{}, new(proto.GetResponse))
+		assertCode(t, status, proto.Unimplemented)
+	})
+
+	t.Run("refuses calls over HTTP/1", func(t *testing.T) {
+		plain := httptest.NewServer(server)
+		defer plain.Close()
+
+		resp, err := http.Post(plain.URL+"/makhzen.Makhzen/Get", proto.ContentType, bytes.NewReader(proto.Frame(nil)))
+		if err != nil {
+			t.Fatalf("could not post: %s", err)
+		}
+		resp.Body.Close()
+
+		assertStatus(t, resp.StatusCode, http.StatusHTTPVersionNotSupported)
+	})
+}
+
+func TestRPCAuth(t *testing.T) {
+	server := newAuthServer(t)
+
+	ts := newRPCServer(server)
+	defer ts.Close()
+
+	t.Run("allows keys the token's rules cover", func(t *testing.T) {
+		put := &proto.PutRequest{Item: &proto.Item{Key: "config/region", Value: "eu"}}
+		assertCode(t, callRPC(t, ts, "/makhzen.Makhzen/Put", "writer-token", put, new(proto.PutResponse)), proto.OK)
+
+		get := &proto.GetRequest{Key: "config/region"}
+		assertCode(t, callRPC(t, ts, "/makhzen.Makhzen/Get", "reader-token", get, new(proto.GetResponse)), proto.OK)
+	})
+
+	t.Run("denies keys the token's rules do not cover", func(t *testing.T) {
+		put := &proto.PutRequest{Item: &proto.Item{Key: "config/region", Value: "eu"}}
+		assertCode(t, callRPC(t, ts, "/makhzen.Makhzen/Put", "reader-token", put, new(proto.PutResponse)), proto.PermissionDenied)
+
+		batch := &proto.BatchGetRequest{Keys: []string{"config/region", "secret"}}
+		assertCode(t, callRPC(t, ts, "/makhzen.Makhzen/BatchGet", "reader-token", batch, new(proto.BatchGetResponse)), proto.PermissionDenied)
+
+		get := &proto.GetRequest{Namespace: "team-a", Key: "config/region"}
+		assertCode(t, callRPC(t, ts, "/makhzen.Makhzen/Get", "reader-token", get, new(proto.GetResponse)), proto.PermissionDenied)
+	})
+
+	t.Run("requires a token", func(t *testing.T) {
+		resp := openRPC(t, ts, "/makhzen.Makhzen/Get", "", &proto.GetRequest{Key: "config/region"})
+		resp.Body.Close()
+
+		assertStatus(t, resp.StatusCode, http.StatusUnauthorized)
+	})
+
+	t.Run("requires an admin token to replicate", func(t *testing.T) {
+		resp := openRPC(t, ts, broadcaster.ReplicatePath, "writer-token")
+		resp.Body.Close()
+
+		assertStatus(t, resp.StatusCode, http.StatusForbidden)
+	})
+}
+
+func TestRPCWatch(t *testing.T) {
+	server, _ := newNamespaceServer()
+	hub := watch.New(100)
+	server.Store.(*store.Store).AddObserver(hub)
+	server.Watcher = hub
+
+	ts := newRPCServer(server)
+	defer ts.Close()
+
+	t.Run("streams events for the prefix", func(t *testing.T) {
+		resp := openRPC(t, ts, "/makhzen.Makhzen/Watch", "", &proto.WatchRequest{Prefix: "config/"})
+		defer resp.Body.Close()
+
+		assertStatus(t, resp.StatusCode, http.StatusOK)
+
+		server.ServeHTTP(httptest.NewRecorder(), newPutValueRequest("other", "ignored"))
+		server.ServeHTTP(httptest.NewRecorder(), newPutValueRequest("config/region", "europe"))
+
+		b, err := proto.ReadFrame(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read event: %s", err)
+		}
+
+		var got proto.Event
+		got.Unmarshal(b)
+
+		if got.Revision != 2 || got.Type != "put" || got.Item == nil || got.Item.Key != "config/region" || got.Item.Value != "europe" {
+			t.Errorf("got %+v, want put of config/region at revision 2", got)
+		}
+	})
+
+	t.Run("resumes after a revision", func(t *testing.T) {
+		resp := openRPC(t, ts, "/makhzen.Makhzen/Watch", "", &proto.WatchRequest{Since: 1})
+		defer resp.Body.Close()
+
+		b, err := proto.ReadFrame(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read event: %s", err)
+		}
+
+		var got proto.Event
+		got.Unmarshal(b)
+
+		if got.Revision != 2 {
+			t.Errorf("got revision %d, want 2", got.Revision)
+		}
+	})
+
+	t.Run("streams values with their type", func(t *testing.T) {
+		resp := openRPC(t, ts, "/makhzen.Makhzen/Watch", "", &proto.WatchRequest{Key: "config/logo"})
+		defer resp.Body.Close()
+
+		assertStatus(t, resp.StatusCode, http.StatusOK)
+
+		server.Store.(*store.Store).SetContent("config/logo", "\x89PNG", "image/png", 0)
+
+		b, err := proto.ReadFrame(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read event: %s", err)
+		}
+
+		var got proto.Event
+		got.Unmarshal(b)
+
+		want := &proto.Item{Key: "config/logo", Type: store.TypeBytes, Data: []byte("\x89PNG"), ContentType: "image/png"}
+		if !reflect.DeepEqual(got.Item, want) {
+			t.Errorf("got %+v, want %+v", got.Item, want)
+		}
+	})
+
+	t.Run("ends when the node is drained", func(t *testing.T) {
+		resp := openRPC(t, ts, "/makhzen.Makhzen/Watch", "", &proto.WatchRequest{Since: 3})
+		defer resp.Body.Close()
+
+		server.Drain()
+
+		if _, err := proto.ReadFrame(resp.Body); err != io.EOF {
+			t.Fatalf("got %v, want the stream to end", err)
+		}
+		assertCode(t, rpcTrailer(t, resp), proto.Unavailable)
+	})
+}
+
+func TestReplicate(t *testing.T) {
+	secret := []byte("secret")
+
+	server, _ := newNamespaceServer()
+	server.Verifier = broadcaster.NewVerifier(secret, time.Minute)
+
+	ts := newRPCServer(server)
+	defer ts.Close()
+
+	peers := &broadcaster.Broadcaster{Secret: secret, Client: ts.Client(), GRPC: true}
+	defer peers.Close()
+
+	t.Run("applies messages streamed to it", func(t *testing.T) {
+		for _, v := range []string{"eu-west", "us-east"} {
+			if err := peers.SendMessage(broadcaster.Message{Key: "region", Value: v}, ts.URL); err != nil {
+				t.Fatalf("could not send message: %s", err)
+			}
+		}
+
+		if got, _ := server.Store.GetValue("region"); got != "us-east" {
+			t.Errorf("got %s, want us-east", got)
+		}
+	})
+
+	t.Run("acks messages it could not apply with why", func(t *testing.T) {
+		err := peers.SendMessage(broadcaster.Message{Namespace: "team-z", Key: "region", Value: "eu"}, ts.URL)
+		if err == nil || !strings.Contains(err.Error(), errUnknownNamespace.Error()) {
+			t.Errorf("got %v, want the namespace not to be found", err)
+		}
+
+		if err := peers.SendMessage(broadcaster.Message{Op: broadcaster.OpPing}, ts.URL); err != nil {
+			t.Errorf("expected the stream to stay open, got %s", err)
+		}
+	})
+
+	t.Run("rejects streams not signed with the cluster secret", func(t *testing.T) {
+		other := &broadcaster.Broadcaster{Secret: []byte("other"), Client: ts.Client(), GRPC: true}
+		defer other.Close()
+
+		err := other.SendMessage(broadcaster.Message{Key: "region", Value: "eu"}, ts.URL)
+		if s, ok := err.(*proto.Status); !ok || s.Code != proto.Unauthenticated {
+			t.Errorf("got %v, want the stream to be unauthenticated", err)
+		}
+	})
+
+	t.Run("rejects messages not signed with the cluster secret", func(t *testing.T) {
+		now := time.Now().Unix()
+		forged := &proto.Message{Key: "region", Value: "asia", SentAt: now, Nonce: "n2"}
+		forged.Signature = broadcaster.Sign([]byte("other"), now, "n2", http.MethodPost, broadcaster.ReplicatePath, (&proto.Message{Key: "region", Value: "asia"}).Marshal())
+
+		for _, m := range []*proto.Message{{Key: "region", Value: "asia"}, forged} {
+			request, _ := http.NewRequest(http.MethodPost, ts.URL+broadcaster.ReplicatePath, bytes.NewReader(proto.Frame(m.Marshal())))
+			request.Header.Set("Content-Type", proto.ContentType)
+			request.Header.Set("TE", "trailers")
+			request.Header.Set(broadcaster.HeaderTimestamp, strconv.FormatInt(now, 10))
+			request.Header.Set(broadcaster.HeaderNonce, "n1"+m.Nonce)
+			request.Header.Set(broadcaster.HeaderSignature, broadcaster.Sign(secret, now, "n1"+m.Nonce, http.MethodPost, broadcaster.ReplicatePath, nil))
+
+			resp, err := ts.Client().Do(request)
+			if err != nil {
+				t.Fatalf("could not open stream: %s", err)
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			assertCode(t, rpcTrailer(t, resp), proto.Unauthenticated)
+		}
+
+		if got, _ := server.Store.GetValue("region"); got != "us-east" {
+			t.Errorf("got %s, want the message not to be applied", got)
+		}
+	})
+
+	t.Run("ends streams when the node is drained", func(t *testing.T) {
+		server.Drain()
+
+		err := peers.SendMessage(broadcaster.Message{Key: "region", Value: "eu"}, ts.URL)
+		if err == nil {
+			t.Error("expected the message not to be applied once the node is drained")
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/wolakec/makhzen/registry"
+)
+
+// Readiness is the body of a response from /readyz. Checks maps the name
+// of every check to "ok" or the reason it failed.
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// ClusterStatus is the body of a response from /cluster/status.
+type ClusterStatus struct {
+	Ready     bool                  `json:"ready"`
+	Reachable int                   `json:"reachable"`
+	Peers     []registry.PeerStatus `json:"peers"`
+}
+
+// SetReady marks the node as having finished starting up. Until it is
+// called /readyz reports the node as not ready.
+func (s *MakhzenServer) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+
+	atomic.StoreInt32(&s.ready, v)
+}
+
+// Drain prepares the node to stop: /readyz reports it as not ready, so
+// load balancers stop sending it requests, and open watch streams and
+// Redis connections are ended so that they do not hold up shutting down.
+func (s *MakhzenServer) Drain() {
+	s.drainOnce.Do(func() {
+		close(s.draining)
+	})
+}
+
+func (s *MakhzenServer) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *MakhzenServer) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	readiness := s.readiness()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !readiness.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(readiness)
+}
+
+func (s *MakhzenServer) readiness() Readiness {
+	checks := map[string]string{
+		"store":     "ok",
+		"bootstrap": "ok",
+		"peers":     "ok",
+		"shutdown":  "ok",
+	}
+
+	if s.Store == nil {
+		checks["store"] = "no store"
+	}
+
+	if atomic.LoadInt32(&s.ready) == 0 {
+		checks["bootstrap"] = "starting"
+	}
+
+	select {
+	case <-s.draining:
+		checks["shutdown"] = "draining"
+	default:
+	}
+
+	if reachable := reachablePeers(s.Registry.Status()); reachable < s.MinPeers {
+		checks["peers"] = fmt.Sprintf("%d reachable, need %d", reachable, s.MinPeers)
+	}
+
+	ready := true
+	for _, result := range checks {
+		if result != "ok" {
+			ready = false
+		}
+	}
+
+	return Readiness{Ready: ready, Checks: checks}
+}
+
+func (s *MakhzenServer) clusterStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	peers := s.Registry.Status()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ClusterStatus{
+		Ready:     s.readiness().Ready,
+		Reachable: reachablePeers(peers),
+		Peers:     peers,
+	})
+}
+
+func reachablePeers(peers []registry.PeerStatus) int {
+	n := 0
+	for _, p := range peers {
+		if p.Reachable {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wolakec/makhzen/registry"
+)
+
+func TestHealth(t *testing.T) {
+	store := StubItemStore{
+		map[string]string{},
+	}
+	reg := StubRegistry{
+		Statuses: []registry.PeerStatus{
+			{Address: "http://127.0.0.1:3001", Reachable: true, Sent: 4},
+			{Address: "http://127.0.0.1:3002", Errors: 2, Missed: 2, LastError: "connection refused"},
+		},
+	}
+	server := NewMakhzenServer(&store, &reg)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, httptest.NewRequest(http.MethodGet, path, nil))
+
+		return response
+	}
+
+	readiness := func(t *testing.T) Readiness {
+		var got Readiness
+		if err := json.NewDecoder(get("/readyz").Body).Decode(&got); err != nil {
+			t.Fatalf("could not decode readiness: %s", err)
+		}
+
+		return got
+	}
+
+	t.Run("healthz returns 200", func(t *testing.T) {
+		assertStatus(t, get("/healthz").Code, http.StatusOK)
+	})
+
+	t.Run("readyz returns 503 while starting", func(t *testing.T) {
+		assertStatus(t, get("/readyz").Code, http.StatusServiceUnavailable)
+
+		if got := readiness(t).Checks["bootstrap"]; got != "starting" {
+			t.Errorf("got bootstrap check %s, want starting", got)
+		}
+	})
+
+	server.SetReady(true)
+
+	t.Run("readyz returns 200 once started", func(t *testing.T) {
+		assertStatus(t, get("/readyz").Code, http.StatusOK)
+	})
+
+	t.Run("readyz returns 503 without enough peers", func(t *testing.T) {
+		server.MinPeers = 2
+		defer func() { server.MinPeers = 0 }()
+
+		assertStatus(t, get("/readyz").Code, http.StatusServiceUnavailable)
+
+		if got := readiness(t).Checks["peers"]; got != "1 reachable, need 2" {
+			t.Errorf("got peers check %s", got)
+		}
+	})
+
+	t.Run("readyz returns 503 once draining", func(t *testing.T) {
+		drained := NewMakhzenServer(&store, &reg)
+		drained.SetReady(true)
+		drained.Drain()
+
+		response := httptest.NewRecorder()
+		drained.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		assertStatus(t, response.Code, http.StatusServiceUnavailable)
+	})
+
+	t.Run("cluster status summarises peers", func(t *testing.T) {
+		response := get("/cluster/status")
+
+		assertStatus(t, response.Code, http.StatusOK)
+
+		var got ClusterStatus
+		json.NewDecoder(response.Body).Decode(&got)
+
+		if !got.Ready || got.Reachable != 1 || len(got.Peers) != 2 {
+			t.Fatalf("got %+v", got)
+		}
+
+		if p := got.Peers[1]; p.Missed != 2 || p.LastError != "connection refused" {
+			t.Errorf("got peer %+v", p)
+		}
+	})
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/wolakec/makhzen/logging"
+)
+
+// withRequestID gives every request an ID, taken from its X-Request-ID
+// header when it has one so that replicated writes keep the ID of the
+// request that made them, and a logger that records it.
+func (s *MakhzenServer) withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(logging.RequestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = logging.NewRequestID()
+		}
+
+		w.Header().Set(logging.RequestIDHeader, id)
+
+		logger := s.Logger.With("request_id", id)
+		next.ServeHTTP(w, r.WithContext(logging.NewContext(r.Context(), logger, id)))
+	})
+}
+
+// maxRequestIDLength bounds the request IDs accepted from clients.
+const maxRequestIDLength = 64
+
+// logger returns the logger for r.
+func (s *MakhzenServer) logger(r *http.Request) *logging.Logger {
+	return logging.FromContext(r.Context(), s.Logger)
+}
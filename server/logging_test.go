@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/registry"
+)
+
+func TestRequestLogging(t *testing.T) {
+	store := StubItemStore{
+		map[string]string{},
+	}
+	reg := StubRegistry{
+		Nodes: []registry.Node{},
+	}
+	server := NewMakhzenServer(&store, &reg)
+
+	var buf bytes.Buffer
+	server.Logger = logging.New(&buf, logging.Info)
+
+	t.Run("generates a request ID", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPutValueRequest("Region", "europe"))
+
+		id := response.Header().Get("X-Request-ID")
+		if id == "" {
+			t.Fatalf("response has no request ID")
+		}
+
+		if got := reg.messages[len(reg.messages)-1].RequestID; got != id {
+			t.Errorf("broadcast request ID %s, want %s", got, id)
+		}
+
+		if !strings.Contains(buf.String(), `"request_id":"`+id+`"`) {
+			t.Errorf("log does not contain request ID %s:\n%s", id, buf.String())
+		}
+	})
+
+	t.Run("keeps request ID of replicated message", func(t *testing.T) {
+		buf.Reset()
+
+		request := newPostMessageRequest("Region", "asia")
+		request.Header.Set("X-Request-ID", "from-node-a")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		if got := response.Header().Get("X-Request-ID"); got != "from-node-a" {
+			t.Errorf("got request ID %s, want from-node-a", got)
+		}
+
+		if !strings.Contains(buf.String(), `"request_id":"from-node-a"`) {
+			t.Errorf("log does not contain request ID:\n%s", buf.String())
+		}
+	})
+
+	t.Run("redacts values", func(t *testing.T) {
+		buf.Reset()
+
+		server.ServeHTTP(httptest.NewRecorder(), newPutValueRequest("Password", "hunter2"))
+
+		if strings.Contains(buf.String(), "hunter2") {
+			t.Errorf("log contains value:\n%s", buf.String())
+		}
+	})
+}
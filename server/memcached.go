@@ -0,0 +1,388 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wolakec/makhzen/store"
+)
+
+// Limits of the memcached text protocol.
+const (
+	maxMemcachedKey   = 250
+	maxMemcachedLine  = 2048
+	maxMemcachedValue = 1024 * 1024
+	// maxRelativeExptime is the largest exptime taken as seconds from now;
+	// larger ones are Unix times.
+	maxRelativeExptime = 60 * 60 * 24 * 30
+)
+
+// memcachedCommand is a command read by serveMemcachedConn. Storage
+// commands carry the value that followed their command line.
+type memcachedCommand struct {
+	name    string
+	args    []string
+	noreply bool
+	value   string
+}
+
+// ServeMemcached serves the default namespace over the memcached text
+// protocol on l, replicating writes like the HTTP API does, until the
+// server is drained. The protocol has no way to authenticate, so it is not
+// served when the server has an ACL.
+func (s *MakhzenServer) ServeMemcached(l net.Listener) error {
+	if s.ACL != nil {
+		l.Close()
+		return errors.New("the memcached protocol cannot be served with an acl")
+	}
+
+	return s.acceptUntilDrained(l, s.serveMemcachedConn)
+}
+
+func (s *MakhzenServer) serveMemcachedConn(conn net.Conn) {
+	defer conn.Close()
+	defer s.interruptOnDrain(conn)()
+
+	r := bufio.NewReaderSize(conn, maxMemcachedLine)
+	w := bufio.NewWriter(conn)
+
+	for {
+		cmd, reply, err := readMemcachedCommand(r)
+		if err != nil {
+			if reply != "" {
+				w.WriteString(reply)
+				w.Flush()
+			}
+			return
+		}
+
+		if reply == "" {
+			if cmd.name == "quit" {
+				w.Flush()
+				return
+			}
+			reply = s.runMemcachedCommand(cmd)
+		}
+
+		if !cmd.noreply {
+			w.WriteString(reply)
+		}
+
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readMemcachedCommand reads the next command. It returns the reply to
+// send straight away when the command cannot be run, and an error when
+// nothing more can be read from the connection after that reply.
+func readMemcachedCommand(r *bufio.Reader) (memcachedCommand, string, error) {
+	line, more, err := r.ReadLine()
+	if err != nil {
+		return memcachedCommand{}, "", err
+	}
+	if more {
+		return memcachedCommand{}, "CLIENT_ERROR line too long\r\n", errors.New("line too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return memcachedCommand{}, "ERROR\r\n", nil
+	}
+
+	cmd := memcachedCommand{name: strings.ToLower(fields[0]), args: fields[1:]}
+
+	switch cmd.name {
+	case "set", "add", "replace", "cas":
+	default:
+		if n := len(cmd.args); n > 0 && cmd.args[n-1] == "noreply" {
+			cmd.noreply = true
+			cmd.args = cmd.args[:n-1]
+		}
+		return cmd, "", nil
+	}
+
+	// Storage commands are followed by a value of the length given as
+	// their fourth argument.
+	want := 4
+	if cmd.name == "cas" {
+		want = 5
+	}
+
+	if len(cmd.args) == want+1 && cmd.args[want] == "noreply" {
+		cmd.noreply = true
+		cmd.args = cmd.args[:want]
+	}
+
+	if len(cmd.args) != want {
+		return cmd, "ERROR\r\n", nil
+	}
+
+	n, err := strconv.Atoi(cmd.args[3])
+	if err != nil || n < 0 {
+		return cmd, "CLIENT_ERROR bad data chunk\r\n", errors.New("bad data length")
+	}
+
+	if n > maxMemcachedValue {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(n)+2); err != nil {
+			return cmd, "", err
+		}
+		return cmd, "SERVER_ERROR object too large for cache\r\n", nil
+	}
+
+	b := make([]byte, n+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return cmd, "", err
+	}
+
+	if b[n] != '\r' || b[n+1] != '\n' {
+		// Skip the rest of a value longer than it said it would be.
+		if b[n+1] != '\n' {
+			if _, err := r.ReadSlice('\n'); err != nil && err != bufio.ErrBufferFull {
+				return cmd, "", err
+			}
+		}
+		cmd.noreply = false
+		return cmd, "CLIENT_ERROR bad data chunk\r\n", nil
+	}
+
+	cmd.value = string(b[:n])
+
+	return cmd, "", nil
+}
+
+// runMemcachedCommand runs cmd and returns its reply.
+func (s *MakhzenServer) runMemcachedCommand(cmd memcachedCommand) string {
+	var reply string
+
+	ctx, span := s.commandContext("memcached " + cmd.name)
+
+	switch cmd.name {
+	case "get", "gets":
+		reply = s.memcachedGet(cmd)
+	case "set", "add", "replace", "cas":
+		reply = s.memcachedStore(ctx, cmd)
+	case "delete":
+		reply = s.memcachedDelete(ctx, cmd)
+	case "incr", "decr":
+		reply = s.memcachedIncr(ctx, cmd)
+	case "touch":
+		reply = s.memcachedTouch(ctx, cmd)
+	case "version":
+		reply = "VERSION makhzen\r\n"
+	default:
+		reply = "ERROR\r\n"
+	}
+
+	span.End()
+
+	name := cmd.name
+	if reply == "ERROR\r\n" {
+		name = "unknown"
+	}
+	s.countCommand("memcached", name, !strings.HasPrefix(reply, "CLIENT_ERROR") && reply != "ERROR\r\n")
+
+	return reply
+}
+
+func validMemcachedKey(key string) bool {
+	if len(key) == 0 || len(key) > maxMemcachedKey {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// memcachedExptime returns the TTL given by exptime: seconds from now up to
+// 30 days, a Unix time beyond that, and none when zero. It reports when
+// exptime has already passed.
+func memcachedExptime(arg string) (time.Duration, bool, error) {
+	exptime, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch {
+	case exptime < 0:
+		return 0, true, nil
+	case exptime == 0:
+		return 0, false, nil
+	case exptime <= maxRelativeExptime:
+		return time.Duration(exptime) * time.Second, false, nil
+	}
+
+	ttl := time.Until(time.Unix(exptime, 0))
+	return ttl, ttl <= 0, nil
+}
+
+func (s *MakhzenServer) memcachedGet(cmd memcachedCommand) string {
+	if len(cmd.args) == 0 {
+		return "ERROR\r\n"
+	}
+
+	var b bytes.Buffer
+
+	for _, key := range cmd.args {
+		if !validMemcachedKey(key) {
+			return "CLIENT_ERROR bad command line format\r\n"
+		}
+
+		item, ok := s.Store.GetItem(key)
+		if !ok {
+			continue
+		}
+
+		// Counters changed by incr and decr are unsigned to memcached.
+		if item.Type == store.TypeCounter {
+			n, _ := strconv.ParseInt(item.Value, 10, 64)
+			item.Value = strconv.FormatUint(uint64(n), 10)
+		}
+
+		b.WriteString("VALUE " + key + " " + strconv.FormatUint(uint64(item.Flags), 10) + " " + strconv.Itoa(len(item.Value)))
+		if cmd.name == "gets" {
+			b.WriteString(" " + strconv.FormatUint(item.CAS, 10))
+		}
+		b.WriteString("\r\n" + item.Value + "\r\n")
+	}
+
+	b.WriteString("END\r\n")
+
+	return b.String()
+}
+
+// memcachedStore serves set, add, replace and cas.
+func (s *MakhzenServer) memcachedStore(ctx context.Context, cmd memcachedCommand) string {
+	key := cmd.args[0]
+	if !validMemcachedKey(key) {
+		return "CLIENT_ERROR bad command line format\r\n"
+	}
+
+	flags, err := strconv.ParseUint(cmd.args[1], 10, 32)
+	if err != nil {
+		return "CLIENT_ERROR bad command line format\r\n"
+	}
+
+	ttl, expired, err := memcachedExptime(cmd.args[2])
+	if err != nil {
+		return "CLIENT_ERROR bad command line format\r\n"
+	}
+
+	var cond store.Condition
+
+	switch cmd.name {
+	case "add":
+		cond.Missing = true
+	case "replace":
+		cond.Present = true
+	case "cas":
+		cond.CAS, err = strconv.ParseUint(cmd.args[4], 10, 64)
+		if err != nil || cond.CAS == 0 {
+			return "CLIENT_ERROR bad command line format\r\n"
+		}
+	}
+
+	_, err = s.putValue(ctx, key, cmd.value, uint32(flags), ttl, cond)
+
+	switch err {
+	case nil:
+	case store.ErrPresent:
+		return "NOT_STORED\r\n"
+	case store.ErrMissing:
+		if cmd.name == "cas" {
+			return "NOT_FOUND\r\n"
+		}
+		return "NOT_STORED\r\n"
+	case store.ErrChanged:
+		return "EXISTS\r\n"
+	case store.ErrFull:
+		return "SERVER_ERROR out of memory storing object\r\n"
+	default:
+		return "SERVER_ERROR " + err.Error() + "\r\n"
+	}
+
+	// A value stored with an exptime that has passed is gone straight away.
+	if expired {
+		s.deleteKey(ctx, key)
+	}
+
+	return "STORED\r\n"
+}
+
+func (s *MakhzenServer) memcachedDelete(ctx context.Context, cmd memcachedCommand) string {
+	// Older clients send a time after the key, which must be zero.
+	if len(cmd.args) == 0 || len(cmd.args) > 2 || (len(cmd.args) == 2 && cmd.args[1] != "0") {
+		return "CLIENT_ERROR bad command line format\r\n"
+	}
+
+	if s.deleteKey(ctx, cmd.args[0]) {
+		return "DELETED\r\n"
+	}
+
+	return "NOT_FOUND\r\n"
+}
+
+// memcachedIncr serves incr and decr, which change unsigned 64-bit decimal
+// values: incr wraps around past the largest and decr stops at zero.
+func (s *MakhzenServer) memcachedIncr(ctx context.Context, cmd memcachedCommand) string {
+	if len(cmd.args) != 2 {
+		return "ERROR\r\n"
+	}
+
+	delta, err := strconv.ParseUint(cmd.args[1], 10, 64)
+	if err != nil {
+		return "CLIENT_ERROR invalid numeric delta argument\r\n"
+	}
+
+	v, err := s.incrUnsigned(ctx, cmd.args[0], delta, cmd.name == "decr")
+	switch err {
+	case nil:
+		return strconv.FormatUint(v, 10) + "\r\n"
+	case store.ErrMissing:
+		return "NOT_FOUND\r\n"
+	case store.ErrNotInteger:
+		return "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"
+	}
+
+	return "SERVER_ERROR " + err.Error() + "\r\n"
+}
+
+func (s *MakhzenServer) memcachedTouch(ctx context.Context, cmd memcachedCommand) string {
+	if len(cmd.args) != 2 {
+		return "ERROR\r\n"
+	}
+
+	ttl, expired, err := memcachedExptime(cmd.args[1])
+	if err != nil {
+		return "CLIENT_ERROR invalid exptime argument\r\n"
+	}
+
+	var ok bool
+	if expired {
+		ok = s.deleteKey(ctx, cmd.args[0])
+	} else if ok, err = s.expireKey(ctx, cmd.args[0], ttl); err != nil {
+		return "SERVER_ERROR " + err.Error() + "\r\n"
+	}
+
+	if ok {
+		return "TOUCHED\r\n"
+	}
+
+	return "NOT_FOUND\r\n"
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/store"
+)
+
+// memcachedClient sends commands to a server started with ServeMemcached.
+type memcachedClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialMemcached(t *testing.T, s *MakhzenServer) *memcachedClient {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeMemcached(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &memcachedClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends request and reads the given number of reply lines, joined with
+// newlines.
+func (c *memcachedClient) do(t *testing.T, request string, lines int) string {
+	t.Helper()
+
+	if _, err := io.WriteString(c.conn, request); err != nil {
+		t.Fatal(err)
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	var reply []string
+	for i := 0; i < lines; i++ {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("could not read reply to %q: %s", request, err)
+		}
+		reply = append(reply, strings.TrimSuffix(line, "\r\n"))
+	}
+
+	return strings.Join(reply, "\n")
+}
+
+func assertMemcached(t *testing.T, got string, want string) {
+	t.Helper()
+
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMemcached(t *testing.T) {
+	newServer := func() (*MakhzenServer, *StubRegistry) {
+		reg := &StubRegistry{}
+		return NewMakhzenServer(store.New(), reg), reg
+	}
+
+	t.Run("stores and gets values", func(t *testing.T) {
+		s, reg := newServer()
+		c := dialMemcached(t, s)
+		defer s.Drain()
+
+		assertMemcached(t, c.do(t, "get region\r\n", 1), "END")
+		assertMemcached(t, c.do(t, "set region 7 0 7\r\neu-west\r\n", 1), "STORED")
+		assertMemcached(t, c.do(t, "get region missing\r\n", 3), "VALUE region 7 7\neu-west\nEND")
+		assertMemcached(t, c.do(t, "add region 0 0 2\r\neu\r\n", 1), "NOT_STORED")
+		assertMemcached(t, c.do(t, "replace zone 0 0 1\r\na\r\n", 1), "NOT_STORED")
+		assertMemcached(t, c.do(t, "add zone 0 60 1\r\na\r\n", 1), "STORED")
+		assertMemcached(t, c.do(t, "replace zone 0 0 1\r\nb\r\n", 1), "STORED")
+		assertMemcached(t, c.do(t, "delete zone\r\n", 1), "DELETED")
+		assertMemcached(t, c.do(t, "delete zone\r\n", 1), "NOT_FOUND")
+
+		want := []broadcaster.Message{
+			{Op: broadcaster.OpPut, Key: "region", Value: "eu-west", Type: store.TypeString, Flags: 7},
+			{Op: broadcaster.OpPut, Key: "zone", Value: "a", Type: store.TypeString, TTL: 60},
+			{Op: broadcaster.OpPut, Key: "zone", Value: "b", Type: store.TypeString},
+			{Op: broadcaster.OpDelete, Key: "zone"},
+		}
+
+		for i := range reg.messages {
+			if reg.messages[i].Timestamp == 0 {
+				t.Errorf("message %d is not stamped with when it was written", i)
+			}
+			reg.messages[i].RequestID, reg.messages[i].Timestamp = "", 0
+		}
+
+		if !reflect.DeepEqual(reg.messages, want) {
+			t.Errorf("got messages %+v, want %+v", reg.messages, want)
+		}
+	})
+
+	t.Run("checks and sets", func(t *testing.T) {
+		s, _ := newServer()
+		c := dialMemcached(t, s)
+		defer s.Drain()
+
+		c.do(t, "set region 0 0 2\r\neu\r\n", 1)
+		item, _ := s.Store.GetItem("region")
+		cas := item.CAS
+
+		assertMemcached(t, c.do(t, "gets region\r\n", 3), "VALUE region 0 2 "+uintString(cas)+"\neu\nEND")
+		assertMemcached(t, c.do(t, "cas region 0 0 2 "+uintString(cas)+"\r\nus\r\n", 1), "STORED")
+		assertMemcached(t, c.do(t, "cas region 0 0 2 "+uintString(cas)+"\r\nap\r\n", 1), "EXISTS")
+		assertMemcached(t, c.do(t, "cas missing 0 0 2 1\r\nap\r\n", 1), "NOT_FOUND")
+		assertMemcached(t, c.do(t, "get region\r\n", 3), "VALUE region 0 2\nus\nEND")
+	})
+
+	t.Run("increments and decrements", func(t *testing.T) {
+		s, _ := newServer()
+		c := dialMemcached(t, s)
+		defer s.Drain()
+
+		assertMemcached(t, c.do(t, "incr hits 1\r\n", 1), "NOT_FOUND")
+		c.do(t, "set hits 7 0 2\r\n10\r\n", 1)
+		assertMemcached(t, c.do(t, "incr hits 5\r\n", 1), "15")
+		assertMemcached(t, c.do(t, "decr hits 20\r\n", 1), "0")
+		assertMemcached(t, c.do(t, "get hits\r\n", 3), "VALUE hits 7 1\n0\nEND")
+
+		c.do(t, "set big 0 0 20\r\n18446744073709551614\r\n", 1)
+		assertMemcached(t, c.do(t, "incr big 1\r\n", 1), "18446744073709551615")
+		assertMemcached(t, c.do(t, "get big\r\n", 3), "VALUE big 0 20\n18446744073709551615\nEND")
+		assertMemcached(t, c.do(t, "incr big 2\r\n", 1), "1")
+		assertMemcached(t, c.do(t, "decr big 18446744073709551615\r\n", 1), "0")
+		assertMemcached(t, c.do(t, "incr hits x\r\n", 1), "CLIENT_ERROR invalid numeric delta argument")
+		c.do(t, "set region 0 0 2\r\neu\r\n", 1)
+		assertMemcached(t, c.do(t, "incr region 1\r\n", 1), "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	})
+
+	t.Run("expires values", func(t *testing.T) {
+		s, reg := newServer()
+		c := dialMemcached(t, s)
+		defer s.Drain()
+
+		c.do(t, "set region 0 0 2\r\neu\r\n", 1)
+		assertMemcached(t, c.do(t, "touch region 100\r\n", 1), "TOUCHED")
+		assertMemcached(t, c.do(t, "touch missing 100\r\n", 1), "NOT_FOUND")
+
+		if ttl, _ := s.Store.(*store.Store).TTL("region"); ttl <= 99*time.Second {
+			t.Errorf("got TTL %s, want 100s", ttl)
+		}
+		if last := reg.messages[len(reg.messages)-1]; last.Op != broadcaster.OpExpire || last.TTL != 100 {
+			t.Errorf("got message %+v", last)
+		}
+
+		assertMemcached(t, c.do(t, "set zone 0 -1 1\r\na\r\n", 1), "STORED")
+		assertMemcached(t, c.do(t, "get zone\r\n", 1), "END")
+
+		future := time.Now().Add(time.Hour).Unix()
+		assertMemcached(t, c.do(t, "set zone 0 "+uintString(uint64(future))+" 1\r\na\r\n", 1), "STORED")
+		if ttl, _ := s.Store.(*store.Store).TTL("zone"); ttl <= 59*time.Minute {
+			t.Errorf("got TTL %s, want an hour", ttl)
+		}
+	})
+
+	t.Run("honours noreply", func(t *testing.T) {
+		s, _ := newServer()
+		c := dialMemcached(t, s)
+		defer s.Drain()
+
+		assertMemcached(t, c.do(t, "set region 0 0 2 noreply\r\neu\r\ndelete missing noreply\r\nget region\r\n", 3), "VALUE region 0 2\neu\nEND")
+	})
+
+	t.Run("rejects bad commands", func(t *testing.T) {
+		s, _ := newServer()
+		c := dialMemcached(t, s)
+		defer s.Drain()
+
+		assertMemcached(t, c.do(t, "flush_all\r\n", 1), "ERROR")
+		assertMemcached(t, c.do(t, "set region 0 0\r\n", 1), "ERROR")
+		assertMemcached(t, c.do(t, "set region 0 0 2\r\neurope\r\n", 1), "CLIENT_ERROR bad data chunk")
+		assertMemcached(t, c.do(t, "get "+strings.Repeat("k", 251)+"\r\n", 1), "CLIENT_ERROR bad command line format")
+		assertMemcached(t, c.do(t, "version\r\n", 1), "VERSION makhzen")
+	})
+
+	t.Run("refuses to serve with an ACL", func(t *testing.T) {
+		s, _ := newServer()
+		s.ACL = &ACL{}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.ServeMemcached(l); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+
+	t.Run("closes connections when draining", func(t *testing.T) {
+		s, _ := newServer()
+		c := dialMemcached(t, s)
+
+		assertMemcached(t, c.do(t, "version\r\n", 1), "VERSION makhzen")
+		s.Drain()
+
+		c.conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.r.ReadByte(); err == nil {
+			t.Errorf("expected the connection to be closed")
+		}
+	})
+}
+
+func uintString(v uint64) string {
+	return strconv.FormatUint(v, 10)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wolakec/makhzen/metrics"
+)
+
+// statusRecorder records the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush lets /watch stream through the recorder.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument counts and times every request to next, when s.Metrics is
+// set, labelled with the route of router it matches.
+func (s *MakhzenServer) instrument(router *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Metrics == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, route := router.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		code := strconv.Itoa(rec.status)
+
+		s.Metrics.Counter("makhzen_http_requests_total", "Requests served, by route and status.", "route", "code").
+			With(route, code).Inc()
+		s.Metrics.Histogram("makhzen_http_request_duration_seconds", "Time taken to serve requests, by route and status.", metrics.DefaultBuckets, "route", "code").
+			With(route, code).Observe(time.Since(start).Seconds())
+	})
+}
+
+func (s *MakhzenServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Metrics == nil {
+		http.Error(w, "metrics are not enabled on this node", http.StatusNotFound)
+		return
+	}
+
+	s.collectMetrics()
+	s.Metrics.ServeHTTP(w, r)
+}
+
+// collectMetrics updates the gauges read from the stores and the registry.
+func (s *MakhzenServer) collectMetrics() {
+	keys := s.Metrics.Gauge("makhzen_store_keys", "Keys held, by namespace.", "namespace")
+	bytes := s.Metrics.Gauge("makhzen_store_bytes", "Estimated memory held by keys and values, by namespace.", "namespace")
+	maxBytes := s.Metrics.Gauge("makhzen_store_max_bytes", "Memory limit, by namespace, or 0 for no limit.", "namespace")
+
+	stats := s.Store.Stats()
+	keys.With("").Set(float64(stats.Keys))
+	bytes.With("").Set(float64(stats.Bytes))
+	maxBytes.With("").Set(float64(stats.MaxBytes))
+
+	if s.Namespaces != nil {
+		for _, settings := range s.Namespaces.List() {
+			n, ok := s.Namespaces.Get(settings.Name)
+			if !ok {
+				continue
+			}
+
+			stats := n.Store.Stats()
+			keys.With(settings.Name).Set(float64(stats.Keys))
+			bytes.With(settings.Name).Set(float64(stats.Bytes))
+			maxBytes.With(settings.Name).Set(float64(stats.MaxBytes))
+		}
+	}
+
+	s.Metrics.Gauge("makhzen_cluster_nodes", "Other nodes this node replicates to.").
+		With().Set(float64(len(s.Registry.GetNodes())))
+}
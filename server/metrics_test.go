@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wolakec/makhzen/metrics"
+)
+
+func TestGETMetrics(t *testing.T) {
+	server, _ := newNamespaceServer()
+
+	t.Run("returns 404 when metrics are disabled", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		assertStatus(t, response.Code, http.StatusNotFound)
+	})
+
+	server.Metrics = metrics.NewRegistry()
+	createNamespace(t, server, `{"name": "team-a"}`)
+
+	server.ServeHTTP(httptest.NewRecorder(), newPutValueRequest("Region", "europe"))
+	server.ServeHTTP(httptest.NewRecorder(), newGetValueRequest("Region"))
+	server.ServeHTTP(httptest.NewRecorder(), newGetValueRequest("Missing"))
+
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assertStatus(t, response.Code, http.StatusOK)
+
+	got := response.Body.String()
+
+	for _, want := range []string{
+		`makhzen_http_requests_total{route="/items/",code="202"} 1`,
+		`makhzen_http_requests_total{route="/items/",code="200"} 1`,
+		`makhzen_http_requests_total{route="/items/",code="404"} 1`,
+		`makhzen_http_requests_total{route="/admin/namespaces",code="201"} 1`,
+		`makhzen_http_request_duration_seconds_count{route="/items/",code="200"} 1`,
+		`makhzen_store_keys{namespace=""} 1`,
+		`makhzen_store_keys{namespace="team-a"} 0`,
+		`makhzen_cluster_nodes 0`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, got)
+		}
+	}
+}
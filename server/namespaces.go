@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/namespace"
+	"github.com/wolakec/makhzen/tracing"
+)
+
+var (
+	errNamespacesDisabled = errors.New("namespaces are not enabled on this node")
+	errUnknownNamespace   = errors.New("namespace not found")
+)
+
+// NamespaceManager holds the namespaces served under /ns.
+type NamespaceManager interface {
+	Create(settings namespace.Settings) (*namespace.Namespace, error)
+	Get(name string) (*namespace.Namespace, bool)
+	List() []namespace.Settings
+}
+
+// keyspace is the store a request reads and writes, along with the
+// settings of the namespace it belongs to and the watcher of its changes,
+// if any.
+type keyspace struct {
+	name       string
+	store      ItemStore
+	watcher    EventWatcher
+	defaultTTL int64
+	replicated bool
+}
+
+// ttl returns the TTL in seconds for a write, applying the keyspace's
+// default when the write does not give one.
+func (ks keyspace) ttl(ttl int64) int64 {
+	if ttl == 0 {
+		return ks.defaultTTL
+	}
+
+	return ttl
+}
+
+func (s *MakhzenServer) defaultKeyspace() keyspace {
+	return keyspace{store: s.Store, watcher: s.Watcher, replicated: true}
+}
+
+func (s *MakhzenServer) namespaceKeyspace(name string) (keyspace, bool) {
+	if s.Namespaces == nil {
+		return keyspace{}, false
+	}
+
+	n, ok := s.Namespaces.Get(name)
+	if !ok {
+		return keyspace{}, false
+	}
+
+	ks := keyspace{
+		name:       name,
+		store:      n.Store,
+		defaultTTL: n.Settings.DefaultTTL,
+		replicated: n.Replicated(),
+	}
+	if n.Hub != nil {
+		ks.watcher = n.Hub
+	}
+
+	return ks, true
+}
+
+// adminKeyspace returns the namespace called name, or the default one
+// when name is empty, writing an error when it does not exist.
+func (s *MakhzenServer) adminKeyspace(w http.ResponseWriter, name string) (keyspace, bool) {
+	if name == "" {
+		return s.defaultKeyspace(), true
+	}
+
+	ks, ok := s.namespaceKeyspace(name)
+	if !ok {
+		http.Error(w, "namespace not found", http.StatusNotFound)
+	}
+
+	return ks, ok
+}
+
+// replicaKeyspace returns the keyspace a message from another node applies
+// to. A namespace this node has not heard of is not created with default
+// settings, which would keep its real settings from being applied when
+// they arrive, so writes to it are refused until it is created here.
+func (s *MakhzenServer) replicaKeyspace(name string) (keyspace, error) {
+	if name == "" {
+		return s.defaultKeyspace(), nil
+	}
+
+	if s.Namespaces == nil {
+		return keyspace{}, errNamespacesDisabled
+	}
+
+	if ks, ok := s.namespaceKeyspace(name); ok {
+		return ks, nil
+	}
+
+	return keyspace{}, errUnknownNamespace
+}
+
+// broadcast sends msg, the result of the request ctx belongs to, to the
+// other nodes unless the keyspace is local.
+func (s *MakhzenServer) broadcast(ctx context.Context, ks keyspace, msg broadcaster.Message) {
+	if !ks.replicated {
+		return
+	}
+
+	msg.Namespace = ks.name
+	msg.RequestID = logging.RequestID(ctx)
+	msg.Traceparent = tracing.FromContext(ctx).Traceparent()
+	s.Registry.Broadcast(msg)
+}
+
+// replicate sends the item at key, as this node holds it after a write, to
+// the other nodes replicating ks. A deleted key is sent as its tombstone.
+func (s *MakhzenServer) replicate(ctx context.Context, ks keyspace, key string) {
+	if !ks.replicated {
+		return
+	}
+
+	for _, e := range ks.store.ExportKeys([]string{key}) {
+		s.broadcast(ctx, ks, entryMessage(e))
+	}
+}
+
+// replicateDelta sends msg, carrying the delta a write made to the
+// replicated value at its key, to the other nodes replicating ks, stamped
+// with when the value was written.
+func (s *MakhzenServer) replicateDelta(ctx context.Context, ks keyspace, msg broadcaster.Message) {
+	if !ks.replicated {
+		return
+	}
+
+	for _, e := range ks.store.ExportKeys([]string{msg.Key}) {
+		msg.Timestamp = timestamp(e.Modified)
+		if e.Since != nil {
+			msg.Since = timestamp(*e.Since)
+		}
+	}
+	s.broadcast(ctx, ks, msg)
+}
+
+// nsHandler serves /ns/{name}/items/{key}, /ns/{name}/incr/{key},
+// /ns/{name}/decr/{key} and /ns/{name}/watch from the named namespace.
+func (s *MakhzenServer) nsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(r.URL.Path[len("/ns/"):], "/", 3)
+	if len(parts) == 2 && parts[1] == "watch" {
+		parts = append(parts, "")
+	}
+	if len(parts) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+
+	ks, ok := s.namespaceKeyspace(parts[0])
+	if !ok {
+		http.Error(w, errUnknownNamespace.Error(), http.StatusNotFound)
+		return
+	}
+
+	key := parts[2]
+
+	switch parts[1] {
+	case "items":
+		s.serveItem(w, r, ks, key)
+	case "incr", "decr":
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		sign := int64(1)
+		if parts[1] == "decr" {
+			sign = -1
+		}
+		s.updateCounter(w, r, ks, key, sign)
+	case "watch":
+		if key != "" {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveWatch(w, r, ks)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// namespacesHandler lists namespaces on GET and creates one on POST. New
+// namespaces are sent to the other nodes so that they are created there
+// too.
+func (s *MakhzenServer) namespacesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Namespaces == nil {
+		http.Error(w, errNamespacesDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Namespaces.List())
+	case http.MethodPost:
+		s.createNamespace(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *MakhzenServer) createNamespace(w http.ResponseWriter, r *http.Request) {
+	var settings namespace.Settings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n, err := s.Namespaces.Create(settings)
+	if err == namespace.ErrExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.logger(r).Info("created namespace", "namespace", n.Settings.Name)
+
+	state, err := json.Marshal(n.Settings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.Registry.Broadcast(broadcaster.Message{
+		Op:        broadcaster.OpNamespace,
+		State:     state,
+		RequestID: logging.RequestID(r.Context()),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(n.Settings)
+}
+
+// applyNamespace creates a namespace sent by another node, returning why
+// it could not.
+func (s *MakhzenServer) applyNamespace(logger *logging.Logger, msg broadcaster.Message) error {
+	if s.Namespaces == nil {
+		return nil
+	}
+
+	logger = logger.With("op", msg.Op)
+
+	var settings namespace.Settings
+	if err := json.Unmarshal(msg.State, &settings); err != nil {
+		logger.Error("could not apply message", "err", err)
+		return err
+	}
+
+	if _, err := s.Namespaces.Create(settings); err != nil && err != namespace.ErrExists {
+		logger.Error("could not apply message", "namespace", settings.Name, "err", err)
+		return err
+	}
+
+	logger.Info("applied message", "namespace", settings.Name)
+	return nil
+}
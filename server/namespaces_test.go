@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/namespace"
+	"github.com/wolakec/makhzen/registry"
+	"github.com/wolakec/makhzen/store"
+	"github.com/wolakec/makhzen/watch"
+)
+
+func newNamespaceServer() (*MakhzenServer, *StubRegistry) {
+	reg := StubRegistry{
+		Nodes: []registry.Node{},
+	}
+	server := NewMakhzenServer(store.New(), &reg)
+	server.Namespaces = namespace.New()
+
+	return server, &reg
+}
+
+func createNamespace(t *testing.T, server *MakhzenServer, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	request, _ := http.NewRequest(http.MethodPost, "/admin/namespaces", strings.NewReader(body))
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+
+	return response
+}
+
+func TestPOSTNamespace(t *testing.T) {
+	server, reg := newNamespaceServer()
+
+	t.Run("creates and broadcasts namespace", func(t *testing.T) {
+		response := createNamespace(t, server, `{"name": "team-a", "defaultTTL": 60}`)
+
+		assertStatus(t, response.Code, http.StatusCreated)
+
+		msg := reg.messages[len(reg.messages)-1]
+		if msg.Op != broadcaster.OpNamespace {
+			t.Errorf("got %v, want namespace message", msg)
+		}
+	})
+
+	t.Run("returns 409 on existing namespace", func(t *testing.T) {
+		response := createNamespace(t, server, `{"name": "team-a"}`)
+
+		assertStatus(t, response.Code, http.StatusConflict)
+	})
+
+	t.Run("returns 400 on invalid settings", func(t *testing.T) {
+		response := createNamespace(t, server, `{"name": "team/b"}`)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("lists namespaces", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/admin/namespaces", nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		var got []namespace.Settings
+		json.NewDecoder(response.Body).Decode(&got)
+
+		want := []namespace.Settings{
+			{Name: "team-a", DefaultTTL: 60, Eviction: "lru", Replication: namespace.ReplicateAll},
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+}
+
+func TestNamespaceItems(t *testing.T) {
+	server, reg := newNamespaceServer()
+	createNamespace(t, server, `{"name": "team-a", "defaultTTL": 60}`)
+	createNamespace(t, server, `{"name": "local", "replication": "none"}`)
+
+	t.Run("keeps keys separate from the default namespace", func(t *testing.T) {
+		request := newPutValueRequest("Region", "europe")
+		request.URL.Path = "/ns/team-a/items/Region"
+		server.ServeHTTP(httptest.NewRecorder(), request)
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newGetValueRequest("Region"))
+		assertStatus(t, response.Code, http.StatusNotFound)
+
+		request, _ = http.NewRequest(http.MethodGet, "/ns/team-a/items/Region", nil)
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		assertResponseBody(t, response.Body.String(), "europe")
+	})
+
+	t.Run("broadcasts with namespace and default ttl", func(t *testing.T) {
+		msg := reg.messages[len(reg.messages)-1]
+
+		if msg.Namespace != "team-a" || msg.TTL != 60 {
+			t.Errorf("got %v, want team-a message with ttl 60", msg)
+		}
+	})
+
+	t.Run("increments counters in namespace", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/ns/team-a/incr/hits", nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertResponseBody(t, response.Body.String(), "1")
+	})
+
+	t.Run("does not broadcast local namespace", func(t *testing.T) {
+		calls := reg.broadcasterCalls
+
+		request := newPutValueRequest("Region", "europe")
+		request.URL.Path = "/ns/local/items/Region"
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusAccepted)
+		if reg.broadcasterCalls != calls {
+			t.Errorf("expected no broadcast for local namespace")
+		}
+	})
+
+	t.Run("returns 404 on unknown namespace", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/ns/team-z/items/Region", nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusNotFound)
+	})
+}
+
+func TestNamespaceMessages(t *testing.T) {
+	server, _ := newNamespaceServer()
+
+	t.Run("creates namespace from message", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodPost, "/message", strings.NewReader(`{"op": "namespace", "key": "", "state": {"name": "team-a", "maxKeys": 5}}`))
+		server.ServeHTTP(httptest.NewRecorder(), request)
+
+		n, ok := server.Namespaces.Get("team-a")
+		if !ok || n.Settings.MaxKeys != 5 {
+			t.Errorf("expected team-a to be created with 5 max keys, got %v", n)
+		}
+	})
+
+	t.Run("applies write to namespace", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodPost, "/message", strings.NewReader(`{"namespace": "team-a", "key": "Region", "value": "europe"}`))
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+
+		n, _ := server.Namespaces.Get("team-a")
+		if got, _ := n.Store.GetValue("Region"); got != "europe" {
+			t.Errorf("incorrect value - got: %s, wanted: %s", got, "europe")
+		}
+
+		if _, ok := server.Store.GetValue("Region"); ok {
+			t.Errorf("expected write not to reach the default namespace")
+		}
+	})
+
+	t.Run("refuses write to unknown namespace", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodPost, "/message", strings.NewReader(`{"namespace": "team-b", "key": "Region", "value": "europe"}`))
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusNotFound)
+
+		if _, ok := server.Namespaces.Get("team-b"); ok {
+			t.Errorf("expected team-b not to be created with default settings")
+		}
+
+		request = httptest.NewRequest(http.MethodPost, "/message", strings.NewReader(`{"op": "namespace", "key": "", "state": {"name": "team-b", "maxKeys": 5}}`))
+		server.ServeHTTP(httptest.NewRecorder(), request)
+
+		if n, ok := server.Namespaces.Get("team-b"); !ok || n.Settings.MaxKeys != 5 {
+			t.Errorf("expected team-b to be created with 5 max keys, got %v", n)
+		}
+	})
+}
+
+func TestNamespaceWatch(t *testing.T) {
+	server, _ := newNamespaceServer()
+	server.Namespaces.(*namespace.Manager).WatchHistory = 100
+	createNamespace(t, server, `{"name": "team-a"}`)
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	t.Run("streams writes to the namespace", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/ns/team-a/watch?prefix=config/")
+		if err != nil {
+			t.Fatalf("could not watch: %s", err)
+		}
+		defer resp.Body.Close()
+
+		assertStatus(t, resp.StatusCode, http.StatusOK)
+		events := bufio.NewReader(resp.Body)
+
+		server.ServeHTTP(httptest.NewRecorder(), newPutValueRequest("config/region", "ignored"))
+		request := newPutValueRequest("config/region", "europe")
+		request.URL.Path = "/ns/team-a/items/config/region"
+		server.ServeHTTP(httptest.NewRecorder(), request)
+
+		assertEvent(t, events, watch.Event{Revision: 1, Type: "put", Key: "config/region", Value: "europe", ValueType: store.TypeString})
+	})
+
+	t.Run("returns 404 on unknown namespace", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/ns/team-z/watch")
+		if err != nil {
+			t.Fatalf("could not watch: %s", err)
+		}
+		defer resp.Body.Close()
+
+		assertStatus(t, resp.StatusCode, http.StatusNotFound)
+	})
+}
@@ -0,0 +1,649 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/resp"
+	"github.com/wolakec/makhzen/store"
+)
+
+// redisConn is the state of a client connected with the Redis protocol.
+type redisConn struct {
+	w     *resp.Writer
+	token string
+	quit  bool
+}
+
+// redisCommand is a command served over the Redis protocol. Arity counts
+// the command name, and is a minimum when negative. The keys a command
+// reads or writes, checked against the ACL, are its arguments from
+// firstKey, every step arguments.
+type redisCommand struct {
+	arity    int
+	write    bool
+	firstKey int
+	step     int
+	run      func(s *MakhzenServer, ctx context.Context, c *redisConn, args []string)
+}
+
+var redisCommands = map[string]redisCommand{
+	"PING":    {arity: -1, run: (*MakhzenServer).redisPing},
+	"ECHO":    {arity: 2, run: (*MakhzenServer).redisEcho},
+	"AUTH":    {arity: -2, run: (*MakhzenServer).redisAuth},
+	"HELLO":   {arity: -1, run: (*MakhzenServer).redisHello},
+	"SELECT":  {arity: 2, run: (*MakhzenServer).redisSelect},
+	"CLIENT":  {arity: -2, run: (*MakhzenServer).redisClient},
+	"COMMAND": {arity: -1, run: (*MakhzenServer).redisCommandInfo},
+	"QUIT":    {arity: 1, run: (*MakhzenServer).redisQuit},
+	"GET":     {arity: 2, firstKey: 1, step: 1, run: (*MakhzenServer).redisGet},
+	"MGET":    {arity: -2, firstKey: 1, step: 1, run: (*MakhzenServer).redisMGet},
+	"SET":     {arity: -3, write: true, firstKey: 1, run: (*MakhzenServer).redisSet},
+	"MSET":    {arity: -3, write: true, firstKey: 1, step: 2, run: (*MakhzenServer).redisMSet},
+	"DEL":     {arity: -2, write: true, firstKey: 1, step: 1, run: (*MakhzenServer).redisDel},
+	"EXISTS":  {arity: -2, firstKey: 1, step: 1, run: (*MakhzenServer).redisExists},
+	"INCR":    {arity: 2, write: true, firstKey: 1, run: (*MakhzenServer).redisIncr},
+	"DECR":    {arity: 2, write: true, firstKey: 1, run: (*MakhzenServer).redisIncr},
+	"INCRBY":  {arity: 3, write: true, firstKey: 1, run: (*MakhzenServer).redisIncr},
+	"DECRBY":  {arity: 3, write: true, firstKey: 1, run: (*MakhzenServer).redisIncr},
+	"EXPIRE":  {arity: 3, write: true, firstKey: 1, run: (*MakhzenServer).redisExpire},
+	"PEXPIRE": {arity: 3, write: true, firstKey: 1, run: (*MakhzenServer).redisExpire},
+	"PERSIST": {arity: 2, write: true, firstKey: 1, run: (*MakhzenServer).redisPersist},
+	"TTL":     {arity: 2, firstKey: 1, run: (*MakhzenServer).redisTTL},
+	"PTTL":    {arity: 2, firstKey: 1, run: (*MakhzenServer).redisTTL},
+	"SCAN":    {arity: -2, run: (*MakhzenServer).redisScan},
+}
+
+// ServeRedis serves the default namespace over the Redis protocol on l,
+// replicating writes like the HTTP API does, until the server is drained.
+func (s *MakhzenServer) ServeRedis(l net.Listener) error {
+	return s.acceptUntilDrained(l, s.serveRedisConn)
+}
+
+func (s *MakhzenServer) serveRedisConn(conn net.Conn) {
+	defer conn.Close()
+	defer s.interruptOnDrain(conn)()
+
+	r := resp.NewReader(conn)
+	c := &redisConn{w: resp.NewWriter(conn)}
+
+	for !c.quit {
+		args, err := r.ReadCommand()
+		if err == resp.ErrProtocol {
+			c.w.Error("ERR Protocol error")
+			c.w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		s.runRedisCommand(c, args)
+
+		if !r.Buffered() {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+
+	c.w.Flush()
+}
+
+// runRedisCommand runs the command in args, checking it against the ACL when
+// one is set.
+func (s *MakhzenServer) runRedisCommand(c *redisConn, args []string) {
+	name := strings.ToUpper(args[0])
+
+	cmd, ok := redisCommands[name]
+	if !ok {
+		s.countCommand("redis", "unknown", false)
+		c.w.Error("ERR unknown command '" + args[0] + "'")
+		return
+	}
+
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		s.countCommand("redis", name, false)
+		c.w.Error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+		return
+	}
+
+	if s.ACL != nil && name != "AUTH" && name != "HELLO" && name != "QUIT" {
+		if !s.ACL.authenticated(c.token) {
+			s.countCommand("redis", name, false)
+			c.w.Error("NOAUTH Authentication required.")
+			return
+		}
+
+		if !s.redisAllowed(c, cmd, args) {
+			s.countCommand("redis", name, false)
+			c.w.Error("NOPERM this user has no permissions to access one of the keys used in the command")
+			return
+		}
+	}
+
+	ctx, span := s.commandContext("redis " + name)
+	cmd.run(s, ctx, c, args)
+	span.End()
+
+	s.countCommand("redis", name, true)
+}
+
+func (s *MakhzenServer) redisAllowed(c *redisConn, cmd redisCommand, args []string) bool {
+	if cmd.firstKey == 0 {
+		return true
+	}
+
+	step := cmd.step
+	if step == 0 {
+		step = len(args)
+	}
+
+	for i := cmd.firstKey; i < len(args); i += step {
+		if !s.ACL.allows(c.token, access{write: cmd.write, key: args[i]}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// redisStoreError writes the reply for an error returned by the store.
+func redisStoreError(c *redisConn, err error) {
+	switch err {
+	case store.ErrNotInteger:
+		c.w.Error("ERR value is not an integer or out of range")
+	case store.ErrWrongType:
+		c.w.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	case store.ErrFull:
+		c.w.Error("OOM " + err.Error())
+	default:
+		c.w.Error("ERR " + err.Error())
+	}
+}
+
+func (s *MakhzenServer) redisPing(ctx context.Context, c *redisConn, args []string) {
+	switch len(args) {
+	case 1:
+		c.w.SimpleString("PONG")
+	case 2:
+		c.w.Bulk(args[1])
+	default:
+		c.w.Error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (s *MakhzenServer) redisEcho(ctx context.Context, c *redisConn, args []string) {
+	c.w.Bulk(args[1])
+}
+
+// redisAuth takes the token as the password, with or without a username.
+func (s *MakhzenServer) redisAuth(ctx context.Context, c *redisConn, args []string) {
+	if len(args) > 3 {
+		c.w.Error("ERR syntax error")
+		return
+	}
+
+	if s.ACL == nil {
+		c.w.Error("ERR AUTH called without any password configured")
+		return
+	}
+
+	token := args[len(args)-1]
+	if !s.ACL.authenticated(token) {
+		c.w.Error("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+
+	c.token = token
+	c.w.SimpleString("OK")
+}
+
+// redisHello switches the protocol version and authenticates, replying
+// with a description of the server.
+func (s *MakhzenServer) redisHello(ctx context.Context, c *redisConn, args []string) {
+	proto := c.w.Proto
+
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil || (v != 2 && v != 3) {
+			c.w.Error("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+	}
+
+	for i := 2; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "AUTH") && i+2 < len(args):
+			if s.ACL == nil || !s.ACL.authenticated(args[i+2]) {
+				c.w.Error("WRONGPASS invalid username-password pair or user is disabled.")
+				return
+			}
+			c.token = args[i+2]
+			i += 2
+		case strings.EqualFold(args[i], "SETNAME") && i+1 < len(args):
+			i++
+		default:
+			c.w.Error("ERR syntax error")
+			return
+		}
+	}
+
+	if s.ACL != nil && !s.ACL.authenticated(c.token) {
+		c.w.Error("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return
+	}
+
+	c.w.Proto = proto
+
+	c.w.Map(4)
+	c.w.Bulk("server")
+	c.w.Bulk("makhzen")
+	c.w.Bulk("proto")
+	c.w.Integer(int64(proto))
+	c.w.Bulk("mode")
+	c.w.Bulk("standalone")
+	c.w.Bulk("role")
+	c.w.Bulk("master")
+}
+
+// redisSelect accepts the only database there is.
+func (s *MakhzenServer) redisSelect(ctx context.Context, c *redisConn, args []string) {
+	if args[1] != "0" {
+		c.w.Error("ERR DB index is out of range")
+		return
+	}
+
+	c.w.SimpleString("OK")
+}
+
+// redisClient accepts the names and library details clients send when they
+// connect.
+func (s *MakhzenServer) redisClient(ctx context.Context, c *redisConn, args []string) {
+	switch strings.ToUpper(args[1]) {
+	case "SETNAME", "SETINFO":
+		c.w.SimpleString("OK")
+	default:
+		c.w.Error("ERR unknown subcommand '" + args[1] + "'")
+	}
+}
+
+// redisCommandInfo describes no commands, which clients such as redis-cli
+// accept.
+func (s *MakhzenServer) redisCommandInfo(ctx context.Context, c *redisConn, args []string) {
+	c.w.Array(0)
+}
+
+func (s *MakhzenServer) redisQuit(ctx context.Context, c *redisConn, args []string) {
+	c.quit = true
+	c.w.SimpleString("OK")
+}
+
+func (s *MakhzenServer) redisGet(ctx context.Context, c *redisConn, args []string) {
+	item, ok := s.Store.GetItem(args[1])
+
+	logging.FromContext(ctx, s.Logger).Debug("get item", "namespace", "", "key", args[1], "found", ok, "value", logging.Value(item.Value))
+
+	if !ok {
+		c.w.Null()
+		return
+	}
+
+	if !redisString(item) {
+		redisStoreError(c, store.ErrWrongType)
+		return
+	}
+
+	c.w.Bulk(item.Value)
+}
+
+// redisMGet serves MGET, returning nil for keys that are missing or do not
+// hold a string, as Redis does.
+func (s *MakhzenServer) redisMGet(ctx context.Context, c *redisConn, args []string) {
+	c.w.Array(len(args) - 1)
+
+	for _, key := range args[1:] {
+		if item, ok := s.Store.GetItem(key); ok && redisString(item) {
+			c.w.Bulk(item.Value)
+		} else {
+			c.w.Null()
+		}
+	}
+}
+
+// redisString reports whether item can be read as a Redis string: every
+// value can but a set, map or register, whose JSON state is not a string
+// to Redis clients.
+func redisString(item store.Item) bool {
+	switch item.Type {
+	case store.TypeSet, store.TypeMap, store.TypeRegister:
+		return false
+	}
+
+	return true
+}
+
+// redisSet serves SET key value [EX seconds | PX milliseconds] [NX | XX].
+func (s *MakhzenServer) redisSet(ctx context.Context, c *redisConn, args []string) {
+	var ttl time.Duration
+	var nx, xx bool
+
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "NX" && !xx:
+			nx = true
+		case opt == "XX" && !nx:
+			xx = true
+		case (opt == "EX" || opt == "PX") && ttl == 0 && i+1 < len(args):
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				c.w.Error("ERR invalid expire time in 'set' command")
+				return
+			}
+
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			ttl = time.Duration(n) * unit
+			i++
+		default:
+			c.w.Error("ERR syntax error")
+			return
+		}
+	}
+
+	_, err := s.putValue(ctx, args[1], args[2], 0, ttl, store.Condition{Present: xx, Missing: nx})
+
+	switch err {
+	case nil:
+		c.w.SimpleString("OK")
+	case store.ErrPresent, store.ErrMissing:
+		c.w.Null()
+	default:
+		redisStoreError(c, err)
+	}
+}
+
+func (s *MakhzenServer) redisMSet(ctx context.Context, c *redisConn, args []string) {
+	if len(args)%2 == 0 {
+		c.w.Error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+
+	for i := 1; i < len(args); i += 2 {
+		if _, err := s.putValue(ctx, args[i], args[i+1], 0, 0, store.Condition{}); err != nil {
+			redisStoreError(c, err)
+			return
+		}
+	}
+
+	c.w.SimpleString("OK")
+}
+
+func (s *MakhzenServer) redisDel(ctx context.Context, c *redisConn, args []string) {
+	var n int64
+
+	for _, key := range args[1:] {
+		if s.deleteKey(ctx, key) {
+			n++
+		}
+	}
+
+	c.w.Integer(n)
+}
+
+func (s *MakhzenServer) redisExists(ctx context.Context, c *redisConn, args []string) {
+	var n int64
+
+	for _, key := range args[1:] {
+		if _, ok := s.Store.GetItem(key); ok {
+			n++
+		}
+	}
+
+	c.w.Integer(n)
+}
+
+// redisIncr serves INCR, DECR, INCRBY and DECRBY on counters.
+func (s *MakhzenServer) redisIncr(ctx context.Context, c *redisConn, args []string) {
+	name := strings.ToUpper(args[0])
+	key := args[1]
+
+	delta := int64(1)
+	if len(args) == 3 {
+		var err error
+		delta, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			c.w.Error("ERR value is not an integer or out of range")
+			return
+		}
+	}
+
+	if strings.HasPrefix(name, "DECR") {
+		if delta == math.MinInt64 {
+			c.w.Error("ERR decrement would overflow")
+			return
+		}
+		delta = -delta
+	}
+
+	v, err := s.incrKey(ctx, key, delta)
+	if err != nil {
+		redisStoreError(c, err)
+		return
+	}
+
+	c.w.Integer(v)
+}
+
+// redisExpire serves EXPIRE and PEXPIRE. A TTL of zero or less deletes the
+// key, as it does in Redis.
+func (s *MakhzenServer) redisExpire(ctx context.Context, c *redisConn, args []string) {
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		c.w.Error("ERR value is not an integer or out of range")
+		return
+	}
+
+	key := args[1]
+
+	if n <= 0 {
+		redisReplyBool(c, s.deleteKey(ctx, key))
+		return
+	}
+
+	unit := time.Second
+	if strings.ToUpper(args[0]) == "PEXPIRE" {
+		unit = time.Millisecond
+	}
+
+	ok, err := s.expireKey(ctx, key, time.Duration(n)*unit)
+	if err != nil {
+		redisStoreError(c, err)
+		return
+	}
+
+	redisReplyBool(c, ok)
+}
+
+func (s *MakhzenServer) redisPersist(ctx context.Context, c *redisConn, args []string) {
+	ttls, err := ttlStore(s.Store)
+	if err != nil {
+		redisStoreError(c, err)
+		return
+	}
+
+	if ttl, ok := ttls.TTL(args[1]); !ok || ttl == 0 {
+		c.w.Integer(0)
+		return
+	}
+
+	ok, err := s.expireKey(ctx, args[1], 0)
+	if err != nil {
+		redisStoreError(c, err)
+		return
+	}
+
+	redisReplyBool(c, ok)
+}
+
+// redisReplyBool replies 1 when ok and 0 otherwise.
+func redisReplyBool(c *redisConn, ok bool) {
+	if ok {
+		c.w.Integer(1)
+		return
+	}
+
+	c.w.Integer(0)
+}
+
+// redisTTL serves TTL and PTTL: -2 for a missing key, -1 for a key that
+// does not expire.
+func (s *MakhzenServer) redisTTL(ctx context.Context, c *redisConn, args []string) {
+	ttls, err := ttlStore(s.Store)
+	if err != nil {
+		redisStoreError(c, err)
+		return
+	}
+
+	ttl, ok := ttls.TTL(args[1])
+
+	switch {
+	case !ok:
+		c.w.Integer(-2)
+	case ttl == 0:
+		c.w.Integer(-1)
+	case strings.ToUpper(args[0]) == "PTTL":
+		c.w.Integer(int64((ttl + time.Millisecond/2) / time.Millisecond))
+	default:
+		c.w.Integer(int64((ttl + time.Second/2) / time.Second))
+	}
+}
+
+// redisScan serves SCAN cursor [MATCH pattern] [COUNT count]. The cursor
+// is a position in the sorted keys, so a key may be returned twice, or be
+// missed, when keys before it are added or deleted during a scan.
+func (s *MakhzenServer) redisScan(ctx context.Context, c *redisConn, args []string) {
+	cursor, err := strconv.Atoi(args[1])
+	if err != nil || cursor < 0 {
+		c.w.Error("ERR invalid cursor")
+		return
+	}
+
+	count := 10
+	var match *regexp.Regexp
+
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			c.w.Error("ERR syntax error")
+			return
+		}
+
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			match, err = globRegexp(args[i+1])
+			if err != nil {
+				c.w.Error("ERR invalid pattern")
+				return
+			}
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				c.w.Error("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			c.w.Error("ERR syntax error")
+			return
+		}
+	}
+
+	keys := s.Store.Keys()
+	if cursor > len(keys) {
+		cursor = len(keys)
+	}
+
+	end := cursor + count
+	if end >= len(keys) {
+		end = len(keys)
+	}
+
+	found := []string{}
+	for _, key := range keys[cursor:end] {
+		if match != nil && !match.MatchString(key) {
+			continue
+		}
+
+		if s.ACL != nil && !s.ACL.allows(c.token, access{key: key}) {
+			continue
+		}
+
+		found = append(found, key)
+	}
+
+	next := end
+	if end == len(keys) {
+		next = 0
+	}
+
+	c.w.Array(2)
+	c.w.Bulk(strconv.Itoa(next))
+	c.w.Array(len(found))
+	for _, key := range found {
+		c.w.Bulk(key)
+	}
+}
+
+// globRegexp compiles a Redis glob pattern, in which * matches any run of
+// characters, ? any one character and [...] any one of a class, with \
+// escaping the next character.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`(?s)^`)
+
+	for i := 0; i < len(pattern); i++ {
+		switch ch := pattern[i]; ch {
+		case '*':
+			buf.WriteString(`.*`)
+		case '?':
+			buf.WriteString(`.`)
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				buf.WriteString(`\[`)
+				continue
+			}
+
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "^") {
+				buf.WriteString(`[^`)
+				class = class[1:]
+			} else {
+				buf.WriteString(`[`)
+			}
+			buf.WriteString(strings.NewReplacer(`\`, `\\`, `[`, `\[`).Replace(class))
+			buf.WriteString(`]`)
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			buf.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+
+	buf.WriteString(`$`)
+
+	return regexp.Compile(buf.String())
+}
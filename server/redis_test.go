@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/resp"
+	"github.com/wolakec/makhzen/store"
+)
+
+// redisClient sends commands to a server started with ServeRedis.
+type redisClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *resp.Writer
+}
+
+func dialRedis(t *testing.T, s *MakhzenServer) *redisClient {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeRedis(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &redisClient{conn: conn, r: bufio.NewReader(conn), w: resp.NewWriter(conn)}
+}
+
+// do sends a command and returns its reply: a string for simple strings
+// and bulk strings, an int64, nil, an error or a slice of replies.
+func (c *redisClient) do(t *testing.T, args ...string) interface{} {
+	t.Helper()
+
+	c.w.Array(len(args))
+	for _, arg := range args {
+		c.w.Bulk(arg)
+	}
+	c.w.Flush()
+
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := readReply(c.r)
+	if err != nil {
+		t.Fatalf("could not read reply to %q: %s", args, err)
+	}
+
+	return reply
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return fmt.Errorf("%s", line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '_':
+		return nil, nil
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*', '%':
+		n, _ := strconv.Atoi(line[1:])
+		if line[0] == '%' {
+			n *= 2
+		}
+		list := []interface{}{}
+		for i := 0; i < n; i++ {
+			v, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	}
+
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+func assertReply(t *testing.T, got interface{}, want interface{}) {
+	t.Helper()
+
+	if err, ok := got.(error); ok {
+		got = "error: " + err.Error()
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
+
+func TestRedis(t *testing.T) {
+	newServer := func() (*MakhzenServer, *StubRegistry) {
+		reg := &StubRegistry{}
+		return NewMakhzenServer(store.New(), reg), reg
+	}
+
+	t.Run("gets and sets values", func(t *testing.T) {
+		s, reg := newServer()
+		c := dialRedis(t, s)
+		defer s.Drain()
+
+		assertReply(t, c.do(t, "PING"), "PONG")
+		assertReply(t, c.do(t, "GET", "region"), nil)
+		assertReply(t, c.do(t, "set", "region", "eu-west"), "OK")
+		assertReply(t, c.do(t, "GET", "region"), "eu-west")
+		assertReply(t, c.do(t, "SET", "region", "us-east", "NX"), nil)
+		assertReply(t, c.do(t, "SET", "zone", "a", "XX"), nil)
+		assertReply(t, c.do(t, "SET", "zone", "a", "NX", "EX", "60"), "OK")
+		assertReply(t, c.do(t, "MSET", "a", "1", "b", "2"), "OK")
+		assertReply(t, c.do(t, "MGET", "a", "missing", "b"), []interface{}{"1", nil, "2"})
+		assertReply(t, c.do(t, "EXISTS", "a", "b", "missing"), int64(2))
+		assertReply(t, c.do(t, "DEL", "a", "missing"), int64(1))
+
+		want := []broadcaster.Message{
+			{Op: broadcaster.OpPut, Key: "region", Value: "eu-west", Type: store.TypeString},
+			{Op: broadcaster.OpPut, Key: "zone", Value: "a", Type: store.TypeString, TTL: 60},
+			{Op: broadcaster.OpPut, Key: "a", Value: "1", Type: store.TypeString},
+			{Op: broadcaster.OpPut, Key: "b", Value: "2", Type: store.TypeString},
+			{Op: broadcaster.OpDelete, Key: "a"},
+		}
+
+		for i := range reg.messages {
+			if reg.messages[i].Timestamp == 0 {
+				t.Errorf("message %d is not stamped with when it was written", i)
+			}
+			reg.messages[i].RequestID, reg.messages[i].Timestamp = "", 0
+		}
+
+		if !reflect.DeepEqual(reg.messages, want) {
+			t.Errorf("got messages %+v, want %+v", reg.messages, want)
+		}
+	})
+
+	t.Run("counts and expires", func(t *testing.T) {
+		s, reg := newServer()
+		c := dialRedis(t, s)
+		defer s.Drain()
+
+		assertReply(t, c.do(t, "INCR", "hits"), int64(1))
+		assertReply(t, c.do(t, "INCRBY", "hits", "10"), int64(11))
+		assertReply(t, c.do(t, "DECR", "hits"), int64(10))
+		assertReply(t, c.do(t, "DECRBY", "hits", "-9223372036854775808"), "error: ERR decrement would overflow")
+		assertReply(t, c.do(t, "INCRBY", "hits", "9223372036854775807"), "error: ERR increment or decrement would overflow")
+		assertReply(t, c.do(t, "SET", "region", "eu"), "OK")
+		assertReply(t, c.do(t, "INCR", "region"), "error: ERR value is not an integer or out of range")
+
+		assertReply(t, c.do(t, "GET", "hits"), "10")
+
+		s.Store.(*store.Store).SetAdd("tags", "a")
+		assertReply(t, c.do(t, "GET", "tags"), "error: WRONGTYPE Operation against a key holding the wrong kind of value")
+		assertReply(t, c.do(t, "MGET", "tags", "hits"), []interface{}{nil, "10"})
+
+		assertReply(t, c.do(t, "TTL", "hits"), int64(-1))
+		assertReply(t, c.do(t, "TTL", "missing"), int64(-2))
+		assertReply(t, c.do(t, "EXPIRE", "hits", "100"), int64(1))
+		assertReply(t, c.do(t, "TTL", "hits"), int64(100))
+		assertReply(t, c.do(t, "PERSIST", "hits"), int64(1))
+		assertReply(t, c.do(t, "TTL", "hits"), int64(-1))
+		assertReply(t, c.do(t, "PEXPIRE", "hits", "0"), int64(1))
+		assertReply(t, c.do(t, "GET", "hits"), nil)
+
+		last := reg.messages[len(reg.messages)-3:]
+		ops := []string{last[0].Op, last[1].Op, last[2].Op}
+		if !reflect.DeepEqual(ops, []string{broadcaster.OpExpire, broadcaster.OpExpire, broadcaster.OpDelete}) || last[0].TTL != 100 {
+			t.Errorf("got messages %+v", last)
+		}
+	})
+
+	t.Run("scans keys", func(t *testing.T) {
+		s, _ := newServer()
+		c := dialRedis(t, s)
+		defer s.Drain()
+
+		for _, key := range []string{"user:1", "user:2", "order:1", "user:3"} {
+			c.do(t, "SET", key, "x")
+		}
+
+		assertReply(t, c.do(t, "SCAN", "0", "COUNT", "2"), []interface{}{"2", []interface{}{"order:1", "user:1"}})
+		assertReply(t, c.do(t, "SCAN", "2", "COUNT", "2"), []interface{}{"0", []interface{}{"user:2", "user:3"}})
+		assertReply(t, c.do(t, "SCAN", "0", "MATCH", "user:[13]"), []interface{}{"0", []interface{}{"user:1", "user:3"}})
+	})
+
+	t.Run("speaks RESP3 after HELLO", func(t *testing.T) {
+		s, _ := newServer()
+		c := dialRedis(t, s)
+		defer s.Drain()
+
+		hello, ok := c.do(t, "HELLO", "3").([]interface{})
+		if !ok || hello[2] != "proto" || hello[3] != int64(3) {
+			t.Errorf("got %#v", hello)
+		}
+
+		c.do(t, "GET", "missing")
+		if c.r.Buffered() != 0 {
+			t.Errorf("unexpected extra reply")
+		}
+
+		assertReply(t, c.do(t, "HELLO", "4"), "error: NOPROTO unsupported protocol version")
+	})
+
+	t.Run("requires a token when there is an ACL", func(t *testing.T) {
+		s, _ := newServer()
+		s.ACL = &ACL{
+			Roles: map[string]Role{
+				"reader": {Rules: []Rule{{Prefix: "config/", Read: true}}},
+			},
+			Tokens: map[string][]string{"r3ad": {"reader"}},
+		}
+		c := dialRedis(t, s)
+		defer s.Drain()
+
+		assertReply(t, c.do(t, "GET", "config/region"), "error: NOAUTH Authentication required.")
+		assertReply(t, c.do(t, "AUTH", "wrong"), "error: WRONGPASS invalid username-password pair or user is disabled.")
+		assertReply(t, c.do(t, "AUTH", "default", "r3ad"), "OK")
+		assertReply(t, c.do(t, "GET", "config/region"), nil)
+		assertReply(t, c.do(t, "SET", "config/region", "eu"), "error: NOPERM this user has no permissions to access one of the keys used in the command")
+		assertReply(t, c.do(t, "MGET", "config/region", "secret"), "error: NOPERM this user has no permissions to access one of the keys used in the command")
+	})
+
+	t.Run("rejects unknown commands and bad arguments", func(t *testing.T) {
+		s, _ := newServer()
+		c := dialRedis(t, s)
+		defer s.Drain()
+
+		assertReply(t, c.do(t, "FLUSHALL"), "error: ERR unknown command 'FLUSHALL'")
+		assertReply(t, c.do(t, "GET"), "error: ERR wrong number of arguments for 'get' command")
+		assertReply(t, c.do(t, "SET", "k", "v", "EX", "-1"), "error: ERR invalid expire time in 'set' command")
+		assertReply(t, c.do(t, "SET", "k", "v", "NX", "XX"), "error: ERR syntax error")
+	})
+
+	t.Run("closes connections when draining", func(t *testing.T) {
+		s, _ := newServer()
+		c := dialRedis(t, s)
+
+		assertReply(t, c.do(t, "PING"), "PONG")
+		if s.WaitForConns(10 * time.Millisecond) {
+			t.Errorf("expected to wait for the open connection")
+		}
+		s.Drain()
+
+		c.conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.r.ReadByte(); err == nil {
+			t.Errorf("expected the connection to be closed")
+		}
+
+		if !s.WaitForConns(time.Second) {
+			t.Errorf("expected every connection to be closed")
+		}
+	})
+}
+
+func TestGlobRegexp(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"*", "config/region", true},
+		{"config/*", "config/region", true},
+		{"user:?", "user:1", true},
+		{"user:?", "user:12", false},
+		{"user:[^1]", "user:2", true},
+		{"user:[^1]", "user:1", false},
+		{"a\\*b", "a*b", true},
+		{"a\\*b", "axb", false},
+		{"a.b", "axb", false},
+		{"[", "[", true},
+	}
+
+	for _, tc := range cases {
+		re, err := globRegexp(tc.pattern)
+		if err != nil {
+			t.Fatalf("globRegexp(%q) returned error: %s", tc.pattern, err)
+		}
+
+		if got := re.MatchString(tc.key); got != tc.want {
+			t.Errorf("%q matching %q: got %v, want %v", tc.pattern, tc.key, got, tc.want)
+		}
+	}
+}
@@ -1,35 +1,239 @@
 package server
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"math"
+	"mime"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/faults"
+	"github.com/wolakec/makhzen/logging"
+	"github.com/wolakec/makhzen/metrics"
+	"github.com/wolakec/makhzen/proto"
 	"github.com/wolakec/makhzen/registry"
+	"github.com/wolakec/makhzen/store"
+	"github.com/wolakec/makhzen/tracing"
+	"github.com/wolakec/makhzen/watch"
 )
 
 type MakhzenServer struct {
-	Store    ItemStore
-	Registry NodeRegistry
+	Store      ItemStore
+	Registry   NodeRegistry
+	Watcher    EventWatcher
+	Namespaces NamespaceManager
+	ACL        *ACL
+	// Verifier, when set, rejects messages from other nodes that are not
+	// signed with the cluster secret.
+	Verifier MessageVerifier
+	// PeerHandler serves the routes used by other nodes. When PeerOnly is
+	// set they are only served by PeerHandler, on a listener of its own, and
+	// not by Handler.
+	PeerHandler http.Handler
+	PeerOnly    bool
+	// Metrics, when set, records requests and is served on /metrics.
+	Metrics *metrics.Registry
+	// MinPeers is how many other nodes must be reachable for /readyz to
+	// report the node as ready.
+	MinPeers int
+	// Logger records requests and replication. Each request logs through a
+	// logger carrying its request ID.
+	Logger *logging.Logger
+	// Tracer, when set, traces requests and the writes they apply.
+	Tracer *tracing.Tracer
+	// Peers sends the requests other than messages that consistency checks
+	// make to other nodes.
+	Peers PeerRequester
+	// Faults, when set, is served on /admin/faults so that faults can be
+	// injected into the messages sent to other nodes. It is for testing.
+	Faults *faults.Transport
 	http.Handler
+
+	ready     int32
+	drainOnce sync.Once
+	draining  chan struct{}
+	// conns counts the Redis and memcached connections being served.
+	conns int64
 }
 
+// ItemStore holds the values of a keyspace, with what every request needs
+// to read and write them and to replicate the writes. What only some
+// requests need is split out into CRDTStore, TTLStore and DigestStore,
+// which a store implements when it supports them; requests needing one
+// a store does not implement fail with errUnsupported. *store.Store
+// implements them all.
 type ItemStore interface {
 	GetValue(key string) (string, bool)
 	Set(key string, value string) string
+	SetWithTTL(key string, value string, ttl time.Duration) string
+	SetTyped(key string, value string, typ string, ttl time.Duration) (string, error)
+	SetContent(key string, data string, contentType string, ttl time.Duration) (string, error)
+	SetIf(key string, value string, typ string, flags uint32, ttl time.Duration, cond store.Condition) (store.Item, error)
+	GetItem(key string) (store.Item, bool)
+	Delete(key string) bool
+	Keys() []string
+	Stats() store.Stats
+	ExportKeys(keys []string) []store.Entry
+	Import(e store.Entry, merge bool) (bool, error)
+}
+
+// CRDTStore changes counters, sets, maps and registers, returning the
+// state or delta to replicate.
+type CRDTStore interface {
+	Incr(key string, delta int64) (int64, store.PNCounter, error)
+	IncrUnsigned(key string, delta uint64, decr bool) (uint64, store.PNCounter, error)
+	SetAdd(key string, elem string) ([]byte, error)
+	SetRemove(key string, elem string) ([]byte, error)
+	MapSet(key string, field string, value string) ([]byte, error)
+	MapRemove(key string, field string) ([]byte, error)
+	RegisterSet(key string, value string) ([]byte, error)
+}
+
+// TTLStore changes and reports when values expire.
+type TTLStore interface {
+	Expire(key string, ttl time.Duration) bool
+	TTL(key string) (time.Duration, bool)
+}
+
+// DigestStore exports every value, for exports and snapshots, and digests
+// them for consistency checks.
+type DigestStore interface {
+	Export() []store.Entry
+	Digests(ranges int) []store.RangeDigest
+	Versions(ranges int, in []int) []store.KeyVersion
+}
+
+// crdtStore returns st as a CRDTStore, or errUnsupported when it is not one.
+func crdtStore(st ItemStore) (CRDTStore, error) {
+	c, ok := st.(CRDTStore)
+	if !ok {
+		return nil, errUnsupported
+	}
+
+	return c, nil
 }
 
+// ttlStore returns st as a TTLStore, or errUnsupported when it is not one.
+func ttlStore(st ItemStore) (TTLStore, error) {
+	t, ok := st.(TTLStore)
+	if !ok {
+		return nil, errUnsupported
+	}
+
+	return t, nil
+}
+
+// digestStore returns st as a DigestStore, or errUnsupported when it is
+// not one.
+func digestStore(st ItemStore) (DigestStore, error) {
+	d, ok := st.(DigestStore)
+	if !ok {
+		return nil, errUnsupported
+	}
+
+	return d, nil
+}
+
+// ItemBody is the body of a PUT to /items. Value is either a JSON string or
+// a JSON number; when Type is omitted it is inferred as string, int or
+// float. Values of type bytes are sent base64 encoded. TTL is in seconds;
+// zero stores the value without an expiry.
 type ItemBody struct {
-	Value string `json:"value"`
+	Value json.RawMessage `json:"value"`
+	Type  string          `json:"type,omitempty"`
+	TTL   int64           `json:"ttl,omitempty"`
+}
+
+// OperationBody is the body of a POST to /items, changing a set, map or
+// register in place. Op is one of add or remove (with Element) for sets,
+// field-set or field-remove (with Field and Value) for maps, or assign
+// (with Value) for registers.
+type OperationBody struct {
+	Op      string `json:"op"`
+	Element string `json:"element,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Value   string `json:"value,omitempty"`
+}
+
+var errUnknownOperation = errors.New("op must be one of add, remove, field-set, field-remove or assign")
+
+var errInvalidBody = errors.New("value must be a JSON string or number")
+
+// errUnsupported is returned for requests needing something the store does
+// not support, such as counters or TTLs.
+var errUnsupported = errors.New("not supported by this store")
+
+// typedValue returns the value in the form held by the store, and its type.
+func (b ItemBody) typedValue() (string, string, error) {
+	if len(b.Value) == 0 {
+		return "", store.TypeString, errInvalidBody
+	}
+
+	if b.Value[0] != '"' {
+		var n json.Number
+		if err := json.Unmarshal(b.Value, &n); err != nil {
+			return "", "", errInvalidBody
+		}
+
+		typ := b.Type
+		if typ == "" {
+			typ = store.TypeInt
+			if _, err := n.Int64(); err != nil {
+				typ = store.TypeFloat
+			}
+		}
+
+		return n.String(), typ, nil
+	}
+
+	var v string
+	if err := json.Unmarshal(b.Value, &v); err != nil {
+		return "", "", errInvalidBody
+	}
+
+	switch b.Type {
+	case "":
+		return v, store.TypeString, nil
+	case store.TypeBytes:
+		data, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return "", "", err
+		}
+		return string(data), store.TypeBytes, nil
+	}
+
+	return v, b.Type, nil
 }
 
 type NodeRegistry interface {
 	AddNode(node registry.Node) registry.Node
 	GetNodes() []registry.Node
-	Broadcast(key string, value string)
+	Broadcast(msg broadcaster.Message)
+	Status() []registry.PeerStatus
+	Synced(namespace string, addr string, asOf time.Time)
+}
+
+// MessageVerifier checks the signature of a message from another node,
+// posted to it or streamed over Peer.Replicate.
+type MessageVerifier interface {
+	Verify(r *http.Request, body []byte) error
+	VerifyMessage(m *proto.Message) error
+}
+
+// EventWatcher streams changes applied to the local store.
+type EventWatcher interface {
+	Subscribe(f watch.Filter, since uint64) (*watch.Subscription, error)
 }
 
 func NewMakhzenServer(store ItemStore, registry NodeRegistry) *MakhzenServer {
@@ -37,14 +241,42 @@ func NewMakhzenServer(store ItemStore, registry NodeRegistry) *MakhzenServer {
 
 	s.Store = store
 	s.Registry = registry
+	s.Logger = logging.New(os.Stderr, logging.Info)
+	s.draining = make(chan struct{})
 
 	router := http.NewServeMux()
 
 	router.Handle("/nodes", http.HandlerFunc(s.nodesHandler))
 	router.Handle("/items/", http.HandlerFunc(s.itemsHandler))
-	router.Handle("/message", http.HandlerFunc(s.messageHandler))
-
-	s.Handler = router
+	router.Handle("/message", s.peerRoute(s.messageHandler))
+	router.Handle("/watch", http.HandlerFunc(s.watchHandler))
+	router.Handle("/incr/", http.HandlerFunc(s.counterHandler))
+	router.Handle("/decr/", http.HandlerFunc(s.counterHandler))
+	router.Handle("/admin/stats", http.HandlerFunc(s.statsHandler))
+	router.Handle("/admin/namespaces", http.HandlerFunc(s.namespacesHandler))
+	router.Handle("/admin/export", http.HandlerFunc(s.exportHandler))
+	router.Handle("/admin/import", http.HandlerFunc(s.importHandler))
+	router.Handle("/ns/", http.HandlerFunc(s.nsHandler))
+	router.Handle("/metrics", http.HandlerFunc(s.metricsHandler))
+	router.Handle("/healthz", http.HandlerFunc(s.healthzHandler))
+	router.Handle("/readyz", http.HandlerFunc(s.readyzHandler))
+	router.Handle("/cluster/status", http.HandlerFunc(s.clusterStatusHandler))
+	router.Handle("/cluster/digest", s.peerRoute(s.digestHandler))
+	router.Handle("/cluster/repair", s.peerRoute(s.repairHandler))
+	router.Handle("/admin/check", http.HandlerFunc(s.checkHandler))
+	router.Handle("/admin/faults", http.HandlerFunc(s.faultsHandler))
+	router.Handle(makhzenService, http.HandlerFunc(s.rpcHandler))
+	router.Handle(broadcaster.ReplicatePath, s.peerRoute(s.replicateHandler))
+
+	s.Handler = s.instrument(router, s.withTracing(router, s.withRequestID(s.withAuth(router))))
+
+	peer := http.NewServeMux()
+	peer.Handle("/message", http.HandlerFunc(s.messageHandler))
+	peer.Handle("/cluster/digest", http.HandlerFunc(s.digestHandler))
+	peer.Handle("/cluster/repair", http.HandlerFunc(s.repairHandler))
+	peer.Handle(broadcaster.ReplicatePath, http.HandlerFunc(s.replicateHandler))
+
+	s.PeerHandler = s.instrument(peer, s.withTracing(peer, s.withRequestID(s.withAuth(peer))))
 
 	return s
 }
@@ -69,69 +301,524 @@ func (s *MakhzenServer) createNode(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 }
 
-func (s *MakhzenServer) messageHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// peerRoute serves a route used by other nodes on Handler, unless it is
+// only served by PeerHandler.
+func (s *MakhzenServer) peerRoute(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.PeerOnly {
+			http.NotFound(w, r)
+			return
+		}
+
+		next(w, r)
+	})
+}
 
+// readPeerBody reads the JSON body of a request from another node into v,
+// first checking its signature when s.Verifier is set. It writes an error
+// and returns false when the body cannot be read or is not signed.
+func (s *MakhzenServer) readPeerBody(w http.ResponseWriter, r *http.Request, logger *logging.Logger, v interface{}) bool {
 	b, err := ioutil.ReadAll(r.Body)
 
 	if err != nil {
-		log.Fatal(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	if s.Verifier != nil {
+		if err := s.Verifier.Verify(r, b); err != nil {
+			logger.Warn("rejected message", "path", r.URL.Path, "err", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return false
+		}
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
 	}
 
+	return true
+}
+
+// messageHandler applies a message from another node, answering 200 only
+// once it has been applied, so that the sender counts a message that could
+// not be, for example because the store is full, as not delivered.
+func (s *MakhzenServer) messageHandler(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger(r).With("node", r.RemoteAddr)
+
 	var msg broadcaster.Message
-	err = json.Unmarshal(b, &msg)
+	if !s.readPeerBody(w, r, logger, &msg) {
+		return
+	}
 
+	if err := s.applyMessage(r.Context(), logger, msg); err != nil {
+		switch {
+		case msg.Op == broadcaster.OpNamespace:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err == errUnknownNamespace || err == errNamespacesDisabled:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			storeError(w, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// applyMessage applies a message from another node, as part of the request
+// ctx belongs to, returning why it could not.
+func (s *MakhzenServer) applyMessage(ctx context.Context, logger *logging.Logger, msg broadcaster.Message) error {
+	if msg.Op == broadcaster.OpPing {
+		return nil
+	}
+
+	if msg.Op == broadcaster.OpNamespace {
+		return s.applyNamespace(logger, msg)
+	}
+
+	logger = logger.With("op", msg.Op, "namespace", msg.Namespace, "key", msg.Key)
+
+	ks, err := s.replicaKeyspace(msg.Namespace)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("could not apply message", "err", err)
+		return err
+	}
+
+	span := s.storeSpan(ctx, ks, msg.Op, msg.Key)
+
+	// Writes are applied as of when they were made on the node that sent
+	// them, so that every node keeps the last write to a key whatever
+	// order they arrive in.
+	if msg.Op == broadcaster.OpExpire {
+		var ttls TTLStore
+		if ttls, err = ttlStore(ks.store); err == nil {
+			ttls.Expire(msg.Key, time.Duration(msg.TTL)*time.Second)
+		}
+	} else {
+		_, err = ks.store.Import(messageEntry(msg), true)
 	}
 
-	s.Store.Set(msg.Key, msg.Value)
+	span.SetError(err)
+	span.End()
 
-	log.Printf("recieved message from node: %s, key: %s, value: %s", r.RemoteAddr, msg.Key, msg.Value)
+	if err != nil {
+		logger.Error("could not apply message", "err", err)
+		return err
+	}
+
+	logger.Info("applied message", "value", logging.Value(msg.Value))
+	return nil
 }
 
 func (s *MakhzenServer) itemsHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Path[len("/items/"):]
 
+	s.serveItem(w, r, s.defaultKeyspace(), key)
+}
+
+func (s *MakhzenServer) serveItem(w http.ResponseWriter, r *http.Request, ks keyspace, key string) {
 	switch r.Method {
 	case http.MethodPut:
-		s.updateItem(w, r, key)
+		s.updateItem(w, r, ks, key)
+	case http.MethodPost:
+		s.applyOperation(w, r, ks, key)
 	case http.MethodGet:
-		s.getItem(w, key)
+		s.getItem(w, r, ks, key)
+	case http.MethodDelete:
+		s.deleteItem(w, r, ks, key)
 	}
 }
 
-func (s *MakhzenServer) updateItem(w http.ResponseWriter, r *http.Request, key string) {
+func (s *MakhzenServer) updateItem(w http.ResponseWriter, r *http.Request, ks keyspace, key string) {
 
-	w.WriteHeader(http.StatusAccepted)
+	if !isJSON(r.Header.Get("Content-Type")) {
+		s.uploadItem(w, r, ks, key)
+		return
+	}
 
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Fatal(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	var item ItemBody
 	err = json.Unmarshal(b, &item)
 	if err != nil {
-		log.Fatal(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	value, typ, err := item.typedValue()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ttl := ks.ttl(item.TTL)
+
+	span := s.storeSpan(r.Context(), ks, broadcaster.OpPut, key)
+	v, err := ks.store.SetTyped(key, value, typ, time.Duration(ttl)*time.Second)
+	span.SetError(err)
+	span.End()
+
+	if err != nil {
+		storeError(w, err)
+		return
 	}
 
-	v := s.Store.Set(key, item.Value)
-	log.Printf("PUT - key %s, value %s", key, v)
+	w.WriteHeader(http.StatusAccepted)
+	s.logger(r).Info("put item", "namespace", ks.name, "key", key, "type", typ, "value", logging.Value(v))
 
-	s.Registry.Broadcast(key, item.Value)
+	s.replicate(r.Context(), ks, key)
 
 	fmt.Fprint(w, v)
 }
 
-func (s *MakhzenServer) getItem(w http.ResponseWriter, key string) {
+// uploadItem stores the raw body of a PUT as bytes, keeping its content
+// type to be returned on GET. A TTL in seconds can be given with ?ttl=.
+func (s *MakhzenServer) uploadItem(w http.ResponseWriter, r *http.Request, ks keyspace, key string) {
+	var ttl int64
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		var err error
+		ttl, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "ttl must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ttl = ks.ttl(ttl)
+
+	contentType := r.Header.Get("Content-Type")
+
+	span := s.storeSpan(r.Context(), ks, broadcaster.OpPut, key)
+	_, err = ks.store.SetContent(key, string(data), contentType, time.Duration(ttl)*time.Second)
+	span.SetError(err)
+	span.End()
+
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	s.logger(r).Info("put item", "namespace", ks.name, "key", key, "type", store.TypeBytes, "contentType", contentType, "bytes", len(data))
+
+	s.replicate(r.Context(), ks, key)
+}
+
+// isJSON reports whether a PUT body should be read as an ItemBody. Bodies
+// without a content type, or sent as a form as curl -d sends them, are
+// treated as JSON for older clients.
+func isJSON(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+
+	t, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (t == "application/json" || t == "application/x-www-form-urlencoded")
+}
+
+func (s *MakhzenServer) getItem(w http.ResponseWriter, r *http.Request, ks keyspace, key string) {
+
+	item, ok := ks.store.GetItem(key)
+
+	if ok == false {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		w.Header().Set("X-Makhzen-Type", item.Type)
+		switch {
+		case item.ContentType != "":
+			w.Header().Set("Content-Type", item.ContentType)
+		case item.Type == store.TypeBytes:
+			w.Header().Set("Content-Type", "application/octet-stream")
+		case item.Type == store.TypeSet, item.Type == store.TypeMap, item.Type == store.TypeRegister:
+			w.Header().Set("Content-Type", "application/json")
+		}
+	}
+
+	s.logger(r).Debug("get item", "namespace", ks.name, "key", key, "found", ok, "value", logging.Value(item.Value))
+	io.WriteString(w, item.Value)
+}
+
+// storeError writes the response for an error returned by the store.
+func storeError(w http.ResponseWriter, err error) {
+	switch err {
+	case store.ErrInvalidValue, store.ErrUnknownType:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case store.ErrWrongType, store.ErrNotInteger, store.ErrOverflow:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case store.ErrMissing:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case store.ErrFull:
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	case errUnsupported:
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// applyOperation changes the set, map or register at key and replicates
+// the resulting delta to the other nodes.
+func (s *MakhzenServer) applyOperation(w http.ResponseWriter, r *http.Request, ks keyspace, key string) {
+	var op OperationBody
+	if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	crdts, err := crdtStore(ks.store)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	var typ string
+	var delta []byte
+
+	span := s.storeSpan(r.Context(), ks, op.Op, key)
+
+	switch op.Op {
+	case "add":
+		typ = store.TypeSet
+		delta, err = crdts.SetAdd(key, op.Element)
+	case "remove":
+		typ = store.TypeSet
+		delta, err = crdts.SetRemove(key, op.Element)
+	case "field-set":
+		typ = store.TypeMap
+		delta, err = crdts.MapSet(key, op.Field, op.Value)
+	case "field-remove":
+		typ = store.TypeMap
+		delta, err = crdts.MapRemove(key, op.Field)
+	case "assign":
+		typ = store.TypeRegister
+		delta, err = crdts.RegisterSet(key, op.Value)
+	default:
+		err = errUnknownOperation
+	}
+
+	span.SetError(err)
+	span.End()
+
+	if err == errUnknownOperation {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	s.logger(r).Info("updated item", "namespace", ks.name, "key", key, "op", op.Op)
+
+	s.replicateDelta(r.Context(), ks, broadcaster.Message{
+		Op:    broadcaster.OpMerge,
+		Key:   key,
+		Type:  typ,
+		State: delta,
+	})
+
+	item, _ := ks.store.GetItem(key)
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, item.Value)
+}
+
+// counterHandler increments (/incr/{key}) or decrements (/decr/{key}) a
+// counter by ?by=, defaulting to 1, and replicates the counter's state so
+// that concurrent updates on different nodes add up.
+func (s *MakhzenServer) counterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/incr/") {
+		s.updateCounter(w, r, s.defaultKeyspace(), r.URL.Path[len("/incr/"):], 1)
+	} else {
+		s.updateCounter(w, r, s.defaultKeyspace(), r.URL.Path[len("/decr/"):], -1)
+	}
+}
+
+func (s *MakhzenServer) updateCounter(w http.ResponseWriter, r *http.Request, ks keyspace, key string, sign int64) {
+	delta := int64(1)
+	if by := r.URL.Query().Get("by"); by != "" {
+		var err error
+		delta, err = strconv.ParseInt(by, 10, 64)
+		if err != nil || (sign < 0 && delta == math.MinInt64) {
+			http.Error(w, "by must be an integer within range", http.StatusBadRequest)
+			return
+		}
+	}
+
+	crdts, err := crdtStore(ks.store)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	span := s.storeSpan(r.Context(), ks, "incr", key)
+	v, entries, err := crdts.Incr(key, sign*delta)
+	span.SetError(err)
+	span.End()
+
+	if err != nil {
+		storeError(w, err)
+		return
+	}
 
-	val, ok := s.Store.GetValue(key)
+	state, err := json.Marshal(entries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.logger(r).Info("updated counter", "namespace", ks.name, "key", key, "delta", sign*delta, "value", logging.Value(strconv.FormatInt(v, 10)))
+
+	s.replicateDelta(r.Context(), ks, broadcaster.Message{
+		Op:    broadcaster.OpMerge,
+		Key:   key,
+		Type:  store.TypeCounter,
+		State: state,
+	})
+
+	fmt.Fprint(w, v)
+}
+
+func (s *MakhzenServer) deleteItem(w http.ResponseWriter, r *http.Request, ks keyspace, key string) {
+	span := s.storeSpan(r.Context(), ks, broadcaster.OpDelete, key)
+	ok := ks.store.Delete(key)
+	span.End()
 
 	if ok == false {
 		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	s.logger(r).Info("deleted item", "namespace", ks.name, "key", key)
+
+	s.replicate(r.Context(), ks, key)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// statsHandler reports the size of the local store, or of the namespace
+// given by ?ns=, against its limits and how many entries have been
+// evicted, expired or rejected.
+func (s *MakhzenServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ks := s.defaultKeyspace()
+
+	if name := r.URL.Query().Get("ns"); name != "" {
+		var ok bool
+		ks, ok = s.namespaceKeyspace(name)
+		if !ok {
+			http.Error(w, "namespace not found", http.StatusNotFound)
+			return
+		}
 	}
 
-	log.Printf("GET - key %s, value %s", key, val)
-	fmt.Fprint(w, val)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ks.store.Stats())
+}
+
+func (s *MakhzenServer) watchHandler(w http.ResponseWriter, r *http.Request) {
+	s.serveWatch(w, r, s.defaultKeyspace())
+}
+
+// serveWatch streams events in ks for ?key= or ?prefix= as Server-Sent
+// Events. Each event carries its revision as the SSE id, so a client
+// reconnecting with Last-Event-ID (or ?since=) resumes without missing
+// events.
+func (s *MakhzenServer) serveWatch(w http.ResponseWriter, r *http.Request, ks keyspace) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if ks.watcher == nil {
+		http.Error(w, "watch is not enabled on this node", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+
+	var rev uint64
+	if since != "" {
+		var err error
+		rev, err = strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid revision", http.StatusBadRequest)
+			return
+		}
+	}
+
+	filter := watch.Filter{
+		Key:    r.URL.Query().Get("key"),
+		Prefix: r.URL.Query().Get("prefix"),
+	}
+
+	sub, err := ks.watcher.Subscribe(filter, rev)
+	if err == watch.ErrCompacted {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.draining:
+			return
+		case ev, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(ev)
+			if err != nil {
+				s.logger(r).Error("could not encode event", "revision", ev.Revision, "err", err)
+				continue
+			}
+
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Revision, ev.Type, data)
+			flusher.Flush()
+		}
+	}
 }
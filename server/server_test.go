@@ -1,17 +1,26 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/wolakec/makhzen/broadcaster"
 	"github.com/wolakec/makhzen/registry"
+	"github.com/wolakec/makhzen/store"
+	"github.com/wolakec/makhzen/watch"
 )
 
 type StubItemStore struct {
@@ -28,9 +37,77 @@ func (s *StubItemStore) Set(key string, v string) string {
 	return v
 }
 
+func (s *StubItemStore) SetWithTTL(key string, v string, ttl time.Duration) string {
+	return s.Set(key, v)
+}
+
+func (s *StubItemStore) SetTyped(key string, v string, typ string, ttl time.Duration) (string, error) {
+	return s.Set(key, v), nil
+}
+
+func (s *StubItemStore) SetContent(key string, data string, contentType string, ttl time.Duration) (string, error) {
+	return s.Set(key, data), nil
+}
+
+func (s *StubItemStore) SetIf(key string, v string, typ string, flags uint32, ttl time.Duration, cond store.Condition) (store.Item, error) {
+	if _, ok := s.items[key]; ok && cond.Missing {
+		return store.Item{}, store.ErrPresent
+	} else if !ok && cond.Present {
+		return store.Item{}, store.ErrMissing
+	}
+
+	return store.Item{Value: s.Set(key, v), Type: typ, Flags: flags}, nil
+}
+
+func (s *StubItemStore) Keys() []string {
+	keys := []string{}
+	for k := range s.items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *StubItemStore) Stats() store.Stats {
+	return store.Stats{Keys: len(s.items)}
+}
+
+func (s *StubItemStore) Import(e store.Entry, merge bool) (bool, error) {
+	if e.Deleted {
+		return s.Delete(e.Key), nil
+	}
+
+	s.Set(e.Key, e.Value)
+	return true, nil
+}
+
+func (s *StubItemStore) ExportKeys(keys []string) []store.Entry {
+	entries := []store.Entry{}
+	for _, k := range keys {
+		if v, ok := s.items[k]; ok {
+			entries = append(entries, store.Entry{Key: k, Type: store.TypeString, Value: v})
+		}
+	}
+	return entries
+}
+
+func (s *StubItemStore) GetItem(key string) (store.Item, bool) {
+	v, ok := s.items[key]
+	return store.Item{Value: v, Type: store.TypeString}, ok
+}
+
+func (s *StubItemStore) Delete(key string) bool {
+	_, ok := s.items[key]
+	delete(s.items, key)
+	return ok
+}
+
 type StubRegistry struct {
 	Nodes            []registry.Node
+	Statuses         []registry.PeerStatus
+	mu               sync.Mutex
 	broadcasterCalls int
+	messages         []broadcaster.Message
 }
 
 func (r *StubRegistry) AddNode(node registry.Node) registry.Node {
@@ -42,10 +119,20 @@ func (r *StubRegistry) GetNodes() []registry.Node {
 	return r.Nodes
 }
 
-func (r *StubRegistry) Broadcast(key string, value string) {
+func (r *StubRegistry) Broadcast(msg broadcaster.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	r.broadcasterCalls = r.broadcasterCalls + 1
+	r.messages = append(r.messages, msg)
+}
+
+func (r *StubRegistry) Status() []registry.PeerStatus {
+	return r.Statuses
 }
 
+func (r *StubRegistry) Synced(namespace string, addr string, asOf time.Time) {}
+
 func TestGETItems(t *testing.T) {
 	store := StubItemStore{
 		map[string]string{
@@ -143,6 +230,357 @@ func TestPUTItems(t *testing.T) {
 	})
 }
 
+func TestPUTTypedItems(t *testing.T) {
+	itemStore := store.New()
+	reg := StubRegistry{
+		Nodes: []registry.Node{},
+	}
+	server := NewMakhzenServer(itemStore, &reg)
+
+	cases := []struct {
+		name     string
+		body     string
+		wantBody string
+		wantType string
+	}{
+		{"infers int", `{"value": 42}`, "42", store.TypeInt},
+		{"infers float", `{"value": 1.5}`, "1.5", store.TypeFloat},
+		{"parses typed string", `{"value": "0042", "type": "int"}`, "42", store.TypeInt},
+		{"decodes bytes", `{"value": "AP8=", "type": "bytes"}`, "\x00\xff", store.TypeBytes},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodPut, "/items/typed", strings.NewReader(c.body))
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertStatus(t, response.Code, http.StatusAccepted)
+
+			response = httptest.NewRecorder()
+			server.ServeHTTP(response, newGetValueRequest("typed"))
+
+			assertResponseBody(t, response.Body.String(), c.wantBody)
+			if got := response.Header().Get("X-Makhzen-Type"); got != c.wantType {
+				t.Errorf("type incorrect - got '%s', wanted '%s'", got, c.wantType)
+			}
+		})
+	}
+
+	t.Run("replicates bytes losslessly", func(t *testing.T) {
+		msg := reg.messages[len(reg.messages)-1]
+
+		if msg.Type != store.TypeBytes || string(msg.Data) != "\x00\xff" {
+			t.Errorf("got %v, want bytes message", msg)
+		}
+	})
+
+	t.Run("returns 400 on mismatched type", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPut, "/items/typed", strings.NewReader(`{"value": "europe", "type": "int"}`))
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+}
+
+func TestPUTRawItems(t *testing.T) {
+	itemStore := store.New()
+	reg := StubRegistry{
+		Nodes: []registry.Node{},
+	}
+	server := NewMakhzenServer(itemStore, &reg)
+	data := "\x89PNG\r\n\x1a\n\x00\xff"
+
+	t.Run("returns raw body with its content type", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPut, "/items/logo", strings.NewReader(data))
+		request.Header.Set("Content-Type", "image/png")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusAccepted)
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newGetValueRequest("logo"))
+
+		assertResponseBody(t, response.Body.String(), data)
+		if got := response.Header().Get("Content-Type"); got != "image/png" {
+			t.Errorf("content type incorrect - got '%s', wanted '%s'", got, "image/png")
+		}
+	})
+
+	t.Run("replicates raw body losslessly", func(t *testing.T) {
+		msg := reg.messages[len(reg.messages)-1]
+
+		b, _ := json.Marshal(msg)
+		peer := store.New()
+		peerServer := NewMakhzenServer(peer, &StubRegistry{})
+		peerServer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/message", bytes.NewReader(b)))
+
+		got, _ := peer.GetItem("logo")
+		want := store.Item{Value: data, Type: store.TypeBytes, ContentType: "image/png", CAS: got.CAS}
+
+		if got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("reads JSON, form and untyped bodies as values", func(t *testing.T) {
+		for i, contentType := range []string{"application/json; charset=utf-8", "application/x-www-form-urlencoded", ""} {
+			key := fmt.Sprintf("region-%d", i)
+			request := newPutValueRequest(key, "eu-west-1")
+			if contentType != "" {
+				request.Header.Set("Content-Type", contentType)
+			}
+			server.ServeHTTP(httptest.NewRecorder(), request)
+
+			got, _ := itemStore.GetItem(key)
+			if got.Value != "eu-west-1" || got.Type != store.TypeString {
+				t.Errorf("got %+v for content type %q, want the value read from the body", got, contentType)
+			}
+		}
+	})
+
+	t.Run("stores octet streams as sent", func(t *testing.T) {
+		body := `{"value": "eu-west-1"}`
+		request, _ := http.NewRequest(http.MethodPut, "/items/report", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/octet-stream")
+		server.ServeHTTP(httptest.NewRecorder(), request)
+
+		got, _ := itemStore.GetItem("report")
+		if got.Value != body || got.Type != store.TypeBytes {
+			t.Errorf("got %+v, want the body stored as sent", got)
+		}
+	})
+}
+
+func TestStoreLimits(t *testing.T) {
+	itemStore := store.New()
+	itemStore.SetLimits(store.Limits{MaxKeys: 1, Policy: store.RejectWrites})
+	reg := StubRegistry{
+		Nodes: []registry.Node{},
+	}
+	server := NewMakhzenServer(itemStore, &reg)
+
+	t.Run("returns 507 when full", func(t *testing.T) {
+		server.ServeHTTP(httptest.NewRecorder(), newPutValueRequest("Region", "europe"))
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPutValueRequest("Platform", "mobile"))
+
+		assertStatus(t, response.Code, http.StatusInsufficientStorage)
+
+		if reg.broadcasterCalls != 1 {
+			t.Errorf("broadcast was called %d times, expected %d", reg.broadcasterCalls, 1)
+		}
+	})
+
+	t.Run("does not acknowledge replicated writes it cannot apply", func(t *testing.T) {
+		cases := []struct {
+			body string
+			want int
+		}{
+			{`{"key": "Platform", "value": "mobile"}`, http.StatusInsufficientStorage},
+			{`{"key": "Region", "value": "x", "type": "int"}`, http.StatusBadRequest},
+		}
+
+		for _, c := range cases {
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/message", strings.NewReader(c.body)))
+
+			assertStatus(t, response.Code, c.want)
+		}
+
+		if _, ok := itemStore.GetValue("Platform"); ok {
+			t.Errorf("a write the store had no room for was applied")
+		}
+	})
+
+	t.Run("reports stats", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/admin/stats", nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		var got store.Stats
+		if err := json.NewDecoder(response.Body).Decode(&got); err != nil {
+			t.Fatalf("could not parse stats: %s", err)
+		}
+
+		if got.Keys != 1 || got.MaxKeys != 1 || got.Policy != "reject" || got.Rejections != 2 {
+			t.Errorf("unexpected stats %+v", got)
+		}
+	})
+}
+
+func TestPOSTCounter(t *testing.T) {
+	itemStore := store.New()
+	itemStore.NodeID = "a"
+	reg := StubRegistry{
+		Nodes: []registry.Node{},
+	}
+	server := NewMakhzenServer(itemStore, &reg)
+
+	t.Run("increments and decrements", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/incr/hits?by=5", nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		request, _ = http.NewRequest(http.MethodPost, "/decr/hits", nil)
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertResponseBody(t, response.Body.String(), "4")
+	})
+
+	t.Run("broadcasts counter state", func(t *testing.T) {
+		msg := reg.messages[len(reg.messages)-1]
+
+		if msg.Op != broadcaster.OpMerge || msg.Type != store.TypeCounter {
+			t.Errorf("got %v, want counter merge message", msg)
+		}
+
+		var c store.PNCounter
+		json.Unmarshal(msg.State, &c)
+
+		if c.Value() != 4 {
+			t.Errorf("counter state incorrect - got %d, wanted %d", c.Value(), 4)
+		}
+	})
+
+	t.Run("merges replicated counter state", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodPost, "/message", strings.NewReader(`{"op": "merge", "key": "hits", "type": "counter", "state": {"p": {"b": 10}, "n": {}}}`))
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		got, _ := itemStore.GetValue("hits")
+		if got != "14" {
+			t.Errorf("incorrect value - got: %s, wanted: %s", got, "14")
+		}
+	})
+
+	t.Run("returns 400 on a decrement that overflows", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/decr/hits?by=-9223372036854775808", nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("returns 409 on a total that overflows", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/incr/hits?by=9223372036854775807", nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusConflict)
+	})
+
+	t.Run("returns 409 on non-integer value", func(t *testing.T) {
+		itemStore.Set("region", "europe")
+
+		request, _ := http.NewRequest(http.MethodPost, "/incr/region", nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusConflict)
+	})
+}
+
+func TestPOSTOperations(t *testing.T) {
+	itemStore := store.New()
+	itemStore.NodeID = "a"
+	reg := StubRegistry{
+		Nodes: []registry.Node{},
+	}
+	server := NewMakhzenServer(itemStore, &reg)
+
+	cases := []struct {
+		name     string
+		key      string
+		body     string
+		wantBody string
+		wantType string
+	}{
+		{"adds to set", "zones", `{"op": "add", "element": "b"}`, `["b"]`, store.TypeSet},
+		{"adds again to set", "zones", `{"op": "add", "element": "a"}`, `["a","b"]`, store.TypeSet},
+		{"removes from set", "zones", `{"op": "remove", "element": "b"}`, `["a"]`, store.TypeSet},
+		{"sets map field", "config", `{"op": "field-set", "field": "region", "value": "europe"}`, `{"region":"europe"}`, store.TypeMap},
+		{"removes map field", "config", `{"op": "field-remove", "field": "region"}`, `{}`, store.TypeMap},
+		{"assigns register", "leader", `{"op": "assign", "value": "node-1"}`, `["node-1"]`, store.TypeRegister},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodPost, "/items/"+c.key, strings.NewReader(c.body))
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertStatus(t, response.Code, http.StatusOK)
+			assertResponseBody(t, response.Body.String(), c.wantBody)
+
+			msg := reg.messages[len(reg.messages)-1]
+			if msg.Op != broadcaster.OpMerge || msg.Type != c.wantType || len(msg.State) == 0 {
+				t.Errorf("got %v, want %s merge message", msg, c.wantType)
+			}
+		})
+	}
+
+	t.Run("merges replicated delta", func(t *testing.T) {
+		peer := store.New()
+		peer.NodeID = "b"
+		delta, _ := peer.SetAdd("zones", "c")
+
+		msg, _ := json.Marshal(broadcaster.Message{Op: broadcaster.OpMerge, Key: "zones", Type: store.TypeSet, State: delta})
+		request := httptest.NewRequest(http.MethodPost, "/message", bytes.NewReader(msg))
+		server.ServeHTTP(httptest.NewRecorder(), request)
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newGetValueRequest("zones"))
+
+		assertResponseBody(t, response.Body.String(), `["a","c"]`)
+	})
+
+	t.Run("returns 409 on wrong type", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/items/zones", strings.NewReader(`{"op": "assign", "value": "x"}`))
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusConflict)
+	})
+
+	t.Run("returns 404 removing from a missing key", func(t *testing.T) {
+		for _, body := range []string{`{"op": "remove", "element": "b"}`, `{"op": "field-remove", "field": "region"}`} {
+			request, _ := http.NewRequest(http.MethodPost, "/items/missing", strings.NewReader(body))
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertStatus(t, response.Code, http.StatusNotFound)
+		}
+
+		if _, ok := itemStore.GetItem("missing"); ok {
+			t.Errorf("removing from a missing key created it")
+		}
+	})
+
+	t.Run("returns 400 on unknown op", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/items/zones", strings.NewReader(`{"op": "append"}`))
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("returns 501 from a store without counters", func(t *testing.T) {
+		server := NewMakhzenServer(&StubItemStore{map[string]string{}}, &StubRegistry{})
+
+		request, _ := http.NewRequest(http.MethodPost, "/incr/hits", nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusNotImplemented)
+	})
+}
+
 func TestBroadcastOnPut(t *testing.T) {
 	store := StubItemStore{
 		map[string]string{},
@@ -231,6 +669,298 @@ func TestPOSTMessage(t *testing.T) {
 	})
 }
 
+func TestSignedMessages(t *testing.T) {
+	secret := []byte("cluster-secret")
+	store := StubItemStore{
+		map[string]string{},
+	}
+	reg := StubRegistry{
+		Nodes: []registry.Node{},
+	}
+	server := NewMakhzenServer(&store, &reg)
+	server.Verifier = broadcaster.NewVerifier(secret, time.Minute)
+
+	signed := func(key string, value string) *http.Request {
+		request := newPostMessageRequest(key, value)
+		body, _ := ioutil.ReadAll(request.Body)
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		nonce := fmt.Sprintf("%s-%s", key, value)
+		ts := time.Now().Unix()
+
+		request.Header.Set(broadcaster.HeaderTimestamp, strconv.FormatInt(ts, 10))
+		request.Header.Set(broadcaster.HeaderNonce, nonce)
+		request.Header.Set(broadcaster.HeaderSignature, broadcaster.Sign(secret, ts, nonce, request.Method, request.URL.RequestURI(), body))
+
+		return request
+	}
+
+	t.Run("rejects unsigned message", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostMessageRequest("Region", "europe"))
+
+		assertStatus(t, response.Code, http.StatusUnauthorized)
+
+		if _, ok := store.GetValue("Region"); ok {
+			t.Errorf("unsigned message was applied")
+		}
+	})
+
+	t.Run("applies signed message", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, signed("Region", "europe"))
+
+		assertStatus(t, response.Code, http.StatusOK)
+
+		if got, _ := store.GetValue("Region"); got != "europe" {
+			t.Errorf("got %s, want europe", got)
+		}
+	})
+
+	t.Run("rejects replayed message", func(t *testing.T) {
+		request := signed("Region", "asia")
+		replay := signed("Region", "asia")
+
+		server.ServeHTTP(httptest.NewRecorder(), request)
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, replay)
+
+		assertStatus(t, response.Code, http.StatusUnauthorized)
+	})
+
+	t.Run("rejects malformed message", func(t *testing.T) {
+		server.Verifier = nil
+		defer func() { server.Verifier = broadcaster.NewVerifier(secret, time.Minute) }()
+
+		request := httptest.NewRequest(http.MethodPost, "/message", strings.NewReader("{"))
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("serves messages only on the peer handler when PeerOnly", func(t *testing.T) {
+		server.PeerOnly = true
+		defer func() { server.PeerOnly = false }()
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, signed("Zone", "a"))
+
+		assertStatus(t, response.Code, http.StatusNotFound)
+
+		response = httptest.NewRecorder()
+		server.PeerHandler.ServeHTTP(response, signed("Zone", "b"))
+
+		assertStatus(t, response.Code, http.StatusOK)
+	})
+
+	t.Run("rejects message sent to another route", func(t *testing.T) {
+		request := signed("Zone", "c")
+		request.URL.Path = "/cluster/repair"
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusUnauthorized)
+	})
+}
+
+func TestDELETEItems(t *testing.T) {
+	itemStore := store.New()
+	itemStore.Set("Region", "europe")
+	reg := StubRegistry{
+		Nodes: []registry.Node{},
+	}
+	server := NewMakhzenServer(itemStore, &reg)
+
+	t.Run("returns no content and broadcasts delete", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodDelete, "/items/Region", nil)
+		request.Header.Set("X-Request-ID", "req-1")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusNoContent)
+
+		if _, ok := itemStore.GetValue("Region"); ok {
+			t.Errorf("key: Region was not deleted")
+		}
+
+		// The delete is stamped with when it was made, so that other nodes
+		// only apply it over older writes.
+		if len(reg.messages) != 1 || reg.messages[0].Timestamp == 0 {
+			t.Fatalf("got %v, want a stamped delete", reg.messages)
+		}
+		reg.messages[0].Timestamp = 0
+
+		want := []broadcaster.Message{{Op: broadcaster.OpDelete, Key: "Region", RequestID: "req-1"}}
+		if !reflect.DeepEqual(reg.messages, want) {
+			t.Errorf("got %v, want %v", reg.messages, want)
+		}
+	})
+
+	t.Run("returns 404 on missing key", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodDelete, "/items/Region", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusNotFound)
+	})
+}
+
+func TestPOSTMessageOrdering(t *testing.T) {
+	itemStore := store.New()
+	server := NewMakhzenServer(itemStore, &StubRegistry{})
+
+	post := func(msg broadcaster.Message) {
+		t.Helper()
+
+		body, _ := json.Marshal(msg)
+		request, _ := http.NewRequest(http.MethodPost, "/message", bytes.NewReader(body))
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		assertStatus(t, response.Code, http.StatusOK)
+	}
+
+	at := time.Now().UnixNano()
+
+	t.Run("keeps the last write whatever order writes arrive in", func(t *testing.T) {
+		post(broadcaster.Message{Key: "Region", Value: "us-east-1", Timestamp: at + 2})
+		post(broadcaster.Message{Key: "Region", Value: "eu-west-1", Timestamp: at + 1})
+
+		if v, _ := itemStore.GetValue("Region"); v != "us-east-1" {
+			t.Errorf("got %q, want the value written last", v)
+		}
+	})
+
+	t.Run("does not bring back a deleted key", func(t *testing.T) {
+		post(broadcaster.Message{Op: broadcaster.OpDelete, Key: "Zone", Timestamp: at + 2})
+		post(broadcaster.Message{Key: "Zone", Value: "eu-west-1a", Timestamp: at + 1})
+
+		if _, ok := itemStore.GetValue("Zone"); ok {
+			t.Errorf("a write made before the delete brought Zone back")
+		}
+	})
+}
+
+func TestPOSTDeleteMessage(t *testing.T) {
+	store := StubItemStore{
+		map[string]string{
+			"Region": "europe",
+		},
+	}
+	reg := StubRegistry{
+		Nodes: []registry.Node{},
+	}
+	server := NewMakhzenServer(&store, &reg)
+
+	request, _ := http.NewRequest(http.MethodPost, "/message", strings.NewReader(`{"op": "delete", "key": "Region"}`))
+	response := httptest.NewRecorder()
+
+	server.ServeHTTP(response, request)
+
+	assertStatus(t, response.Code, http.StatusOK)
+
+	if _, ok := store.GetValue("Region"); ok {
+		t.Errorf("key: Region was not deleted")
+	}
+}
+
+func TestGETWatch(t *testing.T) {
+	itemStore := store.New()
+	hub := watch.New(100)
+	itemStore.AddObserver(hub)
+
+	reg := StubRegistry{
+		Nodes: []registry.Node{},
+	}
+	server := NewMakhzenServer(itemStore, &reg)
+	server.Watcher = hub
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	t.Run("streams client and replicated writes", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/watch?prefix=config/")
+		if err != nil {
+			t.Fatalf("could not watch: %s", err)
+		}
+		defer resp.Body.Close()
+
+		assertStatus(t, resp.StatusCode, http.StatusOK)
+		events := bufio.NewReader(resp.Body)
+
+		server.ServeHTTP(httptest.NewRecorder(), newPutValueRequest("other", "ignored"))
+		server.ServeHTTP(httptest.NewRecorder(), newPutValueRequest("config/region", "europe"))
+		server.ServeHTTP(httptest.NewRecorder(), newPostMessageRequest("config/region", "asia"))
+
+		assertEvent(t, events, watch.Event{Revision: 2, Type: "put", Key: "config/region", Value: "europe", ValueType: store.TypeString})
+		assertEvent(t, events, watch.Event{Revision: 3, Type: "put", Key: "config/region", Value: "asia", ValueType: store.TypeString})
+	})
+
+	t.Run("resumes from Last-Event-ID", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, ts.URL+"/watch?key=config/region", nil)
+		request.Header.Set("Last-Event-ID", "2")
+
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("could not watch: %s", err)
+		}
+		defer resp.Body.Close()
+
+		assertEvent(t, bufio.NewReader(resp.Body), watch.Event{Revision: 3, Type: "put", Key: "config/region", Value: "asia", ValueType: store.TypeString})
+	})
+
+	t.Run("returns 410 on unknown revision", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/watch?since=1000")
+		if err != nil {
+			t.Fatalf("could not watch: %s", err)
+		}
+		defer resp.Body.Close()
+
+		assertStatus(t, resp.StatusCode, http.StatusGone)
+	})
+
+	t.Run("ends streams when draining", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/watch")
+		if err != nil {
+			t.Fatalf("could not watch: %s", err)
+		}
+		defer resp.Body.Close()
+
+		server.Drain()
+
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Errorf("stream did not end cleanly: %s", err)
+		}
+	})
+}
+
+func assertEvent(t *testing.T, r *bufio.Reader, want watch.Event) {
+	t.Helper()
+
+	var got watch.Event
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("could not read event: %s", err)
+		}
+
+		if strings.HasPrefix(line, "data: ") {
+			if err := json.Unmarshal([]byte(line[len("data: "):]), &got); err != nil {
+				t.Fatalf("could not parse event %q: %s", line, err)
+			}
+			break
+		}
+	}
+
+	if got != want {
+		t.Errorf("event incorrect - got %v, wanted %v", got, want)
+	}
+}
+
 func newPostMessageRequest(key string, value string) *http.Request {
 	payload := fmt.Sprintf(`
 			{
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/wolakec/makhzen/namespace"
+)
+
+// Files of a snapshot directory. The values of the default namespace are
+// kept in snapshotItems and those of each namespace in a file named after
+// it, as dumps like those of /admin/export, and the settings of every
+// namespace in snapshotNamespaces.
+const (
+	snapshotItems      = "items.ndjson"
+	snapshotNamespaces = "namespaces.json"
+)
+
+func snapshotFile(ks keyspace) string {
+	if ks.name == "" {
+		return snapshotItems
+	}
+
+	return "ns-" + ks.name + ".ndjson"
+}
+
+// SaveSnapshot writes every value held by the node, in every namespace, to
+// dir, returning how many were written. Each file is written in full
+// before it replaces the one written last time, so a snapshot cut short
+// leaves the last one in place.
+func (s *MakhzenServer) SaveSnapshot(dir string) (int, error) {
+	keyspaces := []keyspace{s.defaultKeyspace()}
+	settings := []namespace.Settings{}
+
+	if s.Namespaces != nil {
+		settings = s.Namespaces.List()
+		for _, n := range settings {
+			if ks, ok := s.namespaceKeyspace(n.Name); ok {
+				keyspaces = append(keyspaces, ks)
+			}
+		}
+	}
+
+	err := writeFile(filepath.Join(dir, snapshotNamespaces), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(settings)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	saved := 0
+	for _, ks := range keyspaces {
+		header, entries, err := dump(ks)
+		if err != nil {
+			return saved, err
+		}
+
+		err = writeFile(filepath.Join(dir, snapshotFile(ks)), func(w io.Writer) error {
+			return writeDump(w, header, entries)
+		})
+		if err != nil {
+			return saved, err
+		}
+
+		saved += len(entries)
+	}
+
+	return saved, nil
+}
+
+// LoadSnapshot loads a snapshot written by SaveSnapshot from dir, creating
+// the namespaces it lists, and returns how many values were loaded. Values
+// that have expired since are left out. A directory without a snapshot
+// loads nothing.
+func (s *MakhzenServer) LoadSnapshot(dir string) (int, error) {
+	keyspaces := []keyspace{s.defaultKeyspace()}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, snapshotNamespaces))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var settings []namespace.Settings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return 0, fmt.Errorf("could not read %s: %s", snapshotNamespaces, err)
+	}
+
+	for _, n := range settings {
+		if s.Namespaces == nil {
+			return 0, errNamespacesDisabled
+		}
+
+		if _, err := s.Namespaces.Create(n); err != nil && err != namespace.ErrExists {
+			return 0, fmt.Errorf("could not create namespace %s: %s", n.Name, err)
+		}
+
+		ks, _ := s.namespaceKeyspace(n.Name)
+		keyspaces = append(keyspaces, ks)
+	}
+
+	loaded := 0
+	for _, ks := range keyspaces {
+		name := snapshotFile(ks)
+
+		f, err := os.Open(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return loaded, err
+		}
+
+		entries, err := readDump(f)
+		f.Close()
+		if err != nil {
+			return loaded, fmt.Errorf("could not read %s: %s", name, err)
+		}
+
+		for _, e := range entries {
+			ok, err := ks.store.Import(e, false)
+			if err != nil {
+				return loaded, fmt.Errorf("could not load %s from %s: %s", e.Key, name, err)
+			}
+			if ok {
+				loaded++
+			}
+		}
+	}
+
+	return loaded, nil
+}
+
+// writeFile writes the file at path with write, through a temporary file
+// in the same directory that replaces it once written.
+func writeFile(path string, write func(w io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
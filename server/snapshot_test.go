@@ -0,0 +1,84 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wolakec/makhzen/namespace"
+	"github.com/wolakec/makhzen/store"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("loads nothing from an empty directory", func(t *testing.T) {
+		server, _ := newNamespaceServer()
+
+		if n, err := server.LoadSnapshot(dir); n != 0 || err != nil {
+			t.Errorf("got %d, %v", n, err)
+		}
+	})
+
+	t.Run("loads the values and namespaces it saved", func(t *testing.T) {
+		server, _ := newNamespaceServer()
+		server.Store.Set("region", "eu-west-1")
+		server.Store.SetWithTTL("session", "abc", time.Hour)
+		server.Store.(*store.Store).Incr("visits", 3)
+
+		n, _ := server.Namespaces.Create(namespace.Settings{Name: "team-a", DefaultTTL: 60})
+		n.Store.Set("region", "us-east-1")
+
+		if saved, err := server.SaveSnapshot(dir); saved != 4 || err != nil {
+			t.Fatalf("got %d, %v", saved, err)
+		}
+
+		restored, _ := newNamespaceServer()
+		if loaded, err := restored.LoadSnapshot(dir); loaded != 4 || err != nil {
+			t.Fatalf("got %d, %v", loaded, err)
+		}
+
+		for key, want := range map[string]string{"region": "eu-west-1", "session": "abc", "visits": "3"} {
+			if got, _ := restored.Store.GetValue(key); got != want {
+				t.Errorf("got %q at %s, want %q", got, key, want)
+			}
+		}
+
+		got, ok := restored.Namespaces.Get("team-a")
+		if !ok || got.Settings.DefaultTTL != 60 {
+			t.Fatalf("got %+v, want team-a with its settings", got)
+		}
+		if v, _ := got.Store.GetValue("region"); v != "us-east-1" {
+			t.Errorf("got %q in team-a, want us-east-1", v)
+		}
+	})
+
+	t.Run("rejects a dump cut short", func(t *testing.T) {
+		path := filepath.Join(dir, snapshotItems)
+		data, _ := ioutil.ReadFile(path)
+		ioutil.WriteFile(path, data[:len(data)/2], 0600)
+
+		restored, _ := newNamespaceServer()
+		if _, err := restored.LoadSnapshot(dir); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+
+	t.Run("leaves no temporary files", func(t *testing.T) {
+		server := NewMakhzenServer(store.New(), &StubRegistry{})
+		server.SaveSnapshot(dir)
+
+		files, _ := ioutil.ReadDir(dir)
+		for _, f := range files {
+			if filepath.Ext(f.Name()) != ".ndjson" && filepath.Ext(f.Name()) != ".json" {
+				t.Errorf("got %s", f.Name())
+			}
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/wolakec/makhzen/tracing"
+)
+
+// withTracing serves every request within a span, continuing the trace
+// given in its traceparent header, labelled with the route of router it
+// matches.
+func (s *MakhzenServer) withTracing(router *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, route := router.Handler(r)
+
+		ctx, span := s.Tracer.Start(tracing.Extract(r.Context(), r.Header), "http "+r.Method+" "+route)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.status_code", strconv.Itoa(rec.status))
+	})
+}
+
+// storeSpan starts a span for applying op to key in ks, as part of the
+// request ctx belongs to.
+func (s *MakhzenServer) storeSpan(ctx context.Context, ks keyspace, op string, key string) *tracing.Span {
+	_, span := s.Tracer.Start(ctx, "store.apply")
+	span.SetAttribute("op", op)
+	span.SetAttribute("namespace", ks.name)
+	span.SetAttribute("key", key)
+
+	return span
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wolakec/makhzen/broadcaster"
+	"github.com/wolakec/makhzen/registry"
+	"github.com/wolakec/makhzen/store"
+	"github.com/wolakec/makhzen/tracing"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := &tracing.MemoryExporter{}
+	tracer := &tracing.Tracer{Exporter: exporter}
+
+	peer := NewMakhzenServer(store.New(), registry.New(nil))
+	peer.Tracer = tracer
+
+	ts := httptest.NewServer(peer.PeerHandler)
+	defer ts.Close()
+
+	reg := registry.New([]string{ts.URL})
+	reg.Tracer = tracer
+	reg.Broadcaster = &broadcaster.Broadcaster{Tracer: tracer}
+
+	server := NewMakhzenServer(store.New(), reg)
+	server.Tracer = tracer
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	request := newPutValueRequest("Region", "europe")
+	request.Header.Set(tracing.Header, "00-"+traceID+"-00f067aa0ba902b7-01")
+	server.ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := map[string]tracing.SpanData{}
+	names := []string{}
+	for _, s := range exporter.Spans() {
+		if s.TraceID != traceID {
+			t.Errorf("span %s has trace %s, want %s", s.Name, s.TraceID, traceID)
+		}
+
+		// The peer's spans are named the same as this node's, so they are
+		// told apart by the order they end in.
+		if _, ok := spans[s.Name]; ok {
+			s.Name = "peer " + s.Name
+		}
+		spans[s.Name] = s
+		names = append(names, s.Name)
+	}
+
+	parents := []struct {
+		child  string
+		parent string
+	}{
+		{"http PUT /items/", ""},
+		{"store.apply", "http PUT /items/"},
+		{"replication.broadcast", "http PUT /items/"},
+		{"replication.send", "replication.broadcast"},
+		{"http POST /message", "replication.send"},
+		{"peer store.apply", "http POST /message"},
+	}
+
+	for _, p := range parents {
+		child, ok := spans[p.child]
+		if !ok {
+			t.Errorf("no %s span in %v", p.child, names)
+			continue
+		}
+
+		want := "00f067aa0ba902b7"
+		if p.parent != "" {
+			want = spans[p.parent].SpanID
+		}
+
+		if child.ParentID != want {
+			t.Errorf("%s has parent %s, want %s (%s)", p.child, child.ParentID, p.parent, want)
+		}
+	}
+}
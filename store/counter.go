@@ -0,0 +1,100 @@
+package store
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// PNCounter is a counter that any node can increment or decrement. Each
+// node only ever raises its own entries in P and N, so merging counters by
+// taking the highest entry per node converges to the same total no matter
+// the order in which, or how often, they are merged.
+//
+// Base is the integer a counter was converted from, which is shared rather
+// than credited to a node, so replicas converting the same integer count
+// it once. BaseTime is when that integer was written, in nanoseconds since
+// the Unix epoch; merging keeps the base written last.
+type PNCounter struct {
+	P        map[string]uint64 `json:"p"`
+	N        map[string]uint64 `json:"n"`
+	Base     int64             `json:"base,omitempty"`
+	BaseTime int64             `json:"baseTime,omitempty"`
+}
+
+func NewPNCounter() PNCounter {
+	return PNCounter{
+		P: make(map[string]uint64),
+		N: make(map[string]uint64),
+	}
+}
+
+// Add records delta against node.
+func (c *PNCounter) Add(node string, delta int64) {
+	if delta >= 0 {
+		c.P[node] += uint64(delta)
+	} else {
+		c.N[node] += uint64(-delta)
+	}
+}
+
+func (c *PNCounter) Merge(o PNCounter) {
+	if o.BaseTime > c.BaseTime || (o.BaseTime == c.BaseTime && o.Base > c.Base) {
+		c.Base, c.BaseTime = o.Base, o.BaseTime
+	}
+
+	for node, v := range o.P {
+		if v > c.P[node] {
+			c.P[node] = v
+		}
+	}
+
+	for node, v := range o.N {
+		if v > c.N[node] {
+			c.N[node] = v
+		}
+	}
+}
+
+func (c PNCounter) Value() int64 {
+	v := c.Base
+
+	for _, p := range c.P {
+		v += int64(p)
+	}
+
+	for _, n := range c.N {
+		v -= int64(n)
+	}
+
+	return v
+}
+
+// Entries returns a counter holding only node's entries and the base.
+func (c PNCounter) Entries(node string) PNCounter {
+	e := NewPNCounter()
+	e.Base, e.BaseTime = c.Base, c.BaseTime
+
+	if p, ok := c.P[node]; ok {
+		e.P[node] = p
+	}
+
+	if n, ok := c.N[node]; ok {
+		e.N[node] = n
+	}
+
+	return e
+}
+
+func (c PNCounter) text() string {
+	return strconv.FormatInt(c.Value(), 10)
+}
+
+func (c *PNCounter) mergeJSON(state []byte) error {
+	in := NewPNCounter()
+	if err := json.Unmarshal(state, &in); err != nil {
+		return err
+	}
+
+	c.Merge(in)
+	return nil
+}
@@ -0,0 +1,228 @@
+package store
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+)
+
+func TestPNCounterValue(t *testing.T) {
+	c := NewPNCounter()
+	c.Add("a", 5)
+	c.Add("b", 3)
+	c.Add("a", -2)
+
+	if got := c.Value(); got != 6 {
+		t.Errorf("Value was incorrect, expected %d but got %d", 6, got)
+	}
+}
+
+func TestPNCounterMergeConverges(t *testing.T) {
+	a := NewPNCounter()
+	a.Add("a", 4)
+	a.Add("a", -1)
+
+	b := NewPNCounter()
+	b.Add("b", 10)
+
+	ab := NewPNCounter()
+	ab.Merge(a)
+	ab.Merge(b)
+	ab.Merge(a)
+
+	ba := NewPNCounter()
+	ba.Merge(b)
+	ba.Merge(a)
+
+	if ab.Value() != 13 || ba.Value() != 13 {
+		t.Errorf("Merge was incorrect, expected %d but got %d and %d", 13, ab.Value(), ba.Value())
+	}
+}
+
+func TestIncr(t *testing.T) {
+	t.Run("starts missing keys at zero", func(t *testing.T) {
+		s := New()
+		s.NodeID = "a"
+
+		s.Incr("hits", 2)
+		got, _, _ := s.Incr("hits", -5)
+
+		if got != -3 {
+			t.Errorf("Incr was incorrect, expected %d but got %d", -3, got)
+		}
+	})
+
+	t.Run("converts integer values", func(t *testing.T) {
+		s := New()
+		s.NodeID = "a"
+		s.SetTyped("hits", "10", TypeInt, 0)
+
+		got, _, _ := s.Incr("hits", 1)
+
+		if got != 11 {
+			t.Errorf("Incr was incorrect, expected %d but got %d", 11, got)
+		}
+
+		i, _ := s.GetItem("hits")
+		if i.Type != TypeCounter {
+			t.Errorf("Incr was incorrect, expected type %s but got %s", TypeCounter, i.Type)
+		}
+	})
+
+	t.Run("counts a converted integer once across replicas", func(t *testing.T) {
+		a, b := New(), New()
+		a.NodeID, b.NodeID = "a", "b"
+		a.SetTyped("hits", "10", TypeInt, 0)
+		b.Import(a.Export()[0], true)
+
+		a.Incr("hits", 1)
+		b.Incr("hits", 1)
+		a.Import(b.Export()[0], true)
+		b.Import(a.Export()[0], true)
+
+		for name, s := range map[string]*Store{"a": a, "b": b} {
+			if v, _ := s.GetValue("hits"); v != "12" {
+				t.Errorf("%s holds %s, want 12", name, v)
+			}
+		}
+	})
+
+	t.Run("picks the same winner between a write and an increment", func(t *testing.T) {
+		a, b := New(), New()
+		a.NodeID, b.NodeID = "a", "b"
+		a.SetTyped("hits", "10", TypeInt, 0)
+		b.Import(a.Export()[0], true)
+
+		a.SetTyped("hits", "5", TypeInt, 0)
+		b.Incr("hits", 1)
+		fromA, fromB := a.Export()[0], b.Export()[0]
+		a.Import(fromB, true)
+		b.Import(fromA, true)
+
+		va, _ := a.GetValue("hits")
+		vb, _ := b.GetValue("hits")
+		if va != vb {
+			t.Errorf("got %s and %s", va, vb)
+		}
+	})
+
+	t.Run("keeps the flags of converted values", func(t *testing.T) {
+		s := New()
+		s.SetIf("hits", "10", TypeInt, 42, 0, Condition{})
+
+		s.Incr("hits", 1)
+
+		if i, _ := s.GetItem("hits"); i.Flags != 42 {
+			t.Errorf("Incr was incorrect, expected flags %d but got %d", 42, i.Flags)
+		}
+	})
+
+	t.Run("rejects totals that overflow", func(t *testing.T) {
+		s := New()
+		s.SetTyped("hits", "9223372036854775807", TypeInt, 0)
+
+		if _, _, err := s.Incr("hits", 1); err != ErrOverflow {
+			t.Errorf("Incr was incorrect, expected %v but got %v", ErrOverflow, err)
+		}
+
+		s.Incr("hits", -9223372036854775807)
+		s.Incr("hits", -9223372036854775807)
+
+		if _, _, err := s.Incr("hits", -2); err != ErrOverflow {
+			t.Errorf("Incr was incorrect, expected %v but got %v", ErrOverflow, err)
+		}
+
+		if v, _ := s.GetValue("hits"); v != "-9223372036854775807" {
+			t.Errorf("Incr was incorrect, expected the total to be unchanged but got %s", v)
+		}
+	})
+
+	t.Run("rejects non-integer values", func(t *testing.T) {
+		s := New()
+		s.Set("region", "europe")
+
+		if _, _, err := s.Incr("region", 1); err != ErrNotInteger {
+			t.Errorf("Incr was incorrect, expected %v but got %v", ErrNotInteger, err)
+		}
+	})
+}
+
+func TestIncrUnsigned(t *testing.T) {
+	t.Run("wraps past the largest uint64", func(t *testing.T) {
+		s := New()
+		s.SetIf("hits", "18446744073709551615", TypeString, 3, 0, Condition{})
+
+		got, _, err := s.IncrUnsigned("hits", 2, false)
+		if err != nil || got != 1 {
+			t.Errorf("IncrUnsigned was incorrect, expected %d but got %d, %v", 1, got, err)
+		}
+
+		if i, _ := s.GetItem("hits"); i.Flags != 3 {
+			t.Errorf("IncrUnsigned was incorrect, expected flags %d but got %d", 3, i.Flags)
+		}
+	})
+
+	t.Run("stops decrements at zero", func(t *testing.T) {
+		s := New()
+		s.Set("hits", "100")
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.IncrUnsigned("hits", 7, true)
+			}()
+		}
+		wg.Wait()
+
+		if v, _ := s.GetValue("hits"); v != "0" {
+			t.Errorf("IncrUnsigned was incorrect, expected %s but got %s", "0", v)
+		}
+	})
+
+	t.Run("does not create missing keys", func(t *testing.T) {
+		s := New()
+
+		if _, _, err := s.IncrUnsigned("hits", 1, false); err != ErrMissing {
+			t.Errorf("IncrUnsigned was incorrect, expected %v but got %v", ErrMissing, err)
+		}
+	})
+
+	t.Run("rejects non-integer values", func(t *testing.T) {
+		s := New()
+		s.Set("hits", "-1")
+
+		if _, _, err := s.IncrUnsigned("hits", 1, false); err != ErrNotInteger {
+			t.Errorf("IncrUnsigned was incorrect, expected %v but got %v", ErrNotInteger, err)
+		}
+	})
+}
+
+func TestConcurrentIncrementsConverge(t *testing.T) {
+	a := New()
+	a.NodeID = "a"
+	b := New()
+	b.NodeID = "b"
+
+	_, fromA, _ := a.Incr("hits", 3)
+	_, fromB, _ := b.Incr("hits", 4)
+	_, fromB2, _ := b.Incr("hits", -1)
+
+	stateA, _ := json.Marshal(fromA)
+	stateB, _ := json.Marshal(fromB)
+	stateB2, _ := json.Marshal(fromB2)
+
+	// b's messages arrive out of order and twice.
+	a.Merge("hits", TypeCounter, stateB2)
+	a.Merge("hits", TypeCounter, stateB)
+	a.Merge("hits", TypeCounter, stateB2)
+	b.Merge("hits", TypeCounter, stateA)
+
+	gotA, _ := a.GetValue("hits")
+	gotB, _ := b.GetValue("hits")
+
+	if gotA != "6" || gotB != "6" {
+		t.Errorf("Merge was incorrect, expected %s but got %s and %s", "6", gotA, gotB)
+	}
+}
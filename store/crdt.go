@@ -0,0 +1,31 @@
+package store
+
+import "encoding/json"
+
+// crdt is implemented by the replicated types held in the store. Each can
+// render itself as text and merge in state encoded by another replica.
+type crdt interface {
+	text() string
+	mergeJSON(state []byte) error
+}
+
+func newCRDT(typ string) (crdt, error) {
+	switch typ {
+	case TypeCounter:
+		c := NewPNCounter()
+		return &c, nil
+	case TypeSet:
+		return NewORSet(), nil
+	case TypeMap:
+		return NewLWWMap(), nil
+	case TypeRegister:
+		return NewMVRegister(), nil
+	}
+
+	return nil, ErrUnknownType
+}
+
+func encode(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
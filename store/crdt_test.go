@@ -0,0 +1,240 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+func TestORSetAddWinsOverConcurrentRemove(t *testing.T) {
+	a := NewORSet()
+	b := NewORSet()
+
+	b.Merge(a.Add("x", "a/1"))
+	removed := b.Remove("x")
+	added := a.Add("x", "a/2")
+
+	a.Merge(removed)
+	b.Merge(added)
+
+	if !a.Contains("x") || !b.Contains("x") {
+		t.Errorf("expected concurrent add to survive, got %v and %v", a.Elements(), b.Elements())
+	}
+}
+
+func TestLWWMapLaterWriteWins(t *testing.T) {
+	a := NewLWWMap()
+	b := NewLWWMap()
+
+	old := a.Set("region", "europe", 1, "a")
+	newer := b.Set("region", "asia", 2, "b")
+	removed := b.Remove("zone", 3, "b")
+
+	a.Merge(newer)
+	a.Merge(removed)
+	b.Merge(old)
+
+	want := map[string]string{"region": "asia"}
+
+	if !reflect.DeepEqual(a.Values(), want) || !reflect.DeepEqual(b.Values(), want) {
+		t.Errorf("got %v and %v, want %v", a.Values(), b.Values(), want)
+	}
+}
+
+func TestMVRegisterKeepsConcurrentValues(t *testing.T) {
+	a := NewMVRegister()
+	b := NewMVRegister()
+
+	da := a.Set("europe", "a")
+	db := b.Set("asia", "b")
+
+	a.Merge(db)
+	b.Merge(da)
+
+	want := []string{"asia", "europe"}
+	if !reflect.DeepEqual(a.Values(), want) || !reflect.DeepEqual(b.Values(), want) {
+		t.Errorf("got %v and %v, want %v", a.Values(), b.Values(), want)
+	}
+
+	a.Merge(a.Set("africa", "a"))
+	b.Merge(a)
+
+	want = []string{"africa"}
+	if !reflect.DeepEqual(b.Values(), want) {
+		t.Errorf("got %v, want %v", b.Values(), want)
+	}
+}
+
+func TestMVRegisterBreaksTiesByNode(t *testing.T) {
+	clock := VersionVector{"a": 1}
+	x := &MVRegister{Entries: []MVEntry{{Value: "europe", Clock: clock, Node: "a"}}}
+	y := &MVRegister{Entries: []MVEntry{{Value: "asia", Clock: clock, Node: "b"}}}
+
+	xy, yx := NewMVRegister(), NewMVRegister()
+	xy.Merge(x)
+	xy.Merge(y)
+	yx.Merge(y)
+	yx.Merge(x)
+
+	want := []string{"asia"}
+	if !reflect.DeepEqual(xy.Values(), want) || !reflect.DeepEqual(yx.Values(), want) {
+		t.Errorf("got %v and %v, want %v", xy.Values(), yx.Values(), want)
+	}
+}
+
+func TestRemoveFromMissingKey(t *testing.T) {
+	s := New()
+
+	if _, err := s.SetRemove("zones", "eu-west-1a"); err != ErrMissing {
+		t.Errorf("got %v removing from a missing set", err)
+	}
+	if _, err := s.MapRemove("config", "region"); err != ErrMissing {
+		t.Errorf("got %v removing from a missing map", err)
+	}
+	if keys := s.Keys(); len(keys) != 0 {
+		t.Errorf("got keys %v", keys)
+	}
+}
+
+func TestDeletedStateIsNotMerged(t *testing.T) {
+	a, b := New(), New()
+	a.NodeID, b.NodeID = "a", "b"
+
+	a.SetAdd("zones", "eu-west-1a")
+	b.Import(a.Export()[0], true)
+	old := b.Export()[0]
+
+	a.Delete("zones")
+	a.SetAdd("zones", "eu-west-1b")
+
+	if ok, _ := a.Import(old, true); ok {
+		t.Errorf("state from before the delete was merged")
+	}
+
+	if ok, _ := b.Import(a.Export()[0], true); !ok {
+		t.Errorf("state created after the delete was not applied")
+	}
+
+	for name, s := range map[string]*Store{"a": a, "b": b} {
+		if v, _ := s.GetValue("zones"); v != `["eu-west-1b"]` {
+			t.Errorf("%s holds %s", name, v)
+		}
+	}
+}
+
+type delta struct {
+	typ   string
+	state []byte
+}
+
+// TestReplicasConverge applies random operations on three replicas and
+// delivers every delta to every other replica in a random order, with
+// duplicates, checking that all replicas end up with the same value.
+func TestReplicasConverge(t *testing.T) {
+	types := []string{TypeSet, TypeMap, TypeRegister, TypeCounter}
+
+	for _, typ := range types {
+		typ := typ
+
+		t.Run(typ, func(t *testing.T) {
+			converges := func(seed int64) bool {
+				r := rand.New(rand.NewSource(seed))
+
+				replicas := make([]*Store, 3)
+				for i := range replicas {
+					replicas[i] = New()
+					replicas[i].NodeID = fmt.Sprintf("node-%d", i)
+				}
+
+				inboxes := make([][]delta, len(replicas))
+
+				for op := 0; op < 20; op++ {
+					from := r.Intn(len(replicas))
+					d, err := randomOp(r, replicas[from], typ)
+					if err == ErrMissing {
+						continue
+					}
+					if err != nil {
+						t.Fatalf("operation failed: %s", err)
+					}
+
+					for to := range replicas {
+						if to == from {
+							continue
+						}
+
+						inboxes[to] = append(inboxes[to], delta{typ, d})
+						if r.Intn(3) == 0 {
+							inboxes[to] = append(inboxes[to], delta{typ, d})
+						}
+					}
+
+					// Deliver some messages early so operations observe each
+					// other's effects.
+					if r.Intn(2) == 0 {
+						deliver(t, r, replicas, inboxes, r.Intn(len(replicas)))
+					}
+				}
+
+				for to := range replicas {
+					deliver(t, r, replicas, inboxes, to)
+				}
+
+				want, _ := replicas[0].GetValue("key")
+				for _, replica := range replicas[1:] {
+					if got, _ := replica.GetValue("key"); got != want {
+						t.Logf("seed %d: got %s, want %s", seed, got, want)
+						return false
+					}
+				}
+
+				return true
+			}
+
+			if err := quick.Check(converges, nil); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func randomOp(r *rand.Rand, s *Store, typ string) ([]byte, error) {
+	elem := fmt.Sprintf("e%d", r.Intn(4))
+
+	switch typ {
+	case TypeSet:
+		if r.Intn(3) == 0 {
+			return s.SetRemove("key", elem)
+		}
+		return s.SetAdd("key", elem)
+	case TypeMap:
+		if r.Intn(3) == 0 {
+			return s.MapRemove("key", elem)
+		}
+		return s.MapSet("key", elem, fmt.Sprintf("v%d", r.Intn(100)))
+	case TypeRegister:
+		return s.RegisterSet("key", fmt.Sprintf("v%d", r.Intn(100)))
+	}
+
+	_, c, err := s.Incr("key", int64(r.Intn(11)-5))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(c)
+}
+
+func deliver(t *testing.T, r *rand.Rand, replicas []*Store, inboxes [][]delta, to int) {
+	inbox := inboxes[to]
+
+	for _, i := range r.Perm(len(inbox)) {
+		d := inbox[i]
+		if err := replicas[to].Merge("key", d.typ, d.state); err != nil {
+			t.Fatalf("merge failed: %s", err)
+		}
+	}
+
+	inboxes[to] = nil
+}
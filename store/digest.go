@@ -0,0 +1,116 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"strconv"
+	"time"
+)
+
+// RangeDigest summarises the keys in one range of a store, so that two
+// stores can be compared range by range without sending every key. Stores
+// holding the same values have the same digest for every range.
+type RangeDigest struct {
+	Range  int    `json:"range"`
+	Keys   int    `json:"keys"`
+	Digest string `json:"digest"`
+}
+
+// KeyVersion identifies the value held at a key. Version is a hash of the
+// value, its type, content type and flags, and is the same on every node
+// holding the same value. Modified is when the value was written on the
+// node that wrote it. Deleted marks the tombstone of a deleted key.
+type KeyVersion struct {
+	Key      string    `json:"key"`
+	Type     string    `json:"type"`
+	Version  string    `json:"version"`
+	Modified time.Time `json:"modified"`
+	Deleted  bool      `json:"deleted,omitempty"`
+}
+
+// KeyRange returns which of ranges ranges key belongs to.
+func KeyRange(key string, ranges int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return int(h.Sum32() % uint32(ranges))
+}
+
+// Digests returns the digest of each of ranges ranges of unexpired keys.
+// Expiry times are left out, as they are set relative to when each node
+// applied a write, and so are tombstones, as a key one node has deleted
+// and another never held is the same on both.
+func (s *Store) Digests(ranges int) []RangeDigest {
+	digests := make([][sha256.Size]byte, ranges)
+	counts := make([]int, ranges)
+
+	s.mu.RLock()
+	now := time.Now()
+	for k, i := range s.items {
+		if i.deleted || i.expired(now) {
+			continue
+		}
+
+		r := KeyRange(k, ranges)
+		counts[r]++
+
+		// Digests combine keys with XOR, so the order they are visited in
+		// does not matter.
+		sum := sha256.Sum256([]byte(k + "\x00" + version(i)))
+		for b := range sum {
+			digests[r][b] ^= sum[b]
+		}
+	}
+	s.mu.RUnlock()
+
+	result := make([]RangeDigest, ranges)
+	for r := range result {
+		result[r] = RangeDigest{Range: r, Keys: counts[r], Digest: hex.EncodeToString(digests[r][:])}
+	}
+
+	return result
+}
+
+// Versions returns the version of every unexpired key in the given ranges
+// of ranges ranges, including the tombstones of deleted keys.
+func (s *Store) Versions(ranges int, in []int) []KeyVersion {
+	wanted := make(map[int]bool)
+	for _, r := range in {
+		wanted[r] = true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	versions := []KeyVersion{}
+
+	for k, i := range s.items {
+		if i.expired(now) || !wanted[KeyRange(k, ranges)] {
+			continue
+		}
+
+		versions = append(versions, KeyVersion{Key: k, Type: i.typ, Version: version(i), Modified: i.modified, Deleted: i.deleted})
+	}
+
+	return versions
+}
+
+// version returns the hex encoded first 8 bytes of a hash of the value of
+// i.
+func version(i item) string {
+	h := sha256.New()
+	if i.deleted {
+		h.Write([]byte("deleted\x00"))
+	}
+	h.Write([]byte(i.typ + "\x00" + i.contentType + "\x00" + strconv.FormatUint(uint64(i.flags), 10) + "\x00"))
+
+	if i.crdt != nil {
+		h.Write([]byte(encode(i.crdt)))
+	} else {
+		h.Write([]byte(i.value))
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDigests(t *testing.T) {
+	a, b := New(), New()
+	// Expiry times are left out, so they may differ.
+	a.SetWithTTL("region", "eu-west-1", time.Hour)
+	b.SetWithTTL("region", "eu-west-1", 2*time.Hour)
+	for _, s := range []*Store{a, b} {
+		s.SetTyped("replicas", "3", TypeInt, 0)
+		s.SetIf("session", "x", TypeString, 7, 0, Condition{})
+	}
+
+	t.Run("match for the same values", func(t *testing.T) {
+		da, db := a.Digests(8), b.Digests(8)
+		if len(da) != 8 {
+			t.Fatalf("got %d ranges, want 8", len(da))
+		}
+
+		keys := 0
+		for r := range da {
+			if da[r] != db[r] {
+				t.Errorf("range %d differs: %+v and %+v", r, da[r], db[r])
+			}
+			keys += da[r].Keys
+		}
+		if keys != 3 {
+			t.Errorf("got %d keys, want 3", keys)
+		}
+	})
+
+	t.Run("differ where a value differs", func(t *testing.T) {
+		b.SetIf("session", "x", TypeString, 8, 0, Condition{})
+		defer b.SetIf("session", "x", TypeString, 7, 0, Condition{})
+
+		da, db := a.Digests(8), b.Digests(8)
+		r := KeyRange("session", 8)
+
+		for i := range da {
+			if (da[i] != db[i]) != (i == r) {
+				t.Errorf("range %d: got %+v and %+v", i, da[i], db[i])
+			}
+		}
+
+		va, vb := a.Versions(8, []int{r}), b.Versions(8, []int{r})
+		if len(va) != 1 || len(vb) != 1 || va[0].Key != "session" || va[0].Version == vb[0].Version {
+			t.Errorf("got versions %+v and %+v", va, vb)
+		}
+	})
+
+	t.Run("match for merged replicated state", func(t *testing.T) {
+		a.NodeID, b.NodeID = "a", "b"
+		_, da, _ := a.Incr("visits", 2)
+		_, db, _ := b.Incr("visits", 3)
+
+		if a.Digests(8)[KeyRange("visits", 8)] == b.Digests(8)[KeyRange("visits", 8)] {
+			t.Errorf("expected counters with different state to differ")
+		}
+
+		a.Merge("visits", TypeCounter, []byte(encode(db)))
+		b.Merge("visits", TypeCounter, []byte(encode(da)))
+
+		if a.Digests(8)[KeyRange("visits", 8)] != b.Digests(8)[KeyRange("visits", 8)] {
+			t.Errorf("expected merged counters to match")
+		}
+	})
+
+	t.Run("leave out expired keys", func(t *testing.T) {
+		s := New()
+		s.SetWithTTL("region", "eu-west-1", time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+
+		if d := s.Digests(1)[0]; d.Keys != 0 {
+			t.Errorf("got %+v", d)
+		}
+		if v := s.Versions(1, []int{0}); len(v) != 0 {
+			t.Errorf("got %+v", v)
+		}
+	})
+}
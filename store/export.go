@@ -0,0 +1,221 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Entry is an item as it is exported from and imported into a store. Plain
+// values are held in Value, or in Data when they are bytes so that they
+// survive JSON encoding unchanged, and replicated types in State. Modified
+// is when the item was written on the node that wrote it, and is its
+// version when importing in merge mode. Deleted marks the tombstone of a
+// deleted key, which has no type or value. Since is set on replicated
+// types created where a key had been deleted, and is when it was.
+type Entry struct {
+	Key         string          `json:"key"`
+	Type        string          `json:"type"`
+	Value       string          `json:"value,omitempty"`
+	Data        []byte          `json:"data,omitempty"`
+	ContentType string          `json:"contentType,omitempty"`
+	Flags       uint32          `json:"flags,omitempty"`
+	State       json.RawMessage `json:"state,omitempty"`
+	ExpiresAt   *time.Time      `json:"expiresAt,omitempty"`
+	Modified    time.Time       `json:"modified"`
+	Deleted     bool            `json:"deleted,omitempty"`
+	Since       *time.Time      `json:"since,omitempty"`
+}
+
+// Export returns every unexpired item, sorted by key, as they all were at
+// one moment.
+func (s *Store) Export() []Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	entries := make([]Entry, 0, len(s.items))
+
+	for k, i := range s.items {
+		if i.deleted || i.expired(now) {
+			continue
+		}
+
+		entries = append(entries, exportItem(k, i))
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Key < entries[b].Key
+	})
+
+	return entries
+}
+
+// ExportKeys returns the unexpired items at keys, sorted by key, with the
+// tombstones of those that were deleted. Keys that are missing are left
+// out.
+func (s *Store) ExportKeys(keys []string) []Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	entries := make([]Entry, 0, len(keys))
+
+	for _, k := range keys {
+		if i, ok := s.items[k]; ok && !i.expired(now) {
+			entries = append(entries, exportItem(k, i))
+		}
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Key < entries[b].Key
+	})
+
+	return entries
+}
+
+func exportItem(k string, i item) Entry {
+	if i.deleted {
+		return Entry{Key: k, Modified: i.modified, Deleted: true}
+	}
+
+	e := Entry{
+		Key:         k,
+		Type:        i.typ,
+		ContentType: i.contentType,
+		Flags:       i.flags,
+		Modified:    i.modified,
+	}
+
+	switch {
+	case i.crdt != nil:
+		e.State = json.RawMessage(encode(i.crdt))
+	case i.typ == TypeBytes:
+		e.Data = []byte(i.value)
+	default:
+		e.Value = i.value
+	}
+
+	if !i.expiresAt.IsZero() {
+		expiresAt := i.expiresAt
+		e.ExpiresAt = &expiresAt
+	}
+
+	if !i.since.IsZero() {
+		since := i.since
+		e.Since = &since
+	}
+
+	return e
+}
+
+// Import stores e, keeping when it was modified and when it expires, and
+// reports whether it changed the store. Entries that have expired are
+// skipped, and a tombstone deletes the item at its key. Unless merge is
+// set, e replaces any item at its key. When merge is set, replicated state
+// is merged with the item at its key as if it had been replicated, and
+// other entries only replace an item written before e was. Replicated
+// state is not merged across a delete: state written before the key was
+// deleted, on either side, is dropped rather than merged.
+func (s *Store) Import(e Entry, merge bool) (bool, error) {
+	if e.ExpiresAt != nil && !time.Now().Before(*e.ExpiresAt) {
+		return false, nil
+	}
+
+	if e.Deleted {
+		return s.importTombstone(e, merge), nil
+	}
+
+	i := item{typ: e.Type, contentType: e.ContentType, flags: e.Flags, modified: e.Modified}
+	if e.ExpiresAt != nil {
+		i.expiresAt = *e.ExpiresAt
+	}
+	if e.Since != nil {
+		i.since = *e.Since
+	}
+
+	switch e.Type {
+	case TypeCounter, TypeSet, TypeMap, TypeRegister:
+		c, _ := newCRDT(e.Type)
+		if err := c.mergeJSON(e.State); err != nil {
+			return false, ErrInvalidValue
+		}
+		i.crdt = c
+	case TypeBytes:
+		i.value = string(e.Data)
+	default:
+		v, err := canonical(e.Value, e.Type)
+		if err != nil {
+			return false, err
+		}
+		i.value = v
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.items[e.Key]
+	if ok && !old.deleted && old.expired(time.Now()) {
+		ok = false
+	}
+
+	if merge && ok {
+		sameType := !old.deleted && i.crdt != nil && old.typ == i.typ
+
+		switch {
+		case sameType && i.since.After(old.modified):
+			// The value held was deleted before e was created.
+		case sameType && old.since.After(i.modified):
+			return false, nil
+		case sameType:
+			before := encode(old.crdt)
+
+			c := s.writable(old)
+			c.mergeJSON(e.State)
+			if encode(c) == before {
+				return false, nil
+			}
+
+			i.crdt = c
+			i.expiresAt = old.expiresAt
+			if old.modified.After(i.modified) {
+				i.modified = old.modified
+			}
+			if old.since.After(i.since) {
+				i.since = old.since
+			}
+		case !newer(i, old):
+			return false, nil
+		case i.crdt != nil && old.modified.After(i.since):
+			i.since = old.modified
+		}
+	}
+
+	if err := s.put(e.Key, i, 0); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// importTombstone deletes the item at the key of e, reporting whether it
+// was present. When merge is set, only an item written before e is.
+func (s *Store) importTombstone(e Entry, merge bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := item{deleted: true, modified: e.Modified}
+	if t.modified.IsZero() {
+		t.modified = s.stamp(e.Key)
+	}
+
+	old, ok := s.items[e.Key]
+	if merge && ok && !newer(t, old) {
+		return false
+	}
+
+	_, present := s.live(e.Key)
+	s.bury(e.Key, t.modified)
+
+	return present
+}
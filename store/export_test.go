@@ -0,0 +1,195 @@
+package store
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	src := New()
+	src.NodeID = "a"
+	src.SetWithTTL("region", "eu-west-1", time.Hour)
+	src.SetTyped("replicas", "3", TypeInt, 0)
+	src.SetContent("logo", "\x89PNG", "image/png", 0)
+	src.SetIf("session", "x", TypeString, 7, 0, Condition{})
+	src.Incr("visits", 5)
+	src.SetAdd("zones", "eu-west-1a")
+
+	entries := src.Export()
+
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	if want := []string{"logo", "region", "replicas", "session", "visits", "zones"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("exported keys %v, want %v", keys, want)
+	}
+
+	// Entries must survive being written out and read back.
+	b, _ := json.Marshal(entries)
+	entries = nil
+	if err := json.Unmarshal(b, &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := New()
+	for _, e := range entries {
+		if ok, err := dst.Import(e, false); !ok || err != nil {
+			t.Errorf("importing %s returned %v, %v", e.Key, ok, err)
+		}
+	}
+
+	for _, k := range keys {
+		want, _ := src.GetItem(k)
+		got, _ := dst.GetItem(k)
+		got.CAS, want.CAS = 0, 0
+
+		if got != want {
+			t.Errorf("imported %s as %+v, want %+v", k, got, want)
+		}
+	}
+
+	if ttl, _ := dst.TTL("region"); ttl < 59*time.Minute {
+		t.Errorf("imported a TTL of %s, want an hour", ttl)
+	}
+
+	got, _ := json.Marshal(dst.Export())
+	if want, _ := json.Marshal(src.Export()); string(got) != string(want) {
+		t.Errorf("exported %s after importing, want %s", got, want)
+	}
+}
+
+func TestImportSkipsExpired(t *testing.T) {
+	s := New()
+	past := time.Now().Add(-time.Second)
+
+	ok, err := s.Import(Entry{Key: "region", Type: TypeString, Value: "eu", ExpiresAt: &past}, false)
+	if ok || err != nil {
+		t.Errorf("got %v, %v", ok, err)
+	}
+
+	if _, ok := s.GetItem("region"); ok {
+		t.Errorf("expired entry was imported")
+	}
+}
+
+func TestImportRejectsInvalidEntries(t *testing.T) {
+	s := New()
+
+	cases := []Entry{
+		{Key: "a", Type: TypeInt, Value: "three"},
+		{Key: "b", Type: "date", Value: "today"},
+		{Key: "c", Type: TypeCounter, State: json.RawMessage(`"nope"`)},
+	}
+
+	for _, e := range cases {
+		if _, err := s.Import(e, false); err == nil {
+			t.Errorf("expected an error importing %+v", e)
+		}
+	}
+}
+
+func TestImportMerge(t *testing.T) {
+	s := New()
+	s.Set("region", "eu-west-1")
+	modified := s.Export()[0].Modified
+
+	older := Entry{Key: "region", Type: TypeString, Value: "us-east-1", Modified: modified.Add(-time.Second)}
+	if ok, _ := s.Import(older, true); ok {
+		t.Errorf("an older value replaced a newer one")
+	}
+
+	if ok, _ := s.Import(older, false); !ok {
+		t.Errorf("an older value was not imported without merging")
+	}
+
+	newer := Entry{Key: "region", Type: TypeString, Value: "ap-south-1", Modified: modified.Add(time.Hour)}
+	if ok, _ := s.Import(newer, true); !ok {
+		t.Errorf("a newer value did not replace an older one")
+	}
+
+	if v, _ := s.GetValue("region"); v != "ap-south-1" {
+		t.Errorf("got %q", v)
+	}
+
+	t.Run("merges replicated state", func(t *testing.T) {
+		a, b := New(), New()
+		a.NodeID, b.NodeID = "a", "b"
+		a.Incr("visits", 2)
+		b.Incr("visits", 3)
+
+		e := a.Export()[0]
+		if ok, _ := b.Import(e, true); !ok {
+			t.Errorf("merge reported no change")
+		}
+		if ok, _ := b.Import(e, true); ok {
+			t.Errorf("merging the same state again reported a change")
+		}
+
+		if v, _ := b.GetValue("visits"); v != "5" {
+			t.Errorf("got %s visits, want 5", v)
+		}
+	})
+
+	t.Run("keeps deletes over older writes", func(t *testing.T) {
+		s := New()
+		s.Set("zone", "eu-west-1a")
+		s.Delete("zone")
+
+		tombstone := s.ExportKeys([]string{"zone"})
+		if len(tombstone) != 1 || !tombstone[0].Deleted {
+			t.Fatalf("got %+v, want the tombstone of zone", tombstone)
+		}
+
+		late := Entry{Key: "zone", Type: TypeString, Value: "eu-west-1a", Modified: tombstone[0].Modified.Add(-time.Second)}
+		if ok, _ := s.Import(late, true); ok {
+			t.Errorf("a write older than the delete brought the key back")
+		}
+
+		other := New()
+		other.Set("zone", "eu-west-1b")
+		if ok, _ := other.Import(tombstone[0], true); ok {
+			t.Errorf("a delete older than the write removed the key")
+		}
+
+		tombstone[0].Modified = time.Now().Add(time.Second)
+		if ok, _ := other.Import(tombstone[0], true); !ok {
+			t.Errorf("a newer delete did not remove the key")
+		}
+		if _, ok := other.GetValue("zone"); ok {
+			t.Errorf("zone is still present")
+		}
+	})
+
+	t.Run("orders writes made at the same moment the same way", func(t *testing.T) {
+		at := time.Now()
+		x := Entry{Key: "region", Type: TypeString, Value: "eu-west-1", Modified: at}
+		y := Entry{Key: "region", Type: TypeString, Value: "us-east-1", Modified: at}
+
+		a, b := New(), New()
+		a.Import(x, true)
+		a.Import(y, true)
+		b.Import(y, true)
+		b.Import(x, true)
+
+		va, _ := a.GetValue("region")
+		vb, _ := b.GetValue("region")
+		if va != vb {
+			t.Errorf("got %q and %q", va, vb)
+		}
+	})
+}
+
+func TestExportKeys(t *testing.T) {
+	s := New()
+	s.Set("region", "eu-west-1")
+	s.Set("zone", "eu-west-1a")
+	s.Set("replicas", "3")
+
+	entries := s.ExportKeys([]string{"zone", "missing", "region"})
+	if len(entries) != 2 || entries[0].Key != "region" || entries[1].Key != "zone" || entries[1].Value != "eu-west-1a" {
+		t.Errorf("got %+v", entries)
+	}
+}
@@ -0,0 +1,277 @@
+package store
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrFull is returned when a write does not fit within the store's limits
+// and nothing can be evicted to make room.
+var ErrFull = errors.New("store is full")
+
+// entryOverhead is the memory held by an entry beyond its key and value:
+// the map bucket slot, the item itself and its usage counters. It was
+// measured as the growth of the heap per entry when storing short strings
+// on 64-bit platforms, which ranged from 210 to 260 bytes as the map grew,
+// so sizes computed with it are approximate.
+const entryOverhead = 240
+
+// evictionSamples is how many entries are compared to choose each one to
+// evict. Sampling keeps eviction cheap regardless of the store's size, at
+// the cost of not always finding the single best entry.
+const evictionSamples = 16
+
+// Limits bounds the size of a store. A zero MaxKeys or MaxBytes is not
+// enforced. Policy chooses what to evict when a write would exceed a
+// limit; a nil Policy rejects the write.
+type Limits struct {
+	MaxKeys  int
+	MaxBytes int64
+	Policy   EvictionPolicy
+}
+
+// EntryInfo describes an entry to an EvictionPolicy.
+type EntryInfo struct {
+	Key        string
+	Size       int64
+	LastAccess time.Time
+	Hits       uint64
+	ExpiresAt  time.Time
+}
+
+// EvictionPolicy chooses which entries are evicted when the store is full.
+type EvictionPolicy interface {
+	Name() string
+	// Before reports whether a should be evicted before b.
+	Before(a EntryInfo, b EntryInfo) bool
+}
+
+// Eviction policies that can be used in Limits.
+var (
+	LRU          EvictionPolicy = lru{}
+	LFU          EvictionPolicy = lfu{}
+	TTLFirst     EvictionPolicy = ttlFirst{}
+	RejectWrites EvictionPolicy = rejectWrites{}
+)
+
+// PolicyByName returns the policy called name, as given by its Name.
+func PolicyByName(name string) (EvictionPolicy, error) {
+	for _, p := range []EvictionPolicy{LRU, LFU, TTLFirst, RejectWrites} {
+		if p.Name() == name {
+			return p, nil
+		}
+	}
+
+	return nil, errors.New("unknown eviction policy " + name)
+}
+
+type lru struct{}
+
+func (lru) Name() string { return "lru" }
+
+func (lru) Before(a EntryInfo, b EntryInfo) bool {
+	return a.LastAccess.Before(b.LastAccess)
+}
+
+type lfu struct{}
+
+func (lfu) Name() string { return "lfu" }
+
+func (lfu) Before(a EntryInfo, b EntryInfo) bool {
+	if a.Hits != b.Hits {
+		return a.Hits < b.Hits
+	}
+
+	return a.LastAccess.Before(b.LastAccess)
+}
+
+// ttlFirst evicts the entries closest to expiring, then entries without an
+// expiry in least recently used order.
+type ttlFirst struct{}
+
+func (ttlFirst) Name() string { return "ttl" }
+
+func (ttlFirst) Before(a EntryInfo, b EntryInfo) bool {
+	switch {
+	case a.ExpiresAt.IsZero() && b.ExpiresAt.IsZero():
+		return a.LastAccess.Before(b.LastAccess)
+	case a.ExpiresAt.IsZero():
+		return false
+	case b.ExpiresAt.IsZero():
+		return true
+	}
+
+	return a.ExpiresAt.Before(b.ExpiresAt)
+}
+
+type rejectWrites struct{}
+
+func (rejectWrites) Name() string { return "reject" }
+
+func (rejectWrites) Before(a EntryInfo, b EntryInfo) bool { return false }
+
+// Stats reports the store's size, limits and how many entries have been
+// removed to stay within them. Tombstones are not counted as keys, but
+// their size is counted in Bytes, and a store over MaxBytes with only
+// tombstones left rejects writes until they are swept.
+type Stats struct {
+	Keys        int    `json:"keys"`
+	Tombstones  int    `json:"tombstones"`
+	Bytes       int64  `json:"bytes"`
+	MaxKeys     int    `json:"maxKeys"`
+	MaxBytes    int64  `json:"maxBytes"`
+	Policy      string `json:"policy"`
+	Evictions   uint64 `json:"evictions"`
+	Expirations uint64 `json:"expirations"`
+	Rejections  uint64 `json:"rejections"`
+}
+
+// usage records reads and writes of an entry. It is shared between copies
+// of an item and updated atomically, as reads only hold the read lock.
+type usage struct {
+	hits       uint64
+	lastAccess int64
+}
+
+func (u *usage) touch() {
+	atomic.AddUint64(&u.hits, 1)
+	atomic.StoreInt64(&u.lastAccess, time.Now().UnixNano())
+}
+
+func sizeOf(k string, i item) int64 {
+	n := len(k) + len(i.typ) + len(i.contentType) + entryOverhead
+
+	if i.crdt != nil {
+		n += len(encode(i.crdt))
+	} else {
+		n += len(i.value)
+	}
+
+	return int64(n)
+}
+
+// SetLimits applies l to the store, evicting entries straight away if the
+// store is already over the new limits.
+func (s *Store) SetLimits(l Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.limits = l
+	s.evict("", len(s.items)-s.tombstones, s.bytes)
+}
+
+func (s *Store) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	st := s.stats
+	st.Keys = len(s.items) - s.tombstones
+	st.Tombstones = s.tombstones
+	st.Bytes = s.bytes
+	st.MaxKeys = s.limits.MaxKeys
+	st.MaxBytes = s.limits.MaxBytes
+	st.Policy = RejectWrites.Name()
+	if s.limits.Policy != nil {
+		st.Policy = s.limits.Policy.Name()
+	}
+
+	return st
+}
+
+// reserve makes room for k to be stored with the given size, evicting
+// other entries as the policy allows. The caller must hold the write lock.
+func (s *Store) reserve(k string, size int64) error {
+	if s.limits.MaxBytes > 0 && size > s.limits.MaxBytes {
+		s.stats.Rejections++
+		return ErrFull
+	}
+
+	old, exists := s.items[k]
+
+	keys := len(s.items) - s.tombstones
+	if !exists || old.deleted {
+		keys++
+	}
+
+	if !s.evict(k, keys, s.bytes+size-old.size) {
+		s.stats.Rejections++
+		return ErrFull
+	}
+
+	return nil
+}
+
+// evict removes entries other than k until keys and bytes are within the
+// limits, reporting whether it succeeded. The caller must hold the write
+// lock.
+func (s *Store) evict(k string, keys int, bytes int64) bool {
+	l := s.limits
+
+	for (l.MaxKeys > 0 && keys > l.MaxKeys) || (l.MaxBytes > 0 && bytes > l.MaxBytes) {
+		victim, expired, ok := s.victim(k)
+		if !ok {
+			return false
+		}
+
+		bytes -= s.items[victim].size
+		keys--
+
+		if expired {
+			s.remove(victim, OpExpire)
+		} else {
+			s.remove(victim, OpEvict)
+		}
+	}
+
+	return true
+}
+
+// victim samples entries other than k and returns the one to evict first.
+// Expired entries are always chosen first; other entries only when the
+// policy allows eviction. Tombstones are never chosen, as a delete whose
+// tombstone was evicted could be undone by an older write arriving late;
+// Sweep removes them once they are older than the TombstoneTTL.
+func (s *Store) victim(k string) (string, bool, bool) {
+	now := time.Now()
+	policy := s.limits.Policy
+	if policy == nil {
+		policy = RejectWrites
+	}
+
+	var best EntryInfo
+	found := false
+	sampled := 0
+
+	for key, i := range s.items {
+		if key == k || i.deleted {
+			continue
+		}
+
+		if i.expired(now) {
+			return key, true, true
+		}
+
+		if policy != RejectWrites {
+			info := EntryInfo{
+				Key:        key,
+				Size:       i.size,
+				LastAccess: time.Unix(0, atomic.LoadInt64(&i.usage.lastAccess)),
+				Hits:       atomic.LoadUint64(&i.usage.hits),
+				ExpiresAt:  i.expiresAt,
+			}
+
+			if !found || policy.Before(info, best) {
+				best = info
+				found = true
+			}
+		}
+
+		sampled++
+		if sampled == evictionSamples {
+			break
+		}
+	}
+
+	return best.Key, false, found
+}
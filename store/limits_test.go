@@ -0,0 +1,182 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMaxKeysEvictsLeastRecentlyUsed(t *testing.T) {
+	s := New()
+	s.SetLimits(Limits{MaxKeys: 2, Policy: LRU})
+
+	s.Set("a", "1")
+	time.Sleep(time.Millisecond)
+	s.Set("b", "2")
+	time.Sleep(time.Millisecond)
+	s.GetValue("a")
+	s.Set("c", "3")
+
+	if _, ok := s.GetValue("b"); ok {
+		t.Errorf("expected least recently used key b to be evicted")
+	}
+
+	for _, k := range []string{"a", "c"} {
+		if _, ok := s.GetValue(k); !ok {
+			t.Errorf("expected key %s to be kept", k)
+		}
+	}
+
+	if got := s.Stats().Evictions; got != 1 {
+		t.Errorf("expected 1 eviction, got %d", got)
+	}
+}
+
+func TestMaxKeysEvictsLeastFrequentlyUsed(t *testing.T) {
+	s := New()
+	s.SetLimits(Limits{MaxKeys: 2, Policy: LFU})
+
+	s.Set("a", "1")
+	s.Set("b", "2")
+	s.GetValue("a")
+	s.GetValue("a")
+	s.GetValue("b")
+	s.Set("c", "3")
+
+	if _, ok := s.GetValue("b"); ok {
+		t.Errorf("expected least frequently used key b to be evicted")
+	}
+}
+
+func TestTTLFirstEvictsSoonestExpiry(t *testing.T) {
+	s := New()
+	s.SetLimits(Limits{MaxKeys: 3, Policy: TTLFirst})
+
+	s.SetWithTTL("later", "1", time.Hour)
+	s.Set("forever", "2")
+	s.SetWithTTL("soon", "3", time.Minute)
+	s.Set("new", "4")
+
+	if _, ok := s.GetValue("soon"); ok {
+		t.Errorf("expected soonest expiring key to be evicted")
+	}
+}
+
+func TestRejectWrites(t *testing.T) {
+	s := New()
+	s.SetLimits(Limits{MaxKeys: 1, Policy: RejectWrites})
+
+	s.SetTyped("a", "1", TypeString, 0)
+
+	if _, err := s.SetTyped("b", "2", TypeString, 0); err != ErrFull {
+		t.Errorf("expected %v, got %v", ErrFull, err)
+	}
+
+	if _, err := s.SetTyped("a", "3", TypeString, 0); err != nil {
+		t.Errorf("expected overwrite to succeed, got %v", err)
+	}
+
+	if _, err := s.SetAdd("set", "x"); err != ErrFull {
+		t.Errorf("expected %v, got %v", ErrFull, err)
+	}
+
+	if got := s.Stats().Rejections; got != 2 {
+		t.Errorf("expected 2 rejections, got %d", got)
+	}
+}
+
+func TestRejectedUpdateLeavesValue(t *testing.T) {
+	s := New()
+	s.SetAdd("set", "x")
+
+	size := s.Stats().Bytes
+	s.SetLimits(Limits{MaxBytes: size, Policy: RejectWrites})
+
+	if _, err := s.SetAdd("set", "y"); err != ErrFull {
+		t.Errorf("expected %v, got %v", ErrFull, err)
+	}
+
+	if got, _ := s.GetValue("set"); got != `["x"]` {
+		t.Errorf("expected set to be unchanged, got %s", got)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	s := New()
+	per := int64(len("key-00") + len(TypeString) + len("0123456789") + entryOverhead)
+	s.SetLimits(Limits{MaxBytes: 10 * per, Policy: LRU})
+
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprintf("key-%02d", i), "0123456789")
+	}
+
+	st := s.Stats()
+	if st.Bytes > st.MaxBytes {
+		t.Errorf("expected at most %d bytes, got %d", st.MaxBytes, st.Bytes)
+	}
+
+	if st.Keys != 10 {
+		t.Errorf("expected 10 keys, got %d", st.Keys)
+	}
+
+	if _, err := s.SetTyped("big", string(make([]byte, st.MaxBytes)), TypeBytes, 0); err != ErrFull {
+		t.Errorf("expected %v for value larger than the store, got %v", ErrFull, err)
+	}
+}
+
+func TestTombstonesAreNotEvicted(t *testing.T) {
+	for _, policy := range []EvictionPolicy{LRU, RejectWrites} {
+		t.Run(policy.Name(), func(t *testing.T) {
+			s := New()
+			s.Set("deleted", "0123456789")
+			s.Delete("deleted")
+
+			s.SetLimits(Limits{MaxBytes: s.Stats().Bytes, Policy: policy})
+
+			if _, err := s.SetTyped("region", "eu-west-1", TypeString, 0); err != ErrFull {
+				t.Errorf("expected %v, got %v", ErrFull, err)
+			}
+
+			// The tombstone still orders the delete after older writes.
+			old := Entry{Key: "deleted", Type: TypeString, Value: "0123456789", Modified: time.Now().Add(-time.Hour)}
+			s.SetLimits(Limits{})
+			s.Import(old, true)
+
+			if _, ok := s.GetValue("deleted"); ok {
+				t.Errorf("expected the older write to be ignored")
+			}
+		})
+	}
+}
+
+func TestSizeAccounting(t *testing.T) {
+	s := New()
+
+	s.Set("key", "value")
+	s.Set("key", "longer value")
+	s.Set("other", "value")
+	s.Delete("other")
+
+	// The tombstone left by the delete is counted too.
+	want := int64(len("key") + len(TypeString) + len("longer value") + entryOverhead + len("other") + entryOverhead)
+	if got := s.Stats().Bytes; got != want {
+		t.Errorf("expected %d bytes, got %d", want, got)
+	}
+
+	if st := s.Stats(); st.Keys != 1 || st.Tombstones != 1 {
+		t.Errorf("expected 1 key and 1 tombstone, got %+v", st)
+	}
+}
+
+func TestPolicyByName(t *testing.T) {
+	for _, name := range []string{"lru", "lfu", "ttl", "reject"} {
+		p, err := PolicyByName(name)
+		if err != nil || p.Name() != name {
+			t.Errorf("expected policy %s, got %v, %v", name, p, err)
+		}
+	}
+
+	if _, err := PolicyByName("random"); err == nil {
+		t.Errorf("expected error for unknown policy")
+	}
+}
@@ -0,0 +1,99 @@
+package store
+
+import "encoding/json"
+
+// LWWEntry is a field of an LWWMap. Removed fields are kept as tombstones
+// so that an older write arriving late cannot bring them back.
+type LWWEntry struct {
+	Value     string `json:"value,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	Timestamp int64  `json:"ts"`
+	Node      string `json:"node"`
+}
+
+// after reports whether e wins over o. Ties on timestamp are broken by node
+// and then by content, so every replica picks the same winner.
+func (e LWWEntry) after(o LWWEntry) bool {
+	if e.Timestamp != o.Timestamp {
+		return e.Timestamp > o.Timestamp
+	}
+
+	if e.Node != o.Node {
+		return e.Node > o.Node
+	}
+
+	if e.Deleted != o.Deleted {
+		return e.Deleted
+	}
+
+	return e.Value > o.Value
+}
+
+// LWWMap is a map whose fields are each resolved by last-writer-wins.
+type LWWMap struct {
+	Fields map[string]LWWEntry `json:"fields"`
+}
+
+func NewLWWMap() *LWWMap {
+	return &LWWMap{
+		Fields: make(map[string]LWWEntry),
+	}
+}
+
+// Set writes field at time ts on behalf of node and returns the delta. The
+// write is ordered after any version of the field already seen here.
+func (m *LWWMap) Set(field string, value string, ts int64, node string) *LWWMap {
+	return m.write(field, LWWEntry{Value: value, Timestamp: ts, Node: node})
+}
+
+// Remove deletes field at time ts on behalf of node and returns the delta.
+func (m *LWWMap) Remove(field string, ts int64, node string) *LWWMap {
+	return m.write(field, LWWEntry{Deleted: true, Timestamp: ts, Node: node})
+}
+
+func (m *LWWMap) write(field string, e LWWEntry) *LWWMap {
+	if cur, ok := m.Fields[field]; ok && e.Timestamp <= cur.Timestamp {
+		e.Timestamp = cur.Timestamp + 1
+	}
+
+	delta := NewLWWMap()
+	delta.Fields[field] = e
+
+	m.Merge(delta)
+	return delta
+}
+
+func (m *LWWMap) Merge(o *LWWMap) {
+	for field, e := range o.Fields {
+		if cur, ok := m.Fields[field]; !ok || e.after(cur) {
+			m.Fields[field] = e
+		}
+	}
+}
+
+// Values returns the fields that have not been removed.
+func (m *LWWMap) Values() map[string]string {
+	values := make(map[string]string)
+
+	for field, e := range m.Fields {
+		if !e.Deleted {
+			values[field] = e.Value
+		}
+	}
+
+	return values
+}
+
+func (m *LWWMap) text() string {
+	return encode(m.Values())
+}
+
+func (m *LWWMap) mergeJSON(state []byte) error {
+	in := NewLWWMap()
+	if err := json.Unmarshal(state, in); err != nil {
+		return err
+	}
+
+	m.Merge(in)
+	return nil
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// ORSet is an observed-remove set. Every add is recorded under a unique
+// tag, and a remove only tombstones the tags it has seen, so an element
+// added concurrently with its removal stays in the set.
+type ORSet struct {
+	Adds    map[string]map[string]bool `json:"adds"`
+	Removes map[string]bool            `json:"removes"`
+}
+
+func NewORSet() *ORSet {
+	return &ORSet{
+		Adds:    make(map[string]map[string]bool),
+		Removes: make(map[string]bool),
+	}
+}
+
+// Add adds elem under tag, which must be unique across the cluster, and
+// returns the delta.
+func (s *ORSet) Add(elem string, tag string) *ORSet {
+	delta := NewORSet()
+	delta.Adds[elem] = map[string]bool{tag: true}
+
+	s.Merge(delta)
+	return delta
+}
+
+// Remove tombstones every observed tag of elem and returns the delta.
+func (s *ORSet) Remove(elem string) *ORSet {
+	delta := NewORSet()
+
+	for tag := range s.Adds[elem] {
+		delta.Removes[tag] = true
+	}
+
+	s.Merge(delta)
+	return delta
+}
+
+func (s *ORSet) Merge(o *ORSet) {
+	for elem, tags := range o.Adds {
+		if s.Adds[elem] == nil {
+			s.Adds[elem] = make(map[string]bool)
+		}
+
+		for tag := range tags {
+			s.Adds[elem][tag] = true
+		}
+	}
+
+	for tag := range o.Removes {
+		s.Removes[tag] = true
+	}
+}
+
+func (s *ORSet) Contains(elem string) bool {
+	for tag := range s.Adds[elem] {
+		if !s.Removes[tag] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Elements returns the members of the set in sorted order.
+func (s *ORSet) Elements() []string {
+	elems := []string{}
+
+	for elem := range s.Adds {
+		if s.Contains(elem) {
+			elems = append(elems, elem)
+		}
+	}
+
+	sort.Strings(elems)
+	return elems
+}
+
+func (s *ORSet) text() string {
+	return encode(s.Elements())
+}
+
+func (s *ORSet) mergeJSON(state []byte) error {
+	in := NewORSet()
+	if err := json.Unmarshal(state, in); err != nil {
+		return err
+	}
+
+	s.Merge(in)
+	return nil
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// VersionVector counts the writes each node has made.
+type VersionVector map[string]uint64
+
+// descends reports whether v has seen every write that o has.
+func (v VersionVector) descends(o VersionVector) bool {
+	for node, n := range o {
+		if v[node] < n {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (v VersionVector) equal(o VersionVector) bool {
+	return v.descends(o) && o.descends(v)
+}
+
+// MVEntry is a value written to a register by Node, with the clock of the
+// write.
+type MVEntry struct {
+	Value string        `json:"value"`
+	Clock VersionVector `json:"clock"`
+	Node  string        `json:"node,omitempty"`
+}
+
+// after reports whether e is kept over f when both were written with the
+// same clock, which happens when a node writes again after losing its
+// earlier writes. Every replica picks the same one.
+func (e MVEntry) after(f MVEntry) bool {
+	if e.Node != f.Node {
+		return e.Node > f.Node
+	}
+
+	return e.Value > f.Value
+}
+
+// MVRegister is a multi-value register. A write replaces every value it
+// has seen; writes made concurrently on different nodes are all kept until
+// a later write replaces them.
+type MVRegister struct {
+	Entries []MVEntry `json:"entries"`
+}
+
+func NewMVRegister() *MVRegister {
+	return &MVRegister{
+		Entries: []MVEntry{},
+	}
+}
+
+// Set replaces the values seen here with value on behalf of node and
+// returns the delta.
+func (r *MVRegister) Set(value string, node string) *MVRegister {
+	clock := VersionVector{}
+
+	for _, e := range r.Entries {
+		for n, c := range e.Clock {
+			if c > clock[n] {
+				clock[n] = c
+			}
+		}
+	}
+	clock[node]++
+
+	delta := &MVRegister{
+		Entries: []MVEntry{{Value: value, Clock: clock, Node: node}},
+	}
+
+	r.Merge(delta)
+	return delta
+}
+
+func (r *MVRegister) Merge(o *MVRegister) {
+	all := append(append([]MVEntry{}, r.Entries...), o.Entries...)
+	kept := []MVEntry{}
+
+	for i, e := range all {
+		superseded := false
+
+		for j, f := range all {
+			if i == j {
+				continue
+			}
+
+			if !f.Clock.descends(e.Clock) {
+				continue
+			}
+
+			// Of entries with the same clock one is kept, and of
+			// copies of the same entry the first.
+			if !f.Clock.equal(e.Clock) || f.after(e) || (!e.after(f) && j < i) {
+				superseded = true
+				break
+			}
+		}
+
+		if !superseded {
+			kept = append(kept, e)
+		}
+	}
+
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Value < kept[j].Value
+	})
+
+	r.Entries = kept
+}
+
+// Values returns the concurrent values held by the register in sorted
+// order.
+func (r *MVRegister) Values() []string {
+	values := []string{}
+
+	for _, e := range r.Entries {
+		values = append(values, e.Value)
+	}
+
+	return values
+}
+
+func (r *MVRegister) text() string {
+	return encode(r.Values())
+}
+
+func (r *MVRegister) mergeJSON(state []byte) error {
+	in := NewMVRegister()
+	if err := json.Unmarshal(state, in); err != nil {
+		return err
+	}
+
+	r.Merge(in)
+	return nil
+}
@@ -1,23 +1,716 @@
 package store
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Operations reported to observers when the store changes.
+const (
+	OpPut    = "put"
+	OpDelete = "delete"
+	OpExpire = "expire"
+	OpEvict  = "evict"
+	OpTouch  = "touch"
+)
+
+// Change describes a single modification applied to the store.
+type Change struct {
+	Op    string
+	Key   string
+	Value string
+	// Type and ContentType are those of the value, when there is one.
+	Type        string
+	ContentType string
+}
+
+// Observer is notified of every change applied to the store, in the order
+// the changes were applied.
+type Observer interface {
+	Observe(c Change)
+}
+
+// Types of value held in the store. Counters, sets, maps and registers are
+// replicated types, changed through their own operations rather than set
+// directly.
+const (
+	TypeString   = "string"
+	TypeInt      = "int"
+	TypeFloat    = "float"
+	TypeBytes    = "bytes"
+	TypeCounter  = "counter"
+	TypeSet      = "set"
+	TypeMap      = "map"
+	TypeRegister = "register"
+)
+
+var (
+	ErrUnknownType  = errors.New("unknown value type")
+	ErrInvalidValue = errors.New("value does not match its type")
+	ErrNotInteger   = errors.New("value is not an integer")
+	ErrWrongType    = errors.New("key holds a value of another type")
+	ErrPresent      = errors.New("key is present")
+	ErrMissing      = errors.New("key is missing")
+	ErrChanged      = errors.New("key has changed")
+	ErrOverflow     = errors.New("increment or decrement would overflow")
+)
+
+// Item is a value together with its type. Value is the textual form for
+// numbers and counters, the raw bytes for strings and bytes, and JSON for
+// sets, maps and registers. ContentType is only set for bytes uploaded
+// with one. Flags are kept for memcached clients, which give every value
+// flags of their own. CAS changes every time the item is written.
+type Item struct {
+	Value       string
+	Type        string
+	ContentType string
+	Flags       uint32
+	CAS         uint64
+}
+
+// Condition restricts a write by SetIf to an item in a given state. The
+// zero Condition allows any write.
+type Condition struct {
+	// Present requires the item to be present, and Missing requires it to
+	// be missing.
+	Present bool
+	Missing bool
+	// CAS, when not zero, requires the item not to have been written since
+	// it had this CAS.
+	CAS uint64
+}
+
+type item struct {
+	value       string
+	typ         string
+	contentType string
+	flags       uint32
+	cas         uint64
+	crdt        crdt
+	expiresAt   time.Time
+	modified    time.Time
+	size        int64
+	usage       *usage
+	// deleted marks a tombstone, left where a key was deleted so that the
+	// delete wins over older writes to the key that arrive after it.
+	deleted bool
+	// since is when the item a replicated value was created over was
+	// written, usually the tombstone of an earlier value at its key. State
+	// written before then belongs to that earlier value.
+	since time.Time
+}
+
+func (i item) expired(now time.Time) bool {
+	return !i.expiresAt.IsZero() && !now.Before(i.expiresAt)
+}
+
+// DefaultTombstoneTTL is how long deleted keys are remembered when a store
+// does not set TombstoneTTL.
+const DefaultTombstoneTTL = 24 * time.Hour
+
 type Store struct {
-	items map[string]string
+	// NodeID identifies this node's entries in counters. Every node in a
+	// cluster must use a different ID.
+	NodeID string
+
+	// TombstoneTTL is how long Sweep keeps a tombstone for a deleted key.
+	// A write older than the delete that reaches the store later than this
+	// brings the key back. Zero uses DefaultTombstoneTTL.
+	TombstoneTTL time.Duration
+
+	mu         sync.RWMutex
+	items      map[string]item
+	observers  []Observer
+	seq        uint64
+	cas        uint64
+	bytes      int64
+	tombstones int
+	limits     Limits
+	stats      Stats
 }
 
 func (s *Store) Set(k string, v string) string {
-	s.items[k] = v
+	return s.SetWithTTL(k, v, 0)
+}
+
+// SetWithTTL stores v under k, expiring it after ttl. A ttl of zero or less
+// stores the value without an expiry.
+func (s *Store) SetWithTTL(k string, v string, ttl time.Duration) string {
+	v, _ = s.SetTyped(k, v, TypeString, ttl)
 	return v
 }
 
+// SetTyped stores v as a value of type typ, returning it in its canonical
+// form. Numbers are validated and normalised.
+func (s *Store) SetTyped(k string, v string, typ string, ttl time.Duration) (string, error) {
+	v, err := canonical(v, typ)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.put(k, item{value: v, typ: typ}, ttl); err != nil {
+		return "", err
+	}
+
+	return v, nil
+}
+
+// SetIf stores v like SetTyped, along with flags, when k meets cond. It
+// returns ErrPresent, ErrMissing or ErrChanged when it does not.
+func (s *Store) SetIf(k string, v string, typ string, flags uint32, ttl time.Duration, cond Condition) (Item, error) {
+	v, err := canonical(v, typ)
+	if err != nil {
+		return Item{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.live(k)
+
+	switch {
+	case ok && cond.Missing:
+		return Item{}, ErrPresent
+	case !ok && (cond.Present || cond.CAS != 0):
+		return Item{}, ErrMissing
+	case cond.CAS != 0 && i.cas != cond.CAS:
+		return Item{}, ErrChanged
+	}
+
+	i = item{value: v, typ: typ, flags: flags}
+	if err := s.put(k, i, ttl); err != nil {
+		return Item{}, err
+	}
+
+	return Item{Value: v, Type: typ, Flags: flags, CAS: s.cas}, nil
+}
+
+// SetContent stores data as bytes along with the content type it was
+// uploaded with.
+func (s *Store) SetContent(k string, data string, contentType string, ttl time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.put(k, item{value: data, typ: TypeBytes, contentType: contentType}, ttl); err != nil {
+		return "", err
+	}
+
+	return data, nil
+}
+
 func (s *Store) GetValue(k string) (string, bool) {
-	v, ok := s.items[k]
+	i, ok := s.GetItem(k)
+
+	return i.Value, ok
+}
+
+func (s *Store) GetItem(k string) (Item, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i, ok := s.live(k)
+	if !ok {
+		return Item{}, false
+	}
+
+	i.usage.touch()
+
+	return Item{Value: i.value, Type: i.typ, ContentType: i.contentType, Flags: i.flags, CAS: i.cas}, true
+}
+
+// Incr adds delta to the counter at k on behalf of this node and returns
+// the new total along with the counter's state, which can be merged into
+// other replicas. A missing key starts at zero, and an integer value is
+// converted into a counter whose base is that value, as of when it was
+// written, so that replicas converting the same value count it once. It
+// returns ErrOverflow when the total would not fit in an int64.
+func (s *Store) Incr(k string, delta int64) (int64, PNCounter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parse := func(v string) (int64, error) {
+		return strconv.ParseInt(v, 10, 64)
+	}
+
+	c, err := s.incr(k, true, parse, func(v int64) (int64, error) {
+		if (delta > 0 && v > math.MaxInt64-delta) || (delta < 0 && v < math.MinInt64-delta) {
+			return 0, ErrOverflow
+		}
+		return delta, nil
+	})
+	if err != nil {
+		return 0, PNCounter{}, err
+	}
+
+	return c.Value(), *c, nil
+}
+
+// IncrUnsigned adds delta to the counter at k, or subtracts it when decr
+// is set, on behalf of this node, treating the total as an unsigned 64-bit
+// integer as memcached does: an increment past the largest wraps around
+// and a decrement stops at zero. Unlike Incr it returns ErrMissing when k
+// is missing, and converts integer values up to the largest uint64. A
+// total past the largest int64 is held, and returned by Incr and GetItem,
+// as the negative int64 with the same bits.
+func (s *Store) IncrUnsigned(k string, delta uint64, decr bool) (uint64, PNCounter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parse := func(v string) (int64, error) {
+		n, err := strconv.ParseUint(v, 10, 64)
+		return int64(n), err
+	}
+
+	c, err := s.incr(k, false, parse, func(v int64) (int64, error) {
+		if !decr {
+			return int64(delta), nil
+		}
+
+		if delta > uint64(v) {
+			delta = uint64(v)
+		}
+		return -int64(delta), nil
+	})
+	if err != nil {
+		return 0, PNCounter{}, err
+	}
+
+	return uint64(c.Value()), *c, nil
+}
+
+// incr adds the delta fn returns for the counter's total to the counter at
+// k, converting an integer value read by parse into a counter as Incr
+// does. A missing key is created when create is set, and ErrMissing is
+// returned when it is not. The caller must hold the write lock.
+func (s *Store) incr(k string, create bool, parse func(string) (int64, error), fn func(v int64) (int64, error)) (*PNCounter, error) {
+	i, ok := s.live(k)
+	if !ok && !create {
+		return nil, ErrMissing
+	}
+	since := i.since
+
+	c, isCounter := s.writable(i).(*PNCounter)
+	if !isCounter {
+		n := NewPNCounter()
+		c = &n
+		since = s.items[k].modified
+
+		if ok {
+			v, err := parse(i.value)
+			if i.crdt != nil || err != nil {
+				return nil, ErrNotInteger
+			}
+			c.Base, c.BaseTime = v, i.modified.UnixNano()
+		}
+	}
+
+	delta, err := fn(c.Value())
+	if err != nil {
+		return nil, err
+	}
+	c.Add(s.NodeID, delta)
+
+	i = item{typ: TypeCounter, contentType: i.contentType, flags: i.flags, crdt: c, expiresAt: i.expiresAt, since: since}
+	if err := s.put(k, i, 0); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Merge applies replicated state of type typ to k. Merging the same state
+// more than once, or states in any order, gives the same result. Replicated
+// state replaces a value of any other type.
+func (s *Store) Merge(k string, typ string, state []byte) error {
+	c, err := newCRDT(typ)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, _ := s.live(k)
+	if i.typ == typ && i.crdt != nil {
+		c = s.writable(i)
+	}
+
+	if err := c.mergeJSON(state); err != nil {
+		return err
+	}
+
+	return s.put(k, item{typ: typ, crdt: c, expiresAt: i.expiresAt}, 0)
+}
+
+// update applies fn to the value of type typ at k and returns the encoded
+// delta fn produces for replication. When k is missing it is created if
+// create is set, and ErrMissing is returned if not.
+func (s *Store) update(k string, typ string, create bool, fn func(c crdt) interface{}) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.live(k)
+
+	c := s.writable(i)
+	switch {
+	case !ok && !create:
+		return nil, ErrMissing
+	case !ok:
+		c, _ = newCRDT(typ)
+		i.since = s.items[k].modified
+	case i.typ != typ:
+		return nil, ErrWrongType
+	}
+
+	delta, err := json.Marshal(fn(c))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.put(k, item{typ: typ, crdt: c, expiresAt: i.expiresAt, since: i.since}, 0); err != nil {
+		return nil, err
+	}
+
+	return delta, nil
+}
+
+// SetAdd adds elem to the set at k and returns the delta to replicate.
+func (s *Store) SetAdd(k string, elem string) ([]byte, error) {
+	return s.update(k, TypeSet, true, func(c crdt) interface{} {
+		s.seq++
+		tag := fmt.Sprintf("%s/%d.%d", s.NodeID, time.Now().UnixNano(), s.seq)
+
+		return c.(*ORSet).Add(elem, tag)
+	})
+}
+
+// SetRemove removes elem from the set at k and returns the delta to
+// replicate, or ErrMissing when there is no set at k. Only additions this
+// node has seen are removed, so a concurrent add on another node survives.
+func (s *Store) SetRemove(k string, elem string) ([]byte, error) {
+	return s.update(k, TypeSet, false, func(c crdt) interface{} {
+		return c.(*ORSet).Remove(elem)
+	})
+}
+
+// MapSet sets field in the map at k and returns the delta to replicate.
+func (s *Store) MapSet(k string, field string, value string) ([]byte, error) {
+	return s.update(k, TypeMap, true, func(c crdt) interface{} {
+		return c.(*LWWMap).Set(field, value, time.Now().UnixNano(), s.NodeID)
+	})
+}
+
+// MapRemove removes field from the map at k and returns the delta to
+// replicate, or ErrMissing when there is no map at k.
+func (s *Store) MapRemove(k string, field string) ([]byte, error) {
+	return s.update(k, TypeMap, false, func(c crdt) interface{} {
+		return c.(*LWWMap).Remove(field, time.Now().UnixNano(), s.NodeID)
+	})
+}
+
+// RegisterSet assigns value to the register at k and returns the delta to
+// replicate.
+func (s *Store) RegisterSet(k string, value string) ([]byte, error) {
+	return s.update(k, TypeRegister, true, func(c crdt) interface{} {
+		return c.(*MVRegister).Set(value, s.NodeID)
+	})
+}
+
+// Delete removes k from the store, leaving a tombstone in its place, and
+// reports whether it was present.
+func (s *Store) Delete(k string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.items[k]
+	if !ok || i.deleted {
+		return false
+	}
+
+	if i.expired(time.Now()) {
+		s.remove(k, OpExpire)
+		return false
+	}
+
+	s.bury(k, s.stamp(k))
+	return true
+}
+
+// Expire makes k expire after ttl, or never when ttl is zero or less,
+// reporting whether k was present. Changing the TTL changes the item's CAS
+// and notifies observers, but does not change when the item was modified,
+// which orders its value against writes on other nodes.
+func (s *Store) Expire(k string, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.live(k)
+	if !ok {
+		return false
+	}
+
+	i.expiresAt = time.Time{}
+	if ttl > 0 {
+		i.expiresAt = time.Now().Add(ttl)
+	}
+
+	s.cas++
+	i.cas = s.cas
+
+	s.items[k] = i
+	s.notify(Change{Op: OpTouch, Key: k, Value: i.value, Type: i.typ, ContentType: i.contentType})
+
+	return true
+}
+
+// TTL returns how long k has left before it expires, or zero when it does
+// not expire, and false when k is not present.
+func (s *Store) TTL(k string) (time.Duration, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i, ok := s.live(k)
+	if !ok || i.expiresAt.IsZero() {
+		return 0, ok
+	}
+
+	return time.Until(i.expiresAt), true
+}
+
+// Keys returns the key of every unexpired item, sorted.
+func (s *Store) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	keys := []string{}
+
+	for k, i := range s.items {
+		if !i.deleted && !i.expired(now) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Sweep removes every expired item and returns how many were removed. It
+// also drops tombstones older than the store's TombstoneTTL.
+func (s *Store) Sweep() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	n := 0
+
+	ttl := s.TombstoneTTL
+	if ttl <= 0 {
+		ttl = DefaultTombstoneTTL
+	}
+
+	for k, i := range s.items {
+		switch {
+		case i.deleted:
+			if now.Sub(i.modified) > ttl {
+				s.remove(k, OpDelete)
+			}
+		case i.expired(now):
+			s.remove(k, OpExpire)
+			n++
+		}
+	}
+
+	return n
+}
+
+// live returns the unexpired item at k, which is missing when it has been
+// deleted. The caller must hold the lock.
+func (s *Store) live(k string) (item, bool) {
+	i, ok := s.items[k]
+	if !ok || i.deleted || i.expired(time.Now()) {
+		return item{}, false
+	}
+
+	return i, true
+}
+
+// stamp returns when a write to k made now is modified: now, or just after
+// the item it replaces when that was modified later, so that each write to
+// a key is ordered after the one before it. The caller must hold the lock.
+func (s *Store) stamp(k string) time.Time {
+	now := time.Now().Round(0)
+	if old, ok := s.items[k]; ok && !now.After(old.modified) {
+		return old.modified.Add(time.Nanosecond)
+	}
+
+	return now
+}
+
+// newer reports whether a was written after b. Writes modified at the same
+// moment are ordered by their versions, so that every node picks the same
+// one.
+func newer(a item, b item) bool {
+	if !a.modified.Equal(b.modified) {
+		return a.modified.After(b.modified)
+	}
+
+	return version(a) > version(b)
+}
+
+// writable returns the replicated value of i for changing. When limits are
+// set it returns a copy, so that a write rejected for lack of space leaves
+// the stored value untouched.
+func (s *Store) writable(i item) crdt {
+	if i.crdt == nil || (s.limits.MaxKeys == 0 && s.limits.MaxBytes == 0) {
+		return i.crdt
+	}
+
+	c, _ := newCRDT(i.typ)
+	c.mergeJSON([]byte(encode(i.crdt)))
+
+	return c
+}
+
+// put stores i under k, rendering replicated types, applying ttl and
+// making room within the store's limits, and notifies observers. Unless i
+// was modified at a given time, it is modified now. The caller must hold
+// the write lock.
+func (s *Store) put(k string, i item, ttl time.Duration) error {
+	if i.crdt != nil {
+		i.value = i.crdt.text()
+	}
+
+	if i.modified.IsZero() {
+		i.modified = s.stamp(k)
+	}
+
+	if ttl > 0 {
+		i.expiresAt = time.Now().Add(ttl)
+	}
+
+	i.size = sizeOf(k, i)
+
+	if err := s.reserve(k, i.size); err != nil {
+		return err
+	}
+	old := s.items[k]
+
+	i.usage = old.usage
+	if i.usage == nil {
+		i.usage = &usage{}
+	}
+	i.usage.touch()
+
+	s.cas++
+	i.cas = s.cas
+
+	s.items[k] = i
+	s.bytes += i.size - old.size
+	if old.deleted {
+		s.tombstones--
+	}
+	s.notify(Change{Op: OpPut, Key: k, Value: i.value, Type: i.typ, ContentType: i.contentType})
+
+	return nil
+}
+
+// bury replaces the item at k with a tombstone modified at the given time,
+// notifying observers when it deletes a live item. The caller must hold
+// the write lock.
+func (s *Store) bury(k string, modified time.Time) {
+	old, exists := s.items[k]
+
+	t := item{deleted: true, modified: modified}
+	t.size = sizeOf(k, t)
+
+	s.items[k] = t
+	s.bytes += t.size - old.size
+
+	switch {
+	case old.deleted:
+	case !exists:
+		s.tombstones++
+	case old.expired(time.Now()):
+		s.tombstones++
+		s.stats.Expirations++
+		s.notify(Change{Op: OpExpire, Key: k})
+	default:
+		s.tombstones++
+		s.notify(Change{Op: OpDelete, Key: k})
+	}
+}
+
+// remove deletes k, reporting op to observers. Tombstones are removed
+// without notifying them. The caller must hold the write lock.
+func (s *Store) remove(k string, op string) {
+	i := s.items[k]
+	s.bytes -= i.size
+	delete(s.items, k)
+
+	if i.deleted {
+		s.tombstones--
+		return
+	}
+
+	switch op {
+	case OpExpire:
+		s.stats.Expirations++
+	case OpEvict:
+		s.stats.Evictions++
+	}
+
+	s.notify(Change{Op: op, Key: k})
+}
+
+func canonical(v string, typ string) (string, error) {
+	switch typ {
+	case TypeString, TypeBytes:
+		return v, nil
+	case TypeInt:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", ErrInvalidValue
+		}
+		return strconv.FormatInt(n, 10), nil
+	case TypeFloat:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return "", ErrInvalidValue
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+	}
+
+	return "", ErrUnknownType
+}
+
+// AddObserver registers o to be notified of subsequent changes.
+func (s *Store) AddObserver(o Observer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.observers = append(s.observers, o)
+}
 
-	return v, ok
+func (s *Store) notify(c Change) {
+	for _, o := range s.observers {
+		o.Observe(c)
+	}
 }
 
 func New() *Store {
 	var s Store
-	s.items = make(map[string]string)
+	s.items = make(map[string]item)
 
 	return &s
 }
@@ -1,6 +1,10 @@
 package store
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestSet(t *testing.T) {
 	var s = New()
@@ -46,3 +50,221 @@ func TestGetValueOnEmptyKey(t *testing.T) {
 		t.Errorf("Get was incorrect, expected %v but got %v", want, got)
 	}
 }
+
+type ObserverSpy struct {
+	changes []Change
+}
+
+func (o *ObserverSpy) Observe(c Change) {
+	o.changes = append(o.changes, c)
+}
+
+func TestDelete(t *testing.T) {
+	var s = New()
+	s.Set("some-key", "1234")
+
+	if !s.Delete("some-key") {
+		t.Errorf("Delete was incorrect, expected key to be present")
+	}
+
+	if _, ok := s.GetValue("some-key"); ok {
+		t.Errorf("Get was incorrect, expected deleted key to be missing")
+	}
+
+	if s.Delete("some-key") {
+		t.Errorf("Delete was incorrect, expected key to be missing")
+	}
+
+	if keys := s.Keys(); len(keys) != 0 {
+		t.Errorf("Keys was incorrect, expected no keys but got %v", keys)
+	}
+}
+
+func TestSweepDropsTombstones(t *testing.T) {
+	var s = New()
+	s.TombstoneTTL = time.Millisecond
+	s.Set("some-key", "1234")
+	s.Delete("some-key")
+
+	s.Sweep()
+	if st := s.Stats(); st.Tombstones != 1 {
+		t.Errorf("expected the tombstone to be kept, got %+v", st)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	s.Sweep()
+	if st := s.Stats(); st.Tombstones != 0 || st.Bytes != 0 {
+		t.Errorf("expected the tombstone to be dropped, got %+v", st)
+	}
+}
+
+func TestSetWithTTLExpires(t *testing.T) {
+	var s = New()
+	s.SetWithTTL("some-key", "1234", time.Millisecond)
+	s.SetWithTTL("other-key", "5678", time.Hour)
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := s.GetValue("some-key"); ok {
+		t.Errorf("Get was incorrect, expected expired key to be missing")
+	}
+
+	if got := s.Sweep(); got != 1 {
+		t.Errorf("Sweep was incorrect, expected 1 removal but got %d", got)
+	}
+
+	if _, ok := s.GetValue("other-key"); !ok {
+		t.Errorf("Get was incorrect, expected unexpired key to be present")
+	}
+}
+
+func TestObserverReceivesChanges(t *testing.T) {
+	var s = New()
+	o := &ObserverSpy{}
+	s.AddObserver(o)
+
+	s.Set("some-key", "1234")
+	s.Expire("some-key", time.Hour)
+	s.Delete("some-key")
+	s.SetWithTTL("other-key", "5678", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	s.Sweep()
+
+	want := []Change{
+		{Op: OpPut, Key: "some-key", Value: "1234", Type: TypeString},
+		{Op: OpTouch, Key: "some-key", Value: "1234", Type: TypeString},
+		{Op: OpDelete, Key: "some-key"},
+		{Op: OpPut, Key: "other-key", Value: "5678", Type: TypeString},
+		{Op: OpExpire, Key: "other-key"},
+	}
+
+	if !reflect.DeepEqual(o.changes, want) {
+		t.Errorf("Observer was incorrect, expected %v but got %v", want, o.changes)
+	}
+}
+
+func TestSetTyped(t *testing.T) {
+	cases := []struct {
+		value string
+		typ   string
+		want  string
+		err   error
+	}{
+		{"europe", TypeString, "europe", nil},
+		{"0042", TypeInt, "42", nil},
+		{"1.50", TypeFloat, "1.5", nil},
+		{"\x00\xff", TypeBytes, "\x00\xff", nil},
+		{"europe", TypeInt, "", ErrInvalidValue},
+		{"europe", "map", "", ErrUnknownType},
+	}
+
+	for _, c := range cases {
+		var s = New()
+
+		got, err := s.SetTyped("some-key", c.value, c.typ, 0)
+
+		if got != c.want || err != c.err {
+			t.Errorf("SetTyped was incorrect, expected %q, %v but got %q, %v", c.want, c.err, got, err)
+		}
+
+		i, ok := s.GetItem("some-key")
+		if c.err == nil && (!ok || i.Type != c.typ) {
+			t.Errorf("GetItem was incorrect, expected type %s but got %s", c.typ, i.Type)
+		}
+	}
+}
+
+func TestSetContent(t *testing.T) {
+	var s = New()
+	data := "\x89PNG\r\n\x1a\n\x00\xff"
+
+	s.SetContent("logo", data, "image/png", 0)
+
+	got, _ := s.GetItem("logo")
+	want := Item{Value: data, Type: TypeBytes, ContentType: "image/png", CAS: got.CAS}
+
+	if got != want {
+		t.Errorf("GetItem was incorrect, expected %v but got %v", want, got)
+	}
+}
+
+func TestSetIf(t *testing.T) {
+	var s = New()
+
+	if _, err := s.SetIf("some-key", "1234", TypeString, 0, 0, Condition{Present: true}); err != ErrMissing {
+		t.Errorf("SetIf was incorrect, expected %v but got %v", ErrMissing, err)
+	}
+
+	first, err := s.SetIf("some-key", "1234", TypeString, 7, 0, Condition{Missing: true})
+	if err != nil || first.Flags != 7 || first.CAS == 0 {
+		t.Errorf("SetIf was incorrect, expected a missing key to be set but got %+v, %v", first, err)
+	}
+
+	if _, err := s.SetIf("some-key", "5678", TypeString, 0, 0, Condition{Missing: true}); err != ErrPresent {
+		t.Errorf("SetIf was incorrect, expected %v but got %v", ErrPresent, err)
+	}
+
+	second, err := s.SetIf("some-key", "5678", TypeString, 0, 0, Condition{CAS: first.CAS})
+	if err != nil || second.CAS == first.CAS {
+		t.Errorf("SetIf was incorrect, expected an unchanged key to be replaced but got %+v, %v", second, err)
+	}
+
+	if _, err := s.SetIf("some-key", "9", TypeString, 0, 0, Condition{CAS: first.CAS}); err != ErrChanged {
+		t.Errorf("SetIf was incorrect, expected %v but got %v", ErrChanged, err)
+	}
+
+	if got, _ := s.GetItem("some-key"); got.Value != "5678" || got.CAS != second.CAS {
+		t.Errorf("GetItem was incorrect, expected 5678 with CAS %d but got %+v", second.CAS, got)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	var s = New()
+	s.Set("some-key", "1234")
+
+	if ttl, ok := s.TTL("some-key"); !ok || ttl != 0 {
+		t.Errorf("TTL was incorrect, expected no expiry but got %s, %v", ttl, ok)
+	}
+
+	before, _ := s.GetItem("some-key")
+
+	if !s.Expire("some-key", time.Hour) {
+		t.Errorf("Expire was incorrect, expected the key to be present")
+	}
+
+	if _, err := s.SetIf("some-key", "5678", TypeString, 0, 0, Condition{CAS: before.CAS}); err != ErrChanged {
+		t.Errorf("SetIf was incorrect, expected a CAS taken before the TTL changed to fail but got %v", err)
+	}
+
+	if ttl, _ := s.TTL("some-key"); ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("TTL was incorrect, expected about an hour but got %s", ttl)
+	}
+
+	s.Expire("some-key", 0)
+	if ttl, _ := s.TTL("some-key"); ttl != 0 {
+		t.Errorf("TTL was incorrect, expected no expiry but got %s", ttl)
+	}
+
+	s.Expire("some-key", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := s.TTL("some-key"); ok {
+		t.Errorf("TTL was incorrect, expected expired key to be missing")
+	}
+
+	if s.Expire("other-key", time.Hour) {
+		t.Errorf("Expire was incorrect, expected a missing key not to be present")
+	}
+}
+
+func TestKeys(t *testing.T) {
+	var s = New()
+	s.Set("b", "1")
+	s.Set("a", "2")
+	s.SetWithTTL("c", "3", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if got := s.Keys(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("Keys was incorrect, expected [a b] but got %v", got)
+	}
+}
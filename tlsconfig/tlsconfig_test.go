@@ -0,0 +1,245 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newAuthority(t *testing.T) authority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "makhzen test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+
+	return authority{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for 127.0.0.1 signed by ca, and its key, to
+// name.crt and name.key in dir.
+func (ca authority) issue(t *testing.T, dir string, name string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+
+	return certFile, keyFile
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "makhzen-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func serialOf(t *testing.T, c *tls.Certificate) int64 {
+	cert, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert.SerialNumber.Int64()
+}
+
+func TestReloader(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ca := newAuthority(t)
+	certFile, keyFile := ca.issue(t, dir, "node", 2)
+
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewReloader returned error: %s", err)
+	}
+
+	t.Run("does not reload unchanged files", func(t *testing.T) {
+		reloaded, err := r.Reload()
+
+		if reloaded || err != nil {
+			t.Errorf("got %v, %v, want false, nil", reloaded, err)
+		}
+	})
+
+	t.Run("reloads changed files", func(t *testing.T) {
+		ca.issue(t, dir, "node", 3)
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(certFile, later, later)
+
+		reloaded, err := r.Reload()
+		if !reloaded || err != nil {
+			t.Fatalf("got %v, %v, want true, nil", reloaded, err)
+		}
+
+		cert, _ := r.GetCertificate(nil)
+		if got := serialOf(t, cert); got != 3 {
+			t.Errorf("got serial %d, want 3", got)
+		}
+	})
+
+	t.Run("keeps certificate when files are invalid", func(t *testing.T) {
+		writeFile(t, keyFile, []byte("not a key"))
+		later := time.Now().Add(2 * time.Minute)
+		os.Chtimes(keyFile, later, later)
+
+		if _, err := r.Reload(); err == nil {
+			t.Errorf("expected an error")
+		}
+
+		cert, _ := r.GetCertificate(nil)
+		if got := serialOf(t, cert); got != 3 {
+			t.Errorf("got serial %d, want 3", got)
+		}
+	})
+}
+
+func TestLoadCertPool(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	t.Run("rejects file without certificates", func(t *testing.T) {
+		path := filepath.Join(dir, "empty.pem")
+		writeFile(t, path, []byte("nothing here"))
+
+		if _, err := LoadCertPool(path); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ca := newAuthority(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem)
+
+	pool, err := LoadCertPool(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCerts, err := NewReloader(ca.issue(t, dir, "server", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCerts, err := NewReloader(ca.issue(t, dir, "client", 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", ServerConfig(serverCerts, pool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	url := "https://" + ln.Addr().String()
+
+	get := func(config *tls.Config) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		return nil
+	}
+
+	t.Run("accepts client with certificate", func(t *testing.T) {
+		if err := get(ClientConfig(clientCerts, pool)); err != nil {
+			t.Errorf("request failed: %s", err)
+		}
+	})
+
+	t.Run("rejects client without certificate", func(t *testing.T) {
+		if err := get(ClientConfig(nil, pool)); err == nil {
+			t.Errorf("expected request to fail")
+		}
+	})
+
+	t.Run("rejects server from another CA", func(t *testing.T) {
+		other := x509.NewCertPool()
+		other.AddCert(newAuthority(t).cert)
+
+		if err := get(ClientConfig(clientCerts, other)); err == nil {
+			t.Errorf("expected request to fail")
+		}
+	})
+}
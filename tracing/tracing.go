@@ -0,0 +1,254 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header is the W3C trace context header carrying the span a request is
+// part of.
+const Header = "traceparent"
+
+var ErrInvalidTraceparent = errors.New("invalid traceparent")
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+	Sampled bool
+}
+
+// Valid reports whether sc identifies a span.
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != "" && sc.SpanID != ""
+}
+
+// Traceparent returns sc as the value of a traceparent header, or an empty
+// string when sc is not valid.
+func (sc SpanContext) Traceparent() string {
+	if !sc.Valid() {
+		return ""
+	}
+
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return "00-" + sc.TraceID + "-" + sc.SpanID + "-" + flags
+}
+
+// ParseTraceparent parses the value of a traceparent header.
+func ParseTraceparent(s string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || parts[0] == "ff" || len(parts[0]) != 2 || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+
+	traceID, spanID, flags := parts[1], parts[2], parts[3]
+
+	if !isHex(traceID, 32) || !isHex(spanID, 16) || !isHex(flags, 2) {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+
+	if traceID == strings.Repeat("0", 32) || spanID == strings.Repeat("0", 16) {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+
+	b, _ := hex.DecodeString(flags)
+
+	return SpanContext{TraceID: traceID, SpanID: spanID, Sampled: b[0]&1 == 1}, nil
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n || strings.ToLower(s) != s {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// SpanData is a finished span, as given to an Exporter.
+type SpanData struct {
+	Name       string            `json:"name"`
+	TraceID    string            `json:"traceId"`
+	SpanID     string            `json:"spanId"`
+	ParentID   string            `json:"parentId,omitempty"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// Exporter receives every sampled span when it ends.
+type Exporter interface {
+	Export(s SpanData)
+}
+
+// Tracer starts spans and gives them to Exporter when they end. A nil
+// Tracer starts spans that record nothing, but still propagates the trace
+// context it is given.
+type Tracer struct {
+	Exporter Exporter
+}
+
+// Span is an operation within a trace. A nil Span can be used and does
+// nothing.
+type Span struct {
+	tracer *Tracer
+	ctx    SpanContext
+
+	mu   sync.Mutex
+	data SpanData
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteKey
+)
+
+// Start starts a span called name, as a child of the span in ctx or of the
+// remote span ctx was given with ContextWithRemote, or as the root of a new
+// trace. It returns a copy of ctx carrying the new span.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := FromContext(ctx)
+
+	if t == nil {
+		// Without a tracer the parent is passed on unchanged, so that the
+		// trace continues on the nodes this one calls.
+		return ctx, nil
+	}
+
+	sc := SpanContext{TraceID: parent.TraceID, SpanID: newID(8), Sampled: parent.Sampled}
+	if !parent.Valid() {
+		sc.TraceID = newID(16)
+		sc.Sampled = true
+	}
+
+	s := &Span{
+		tracer: t,
+		ctx:    sc,
+		data: SpanData{
+			Name:     name,
+			TraceID:  sc.TraceID,
+			SpanID:   sc.SpanID,
+			ParentID: parent.SpanID,
+			Start:    time.Now(),
+		},
+	}
+
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// StartRemote starts a span called name as a child of the span with the
+// given traceparent, or as the root of a new trace when it is not valid.
+func (t *Tracer) StartRemote(traceparent string, name string) (context.Context, *Span) {
+	ctx := context.Background()
+	if sc, err := ParseTraceparent(traceparent); err == nil {
+		ctx = ContextWithRemote(ctx, sc)
+	}
+
+	return t.Start(ctx, name)
+}
+
+// Context returns the span's context, to be propagated to other nodes.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+
+	return s.ctx
+}
+
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]string)
+	}
+	s.data.Attributes[key] = value
+}
+
+// SetError records that the span's operation failed, when err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Error = err.Error()
+}
+
+// End finishes the span and exports it if it is sampled.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if s.ctx.Sampled && s.tracer.Exporter != nil {
+		s.tracer.Exporter.Export(data)
+	}
+}
+
+// ContextWithRemote returns a copy of ctx whose spans are children of sc,
+// a span on another node.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// FromContext returns the context of the span in ctx, or of the remote span
+// it was given, so that it can be propagated.
+func FromContext(ctx context.Context) SpanContext {
+	if s, ok := ctx.Value(spanKey).(*Span); ok {
+		return s.ctx
+	}
+
+	sc, _ := ctx.Value(remoteKey).(SpanContext)
+	return sc
+}
+
+// Extract returns a copy of ctx carrying the span context in the
+// traceparent header of h, if it has a valid one.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, err := ParseTraceparent(h.Get(Header))
+	if err != nil {
+		return ctx
+	}
+
+	return ContextWithRemote(ctx, sc)
+}
+
+// Inject sets the traceparent header of h to sc, if it is valid.
+func Inject(h http.Header, sc SpanContext) {
+	if tp := sc.Traceparent(); tp != "" {
+		h.Set(Header, tp)
+	}
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,138 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	valid := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	t.Run("parses valid header", func(t *testing.T) {
+		sc, err := ParseTraceparent(valid)
+		if err != nil {
+			t.Fatalf("ParseTraceparent returned error: %s", err)
+		}
+
+		want := SpanContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Sampled: true}
+		if sc != want {
+			t.Errorf("got %+v, want %+v", sc, want)
+		}
+
+		if got := sc.Traceparent(); got != valid {
+			t.Errorf("got %s, want %s", got, valid)
+		}
+	})
+
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		t.Run("rejects "+header, func(t *testing.T) {
+			if _, err := ParseTraceparent(header); err != ErrInvalidTraceparent {
+				t.Errorf("got %v, want %v", err, ErrInvalidTraceparent)
+			}
+		})
+	}
+}
+
+func TestStart(t *testing.T) {
+	exporter := &MemoryExporter{}
+	tracer := &Tracer{Exporter: exporter}
+
+	t.Run("starts a new trace", func(t *testing.T) {
+		exporter.Reset()
+
+		ctx, root := tracer.Start(context.Background(), "root")
+		_, child := tracer.Start(ctx, "child")
+		child.SetAttribute("key", "region")
+		child.SetError(errors.New("boom"))
+		child.End()
+		root.End()
+
+		spans := exporter.Spans()
+		if len(spans) != 2 {
+			t.Fatalf("got %d spans, want 2", len(spans))
+		}
+
+		c, r := spans[0], spans[1]
+		if c.TraceID != r.TraceID || c.ParentID != r.SpanID || r.ParentID != "" {
+			t.Errorf("child %+v is not a child of root %+v", c, r)
+		}
+
+		if c.Attributes["key"] != "region" || c.Error != "boom" {
+			t.Errorf("got %+v", c)
+		}
+	})
+
+	t.Run("continues a remote trace", func(t *testing.T) {
+		exporter.Reset()
+
+		h := http.Header{}
+		h.Set(Header, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+		_, span := tracer.Start(Extract(context.Background(), h), "server")
+		span.End()
+
+		got := exporter.Spans()[0]
+		if got.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || got.ParentID != "00f067aa0ba902b7" {
+			t.Errorf("got %+v", got)
+		}
+
+		out := http.Header{}
+		Inject(out, span.Context())
+		if sc, _ := ParseTraceparent(out.Get(Header)); sc != span.Context() {
+			t.Errorf("injected %s, want %+v", out.Get(Header), span.Context())
+		}
+	})
+
+	t.Run("does not export unsampled spans", func(t *testing.T) {
+		exporter.Reset()
+
+		_, span := tracer.StartRemote("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "server")
+		span.End()
+
+		if got := len(exporter.Spans()); got != 0 {
+			t.Errorf("got %d spans, want 0", got)
+		}
+	})
+
+	t.Run("nil tracer passes the remote parent on", func(t *testing.T) {
+		var nilTracer *Tracer
+		remote := SpanContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Sampled: true}
+
+		ctx, span := nilTracer.Start(ContextWithRemote(context.Background(), remote), "server")
+		span.SetAttribute("key", "region")
+		span.End()
+
+		if got := FromContext(ctx); got != remote {
+			t.Errorf("got %+v, want %+v", got, remote)
+		}
+	})
+}
+
+func TestJSONExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := &Tracer{Exporter: &JSONExporter{W: &buf}}
+
+	_, span := tracer.Start(context.Background(), "root")
+	span.End()
+
+	var got SpanData
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("could not parse %q: %s", buf.String(), err)
+	}
+
+	if got.Name != "root" || got.TraceID != span.Context().TraceID {
+		t.Errorf("got %+v", got)
+	}
+}
@@ -0,0 +1,204 @@
+package watch
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/wolakec/makhzen/store"
+)
+
+// ErrCompacted is returned when a subscriber asks to resume from a revision
+// that is no longer held in the hub's history.
+var ErrCompacted = errors.New("requested revision is no longer available")
+
+const subscriberBuffer = 64
+
+// Event is a change to a key, numbered with a revision that increases by one
+// for every change applied to this node.
+type Event struct {
+	Revision uint64 `json:"revision"`
+	Type     string `json:"type"`
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	// ValueType and ContentType are the type and content type of Value.
+	ValueType   string `json:"value_type,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// Filter selects the keys a subscriber is interested in. An empty filter
+// matches every key.
+type Filter struct {
+	Key    string
+	Prefix string
+}
+
+func (f Filter) Matches(key string) bool {
+	if f.Key != "" && f.Key != key {
+		return false
+	}
+
+	return strings.HasPrefix(key, f.Prefix)
+}
+
+// Subscription delivers matching events on Events. The channel is closed
+// when the subscription is closed, or when the subscriber falls too far
+// behind, in which case it should resubscribe from its last revision.
+type Subscription struct {
+	Events <-chan Event
+
+	events chan Event
+	filter Filter
+	hub    *Hub
+}
+
+func (s *Subscription) Close() {
+	s.hub.unsubscribe(s)
+}
+
+// Hub fans out store changes to subscribers and keeps a bounded history of
+// recent events so that reconnecting subscribers can resume.
+type Hub struct {
+	mu          sync.Mutex
+	revision    uint64
+	history     []Event
+	size        int
+	subscribers map[*Subscription]struct{}
+}
+
+func (h *Hub) Observe(c store.Change) {
+	h.publish(Event{Type: c.Op, Key: c.Key, Value: c.Value, ValueType: c.Type, ContentType: c.ContentType})
+}
+
+func (h *Hub) Publish(typ string, key string, value string) Event {
+	return h.publish(Event{Type: typ, Key: key, Value: value})
+}
+
+// publish numbers ev with the next revision and sends it to the
+// subscribers whose filter matches its key.
+func (h *Hub) publish(ev Event) Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.revision++
+	ev.Revision = h.revision
+	key := ev.Key
+
+	h.history = append(h.history, ev)
+	if len(h.history) > h.size {
+		h.history = h.history[len(h.history)-h.size:]
+	}
+
+	for sub := range h.subscribers {
+		if !sub.filter.Matches(key) {
+			continue
+		}
+
+		select {
+		case sub.events <- ev:
+		default:
+			h.drop(sub)
+		}
+	}
+
+	return ev
+}
+
+// Subscribe returns a subscription for keys matching f. When since is
+// non-zero, events after that revision still held in history are replayed
+// before live events.
+func (h *Hub) Subscribe(f Filter, since uint64) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var backlog []Event
+
+	if since > 0 {
+		if since > h.revision || since < h.oldest()-1 {
+			return nil, ErrCompacted
+		}
+
+		for _, ev := range h.history {
+			if ev.Revision > since && f.Matches(ev.Key) {
+				backlog = append(backlog, ev)
+			}
+		}
+	}
+
+	events := make(chan Event, len(backlog)+subscriberBuffer)
+	for _, ev := range backlog {
+		events <- ev
+	}
+
+	sub := &Subscription{
+		Events: events,
+		events: events,
+		filter: f,
+		hub:    h,
+	}
+	h.subscribers[sub] = struct{}{}
+
+	return sub, nil
+}
+
+// Revision returns the revision of the most recently published event.
+func (h *Hub) Revision() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.revision
+}
+
+// Subscribers returns the number of open subscriptions.
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subscribers)
+}
+
+// Queued returns the number of events waiting to be read by subscribers.
+func (h *Hub) Queued() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := 0
+	for sub := range h.subscribers {
+		n += len(sub.events)
+	}
+
+	return n
+}
+
+func (h *Hub) oldest() uint64 {
+	if len(h.history) == 0 {
+		return h.revision + 1
+	}
+
+	return h.history[0].Revision
+}
+
+func (h *Hub) unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.drop(s)
+}
+
+func (h *Hub) drop(s *Subscription) {
+	if _, ok := h.subscribers[s]; !ok {
+		return
+	}
+
+	delete(h.subscribers, s)
+	close(s.events)
+}
+
+// New returns a hub retaining the last size events for resumption.
+func New(size int) *Hub {
+	var h Hub
+	h.size = size
+	h.subscribers = make(map[*Subscription]struct{})
+
+	return &h
+}
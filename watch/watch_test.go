@@ -0,0 +1,155 @@
+package watch
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wolakec/makhzen/store"
+)
+
+func TestFilterMatches(t *testing.T) {
+	cases := []struct {
+		filter Filter
+		key    string
+		want   bool
+	}{
+		{Filter{}, "region", true},
+		{Filter{Key: "region"}, "region", true},
+		{Filter{Key: "region"}, "regions", false},
+		{Filter{Prefix: "config/"}, "config/region", true},
+		{Filter{Prefix: "config/"}, "region", false},
+	}
+
+	for _, c := range cases {
+		if got := c.filter.Matches(c.key); got != c.want {
+			t.Errorf("%+v matching %s: got %v, want %v", c.filter, c.key, got, c.want)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	t.Run("delivers matching events", func(t *testing.T) {
+		h := New(10)
+		sub, _ := h.Subscribe(Filter{Prefix: "config/"}, 0)
+		defer sub.Close()
+
+		h.Publish(store.OpPut, "other", "1")
+		h.Publish(store.OpPut, "config/region", "europe")
+
+		got := <-sub.Events
+		want := Event{Revision: 2, Type: store.OpPut, Key: "config/region", Value: "europe"}
+
+		if got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("replays events after revision", func(t *testing.T) {
+		h := New(10)
+		h.Publish(store.OpPut, "region", "europe")
+		h.Publish(store.OpPut, "region", "asia")
+		h.Publish(store.OpDelete, "region", "")
+
+		sub, err := h.Subscribe(Filter{Key: "region"}, 1)
+		if err != nil {
+			t.Fatalf("Subscribe returned error: %s", err)
+		}
+		defer sub.Close()
+
+		got := []Event{<-sub.Events, <-sub.Events}
+		want := []Event{
+			{Revision: 2, Type: store.OpPut, Key: "region", Value: "asia"},
+			{Revision: 3, Type: store.OpDelete, Key: "region"},
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("rejects compacted revision", func(t *testing.T) {
+		h := New(2)
+		h.Publish(store.OpPut, "a", "1")
+		h.Publish(store.OpPut, "b", "2")
+		h.Publish(store.OpPut, "c", "3")
+		h.Publish(store.OpPut, "d", "4")
+
+		if _, err := h.Subscribe(Filter{}, 1); err != ErrCompacted {
+			t.Errorf("got %v, want %v", err, ErrCompacted)
+		}
+
+		if _, err := h.Subscribe(Filter{}, 2); err != nil {
+			t.Errorf("Subscribe returned error: %s", err)
+		}
+	})
+
+	t.Run("rejects future revision", func(t *testing.T) {
+		h := New(2)
+
+		if _, err := h.Subscribe(Filter{}, 5); err != ErrCompacted {
+			t.Errorf("got %v, want %v", err, ErrCompacted)
+		}
+	})
+
+	t.Run("drops subscriber that falls behind", func(t *testing.T) {
+		h := New(1)
+		sub, _ := h.Subscribe(Filter{}, 0)
+
+		for i := 0; i <= subscriberBuffer; i++ {
+			h.Publish(store.OpPut, "region", "europe")
+		}
+
+		n := 0
+		for range sub.Events {
+			n++
+		}
+
+		if n != subscriberBuffer {
+			t.Errorf("received %d events, want %d", n, subscriberBuffer)
+		}
+	})
+}
+
+func TestQueued(t *testing.T) {
+	h := New(10)
+	sub, _ := h.Subscribe(Filter{}, 0)
+
+	h.Publish(store.OpPut, "region", "europe")
+	h.Publish(store.OpPut, "region", "asia")
+
+	if got := h.Subscribers(); got != 1 {
+		t.Errorf("got %d subscribers, want 1", got)
+	}
+
+	if got := h.Queued(); got != 2 {
+		t.Errorf("got %d queued events, want 2", got)
+	}
+
+	sub.Close()
+
+	if got := h.Queued(); got != 0 {
+		t.Errorf("got %d queued events after close, want 0", got)
+	}
+}
+
+func TestObserveStore(t *testing.T) {
+	h := New(10)
+	s := store.New()
+	s.AddObserver(h)
+
+	sub, _ := h.Subscribe(Filter{}, 0)
+	defer sub.Close()
+
+	s.Set("region", "europe")
+	s.Delete("region")
+
+	got := []Event{<-sub.Events, <-sub.Events}
+	want := []Event{
+		{Revision: 1, Type: store.OpPut, Key: "region", Value: "europe", ValueType: store.TypeString},
+		{Revision: 2, Type: store.OpDelete, Key: "region"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}